@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// adminJobData holds the information of a single registration job for the
+// admin job list.
+type adminJobData struct {
+	DOI        string
+	State      JobState
+	Repository string
+	Username   string
+	RealName   string
+	Email      string
+	CommitHash string
+	ZipSize    string
+	Created    time.Time
+	Updated    time.Time
+	Errors     []string
+	Warnings   []string
+	// Retryable is true if the job can be re-run.
+	Retryable bool
+	// Reviewable is true if the job awaits the curator review.
+	Reviewable bool
+	// Registered is the time the DOI was registered at DataCite.
+	Registered *time.Time
+}
+
+// adminJobListData is used to render the AdminJobList template.
+type adminJobListData struct {
+	// Filter is the state the list is filtered by; empty for all jobs.
+	Filter      JobState
+	States      []JobState
+	RetryStages []RetryStage
+	Jobs        []adminJobData
+	// Storage holds the usage of the storage directories.
+	Storage []storageUsage
+	// CSRFToken is submitted with the forms that change a job.
+	CSRFToken string
+}
+
+// newAdminJobData creates the admin job list entry from a job record.
+func newAdminJobData(rec JobRecord) adminJobData {
+	data := adminJobData{
+		DOI:        rec.Metadata.Identifier.ID,
+		State:      rec.State,
+		Repository: rec.Metadata.SourceRepository,
+		CommitHash: rec.CommitHash,
+		Created:    rec.Created,
+		Updated:    rec.Updated,
+		Errors:     rec.Errors,
+		Warnings:   rec.Warnings,
+		Retryable:  rec.State.Retryable(),
+		Reviewable: rec.State.Reviewable(),
+		Registered: rec.Registered,
+	}
+	if user := rec.Metadata.RequestingUser; user != nil {
+		data.Username = user.Username
+		data.RealName = user.RealName
+		data.Email = user.Email
+	}
+	if rec.ZipSize > 0 {
+		data.ZipSize = humanize.IBytes(uint64(rec.ZipSize))
+	}
+	return data
+}
+
+// checkAdmin verifies the HTTP basic authentication credentials of a request
+// against the configured admin credentials. If the credentials are missing or
+// invalid, the appropriate response is written and the function returns false.
+// If no admin password is configured, the admin interface is disabled and all
+// requests are answered with 'not found'.
+func checkAdmin(w http.ResponseWriter, r *http.Request, conf *Configuration) bool {
+	if conf.Admin.Password == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	username, password, ok := r.BasicAuth()
+	validuser := subtle.ConstantTimeCompare([]byte(username), []byte(conf.Admin.Username)) == 1
+	validpass := subtle.ConstantTimeCompare([]byte(password), []byte(conf.Admin.Password)) == 1
+	if !ok || !validuser || !validpass {
+		log.Printf("Unauthorized admin request from %s", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="GIN DOI admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// csrfToken returns the token the admin forms submit to show that a request
+// was sent from a page of the admin interface. Browsers resend the basic
+// authentication credentials with cross-site requests, so the credentials
+// alone do not prove this. The token is derived from the service key and the
+// admin credentials and changes with them.
+func csrfToken(conf *Configuration) string {
+	mac := hmac.New(sha256.New, []byte(conf.Key))
+	mac.Write([]byte("admin:" + conf.Admin.Username + ":" + conf.Admin.Password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkAdminPost verifies an admin request that changes a job: it must be an
+// authenticated POST request carrying the CSRF token of the admin forms in
+// the 'csrf' form value. If the request is invalid, the appropriate response
+// is written and the function returns false.
+func checkAdminPost(w http.ResponseWriter, r *http.Request, conf *Configuration) bool {
+	if !checkAdmin(w, r, conf) {
+		return false
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	token := r.PostFormValue("csrf")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(csrfToken(conf))) != 1 {
+		log.Printf("Admin request from %s without valid CSRF token", r.RemoteAddr)
+		http.Error(w, "Invalid form token; reload the admin page and try again", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// renderAdminJobList renders the list of all registration jobs for the
+// curators together with the usage of the storage directories. The list can
+// be filtered by job state via the 'state' query parameter.
+func renderAdminJobList(w http.ResponseWriter, r *http.Request, conf *Configuration) {
+	if !checkAdmin(w, r, conf) {
+		return
+	}
+
+	data := adminJobListData{
+		Filter:      JobState(r.URL.Query().Get("state")),
+		States:      jobStates,
+		RetryStages: retryStages,
+		Jobs:        make([]adminJobData, 0),
+		Storage:     storageUsages(r.Context(), conf),
+		CSRFToken:   csrfToken(conf),
+	}
+	if conf.Jobs != nil {
+		for _, rec := range conf.Jobs.List() {
+			if data.Filter != "" && rec.State != data.Filter {
+				continue
+			}
+			data.Jobs = append(data.Jobs, newAdminJobData(rec))
+		}
+	}
+
+	tmpl, err := prepareTemplates("AdminJobList")
+	if err != nil {
+		log.Printf("Failed to parse AdminJobList template: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Overwrite default GIN server URL with config GIN server URL
+	tmpl = injectDynamicGINURL(tmpl, GetGINURL(conf))
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Printf("Error rendering AdminJobList template: %v", err.Error())
+	}
+}
+
+// validRetryStage returns true if the stage is a known retry stage.
+func validRetryStage(stage RetryStage) bool {
+	for _, s := range retryStages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// retryJob re-runs a finished registration job from the stage provided via
+// the 'stage' form value. Only POST requests are accepted and the job is
+// identified by the 'doi' form value. On success, the request is redirected
+// to the admin job list.
+func retryJob(w http.ResponseWriter, r *http.Request, jobQueue chan *RegistrationJob, conf *Configuration) {
+	if !checkAdminPost(w, r, conf) {
+		return
+	}
+	if conf.Jobs == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	doi := r.FormValue("doi")
+	stage := RetryStage(r.FormValue("stage"))
+	if !validRetryStage(stage) {
+		http.Error(w, fmt.Sprintf("Invalid retry stage %q", stage), http.StatusBadRequest)
+		return
+	}
+	rec, ok := conf.Jobs.Get(doi)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	job, err := rec.newJob(conf)
+	if err != nil {
+		log.Printf("Failed to prepare re-run of job %q: %s", doi, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	job.Retry = stage
+
+	// the state is checked and changed in one step, so a job submitted
+	// twice is only queued once
+	if _, err := conf.Jobs.Transition(doi, JobState.Retryable, JobQueued, fmt.Sprintf("re-run from stage %s", stage)); err != nil {
+		if serr, ok := err.(*jobStateError); ok {
+			http.Error(w, fmt.Sprintf("Job %s is %s and cannot be re-run", doi, serr.State), http.StatusConflict)
+			return
+		}
+		log.Printf("Failed to update job %q: %s", doi, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Re-running job %q from stage %q", doi, stage)
+	go func() { jobQueue <- job }()
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// Review actions of the curators.
+const (
+	reviewApprove = "approve"
+	reviewChanges = "changes"
+	reviewReject  = "reject"
+)
+
+// reviewJob handles the curator review of a prepared dataset. The job is
+// identified by the 'doi' form value and the 'action' form value is one of
+// 'approve', 'changes' or 'reject'. Requesting changes and rejecting require
+// a 'message' that is sent to the requester. Approving starts the
+// publication of the dataset in the background; the publication is tracked,
+// so the service waits for it on shutdown. On success, the request is
+// redirected to the admin job list.
+func reviewJob(w http.ResponseWriter, r *http.Request, pubs *publications, conf *Configuration) {
+	if !checkAdminPost(w, r, conf) {
+		return
+	}
+	if conf.Jobs == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	doi := r.FormValue("doi")
+	action := r.FormValue("action")
+	message := strings.TrimSpace(r.FormValue("message"))
+	rec, ok := conf.Jobs.Get(doi)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// conflict writes the response for a job that is not in a state the
+	// review action applies to
+	conflict := func(err error) {
+		if serr, ok := err.(*jobStateError); ok {
+			http.Error(w, fmt.Sprintf("Job %s is %s and cannot be reviewed", doi, serr.State), http.StatusConflict)
+			return
+		}
+		log.Printf("Failed to update job %q: %s", doi, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	var state JobState
+	var from func(JobState) bool
+	var subject, body string
+	switch action {
+	case reviewApprove:
+		if !pubs.add() {
+			http.Error(w, "The service is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		rec, err := approveJob(conf, doi)
+		if err != nil {
+			pubs.done()
+			conflict(err)
+			return
+		}
+		log.Printf("Job %q approved", doi)
+		go func() {
+			defer pubs.done()
+			if err := publishApproved(context.Background(), conf, rec); err != nil {
+				log.Printf("Publication of %q failed: %s", doi, err.Error())
+			}
+		}()
+		http.Redirect(w, r, "/admin", http.StatusSeeOther)
+		return
+	case reviewChanges:
+		state = JobChangesRequested
+		from = JobState.Reviewable
+		subject = "Changes requested for DOI registration"
+		body = msgChangesRequestedEmail
+	case reviewReject:
+		state = JobRejected
+		from = func(s JobState) bool { return s == JobDone }
+		subject = "DOI registration rejected"
+		body = msgRejectedEmail
+	default:
+		http.Error(w, fmt.Sprintf("Invalid review action %q", action), http.StatusBadRequest)
+		return
+	}
+	if message == "" {
+		http.Error(w, "A message to the requester is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := conf.Jobs.Transition(doi, from, state, message); err != nil {
+		conflict(err)
+		return
+	}
+	log.Printf("Job %q reviewed: %s", doi, state)
+	setReservationState(conf, doi, reservationState(state))
+	body = fmt.Sprintf(body, requesterName(rec), rec.Metadata.SourceRepository, doi, message)
+	if err := notifyRequester(r.Context(), conf, rec, subject, body); err != nil {
+		log.Printf("Failed to notify requester: %s", err.Error())
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/G-Node/libgin/libgin"
+)
+
+func TestCheckAdmin(t *testing.T) {
+	conf := &Configuration{}
+	conf.Admin.Username = "admin"
+
+	// check admin interface is disabled without password
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/admin", nil)
+	req.SetBasicAuth("admin", "")
+	if checkAdmin(w, req, conf) || w.Code != http.StatusNotFound {
+		t.Fatalf("Expected disabled admin interface but got [%d]", w.Code)
+	}
+
+	conf.Admin.Password = "secret"
+
+	// check missing credentials
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/admin", nil)
+	if checkAdmin(w, req, conf) || w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected unauthorized on missing credentials but got [%d]", w.Code)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatal("Missing authentication header")
+	}
+
+	// check invalid credentials
+	for _, cred := range [][]string{{"admin", "wrong"}, {"wrong", "secret"}} {
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/admin", nil)
+		req.SetBasicAuth(cred[0], cred[1])
+		if checkAdmin(w, req, conf) || w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected unauthorized on invalid credentials %v but got [%d]", cred, w.Code)
+		}
+	}
+
+	// check valid credentials
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/admin", nil)
+	req.SetBasicAuth("admin", "secret")
+	if !checkAdmin(w, req, conf) {
+		t.Fatalf("Expected valid credentials but got [%d]", w.Code)
+	}
+}
+
+func TestCheckAdminPost(t *testing.T) {
+	conf := &Configuration{Key: "servicekey"}
+	conf.Admin.Username = "admin"
+	conf.Admin.Password = "secret"
+	token := csrfToken(conf)
+
+	adminPost := func(method string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/admin/review", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "secret")
+		checkAdminPost(w, req, conf)
+		return w
+	}
+
+	if w := adminPost("GET", url.Values{"csrf": {token}}); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected method not allowed but got [%d]", w.Code)
+	}
+	// a cross-site form carries the credentials but not the token
+	if w := adminPost("POST", url.Values{}); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden without token but got [%d]", w.Code)
+	}
+	if w := adminPost("POST", url.Values{"csrf": {"invalid"}}); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden with invalid token but got [%d]", w.Code)
+	}
+	if w := adminPost("POST", url.Values{"csrf": {token}}); w.Code != http.StatusOK {
+		t.Fatalf("Expected valid request but got [%d]", w.Code)
+	}
+
+	// the token changes with the credentials
+	conf.Admin.Password = "newsecret"
+	if csrfToken(conf) == token {
+		t.Fatal("Token did not change with the admin password")
+	}
+}
+
+func TestRenderAdminJobList(t *testing.T) {
+	conf := &Configuration{}
+	conf.Admin.Username = "admin"
+	conf.Admin.Password = "secret"
+	conf.Storage.PreparationDirectory = t.TempDir()
+	store, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf.Jobs = store
+
+	done := testJob("10.12751/g-node.ddddd1", "owner/donerepo", conf)
+	failed := testJob("10.12751/g-node.fffff2", "owner/failedrepo", conf)
+	for _, job := range []*RegistrationJob{done, failed} {
+		if err := store.Add(job); err != nil {
+			t.Fatalf("Error adding job: %q", err.Error())
+		}
+	}
+	setJobState(done, JobDone, "")
+	updateJob(done, func(rec *JobRecord) {
+		rec.CommitHash = "abcdef123456"
+		rec.ZipSize = 2048
+	})
+	setJobState(failed, JobFailed, "")
+	recordReport(failed, []string{"failed to clone repository"}, []string{"Abstract may be too short"})
+
+	adminRequest := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", target, nil)
+		req.SetBasicAuth("admin", "secret")
+		renderAdminJobList(w, req, conf)
+		return w
+	}
+
+	// check full list
+	w := adminRequest("/admin")
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected admin list response [%d]: %s", w.Code, body)
+	}
+	for _, expected := range []string{"owner/donerepo", "owner/failedrepo", "abcdef123456", "2.0 KiB", "failed to clone repository", "Abstract may be too short", "<h3>Storage</h3>", conf.Storage.PreparationDirectory, csrfToken(conf)} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Admin list is missing %q", expected)
+		}
+	}
+
+	// check state filter
+	w = adminRequest("/admin?state=failed")
+	body = w.Body.String()
+	if !strings.Contains(body, "owner/failedrepo") || strings.Contains(body, "owner/donerepo") {
+		t.Fatalf("Unexpected filtered admin list: %s", body)
+	}
+}
+
+func TestRetryJob(t *testing.T) {
+	conf := &Configuration{}
+	conf.Admin.Username = "admin"
+	conf.Admin.Password = "secret"
+	store, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf.Jobs = store
+
+	failed := testJob("10.12751/g-node.fffff1", "owner/failedrepo", conf)
+	running := testJob("10.12751/g-node.rrrrr2", "owner/runningrepo", conf)
+	for _, job := range []*RegistrationJob{failed, running} {
+		if err := store.Add(job); err != nil {
+			t.Fatalf("Error adding job: %q", err.Error())
+		}
+	}
+	setJobState(failed, JobFailed, "")
+	setJobState(running, JobRunning, "")
+
+	jobQueue := make(chan *RegistrationJob, 1)
+	retryRequest := func(method, doi, stage string) *httptest.ResponseRecorder {
+		form := url.Values{"doi": {doi}, "stage": {stage}, "csrf": {csrfToken(conf)}}
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/admin/retry", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "secret")
+		retryJob(w, req, jobQueue, conf)
+		return w
+	}
+
+	// check invalid requests
+	if w := retryRequest("GET", failed.Metadata.Identifier.ID, string(RetryZip)); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected method not allowed but got [%d]", w.Code)
+	}
+	if w := retryRequest("POST", failed.Metadata.Identifier.ID, "nostage"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected bad request on invalid stage but got [%d]", w.Code)
+	}
+	if w := retryRequest("POST", "i/do/not/exist", string(RetryZip)); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected not found on unknown job but got [%d]", w.Code)
+	}
+	if w := retryRequest("POST", running.Metadata.Identifier.ID, string(RetryZip)); w.Code != http.StatusConflict {
+		t.Fatalf("Expected conflict on unfinished job but got [%d]", w.Code)
+	}
+
+	// check failed job is re-queued from the requested stage
+	w := retryRequest("POST", failed.Metadata.Identifier.ID, string(RetryZip))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect but got [%d]: %s", w.Code, w.Body.String())
+	}
+	job := <-jobQueue
+	if job.Retry != RetryZip || job.Metadata.Identifier.ID != failed.Metadata.Identifier.ID || job.Config != conf {
+		t.Fatalf("Unexpected re-queued job %v", job)
+	}
+	rec, _ := store.Get(failed.Metadata.Identifier.ID)
+	if rec.State != JobQueued {
+		t.Fatalf("Expected re-run job to be queued but got %q", rec.State)
+	}
+	if rec.Metadata == job.Metadata {
+		t.Fatal("Re-run job shares metadata with the job record")
+	}
+
+	// a repeated request does not queue the job twice
+	if w := retryRequest("POST", failed.Metadata.Identifier.ID, string(RetryZip)); w.Code != http.StatusConflict {
+		t.Fatalf("Expected conflict on re-queued job but got [%d]", w.Code)
+	}
+	if len(jobQueue) != 0 {
+		t.Fatal("Job was queued twice")
+	}
+}
+
+func TestReviewJob(t *testing.T) {
+	server, stub := serveDataciteAPI()
+	defer server.Close()
+
+	approved := testJob("10.12751/g-node.noex1st", "owner/approvedrepo", nil)
+	changes := testJob("10.12751/g-node.ccccc2", "owner/changesrepo", nil)
+	rejected := testJob("10.12751/g-node.rrrrr3", "owner/rejectedrepo", nil)
+	conf := dataciteTestConf(t, server.URL, approved.Metadata.Identifier.ID)
+	conf.Admin.Username = "admin"
+	conf.Admin.Password = "secret"
+	store, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf.Jobs = store
+	for _, job := range []*RegistrationJob{approved, changes, rejected} {
+		job.Config = conf
+		job.Metadata.RequestingUser = &libgin.GINUser{Username: "requester", Email: "requester@example.org"}
+		if err := store.Add(job); err != nil {
+			t.Fatalf("Error adding job: %q", err.Error())
+		}
+		setJobState(job, JobDone, "")
+	}
+
+	pubs := new(publications)
+	reviewRequest := func(doi, action, message string) *httptest.ResponseRecorder {
+		form := url.Values{"doi": {doi}, "action": {action}, "message": {message}, "csrf": {csrfToken(conf)}}
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/admin/review", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "secret")
+		reviewJob(w, req, pubs, conf)
+		return w
+	}
+
+	// check invalid requests
+	if w := reviewRequest("i/do/not/exist", reviewApprove, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected not found on unknown job but got [%d]", w.Code)
+	}
+	if w := reviewRequest(changes.Metadata.Identifier.ID, "publish", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected bad request on invalid action but got [%d]", w.Code)
+	}
+	if w := reviewRequest(changes.Metadata.Identifier.ID, reviewChanges, " "); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected bad request on missing message but got [%d]", w.Code)
+	}
+
+	// check request changes and reject
+	if w := reviewRequest(changes.Metadata.Identifier.ID, reviewChanges, "Please add a LICENSE file"); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect but got [%d]: %s", w.Code, w.Body.String())
+	}
+	rec, _ := store.Get(changes.Metadata.Identifier.ID)
+	if rec.State != JobChangesRequested || rec.History[len(rec.History)-1].Note != "Please add a LICENSE file" {
+		t.Fatalf("Unexpected job state %q or history %v", rec.State, rec.History)
+	}
+	if w := reviewRequest(rejected.Metadata.Identifier.ID, reviewReject, "Not a dataset"); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect but got [%d]: %s", w.Code, w.Body.String())
+	}
+	if rec, _ = store.Get(rejected.Metadata.Identifier.ID); rec.State != JobRejected {
+		t.Fatalf("Expected rejected job but got %q", rec.State)
+	}
+	// reviewed jobs cannot be reviewed again
+	if w := reviewRequest(rejected.Metadata.Identifier.ID, reviewApprove, ""); w.Code != http.StatusConflict {
+		t.Fatalf("Expected conflict on rejected job but got [%d]", w.Code)
+	}
+
+	// check approval publishes the dataset in the background; a repeated
+	// approval does not start a second publication
+	if w := reviewRequest(approved.Metadata.Identifier.ID, reviewApprove, ""); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect but got [%d]: %s", w.Code, w.Body.String())
+	}
+	if w := reviewRequest(approved.Metadata.Identifier.ID, reviewApprove, ""); w.Code != http.StatusConflict {
+		t.Fatalf("Expected conflict on repeated approval but got [%d]", w.Code)
+	}
+	if !pubs.stop(5 * time.Second) {
+		t.Fatal("Publication did not finish")
+	}
+	if rec, _ = store.Get(approved.Metadata.Identifier.ID); rec.State != JobPublished {
+		t.Fatalf("Expected published job but got %q", rec.State)
+	}
+	// no publications are started during shutdown
+	if w := reviewRequest(changes.Metadata.Identifier.ID, reviewApprove, ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected unavailable during shutdown but got [%d]", w.Code)
+	}
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if stub.dois[approved.Metadata.Identifier.ID].State != "findable" {
+		t.Fatal("DOI was not registered on approval")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArchiveFormat selects the package format of the dataset archives.
+type ArchiveFormat string
+
+const (
+	// ArchiveZip is a flat zip file of the repository content without
+	// compression.
+	ArchiveZip ArchiveFormat = "zip"
+	// ArchiveZipDeflate is a flat zip file of the repository content with
+	// compression of all files that are not already compressed.
+	ArchiveZipDeflate ArchiveFormat = "zip-deflate"
+	// ArchiveTarGz is a gzip compressed tar file of the repository content.
+	ArchiveTarGz ArchiveFormat = "tar.gz"
+	// ArchiveTarZst is a zstd compressed tar file of the repository content.
+	ArchiveTarZst ArchiveFormat = "tar.zst"
+	// ArchiveBagIt is a zip file containing a BagIt bag of the repository
+	// content.
+	ArchiveBagIt ArchiveFormat = "bagit"
+)
+
+// archiveFormats lists all supported archive formats.
+var archiveFormats = []ArchiveFormat{ArchiveZip, ArchiveZipDeflate, ArchiveTarGz, ArchiveTarZst, ArchiveBagIt}
+
+// validArchiveFormat returns true if the format is one of the supported
+// archive formats.
+func validArchiveFormat(format ArchiveFormat) bool {
+	for _, supported := range archiveFormats {
+		if format == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultStoredExtensions lists the file extensions of formats that are
+// already compressed. Files with these extensions are stored without
+// compression in compressed zip archives.
+var defaultStoredExtensions = []string{
+	".7z", ".avi", ".bz2", ".docx", ".flac", ".gif", ".gz", ".jpeg", ".jpg",
+	".mkv", ".mov", ".mp3", ".mp4", ".ogg", ".pdf", ".png", ".pptx", ".rar",
+	".tgz", ".webm", ".webp", ".xlsx", ".xz", ".zip", ".zst",
+}
+
+// archiveEntry describes a file added to an archive.
+type archiveEntry struct {
+	// Path of the file in the archive; slash separated
+	Path string
+	// Size of the file content in bytes
+	Size int64
+	// Mode of the file; symlinks are archived as links to Linkname
+	Mode     os.FileMode
+	Linkname string
+	Modified time.Time
+}
+
+// archiveWriter writes files to a dataset archive.
+type archiveWriter interface {
+	// create adds a file to the archive and returns a writer for the file
+	// content. The content of symlinks is their target.
+	create(entry archiveEntry) (io.Writer, error)
+	// Close finishes the archive without closing the underlying writer.
+	Close() error
+}
+
+// annexObject returns the file info of the annex object a locked annex file
+// at fname points to, given the target of the symlink. Locked files are
+// symlinks into the annex object store of the repository; reading the object
+// directly avoids unlocking the files in a second copy of the repository.
+// Returns false if the symlink does not point to an annex object or if the
+// annex content is not available.
+func annexObject(fname string, target string) (os.FileInfo, bool) {
+	if !strings.Contains(filepath.ToSlash(target), "annex/objects/") {
+		return nil, false
+	}
+	// stat follows the symlink to the annex object
+	objinfo, err := os.Stat(fname)
+	if err != nil || !objinfo.Mode().IsRegular() {
+		return nil, false
+	}
+	return objinfo, true
+}
+
+// annexObjectMode returns the mode of a locked annex file when it is archived
+// as a regular file. Annex objects are write protected; the archived file
+// gets the permissions of an unlocked file instead.
+func annexObjectMode(objinfo os.FileInfo) os.FileMode {
+	return objinfo.Mode().Perm() | 0200
+}
+
+// extension returns the file extension of the archives of an archive format.
+func (format ArchiveFormat) extension() string {
+	switch format {
+	case ArchiveTarGz:
+		return ".tar.gz"
+	case ArchiveTarZst:
+		return ".tar.zst"
+	default:
+		return ".zip"
+	}
+}
+
+// archiveExtensions lists the file extensions of all supported archive
+// formats.
+func archiveExtensions() []string {
+	exts := make([]string, 0, len(archiveFormats))
+	for _, format := range archiveFormats {
+		ext := format.extension()
+		known := false
+		for _, e := range exts {
+			known = known || e == ext
+		}
+		if !known {
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// trimArchiveExt removes the archive extension from a file name.
+func trimArchiveExt(fname string) string {
+	for _, ext := range archiveExtensions() {
+		if strings.HasSuffix(fname, ext) {
+			return strings.TrimSuffix(fname, ext)
+		}
+	}
+	return strings.TrimSuffix(fname, filepath.Ext(fname))
+}
+
+// newArchiveWriter returns an archiveWriter writing an archive of the given
+// format to dest. Compressed zip archives store files with one of the stored
+// extensions without compression.
+func newArchiveWriter(dest io.Writer, format ArchiveFormat, stored []string) (archiveWriter, error) {
+	switch format {
+	case ArchiveZip, ArchiveBagIt:
+		return &zipArchiveWriter{zipwriter: zip.NewWriter(dest)}, nil
+	case ArchiveZipDeflate:
+		return &zipArchiveWriter{zipwriter: zip.NewWriter(dest), compress: true, stored: stored}, nil
+	case ArchiveTarGz:
+		compressor := gzip.NewWriter(dest)
+		return &tarArchiveWriter{tarwriter: tar.NewWriter(compressor), compressor: compressor}, nil
+	case ArchiveTarZst:
+		compressor, err := zstd.NewWriter(dest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up zstd compression: %s", err.Error())
+		}
+		return &tarArchiveWriter{tarwriter: tar.NewWriter(compressor), compressor: compressor}, nil
+	}
+	return nil, fmt.Errorf("unsupported archive format %q", format)
+}
+
+// zipArchiveWriter writes zip archives. Without compression all files are
+// stored; with compression all files are deflated except for those with one
+// of the stored extensions.
+type zipArchiveWriter struct {
+	zipwriter *zip.Writer
+	compress  bool
+	stored    []string
+}
+
+func (aw *zipArchiveWriter) create(entry archiveEntry) (io.Writer, error) {
+	header := &zip.FileHeader{
+		Name:               entry.Path,
+		Method:             zip.Store,
+		Modified:           entry.Modified,
+		UncompressedSize64: uint64(entry.Size),
+	}
+	header.SetMode(entry.Mode)
+	if aw.compress && compressible(entry.Path, aw.stored) {
+		header.Method = zip.Deflate
+	}
+	return aw.zipwriter.CreateHeader(header)
+}
+
+func (aw *zipArchiveWriter) Close() error {
+	return aw.zipwriter.Close()
+}
+
+// compressible returns false if the file has one of the stored extensions.
+func compressible(fname string, stored []string) bool {
+	fname = strings.ToLower(fname)
+	for _, ext := range stored {
+		if strings.HasSuffix(fname, strings.ToLower(ext)) {
+			return false
+		}
+	}
+	return true
+}
+
+// tarArchiveWriter writes compressed tar archives. The whole archive is
+// compressed, so all files are compressed independent of their extension.
+type tarArchiveWriter struct {
+	tarwriter  *tar.Writer
+	compressor io.WriteCloser
+}
+
+func (aw *tarArchiveWriter) create(entry archiveEntry) (io.Writer, error) {
+	header := &tar.Header{
+		Name:     entry.Path,
+		Mode:     int64(entry.Mode.Perm()),
+		Size:     entry.Size,
+		ModTime:  entry.Modified,
+		Typeflag: tar.TypeReg,
+	}
+	if entry.Mode&os.ModeSymlink != 0 {
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = entry.Linkname
+		header.Size = 0
+		if err := aw.tarwriter.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		// the link target is part of the header
+		return io.Discard, nil
+	}
+	if err := aw.tarwriter.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	return aw.tarwriter, nil
+}
+
+func (aw *tarArchiveWriter) Close() error {
+	if err := aw.tarwriter.Close(); err != nil {
+		return err
+	}
+	return aw.compressor.Close()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/G-Node/libgin/libgin"
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveSource creates a source directory for archive tests and returns its
+// path and the contained regular files.
+func archiveSource(t *testing.T) (string, map[string]string) {
+	files := map[string]string{
+		"table.csv":      strings.Repeat("1,2,3,4\n", 1000),
+		"data/image.png": strings.Repeat("x", 1000),
+	}
+	source := writeSourceFiles(t, files)
+	if err := os.Symlink("../.git/annex/objects/key", filepath.Join(source, "data", "link.raw")); err != nil {
+		t.Fatalf("Error creating symlink: %s", err.Error())
+	}
+	return source, files
+}
+
+func TestArchiveFormats(t *testing.T) {
+	source, files := archiveSource(t)
+	targetdir := t.TempDir()
+	progress := func(JobState, string) {}
+	// zip archives
+	for _, format := range []ArchiveFormat{ArchiveZip, ArchiveZipDeflate} {
+		zipfilename := filepath.Join(targetdir, archiveName("10.12751/g-node.fmt001", format))
+		if _, err := runzip(context.Background(), source, zipfilename, format, defaultStoredExtensions, 0, nil, nil, progress); err != nil {
+			t.Fatalf("[%s] Error creating archive: %s", format, err.Error())
+		}
+		zipreader, err := zip.OpenReader(zipfilename)
+		if err != nil {
+			t.Fatalf("[%s] Error opening archive: %s", format, err.Error())
+		}
+		methods := make(map[string]uint16)
+		for _, file := range zipreader.File {
+			methods[file.Name] = file.Method
+			if content, ok := files[file.Name]; ok {
+				fp, err := file.Open()
+				if err != nil {
+					t.Fatalf("[%s] Error opening archived file: %s", format, err.Error())
+				}
+				data, err := io.ReadAll(fp)
+				fp.Close()
+				if err != nil || string(data) != content {
+					t.Fatalf("[%s] Unexpected content of %q: %v", format, file.Name, err)
+				}
+			}
+		}
+		zipreader.Close()
+		deflated := format == ArchiveZipDeflate
+		if (methods["table.csv"] == zip.Deflate) != deflated {
+			t.Fatalf("[%s] Unexpected compression method for text file: %d", format, methods["table.csv"])
+		}
+		if methods["data/image.png"] != zip.Store {
+			t.Fatalf("[%s] Compressed file with stored extension", format)
+		}
+	}
+
+	// tar archives
+	for _, format := range []ArchiveFormat{ArchiveTarGz, ArchiveTarZst} {
+		zipfilename := filepath.Join(targetdir, archiveName("10.12751/g-node.fmt001", format))
+		if _, err := runzip(context.Background(), source, zipfilename, format, defaultStoredExtensions, 0, nil, nil, progress); err != nil {
+			t.Fatalf("[%s] Error creating archive: %s", format, err.Error())
+		}
+		if !strings.HasSuffix(zipfilename, "."+string(format)) {
+			t.Fatalf("[%s] Unexpected archive name %q", format, zipfilename)
+		}
+		fp, err := os.Open(zipfilename)
+		if err != nil {
+			t.Fatalf("[%s] Error opening archive: %s", format, err.Error())
+		}
+		var stream io.Reader
+		if format == ArchiveTarGz {
+			stream, err = gzip.NewReader(fp)
+		} else {
+			stream, err = zstd.NewReader(fp)
+		}
+		if err != nil {
+			t.Fatalf("[%s] Error decompressing archive: %s", format, err.Error())
+		}
+		tarreader := tar.NewReader(stream)
+		found := make(map[string]bool)
+		for {
+			header, err := tarreader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("[%s] Error reading archive: %s", format, err.Error())
+			}
+			found[header.Name] = true
+			if header.Name == "data/link.raw" {
+				if header.Typeflag != tar.TypeSymlink || header.Linkname != "../.git/annex/objects/key" {
+					t.Fatalf("[%s] Unexpected symlink header: %+v", format, header)
+				}
+				continue
+			}
+			if content, ok := files[header.Name]; ok {
+				data, err := io.ReadAll(tarreader)
+				if err != nil || string(data) != content {
+					t.Fatalf("[%s] Unexpected content of %q: %v", format, header.Name, err)
+				}
+			}
+		}
+		fp.Close()
+		for _, fname := range []string{"table.csv", "data/image.png", "data/link.raw", manifestfname} {
+			if !found[fname] {
+				t.Fatalf("[%s] Missing file %q in archive", format, fname)
+			}
+		}
+	}
+
+	// all archives share the manifest file
+	if _, err := os.Stat(filepath.Join(targetdir, "10.12751_g-node.fmt001.manifest.json")); err != nil {
+		t.Fatalf("Missing manifest: %s", err.Error())
+	}
+	if parts := findArchives(context.Background(), "10.12751/g-node.fmt001", targetdir); len(parts) != 1 || parts[0].Name != "10.12751_g-node.fmt001.zip" {
+		t.Fatalf("Unexpected archive found: %v", parts)
+	}
+	removeArchives(context.Background(), targetdir, "10.12751/g-node.fmt001", []archivePart{{Name: "10.12751_g-node.fmt001.tar.zst"}})
+	if parts := findArchives(context.Background(), "10.12751/g-node.fmt001", targetdir); len(parts) != 1 || parts[0].Name != "10.12751_g-node.fmt001.tar.zst" {
+		t.Fatalf("Unexpected archive found after removal: %v", parts)
+	}
+	if _, err := os.Stat(checksumName(filepath.Join(targetdir, "10.12751_g-node.fmt001.zip"))); !os.IsNotExist(err) {
+		t.Fatal("Checksum file of removed archive still exists")
+	}
+}
+
+func TestTrimArchiveExt(t *testing.T) {
+	names := map[string]string{
+		"a/b.zip":       "a/b",
+		"a/b.tar.gz":    "a/b",
+		"a/b.tar.zst":   "a/b",
+		"a/b.unknown":   "a/b",
+		"10.12751_x.gz": "10.12751_x",
+	}
+	for fname, expected := range names {
+		if trimmed := trimArchiveExt(fname); trimmed != expected {
+			t.Fatalf("Unexpected trimmed name for %q: %q", fname, trimmed)
+		}
+	}
+	if !compressible("data/table.CSV", defaultStoredExtensions) || compressible("data/image.PNG", defaultStoredExtensions) {
+		t.Fatal("Unexpected compressible result")
+	}
+}
+
+func TestLandingPageArchiveExt(t *testing.T) {
+	targetdir := t.TempDir()
+	metadata := new(libgin.RepositoryMetadata)
+	datacite := libgin.NewDataCite()
+	metadata.DataCite = &datacite
+	metadata.Identifier.ID = "10.12751/g-node.fmt002"
+	metadata.Titles = []string{"Test title"}
+	metadata.RightsList = []libgin.Rights{{Name: "CC-BY", URL: "https://creativecommons.org/licenses/by/4.0/"}}
+	metadata.ResourceType.Value = "Dataset"
+
+	landingpage := filepath.Join(targetdir, "index.html")
+	if err := createLandingPage(context.Background(), metadata, landingpage, ""); err != nil {
+		t.Fatalf("Error creating landing page: %s", err.Error())
+	}
+	page, _ := os.ReadFile(landingpage)
+	if !strings.Contains(string(page), "10.12751_g-node.fmt002.zip") || !strings.Contains(string(page), "(ZIP") {
+		t.Fatal("Missing default zip archive link on landing page")
+	}
+
+	if err := os.WriteFile(filepath.Join(targetdir, "10.12751_g-node.fmt002.tar.zst"), []byte("archive"), 0666); err != nil {
+		t.Fatalf("Error writing archive: %s", err.Error())
+	}
+	if err := createLandingPage(context.Background(), metadata, landingpage, ""); err != nil {
+		t.Fatalf("Error creating landing page: %s", err.Error())
+	}
+	page, _ = os.ReadFile(landingpage)
+	if !strings.Contains(string(page), "10.12751_g-node.fmt002.tar.zst") || !strings.Contains(string(page), "(TAR.ZST") {
+		t.Fatal("Missing tar.zst archive link on landing page")
+	}
+}
+
+func TestLockedAnnexArchive(t *testing.T) {
+	source, _ := archiveSource(t)
+	key := "SHA256E-s12--0123abcd.dat"
+	objdir := filepath.Join(source, ".git", "annex", "objects", "Xy", "Zw", key)
+	if err := os.MkdirAll(objdir, 0777); err != nil {
+		t.Fatalf("Error creating annex object directory: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(objdir, key), []byte("locked data\n"), 0444); err != nil {
+		t.Fatalf("Error writing annex object: %s", err.Error())
+	}
+	target := filepath.Join("..", ".git", "annex", "objects", "Xy", "Zw", key, key)
+	if err := os.Symlink(target, filepath.Join(source, "data", "locked.dat")); err != nil {
+		t.Fatalf("Error creating locked annex file: %s", err.Error())
+	}
+	targetdir := t.TempDir()
+	progress := func(JobState, string) {}
+	// the locked file is sized by its annex object
+	plan, err := planParts(source, []string{".git"}, 12)
+	if err != nil {
+		t.Fatalf("Error planning parts: %s", err.Error())
+	}
+	for _, files := range plan {
+		if len(files) > 1 {
+			t.Fatalf("Unexpected part size of locked annex file: %v", plan)
+		}
+	}
+
+	zipfilename := filepath.Join(targetdir, archiveName("10.12751/g-node.lck001", ArchiveZip))
+	if _, err := runzip(context.Background(), source, zipfilename, ArchiveZip, nil, 0, []string{".git"}, nil, progress); err != nil {
+		t.Fatalf("Error creating archive: %s", err.Error())
+	}
+	zipreader, err := zip.OpenReader(zipfilename)
+	if err != nil {
+		t.Fatalf("Error opening archive: %s", err.Error())
+	}
+	defer zipreader.Close()
+	found := false
+	for _, file := range zipreader.File {
+		if strings.HasPrefix(file.Name, ".git") {
+			t.Fatalf("Unexpected annex object store file in archive: %q", file.Name)
+		}
+		switch file.Name {
+		case "data/locked.dat":
+			found = true
+			if !file.Mode().IsRegular() || file.Mode().Perm()&0200 == 0 {
+				t.Fatalf("Unexpected mode of locked annex file: %s", file.Mode())
+			}
+			fp, err := file.Open()
+			if err != nil {
+				t.Fatalf("Error opening archived file: %s", err.Error())
+			}
+			data, err := io.ReadAll(fp)
+			fp.Close()
+			if err != nil || string(data) != "locked data\n" {
+				t.Fatalf("Unexpected content of locked annex file: %q %v", data, err)
+			}
+		case "data/link.raw":
+			// symlinks without annex content remain symlinks
+			if file.Mode()&os.ModeSymlink == 0 {
+				t.Fatalf("Unexpected mode of symlink: %s", file.Mode())
+			}
+		}
+	}
+	if !found {
+		t.Fatal("Missing locked annex file in archive")
+	}
+
+	// the manifest records the annex key of the locked file
+	data, err := os.ReadFile(manifestName(zipfilename))
+	if err != nil || !strings.Contains(string(data), key) {
+		t.Fatalf("Missing annex key in manifest: %v", err)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/G-Node/libgin/libgin"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+// bagPayloadDir is the payload directory of a BagIt bag.
+const bagPayloadDir = "data"
+
+// bagWriter receives the files of a BagIt bag.
+type bagWriter interface {
+	// create returns a writer for the file at the slash separated path
+	// relative to the bag root.
+	create(fpath string) (io.WriteCloser, error)
+}
+
+// dirBagWriter writes a bag to a directory.
+type dirBagWriter struct {
+	root string
+}
+
+func (bw dirBagWriter) create(fpath string) (io.WriteCloser, error) {
+	fname := filepath.Join(bw.root, filepath.FromSlash(fpath))
+	if err := os.MkdirAll(filepath.Dir(fname), 0777); err != nil {
+		return nil, err
+	}
+	return os.Create(fname)
+}
+
+// zipBagWriter writes a bag to a zip file. As required for serialized bags,
+// all files are placed below a single top level directory named after the bag.
+type zipBagWriter struct {
+	zipwriter *zip.Writer
+	name      string
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func (bw zipBagWriter) create(fpath string) (io.WriteCloser, error) {
+	header := &zip.FileHeader{Name: path.Join(bw.name, fpath), Method: zip.Store, Modified: time.Now()}
+	w, err := bw.zipwriter.CreateHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// writeBagFile writes the content to the file at fpath in the bag and returns
+// the number of bytes written and the hex encoded SHA-256 checksum.
+func writeBagFile(bw bagWriter, fpath string, content io.Reader) (int64, string, error) {
+	w, err := bw.create(fpath)
+	if err != nil {
+		return 0, "", err
+	}
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, hasher), content)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// makeBag writes all files found under the source directory as payload of a
+// BagIt bag (version 1.0) to the provided bagWriter and returns the manifest
+// of the payload files. Directories and files specified via the exclude
+// parameter, relative to the source directory, are ignored. The bag
+// information is populated from the DataCite metadata. The manifest is added
+// to the bag as an additional tag file. annexKeys and added are handled as
+// described for makeArchive. Bagging is aborted if the context is done.
+func makeBag(ctx context.Context, bw bagWriter, source string, exclude []string, annexKeys map[string]string, datacite *libgin.DataCite, added func(manifestEntry)) ([]manifestEntry, error) {
+	if _, err := os.Stat(source); err != nil {
+		return nil, fmt.Errorf("cannot access '%s': %s", source, err.Error())
+	}
+
+	manifest := make([]manifestEntry, 0)
+	walker := func(fname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		relpath, err := filepath.Rel(source, fname)
+		if err != nil {
+			return err
+		}
+		for i := range exclude {
+			if exclude[i] == relpath {
+				return filepath.SkipDir
+			}
+		}
+		if fi.Mode().IsDir() {
+			return nil
+		}
+
+		entry := manifestEntry{Path: filepath.ToSlash(relpath), AnnexKey: annexKeys[filepath.ToSlash(relpath)]}
+		var content io.Reader
+		if fi.Mode()&os.ModeSymlink != 0 {
+			data, err := os.Readlink(fname)
+			if err != nil {
+				return err
+			}
+			if entry.AnnexKey == "" && strings.Contains(filepath.ToSlash(data), "annex/objects/") {
+				entry.AnnexKey = filepath.Base(data)
+			}
+			if _, ok := annexObject(fname, data); ok {
+				// locked annex file; bag the content of the annex object
+				f, err := os.Open(fname)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				content = f
+			} else {
+				content = strings.NewReader(data)
+			}
+		} else {
+			f, err := os.Open(fname)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			content = f
+		}
+
+		entry.Size, entry.SHA256, err = writeBagFile(bw, path.Join(bagPayloadDir, entry.Path), contextReader{ctx, content})
+		if err != nil {
+			return err
+		}
+		manifest = append(manifest, entry)
+		if added != nil {
+			added(entry)
+		}
+		return nil
+	}
+	if err := filepath.Walk(source, walker); err != nil {
+		return nil, fmt.Errorf("error adding %s to bag: %s", source, err.Error())
+	}
+
+	if err := writeBagTags(bw, manifest, datacite); err != nil {
+		return nil, fmt.Errorf("error writing bag tag files: %s", err.Error())
+	}
+	return manifest, nil
+}
+
+// writeBagTags writes the tag files of a bag with the provided payload
+// manifest: the bag declaration, the payload manifest, the bag information,
+// the gin-doi manifest, and finally the tag manifest.
+func writeBagTags(bw bagWriter, manifest []manifestEntry, datacite *libgin.DataCite) error {
+	var payloadManifest strings.Builder
+	var payloadSize int64
+	for _, entry := range manifest {
+		fmt.Fprintf(&payloadManifest, "%s  %s\n", entry.SHA256, bagPath(path.Join(bagPayloadDir, entry.Path)))
+		payloadSize += entry.Size
+	}
+	manifestdata, err := marshalManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	tagfiles := []struct {
+		name    string
+		content string
+	}{
+		{"bagit.txt", "BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n"},
+		{"manifest-sha256.txt", payloadManifest.String()},
+		{"bag-info.txt", bagInfo(datacite, payloadSize, len(manifest))},
+		{manifestfname, string(manifestdata)},
+	}
+	var tagManifest strings.Builder
+	for _, tagfile := range tagfiles {
+		_, sum, err := writeBagFile(bw, tagfile.name, strings.NewReader(tagfile.content))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&tagManifest, "%s  %s\n", sum, tagfile.name)
+	}
+	_, _, err = writeBagFile(bw, "tagmanifest-sha256.txt", strings.NewReader(tagManifest.String()))
+	return err
+}
+
+// bagPath encodes the characters of a file path that are not permitted in
+// BagIt manifest files.
+func bagPath(fpath string) string {
+	return strings.NewReplacer("%", "%25", "\n", "%0A", "\r", "%0D").Replace(fpath)
+}
+
+// bagInfo returns the content of the bag-info.txt file populated from the
+// DataCite metadata of a dataset.
+func bagInfo(datacite *libgin.DataCite, payloadSize int64, nfiles int) string {
+	// bag-info values are single lines
+	clean := func(value string) string {
+		return strings.Join(strings.Fields(value), " ")
+	}
+	lines := make([]string, 0, 16)
+	add := func(label, value string) {
+		if value = clean(value); value != "" {
+			lines = append(lines, fmt.Sprintf("%s: %s", label, value))
+		}
+	}
+
+	if datacite != nil {
+		add("Source-Organization", datacite.Publisher)
+		if datacite.Identifier.ID != "" {
+			add("External-Identifier", fmt.Sprintf("https://doi.org/%s", datacite.Identifier.ID))
+		}
+		if len(datacite.Titles) > 0 {
+			add("External-Description", datacite.Titles[0])
+			add("Title", datacite.Titles[0])
+		}
+		for _, creator := range datacite.Creators {
+			add("Creator", creator.Name)
+		}
+		if datacite.Year > 0 {
+			add("Publication-Year", fmt.Sprintf("%d", datacite.Year))
+		}
+		for _, rights := range datacite.RightsList {
+			add("License", strings.TrimSpace(fmt.Sprintf("%s %s", rights.Name, rights.URL)))
+		}
+		if datacite.Subjects != nil {
+			subjects := append([]string(nil), *datacite.Subjects...)
+			sort.Strings(subjects)
+			add("Keywords", strings.Join(subjects, ", "))
+		}
+		add("Resource-Type", datacite.ResourceType.Value)
+	}
+	add("Bagging-Date", time.Now().Format("2006-01-02"))
+	add("Bag-Software-Agent", "gin-doi")
+	add("Payload-Oxum", fmt.Sprintf("%d.%d", payloadSize, nfiles))
+	add("Bag-Size", humanize.IBytes(uint64(payloadSize)))
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// runbag writes the content of a source directory as BagIt bag to a zip file
+// with the given filename. Like runzip, it writes the manifest and the
+// checksum of the archive next to the archive.
+func runbag(ctx context.Context, source, zipfilename string, exclude []string, annexKeys map[string]string, datacite *libgin.DataCite, progress progressFunc) (int64, error) {
+	progress(JobZipping, "creating BagIt zip file")
+	bagname := strings.TrimSuffix(filepath.Base(zipfilename), filepath.Ext(zipfilename))
+	return writeArchive(zipfilename, func(dest io.Writer) ([]manifestEntry, error) {
+		zipwriter := zip.NewWriter(dest)
+		defer zipwriter.Close()
+		manifest, err := makeBag(ctx, zipBagWriter{zipwriter: zipwriter, name: bagname}, source, exclude, annexKeys, datacite, zipProgress(progress))
+		if err != nil {
+			return nil, err
+		}
+		if err := zipwriter.Close(); err != nil {
+			return nil, fmt.Errorf("error finishing zip file: %s", err.Error())
+		}
+		return manifest, nil
+	})
+}
+
+// exportBag writes the content of a source directory as BagIt bag to the
+// directory bagdir. An existing bag directory is replaced.
+func exportBag(ctx context.Context, source, bagdir string, exclude []string, annexKeys map[string]string, datacite *libgin.DataCite) error {
+	if err := os.RemoveAll(bagdir); err != nil {
+		return fmt.Errorf("failed to remove previous bag directory: %s", err.Error())
+	}
+	logger(ctx).Info("Exporting BagIt bag", "dir", bagdir)
+	if _, err := makeBag(ctx, dirBagWriter{root: bagdir}, source, exclude, annexKeys, datacite, nil); err != nil {
+		return fmt.Errorf("failed to create bag directory: %s", err.Error())
+	}
+	return nil
+}
+
+// clibag handles command line arguments and creates a BagIt bag from a
+// directory and the metadata of a DataCite XML file.
+func clibag(cmd *cobra.Command, args []string) {
+	source, xmlfile := args[0], args[1]
+	outpath, err := cmd.Flags().GetString("out")
+	if err != nil {
+		log.Printf("-- Error parsing output directory flag: %s\n", err.Error())
+	}
+	zipped, err := cmd.Flags().GetBool("zip")
+	if err != nil {
+		log.Printf("-- Error parsing zip flag: %s\n", err.Error())
+	}
+
+	var contents []byte
+	if isURL(xmlfile) {
+		contents, err = readFileAtURL(xmlfile)
+	} else {
+		contents, err = readFileAtPath(xmlfile)
+	}
+	if err != nil {
+		fmt.Printf("Failed to read file at %q: %s\n", xmlfile, err.Error())
+		return
+	}
+	datacite := new(libgin.DataCite)
+	if err := xml.Unmarshal(contents, datacite); err != nil {
+		fmt.Printf("Failed to unmarshal contents of %q: %s\n", xmlfile, err.Error())
+		return
+	}
+
+	bagname := filepath.Base(filepath.Clean(source))
+	if datacite.Identifier.ID != "" {
+		bagname = strings.ReplaceAll(datacite.Identifier.ID, "/", "_")
+	}
+	exclude := []string{".git"}
+	ctx := context.Background()
+	keys := annexKeys(ctx, source)
+	if zipped {
+		zipfilename := filepath.Join(outpath, bagname+".zip")
+		progress := func(JobState, string) {}
+		if _, err := runbag(ctx, source, zipfilename, exclude, keys, datacite, progress); err != nil {
+			fmt.Printf("Failed to create bag: %s\n", err.Error())
+			return
+		}
+		fmt.Printf("\t-> %s\n", zipfilename)
+		return
+	}
+	bagdir := filepath.Join(outpath, bagname)
+	if err := exportBag(ctx, source, bagdir, exclude, keys, datacite); err != nil {
+		fmt.Printf("Failed to create bag: %s\n", err.Error())
+		return
+	}
+	fmt.Printf("\t-> %s\n", bagdir)
+}
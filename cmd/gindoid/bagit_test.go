@@ -0,0 +1,187 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/G-Node/libgin/libgin"
+)
+
+// bagSource creates a source directory for bag tests and returns its path
+// and the contained files.
+func bagSource(t *testing.T) (string, map[string]string) {
+	files := map[string]string{
+		"README.md":            "readme",
+		"data/file.raw":        "some data",
+		".git/config":          "excluded",
+		"data/sub/another.txt": "more data",
+	}
+	source := writeSourceFiles(t, files)
+	delete(files, ".git/config")
+	return source, files
+}
+
+func bagDataCite() *libgin.DataCite {
+	datacite := libgin.NewDataCite()
+	datacite.Identifier.ID = "10.12751/g-node.bag001"
+	datacite.Titles = []string{"A bagged\n dataset"}
+	datacite.Creators = []libgin.Creator{{Name: "Doe, Jane"}, {Name: "Roe, Richard"}}
+	datacite.Year = 2026
+	datacite.RightsList = []libgin.Rights{{Name: "CC-BY", URL: "https://creativecommons.org/licenses/by/4.0/"}}
+	return &datacite
+}
+
+func sha256hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestMakeBag(t *testing.T) {
+	source, files := bagSource(t)
+	bagdir := filepath.Join(t.TempDir(), "bag")
+	datacite := bagDataCite()
+	if err := exportBag(context.Background(), source, bagdir, []string{".git"}, nil, datacite); err != nil {
+		t.Fatalf("Error creating bag: %s", err.Error())
+	}
+
+	// payload
+	for fname, content := range files {
+		data, err := os.ReadFile(filepath.Join(bagdir, "data", filepath.FromSlash(fname)))
+		if err != nil || string(data) != content {
+			t.Fatalf("Unexpected payload file %q: %q %v", fname, data, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(bagdir, "data", ".git")); !os.IsNotExist(err) {
+		t.Fatal("Excluded directory in bag payload")
+	}
+
+	// payload manifest
+	data, err := os.ReadFile(filepath.Join(bagdir, "manifest-sha256.txt"))
+	if err != nil {
+		t.Fatalf("Error reading payload manifest: %s", err.Error())
+	}
+	manifest := string(data)
+	if lines := strings.Split(strings.TrimSpace(manifest), "\n"); len(lines) != len(files) {
+		t.Fatalf("Unexpected number of payload manifest lines: %q", manifest)
+	}
+	for fname, content := range files {
+		line := sha256hex(content) + "  data/" + fname + "\n"
+		if !strings.Contains(manifest, line) {
+			t.Fatalf("Missing payload manifest line %q: %q", line, manifest)
+		}
+	}
+
+	// bag declaration and information
+	data, err = os.ReadFile(filepath.Join(bagdir, "bagit.txt"))
+	if err != nil || string(data) != "BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n" {
+		t.Fatalf("Unexpected bag declaration %q: %v", data, err)
+	}
+	data, err = os.ReadFile(filepath.Join(bagdir, "bag-info.txt"))
+	if err != nil {
+		t.Fatalf("Error reading bag information: %s", err.Error())
+	}
+	info := string(data)
+	expected := []string{
+		"Source-Organization: G-Node\n",
+		"External-Identifier: https://doi.org/10.12751/g-node.bag001\n",
+		"External-Description: A bagged dataset\n",
+		"Creator: Doe, Jane\n",
+		"Creator: Roe, Richard\n",
+		"Publication-Year: 2026\n",
+		"Payload-Oxum: 24.3\n",
+		"Bagging-Date: ",
+	}
+	for _, line := range expected {
+		if !strings.Contains(info, line) {
+			t.Fatalf("Missing bag information %q: %q", line, info)
+		}
+	}
+
+	// tag manifest
+	data, err = os.ReadFile(filepath.Join(bagdir, "tagmanifest-sha256.txt"))
+	if err != nil {
+		t.Fatalf("Error reading tag manifest: %s", err.Error())
+	}
+	for _, tagfile := range []string{"bagit.txt", "manifest-sha256.txt", "bag-info.txt", manifestfname} {
+		content, err := os.ReadFile(filepath.Join(bagdir, tagfile))
+		if err != nil {
+			t.Fatalf("Error reading tag file %q: %s", tagfile, err.Error())
+		}
+		line := sha256hex(string(content)) + "  " + tagfile + "\n"
+		if !strings.Contains(string(data), line) {
+			t.Fatalf("Missing tag manifest line %q: %q", line, data)
+		}
+	}
+
+	// a second export replaces the bag
+	if err := os.WriteFile(filepath.Join(bagdir, "stale.txt"), []byte("stale"), 0666); err != nil {
+		t.Fatalf("Error writing file: %s", err.Error())
+	}
+	if err := exportBag(context.Background(), source, bagdir, []string{".git"}, nil, datacite); err != nil {
+		t.Fatalf("Error recreating bag: %s", err.Error())
+	}
+	if _, err := os.Stat(filepath.Join(bagdir, "stale.txt")); !os.IsNotExist(err) {
+		t.Fatal("Previous bag content was not removed")
+	}
+
+	// missing source directory
+	if err := exportBag(context.Background(), filepath.Join(source, "missing"), bagdir, nil, nil, datacite); err == nil {
+		t.Fatal("Missing error on missing source directory")
+	}
+}
+
+func TestRunbag(t *testing.T) {
+	source, files := bagSource(t)
+	zipfilename := filepath.Join(t.TempDir(), "10.12751_g-node.bag001.zip")
+	progress := func(JobState, string) {}
+	size, err := runbag(context.Background(), source, zipfilename, []string{".git"}, nil, bagDataCite(), progress)
+	if err != nil {
+		t.Fatalf("Error creating zipped bag: %s", err.Error())
+	}
+	stat, err := os.Stat(zipfilename)
+	if err != nil || stat.Size() != size {
+		t.Fatalf("Unexpected zipped bag size %d: %v", size, err)
+	}
+
+	zipreader, err := zip.OpenReader(zipfilename)
+	if err != nil {
+		t.Fatalf("Error opening zip file: %s", err.Error())
+	}
+	defer zipreader.Close()
+	names := make(map[string]bool)
+	for _, file := range zipreader.File {
+		if !strings.HasPrefix(file.Name, "10.12751_g-node.bag001/") {
+			t.Fatalf("Zipped bag file outside of the bag directory: %q", file.Name)
+		}
+		names[strings.TrimPrefix(file.Name, "10.12751_g-node.bag001/")] = true
+	}
+	expected := []string{"bagit.txt", "bag-info.txt", "manifest-sha256.txt", "tagmanifest-sha256.txt", manifestfname}
+	for fname := range files {
+		expected = append(expected, "data/"+fname)
+	}
+	for _, fname := range expected {
+		if !names[fname] {
+			t.Fatalf("Missing file %q in zipped bag: %v", fname, names)
+		}
+	}
+
+	// checksum and manifest next to the archive
+	if checksum := readArchiveChecksum(context.Background(), zipfilename); len(checksum) != 64 {
+		t.Fatalf("Unexpected archive checksum %q", checksum)
+	}
+	if _, err := os.Stat(manifestName(zipfilename)); err != nil {
+		t.Fatalf("Missing manifest next to the zipped bag: %s", err.Error())
+	}
+}
+
+func TestBagPath(t *testing.T) {
+	if p := bagPath("data/a%b\nc\rd.txt"); p != "data/a%25b%0Ac%0Dd.txt" {
+		t.Fatalf("Unexpected encoded bag path %q", p)
+	}
+}
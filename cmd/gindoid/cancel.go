@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// cancelledError is returned if a stage of a registration job is aborted,
+// because the stage timeout was exceeded or the job was cancelled.
+type cancelledError struct {
+	Stage   JobState
+	Timeout time.Duration
+	// Err is the error of the stage context
+	Err error
+}
+
+func (e *cancelledError) Error() string {
+	if errors.Is(e.Err, context.DeadlineExceeded) && e.Timeout > 0 {
+		return fmt.Sprintf("job cancelled: %s stage timed out after %s", e.Stage, e.Timeout)
+	}
+	return fmt.Sprintf("job cancelled during %s stage", e.Stage)
+}
+
+// stageContext returns the context of a job stage, which is done when the job
+// context is done or the stage timeout is exceeded. A timeout of zero does not
+// limit the stage.
+func stageContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// stageError returns a cancelledError for the stage if the stage context is
+// done; otherwise the provided error is returned unchanged. It has to be
+// called before the stage context is cancelled.
+func stageError(ctx context.Context, stage JobState, timeout time.Duration, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	logger(ctx).Error("Stage aborted", "stage", stage, "error", err.Error())
+	return &cancelledError{Stage: stage, Timeout: timeout, Err: ctx.Err()}
+}
+
+// contextReader is an io.Reader that fails once the context is done; it
+// aborts copying large files when a job is cancelled.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCancelledError(t *testing.T) {
+	err := &cancelledError{Stage: JobCloning, Timeout: time.Minute, Err: context.DeadlineExceeded}
+	if msg := err.Error(); msg != "job cancelled: cloning stage timed out after 1m0s" {
+		t.Fatalf("Unexpected timeout message %q", msg)
+	}
+	err = &cancelledError{Stage: JobZipping, Err: context.Canceled}
+	if msg := err.Error(); msg != "job cancelled during zipping stage" {
+		t.Fatalf("Unexpected cancel message %q", msg)
+	}
+
+	// stageError only wraps errors of done contexts
+	ctx, cancel := context.WithCancel(context.Background())
+	plain := errors.New("plain error")
+	if err := stageError(ctx, JobZipping, 0, plain); err != plain {
+		t.Fatalf("Unexpected error for a running stage: %v", err)
+	}
+	cancel()
+	if err := stageError(ctx, JobZipping, 0, plain); err == nil {
+		t.Fatal("Missing error for a cancelled stage")
+	} else if _, ok := err.(*cancelledError); !ok {
+		t.Fatalf("Unexpected error type for a cancelled stage: %T", err)
+	}
+	if err := stageError(ctx, JobZipping, 0, nil); err != nil {
+		t.Fatalf("Unexpected error for a successful stage: %v", err)
+	}
+}
+
+func TestRunCommandCancel(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep is not available")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// the child of the shell has to be killed as well for the command to end
+	_, _, err := runCommand(ctx, exec.Command("sh", "-c", "sleep 30; echo done"))
+	if err == nil || !strings.Contains(err.Error(), "aborted") {
+		t.Fatalf("Unexpected error running a cancelled command: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("Cancelled command ran for %s", elapsed)
+	}
+
+	// a done context does not start the command
+	if _, _, err := runCommand(ctx, exec.Command("true")); err == nil {
+		t.Fatal("Unexpected command run with a done context")
+	}
+}
+
+func TestCloneRepoTimeout(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	remoteroot := t.TempDir()
+	commit := fixtureRepo(t, remoteroot, "owner", "repo")
+	conf := new(Configuration)
+	cloneFrom(t, remoteroot)
+	conf.Timeouts.Clone = time.Nanosecond
+	progress := func(JobState, string) {}
+
+	err := cloneRepo(context.Background(), "owner/repo", commit, t.TempDir(), conf, new(downloadStats), progress)
+	cerr, ok := err.(*cancelledError)
+	if !ok {
+		t.Fatalf("Unexpected error for a timed out clone: %v", err)
+	}
+	if cerr.Stage != JobCloning || !strings.Contains(cerr.Error(), "timed out") {
+		t.Fatalf("Unexpected cancel error %q", cerr.Error())
+	}
+
+	// without a timeout the clone succeeds
+	conf.Timeouts.Clone = 0
+	if err := cloneRepo(context.Background(), "owner/repo", commit, t.TempDir(), conf, new(downloadStats), progress); err != nil {
+		t.Fatalf("Error cloning without timeout: %s", err.Error())
+	}
+}
+
+func TestMakeArchiveCancel(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "data.txt"), []byte("content"), 0666); err != nil {
+		t.Fatalf("Error writing test file: %s", err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	zipfilename := filepath.Join(t.TempDir(), "cancelled.zip")
+	progress := func(JobState, string) {}
+	if _, err := runzip(ctx, source, zipfilename, ArchiveZip, nil, 0, nil, nil, progress); err == nil {
+		t.Fatal("Unexpected archive of a cancelled job")
+	}
+}
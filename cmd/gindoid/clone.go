@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	gingit "github.com/G-Node/gin-cli/git"
+)
+
+// cloneURL returns the address of the GIN git server the repository
+// specified by URI is cloned from. Tests replace it to clone local fixtures.
+var cloneURL = func(conf *Configuration, URI string) string {
+	return fmt.Sprintf("%s/%s", conf.GIN.Session.GitAddress(), strings.ToLower(URI))
+}
+
+// scanProgressLines is a bufio.SplitFunc splitting git progress output into
+// lines. git updates progress lines in place using carriage returns.
+func scanProgressLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if idx := bytes.IndexAny(data, "\r\n"); idx >= 0 {
+		return idx + 1, data[:idx], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// cloneGitRepo clones the git repository at remote into repodir. The clone
+// runs in the parent directory of repodir, independent of the working
+// directory of the process. The transfer progress of git is reported to the
+// provided progressFunc; any other output is returned with the error if the
+// clone fails. The clone is aborted if the context is done.
+func cloneGitRepo(ctx context.Context, remote string, repodir string, progress progressFunc) error {
+	if _, err := os.Stat(repodir); err == nil {
+		return fmt.Errorf("clone directory %q already exists", repodir)
+	}
+	cmd := gingit.Command("version")
+	cmd.Args = []string{"git", "-C", filepath.Dir(repodir), "clone", "--progress", remote, filepath.Base(repodir)}
+	logger(ctx).Debug("Running git clone", "args", cmd.Args)
+	if err := startCommand(ctx, cmd.Cmd); err != nil {
+		return fmt.Errorf("failed to start git clone: %s", err.Error())
+	}
+	// closing the output pipes of git by killing it ends the progress scan
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killCommand(cmd.Cmd)
+		case <-stop:
+		}
+	}()
+	messages := make([]string, 0)
+	scanner := bufio.NewScanner(cmd.ErrReader)
+	scanner.Split(scanProgressLines)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "Receiving objects"), strings.HasPrefix(line, "Resolving deltas"):
+			progress(JobCloning, line)
+		default:
+			messages = append(messages, line)
+		}
+	}
+	// drain stdout to let git finish
+	_, _ = io.Copy(io.Discard, cmd.OutReader)
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("git clone aborted: %s", ctx.Err().Error())
+		}
+		return fmt.Errorf("git clone failed: %s: %s", err.Error(), strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// annexBranch returns whether the clone at repodir has a git-annex branch,
+// i.e. whether the repository uses git annex.
+func annexBranch(ctx context.Context, repodir string) bool {
+	_, _, err := remoteGitCMD(ctx, repodir, false, "rev-parse", "--verify", "--quiet", "refs/remotes/origin/git-annex")
+	return err == nil
+}
+
+// initAnnexClone configures the clone at repodir and initialises git annex
+// with a description naming the GIN user and the host of the service.
+func initAnnexClone(ctx context.Context, repodir string, username string) error {
+	if username == "" {
+		username = "gin-doi"
+	}
+	// quoted paths break the file lists read from git annex output
+	if _, stderr, err := remoteGitCMD(ctx, repodir, false, "config", "core.quotepath", "false"); err != nil {
+		return fmt.Errorf("failed to configure clone: %s: %s", err.Error(), stderr)
+	}
+	// git annex commits to the git-annex branch and requires a git user
+	if name, _, _ := remoteGitCMD(ctx, repodir, false, "config", "user.name"); strings.TrimSpace(name) == "" {
+		if _, stderr, err := remoteGitCMD(ctx, repodir, false, "config", "user.name", username); err != nil {
+			return fmt.Errorf("failed to configure git user: %s: %s", err.Error(), stderr)
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	description := fmt.Sprintf("%s@%s", username, hostname)
+	if _, stderr, err := remoteGitCMD(ctx, repodir, true, "init", description); err != nil {
+		return fmt.Errorf("failed to initialise annex: %s: %s", err.Error(), stderr)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// cloneFrom clones repositories from the directories below root instead of
+// the GIN git server for the duration of the test.
+func cloneFrom(t *testing.T, root string) {
+	gitserver := cloneURL
+	cloneURL = func(_ *Configuration, URI string) string {
+		return filepath.Join(root, strings.ToLower(URI))
+	}
+	t.Cleanup(func() { cloneURL = gitserver })
+}
+
+// fixtureRepo creates a git repository at remoteroot/owner/name with a README
+// and a data file unique to the repository and returns the commit hash.
+func fixtureRepo(t *testing.T, remoteroot string, owner string, name string) string {
+	repodir := filepath.Join(remoteroot, owner, name)
+	writeFiles(t, repodir, map[string]string{
+		"README.md":             fmt.Sprintf("# %s\n", name),
+		"data/" + name + ".txt": strings.Repeat(name+"\n", 100),
+	})
+	git := func(args ...string) string {
+		args = append([]string{"-C", repodir, "-c", "user.name=Fixture", "-c", "user.email=fixture@example.com"}, args...)
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("Error running git %v: %s: %s", args, err.Error(), out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "--quiet")
+	git("add", ".")
+	git("commit", "--quiet", "-m", "Fixture content")
+	return git("rev-parse", "HEAD")
+}
+
+func TestConcurrentCloneAndZip(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	remoteroot := t.TempDir()
+	preproot := t.TempDir()
+	targetroot := t.TempDir()
+
+	conf := new(Configuration)
+	cloneFrom(t, remoteroot)
+	conf.Storage.PreparationDirectory = preproot
+	conf.Storage.TargetDirectory = targetroot
+	conf.Storage.ArchiveFormat = ArchiveZip
+	conf.Download.Jobs = 1
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Error reading working directory: %s", err.Error())
+	}
+
+	const njobs = 4
+	commits := make([]string, njobs)
+	for idx := range commits {
+		commits[idx] = fixtureRepo(t, remoteroot, "owner", fmt.Sprintf("repo%d", idx))
+	}
+
+	results := make([][]archivePart, njobs)
+	errs := make([]error, njobs)
+	var wg sync.WaitGroup
+	for idx := 0; idx < njobs; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			jobname := fmt.Sprintf("10.12751/g-node.cnc%03d", idx)
+			preppath := filepath.Join(preproot, jobname)
+			targetpath := filepath.Join(targetroot, jobname)
+			if err := os.MkdirAll(targetpath, 0777); err != nil {
+				errs[idx] = err
+				return
+			}
+			progress := func(JobState, string) {}
+			// the repository path is lowercased for cloning
+			repopath := fmt.Sprintf("Owner/Repo%d", idx)
+			results[idx], errs[idx] = cloneAndZip(context.Background(), repopath, commits[idx], jobname, preppath, targetpath, nil, conf, new(downloadStats), progress)
+		}(idx)
+	}
+	wg.Wait()
+
+	if cwd, err := os.Getwd(); err != nil || cwd != wd {
+		t.Fatalf("Working directory changed from %q to %q: %v", wd, cwd, err)
+	}
+	for idx := 0; idx < njobs; idx++ {
+		if errs[idx] != nil {
+			t.Fatalf("Job %d failed: %s", idx, errs[idx].Error())
+		}
+		if len(results[idx]) != 1 {
+			t.Fatalf("Unexpected archive parts of job %d: %v", idx, results[idx])
+		}
+		jobname := fmt.Sprintf("10.12751/g-node.cnc%03d", idx)
+		zipfilename := filepath.Join(targetroot, jobname, results[idx][0].Name)
+		zipreader, err := zip.OpenReader(zipfilename)
+		if err != nil {
+			t.Fatalf("Error opening archive of job %d: %s", idx, err.Error())
+		}
+		found := make(map[string]string)
+		for _, file := range zipreader.File {
+			fp, err := file.Open()
+			if err != nil {
+				t.Fatalf("Error opening archived file: %s", err.Error())
+			}
+			data, err := io.ReadAll(fp)
+			fp.Close()
+			if err != nil {
+				t.Fatalf("Error reading archived file: %s", err.Error())
+			}
+			found[file.Name] = string(data)
+		}
+		zipreader.Close()
+
+		name := fmt.Sprintf("repo%d", idx)
+		expected := map[string]string{
+			"README.md":             fmt.Sprintf("# %s\n", name),
+			"data/" + name + ".txt": strings.Repeat(name+"\n", 100),
+		}
+		for fname, content := range expected {
+			if found[fname] != content {
+				t.Fatalf("Unexpected content of %q in archive of job %d: %q", fname, idx, found[fname])
+			}
+		}
+		for fname := range found {
+			if _, ok := expected[fname]; !ok && fname != manifestfname {
+				t.Fatalf("Unexpected file %q in archive of job %d", fname, idx)
+			}
+		}
+	}
+}
+
+func TestCloneGitRepoFailure(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	repodir := filepath.Join(t.TempDir(), "missing")
+	progress := func(JobState, string) {}
+	err := cloneGitRepo(context.Background(), filepath.Join(t.TempDir(), "owner", "missing"), repodir, progress)
+	if err == nil || !strings.Contains(err.Error(), "git clone failed") {
+		t.Fatalf("Unexpected error cloning a missing repository: %v", err)
+	}
+
+	// an existing clone directory is not overwritten
+	fixtureRepo(t, filepath.Dir(repodir), "", "missing")
+	if err := cloneGitRepo(context.Background(), repodir, repodir, progress); err == nil {
+		t.Fatal("Unexpected clone into an existing directory")
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/G-Node/gin-cli/ginclient"
 	"github.com/G-Node/gin-cli/ginclient/config"
@@ -22,6 +25,8 @@ type Configuration struct {
 	// Processing queue length and max concurrent workers
 	MaxQueue   int
 	MaxWorkers int
+	// Time running jobs are given to finish when the service shuts down
+	ShutdownTimeout time.Duration
 	// GIN server configuration (web and git URLs) and DOI username and
 	// password for cloning
 	GIN struct {
@@ -29,6 +34,19 @@ type Configuration struct {
 		Password string
 		Session  *ginclient.Client
 	}
+	// Credentials for the curator admin web interface; the interface is
+	// disabled if no password is set
+	Admin struct {
+		Username string
+		Password string
+	}
+	// DataCite REST API endpoint and repository account used to register
+	// DOIs; DOI registration via the API is disabled if no username is set
+	DataCite struct {
+		URL      string
+		Username string
+		Password string
+	}
 	// DOI prefix
 	DOIBase string
 	// Email related settings (for sending notifications)
@@ -55,11 +73,69 @@ type Configuration struct {
 		// Used in email notification for convenient XML file retrieval (SCP
 		// format host:/path/)
 		XMLURL string
+		// Package format of the dataset archives
+		ArchiveFormat ArchiveFormat
+		// File extensions of files that are not compressed in compressed zip
+		// archives
+		StoredExtensions []string
+		// Maximum size of an archive file in bytes; larger archives are
+		// split into multiple parts. Archives are not split if zero.
+		ArchivePartSize int64
+		// Optional directory where each dataset is additionally stored as
+		// BagIt bag directory
+		BagDirectory string
+		// Maximum size of the content of the preparation and the target
+		// directory in bytes; there is no quota if zero
+		PreparationQuota int64
+		TargetQuota      int64
+		// Free space in bytes the file systems of the preparation and the
+		// target directory need for the service to report ready
+		MinFreeSpace int64
+		// Time after which a job that was deferred for lack of disk space
+		// is queued again
+		DeferInterval time.Duration
 	}
-	// LockedContentCutoffSize defines the git annex size above which a repository
-	// containing locked annex files is no longer handled by the server.
-	// The size number always refers to gigabytes.
-	LockedContentCutoffSize float64
+	// Settings for the git annex content download
+	Download struct {
+		// Number of parallel file downloads
+		Jobs int
+		// Number of retries of a failed file download
+		Retries int
+		// Time without download progress after which a file download is
+		// considered stalled and aborted
+		StallTimeout time.Duration
+	}
+	// Timeouts of the stages of a registration job and of the requests to
+	// external services; a running stage or request is aborted when its
+	// timeout is exceeded. A timeout of zero disables the timeout.
+	Timeouts struct {
+		// Cloning the repository and checking out the requested revision
+		Clone time.Duration
+		// Downloading the annex content
+		Download time.Duration
+		// Creating the archive
+		Zip time.Duration
+		// Single requests to the GIN API
+		GIN time.Duration
+		// Sending a single notification email
+		Mail time.Duration
+	}
+	// Settings of the service log
+	Log struct {
+		// Output format of the log records
+		Format LogFormat
+		// Minimum level of logged records
+		Level slog.Level
+		// Write the log records of each registration job additionally to a
+		// log file in the preparation directory of the job
+		JobFiles bool
+	}
+	// Jobs holds the persistent registration job records; it is set up
+	// when the service starts.
+	Jobs *JobStore `json:"-"`
+	// Reservations holds all allocated DOIs; it is set up when the service
+	// starts.
+	Reservations *ReservationStore `json:"-"`
 }
 
 // parseconfigvars loads all DOI server config vars from the
@@ -76,9 +152,35 @@ func parseconfigvars(cfg *Configuration) error {
 	cfg.Storage.TargetDirectory = libgin.ReadConf("target")
 	cfg.Storage.StoreURL = libgin.ReadConf("storeurl")
 	cfg.Storage.XMLURL = libgin.ReadConf("xmlurl")
+	cfg.Storage.BagDirectory = libgin.ReadConf("bagdir")
+
+	archiveformat := ArchiveFormat(libgin.ReadConfDefault("archiveformat", string(ArchiveZip)))
+	if !validArchiveFormat(archiveformat) {
+		log.Printf("Unsupported archive format %q", archiveformat)
+		log.Printf("Using default %q", ArchiveZip)
+		archiveformat = ArchiveZip
+	}
+	cfg.Storage.ArchiveFormat = archiveformat
+
+	cfg.Storage.StoredExtensions = defaultStoredExtensions
+	if storedexts := libgin.ReadConf("storedextensions"); storedexts != "" {
+		cfg.Storage.StoredExtensions = nil
+		for _, ext := range strings.Split(storedexts, ",") {
+			if ext = strings.TrimSpace(ext); ext != "" {
+				cfg.Storage.StoredExtensions = append(cfg.Storage.StoredExtensions, ext)
+			}
+		}
+	}
 
 	cfg.XMLRepo = libgin.ReadConf("xmlrepo")
 
+	cfg.Admin.Username = libgin.ReadConfDefault("adminuser", "admin")
+	cfg.Admin.Password = libgin.ReadConf("adminpassword")
+
+	cfg.DataCite.URL = libgin.ReadConfDefault("dataciteurl", "https://api.datacite.org")
+	cfg.DataCite.Username = libgin.ReadConf("dataciteuser")
+	cfg.DataCite.Password = libgin.ReadConf("datacitepassword")
+
 	cfg.Key = libgin.ReadConf("key")
 	maxqueue, err := strconv.Atoi(libgin.ReadConfDefault("maxqueue", "100"))
 	if err != nil {
@@ -96,6 +198,38 @@ func parseconfigvars(cfg *Configuration) error {
 	}
 	cfg.MaxWorkers = maxworkers
 
+	shutdowntimeout, err := strconv.Atoi(libgin.ReadConfDefault("shutdowntimeout", "600"))
+	if err != nil {
+		log.Printf("Error while parsing shutdowntimeout flag: %s", err.Error())
+		log.Print("Using default")
+		shutdowntimeout = 600
+	}
+	cfg.ShutdownTimeout = time.Duration(shutdowntimeout) * time.Second
+
+	annexjobs, err := strconv.Atoi(libgin.ReadConfDefault("annexjobs", "4"))
+	if err != nil || annexjobs < 1 {
+		log.Printf("Error while parsing annexjobs flag: %v", err)
+		log.Print("Using default")
+		annexjobs = 4
+	}
+	cfg.Download.Jobs = annexjobs
+
+	annexretries, err := strconv.Atoi(libgin.ReadConfDefault("annexretries", "3"))
+	if err != nil || annexretries < 0 {
+		log.Printf("Error while parsing annexretries flag: %v", err)
+		log.Print("Using default")
+		annexretries = 3
+	}
+	cfg.Download.Retries = annexretries
+
+	stalltimeout, err := strconv.Atoi(libgin.ReadConfDefault("annexstalltimeout", "300"))
+	if err != nil || stalltimeout < 1 {
+		log.Printf("Error while parsing annexstalltimeout flag: %v", err)
+		log.Print("Using default")
+		stalltimeout = 300
+	}
+	cfg.Download.StallTimeout = time.Duration(stalltimeout) * time.Second
+
 	portstr := libgin.ReadConfDefault("port", "10443")
 	port, err := strconv.ParseUint(portstr, 10, 16)
 	if err != nil {
@@ -104,13 +238,89 @@ func parseconfigvars(cfg *Configuration) error {
 
 	cfg.Port = uint16(port)
 
-	cutsize, err := strconv.ParseFloat(libgin.ReadConfDefault("lockedcutoffsize", "250.0"), 64)
+	// archive part size in gigabytes
+	partsize, err := strconv.ParseFloat(libgin.ReadConfDefault("archivepartsize", "0"), 64)
+	if err != nil || partsize < 0 {
+		log.Printf("Error while parsing archive part size flag: %v", err)
+		log.Print("Using default; archives are not split")
+		partsize = 0
+	}
+	cfg.Storage.ArchivePartSize = int64(partsize * (1 << 30))
+
+	// storage quotas in gigabytes
+	prepquota, err := strconv.ParseFloat(libgin.ReadConfDefault("preparationquota", "0"), 64)
+	if err != nil || prepquota < 0 {
+		log.Printf("Error while parsing preparation quota flag: %v", err)
+		log.Print("Using default; no quota")
+		prepquota = 0
+	}
+	cfg.Storage.PreparationQuota = int64(prepquota * (1 << 30))
+
+	targetquota, err := strconv.ParseFloat(libgin.ReadConfDefault("targetquota", "0"), 64)
+	if err != nil || targetquota < 0 {
+		log.Printf("Error while parsing target quota flag: %v", err)
+		log.Print("Using default; no quota")
+		targetquota = 0
+	}
+	cfg.Storage.TargetQuota = int64(targetquota * (1 << 30))
+
+	// minimum free space in gigabytes
+	minfree, err := strconv.ParseFloat(libgin.ReadConfDefault("minfreespace", "1"), 64)
+	if err != nil || minfree < 0 {
+		log.Printf("Error while parsing minfreespace flag: %v", err)
+		log.Print("Using default")
+		minfree = 1
+	}
+	cfg.Storage.MinFreeSpace = int64(minfree * (1 << 30))
+
+	deferinterval, err := strconv.Atoi(libgin.ReadConfDefault("deferinterval", "1800"))
+	if err != nil || deferinterval < 1 {
+		log.Printf("Error while parsing deferinterval flag: %v", err)
+		log.Print("Using default")
+		deferinterval = 1800
+	}
+	cfg.Storage.DeferInterval = time.Duration(deferinterval) * time.Second
+
+	timeouts := []struct {
+		name    string
+		defval  int
+		timeout *time.Duration
+	}{
+		{"clonetimeout", 3600, &cfg.Timeouts.Clone},
+		{"downloadtimeout", 172800, &cfg.Timeouts.Download},
+		{"ziptimeout", 86400, &cfg.Timeouts.Zip},
+		{"gintimeout", 60, &cfg.Timeouts.GIN},
+		{"mailtimeout", 60, &cfg.Timeouts.Mail},
+	}
+	for _, t := range timeouts {
+		seconds, err := strconv.Atoi(libgin.ReadConfDefault(t.name, strconv.Itoa(t.defval)))
+		if err != nil || seconds < 0 {
+			log.Printf("Error while parsing %s flag: %v", t.name, err)
+			log.Print("Using default")
+			seconds = t.defval
+		}
+		*t.timeout = time.Duration(seconds) * time.Second
+	}
+
+	logformat := LogFormat(libgin.ReadConfDefault("logformat", string(LogText)))
+	if logformat != LogText && logformat != LogJSON {
+		log.Printf("Invalid log format %q", logformat)
+		log.Printf("Using default %q", LogText)
+		logformat = LogText
+	}
+	cfg.Log.Format = logformat
+	if err := cfg.Log.Level.UnmarshalText([]byte(libgin.ReadConfDefault("loglevel", "info"))); err != nil {
+		log.Printf("Error while parsing loglevel flag: %s", err.Error())
+		log.Print("Using default")
+		cfg.Log.Level = slog.LevelInfo
+	}
+	joblogs, err := strconv.ParseBool(libgin.ReadConfDefault("joblogs", "false"))
 	if err != nil {
-		log.Printf("Error while parsing locked content cutoff size flag: %s", err.Error())
-		log.Printf("Using default %.1f", 250.0)
-		cutsize = 250.0
+		log.Printf("Error while parsing joblogs flag: %s", err.Error())
+		log.Print("Using default")
+		joblogs = false
 	}
-	cfg.LockedContentCutoffSize = cutsize
+	cfg.Log.JobFiles = joblogs
 
 	return nil
 }
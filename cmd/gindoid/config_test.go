@@ -1,9 +1,12 @@
 package main
 
 import (
+	"log/slog"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseConfigVars(t *testing.T) {
@@ -13,7 +16,7 @@ func TestParseConfigVars(t *testing.T) {
 	defport := uint16(10443)
 	defqueue := 100
 	defwork := 3
-	defcutoff := 250.0
+	defshutdown := 600 * time.Second
 
 	// test no error on basic load
 	err := parseconfigvars(&cfg)
@@ -25,6 +28,9 @@ func TestParseConfigVars(t *testing.T) {
 	if cfg.Port != defport || cfg.MaxQueue != defqueue || cfg.MaxWorkers != defwork {
 		t.Fatalf("Encountered unexpected default value(s): port (%d), queue (%d), workers (%d)", cfg.Port, cfg.MaxQueue, cfg.MaxWorkers)
 	}
+	if cfg.ShutdownTimeout != defshutdown {
+		t.Fatalf("Unexpected default shutdown timeout: %s", cfg.ShutdownTimeout)
+	}
 
 	// test invalid port entry handling
 	if err = os.Setenv("port", "abc"); err != nil {
@@ -102,26 +108,213 @@ func TestParseConfigVars(t *testing.T) {
 		t.Fatalf("Unexpected maxworkers value: %d", cfg.MaxWorkers)
 	}
 
-	// check cutoff size entry handling
-	if err = os.Setenv("lockedcutoffsize", "abc"); err != nil {
-		t.Fatalf("Error setting 'cutoff': %q", err.Error())
+	// check shutdown timeout entry handling
+	if err = os.Setenv("shutdowntimeout", "abc"); err != nil {
+		t.Fatalf("Error setting 'shutdowntimeout': %q", err.Error())
 	}
 	err = parseconfigvars(&cfg)
 	if err != nil {
-		t.Fatalf("Unexpected cutoff error: %q", err.Error())
-	} else if cfg.LockedContentCutoffSize != defcutoff {
-		t.Fatalf("Unexpected cutoff default value: %.1f", cfg.LockedContentCutoffSize)
+		t.Fatalf("Unexpected shutdowntimeout error: %q", err.Error())
+	} else if cfg.ShutdownTimeout != defshutdown {
+		t.Fatalf("Unexpected shutdowntimeout default value: %s", cfg.ShutdownTimeout)
 	}
 
-	// valid entry
-	if err = os.Setenv("lockedcutoffsize", "5"); err != nil {
-		t.Fatalf("Error re-setting 'cutoff': %q", err.Error())
+	if err = os.Setenv("shutdowntimeout", "30"); err != nil {
+		t.Fatalf("Error re-setting 'shutdowntimeout': %q", err.Error())
+	}
+	err = parseconfigvars(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected shutdowntimeout error: %q", err.Error())
+	} else if cfg.ShutdownTimeout != 30*time.Second {
+		t.Fatalf("Unexpected shutdowntimeout value: %s", cfg.ShutdownTimeout)
+	}
+
+	// check archive format entry handling
+	if cfg.Storage.ArchiveFormat != ArchiveZip {
+		t.Fatalf("Unexpected default archive format: %q", cfg.Storage.ArchiveFormat)
+	}
+	if err = os.Setenv("archiveformat", "rar"); err != nil {
+		t.Fatalf("Error setting 'archiveformat': %q", err.Error())
+	}
+	err = parseconfigvars(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected archiveformat error: %q", err.Error())
+	} else if cfg.Storage.ArchiveFormat != ArchiveZip {
+		t.Fatalf("Unexpected archiveformat default value: %q", cfg.Storage.ArchiveFormat)
+	}
+
+	if err = os.Setenv("archiveformat", "bagit"); err != nil {
+		t.Fatalf("Error re-setting 'archiveformat': %q", err.Error())
+	}
+	err = parseconfigvars(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected archiveformat error: %q", err.Error())
+	} else if cfg.Storage.ArchiveFormat != ArchiveBagIt {
+		t.Fatalf("Unexpected archiveformat value: %q", cfg.Storage.ArchiveFormat)
+	}
+	os.Unsetenv("archiveformat")
+
+	// check stored extensions entry handling
+	if len(cfg.Storage.StoredExtensions) != len(defaultStoredExtensions) {
+		t.Fatalf("Unexpected default stored extensions: %v", cfg.Storage.StoredExtensions)
+	}
+	if err = os.Setenv("storedextensions", ".h5, .nwb,,"); err != nil {
+		t.Fatalf("Error setting 'storedextensions': %q", err.Error())
+	}
+	err = parseconfigvars(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected storedextensions error: %q", err.Error())
+	} else if len(cfg.Storage.StoredExtensions) != 2 || cfg.Storage.StoredExtensions[1] != ".nwb" {
+		t.Fatalf("Unexpected stored extensions: %v", cfg.Storage.StoredExtensions)
+	}
+	os.Unsetenv("storedextensions")
+
+	// check archive part size entry handling
+	if cfg.Storage.ArchivePartSize != 0 {
+		t.Fatalf("Unexpected default archive part size: %d", cfg.Storage.ArchivePartSize)
+	}
+	if err = os.Setenv("archivepartsize", "abc"); err != nil {
+		t.Fatalf("Error setting 'archivepartsize': %q", err.Error())
+	}
+	err = parseconfigvars(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected archivepartsize error: %q", err.Error())
+	} else if cfg.Storage.ArchivePartSize != 0 {
+		t.Fatalf("Unexpected archivepartsize default value: %d", cfg.Storage.ArchivePartSize)
+	}
+
+	if err = os.Setenv("archivepartsize", "1.5"); err != nil {
+		t.Fatalf("Error re-setting 'archivepartsize': %q", err.Error())
 	}
 	err = parseconfigvars(&cfg)
 	if err != nil {
-		t.Fatalf("Unexpected cutoff error: %q", err.Error())
-	} else if cfg.LockedContentCutoffSize != 5 {
-		t.Fatalf("Unexpected cutoff value: %.1f", cfg.LockedContentCutoffSize)
+		t.Fatalf("Unexpected archivepartsize error: %q", err.Error())
+	} else if cfg.Storage.ArchivePartSize != 3<<29 {
+		t.Fatalf("Unexpected archivepartsize value: %d", cfg.Storage.ArchivePartSize)
+	}
+	os.Unsetenv("archivepartsize")
+
+	// check storage quota and defer interval handling
+	if cfg.Storage.PreparationQuota != 0 || cfg.Storage.TargetQuota != 0 || cfg.Storage.DeferInterval != 1800*time.Second || cfg.Storage.MinFreeSpace != 1<<30 {
+		t.Fatalf("Unexpected default storage settings: %d %d %s %d", cfg.Storage.PreparationQuota, cfg.Storage.TargetQuota, cfg.Storage.DeferInterval, cfg.Storage.MinFreeSpace)
+	}
+	for _, envvar := range []string{"preparationquota", "targetquota", "deferinterval", "minfreespace"} {
+		if err = os.Setenv(envvar, "-2"); err != nil {
+			t.Fatalf("Error setting %q: %q", envvar, err.Error())
+		}
+	}
+	err = parseconfigvars(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected storage settings error: %q", err.Error())
+	} else if cfg.Storage.PreparationQuota != 0 || cfg.Storage.TargetQuota != 0 || cfg.Storage.DeferInterval != 1800*time.Second || cfg.Storage.MinFreeSpace != 1<<30 {
+		t.Fatalf("Unexpected storage settings default values: %d %d %s %d", cfg.Storage.PreparationQuota, cfg.Storage.TargetQuota, cfg.Storage.DeferInterval, cfg.Storage.MinFreeSpace)
+	}
+	for envvar, value := range map[string]string{"preparationquota": "0.5", "targetquota": "2", "deferinterval": "60", "minfreespace": "0"} {
+		if err = os.Setenv(envvar, value); err != nil {
+			t.Fatalf("Error re-setting %q: %q", envvar, err.Error())
+		}
+	}
+	err = parseconfigvars(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected storage settings error: %q", err.Error())
+	} else if cfg.Storage.PreparationQuota != 1<<29 || cfg.Storage.TargetQuota != 2<<30 || cfg.Storage.DeferInterval != 60*time.Second || cfg.Storage.MinFreeSpace != 0 {
+		t.Fatalf("Unexpected storage settings values: %d %d %s %d", cfg.Storage.PreparationQuota, cfg.Storage.TargetQuota, cfg.Storage.DeferInterval, cfg.Storage.MinFreeSpace)
+	}
+	for _, envvar := range []string{"preparationquota", "targetquota", "deferinterval", "minfreespace"} {
+		os.Unsetenv(envvar)
+	}
+
+	// check annex download entry handling
+	if cfg.Download.Jobs != 4 || cfg.Download.Retries != 3 || cfg.Download.StallTimeout != 300*time.Second {
+		t.Fatalf("Unexpected default download settings: %+v", cfg.Download)
+	}
+	for _, envvar := range []string{"annexjobs", "annexretries", "annexstalltimeout"} {
+		if err = os.Setenv(envvar, "-1"); err != nil {
+			t.Fatalf("Error setting %q: %q", envvar, err.Error())
+		}
+	}
+	err = parseconfigvars(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected download settings error: %q", err.Error())
+	} else if cfg.Download.Jobs != 4 || cfg.Download.Retries != 3 || cfg.Download.StallTimeout != 300*time.Second {
+		t.Fatalf("Unexpected download settings default values: %+v", cfg.Download)
+	}
+	for envvar, value := range map[string]string{"annexjobs": "8", "annexretries": "0", "annexstalltimeout": "60"} {
+		if err = os.Setenv(envvar, value); err != nil {
+			t.Fatalf("Error re-setting %q: %q", envvar, err.Error())
+		}
+	}
+	err = parseconfigvars(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected download settings error: %q", err.Error())
+	} else if cfg.Download.Jobs != 8 || cfg.Download.Retries != 0 || cfg.Download.StallTimeout != 60*time.Second {
+		t.Fatalf("Unexpected download settings values: %+v", cfg.Download)
+	}
+	for _, envvar := range []string{"annexjobs", "annexretries", "annexstalltimeout"} {
+		os.Unsetenv(envvar)
+	}
+
+	// check stage timeout entry handling
+	if cfg.Timeouts.Clone != time.Hour || cfg.Timeouts.Download != 48*time.Hour || cfg.Timeouts.Zip != 24*time.Hour || cfg.Timeouts.GIN != time.Minute || cfg.Timeouts.Mail != time.Minute {
+		t.Fatalf("Unexpected default timeouts: %+v", cfg.Timeouts)
+	}
+	timeoutvars := []string{"clonetimeout", "downloadtimeout", "ziptimeout", "gintimeout", "mailtimeout"}
+	for _, envvar := range timeoutvars {
+		if err = os.Setenv(envvar, "-1"); err != nil {
+			t.Fatalf("Error setting %q: %q", envvar, err.Error())
+		}
+	}
+	err = parseconfigvars(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected timeout settings error: %q", err.Error())
+	} else if cfg.Timeouts.Clone != time.Hour || cfg.Timeouts.Mail != time.Minute {
+		t.Fatalf("Unexpected timeout default values: %+v", cfg.Timeouts)
+	}
+	for idx, envvar := range timeoutvars {
+		if err = os.Setenv(envvar, strconv.Itoa(idx*10)); err != nil {
+			t.Fatalf("Error re-setting %q: %q", envvar, err.Error())
+		}
+	}
+	err = parseconfigvars(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected timeout settings error: %q", err.Error())
+	} else if cfg.Timeouts.Clone != 0 || cfg.Timeouts.Download != 10*time.Second || cfg.Timeouts.Mail != 40*time.Second {
+		t.Fatalf("Unexpected timeout values: %+v", cfg.Timeouts)
+	}
+	for _, envvar := range timeoutvars {
+		os.Unsetenv(envvar)
+	}
+
+	// check log entry handling
+	if cfg.Log.Format != LogText || cfg.Log.Level != slog.LevelInfo || cfg.Log.JobFiles {
+		t.Fatalf("Unexpected default log settings: %+v", cfg.Log)
+	}
+	logvars := map[string]string{"logformat": "xml", "loglevel": "verbose", "joblogs": "maybe"}
+	for envvar, value := range logvars {
+		if err = os.Setenv(envvar, value); err != nil {
+			t.Fatalf("Error setting %q: %q", envvar, err.Error())
+		}
+	}
+	err = parseconfigvars(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected log settings error: %q", err.Error())
+	} else if cfg.Log.Format != LogText || cfg.Log.Level != slog.LevelInfo || cfg.Log.JobFiles {
+		t.Fatalf("Unexpected log default values: %+v", cfg.Log)
+	}
+	logvars = map[string]string{"logformat": "json", "loglevel": "debug", "joblogs": "true"}
+	for envvar, value := range logvars {
+		if err = os.Setenv(envvar, value); err != nil {
+			t.Fatalf("Error re-setting %q: %q", envvar, err.Error())
+		}
+	}
+	err = parseconfigvars(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected log settings error: %q", err.Error())
+	} else if cfg.Log.Format != LogJSON || cfg.Log.Level != slog.LevelDebug || !cfg.Log.JobFiles {
+		t.Fatalf("Unexpected log values: %+v", cfg.Log)
+	}
+	for envvar := range logvars {
+		os.Unsetenv(envvar)
 	}
 
 	// test no panic on unset variables
@@ -162,6 +355,21 @@ func TestParseConfigVars(t *testing.T) {
 	if cfg.Storage.XMLURL != "" {
 		t.Fatalf("Unexpected XMLURL %q", cfg.Storage.XMLURL)
 	}
+	if cfg.Storage.BagDirectory != "" {
+		t.Fatalf("Unexpected BagDirectory %q", cfg.Storage.BagDirectory)
+	}
+	if cfg.Admin.Username != "admin" {
+		t.Fatalf("Unexpected default Admin.Username %q", cfg.Admin.Username)
+	}
+	if cfg.Admin.Password != "" {
+		t.Fatalf("Unexpected Admin.Password %q", cfg.Admin.Password)
+	}
+	if cfg.DataCite.URL != "https://api.datacite.org" {
+		t.Fatalf("Unexpected default DataCite.URL %q", cfg.DataCite.URL)
+	}
+	if cfg.DataCite.Username != "" || cfg.DataCite.Password != "" {
+		t.Fatalf("Unexpected DataCite credentials %q:%q", cfg.DataCite.Username, cfg.DataCite.Password)
+	}
 }
 
 func TestLoadconfig(t *testing.T) {
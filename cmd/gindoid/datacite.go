@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dataciteDOIPath is the DataCite REST API path for DOI resources.
+const dataciteDOIPath = "dois"
+
+// DataCiteClient registers DOIs and their metadata via the DataCite REST API.
+type DataCiteClient struct {
+	// URL of the DataCite REST API
+	URL string
+	// Repository account ID and password
+	Username string
+	Password string
+	client   *http.Client
+}
+
+// dataciteRequest is the JSON:API document used to create and update DOIs.
+type dataciteRequest struct {
+	Data dataciteData `json:"data"`
+}
+
+type dataciteData struct {
+	Type       string             `json:"type"`
+	Attributes dataciteAttributes `json:"attributes"`
+}
+
+type dataciteAttributes struct {
+	DOI   string `json:"doi,omitempty"`
+	Event string `json:"event,omitempty"`
+	// Base64 encoded DataCite XML metadata
+	XML   string `json:"xml,omitempty"`
+	URL   string `json:"url,omitempty"`
+	State string `json:"state,omitempty"`
+}
+
+// newDataCiteClient creates a DataCite REST API client from the service
+// configuration. Returns nil if DOI registration via the API is disabled.
+func newDataCiteClient(conf *Configuration) *DataCiteClient {
+	if conf.DataCite.Username == "" {
+		return nil
+	}
+	return &DataCiteClient{
+		URL:      conf.DataCite.URL,
+		Username: conf.DataCite.Username,
+		Password: conf.DataCite.Password,
+		client:   &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// request sends a JSON:API request to the DataCite API path and decodes the
+// response attributes. If attr is nil, the request is sent without body.
+func (dc *DataCiteClient) request(method string, path string, attr *dataciteAttributes) (*dataciteAttributes, int, error) {
+	var body io.Reader
+	if attr != nil {
+		data, err := json.Marshal(dataciteRequest{Data: dataciteData{Type: "dois", Attributes: *attr}})
+		if err != nil {
+			return nil, -1, err
+		}
+		body = bytes.NewReader(data)
+	}
+	requrl := fmt.Sprintf("%s/%s", strings.TrimSuffix(dc.URL, "/"), path)
+	req, err := http.NewRequest(method, requrl, body)
+	if err != nil {
+		return nil, -1, err
+	}
+	req.SetBasicAuth(dc.Username, dc.Password)
+	req.Header.Set("Content-Type", "application/vnd.api+json")
+	req.Header.Set("Accept", "application/vnd.api+json")
+
+	resp, err := dc.client.Do(req)
+	if err != nil {
+		return nil, -1, err
+	}
+	defer resp.Body.Close()
+	respbody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, resp.StatusCode, fmt.Errorf("DataCite request %s %s failed [%d]: %s", method, path, resp.StatusCode, string(respbody))
+	}
+	var respdata dataciteRequest
+	if err := json.Unmarshal(respbody, &respdata); err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("invalid DataCite response: %s", err.Error())
+	}
+	return &respdata.Data.Attributes, resp.StatusCode, nil
+}
+
+// State returns the DataCite state (draft, registered, findable) of a DOI.
+// Returns an empty string if the DOI does not exist.
+func (dc *DataCiteClient) State(doi string) (string, error) {
+	attr, code, err := dc.request(http.MethodGet, fmt.Sprintf("%s/%s", dataciteDOIPath, doi), nil)
+	if code == http.StatusNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return attr.State, nil
+}
+
+// CreateDraft creates a draft DOI.
+func (dc *DataCiteClient) CreateDraft(doi string) error {
+	_, _, err := dc.request(http.MethodPost, dataciteDOIPath, &dataciteAttributes{DOI: doi})
+	return err
+}
+
+// UploadMetadata uploads the DataCite XML metadata and sets the landing page
+// URL of a DOI.
+func (dc *DataCiteClient) UploadMetadata(doi string, xml []byte, landingURL string) error {
+	attr := &dataciteAttributes{
+		XML: base64.StdEncoding.EncodeToString(xml),
+		URL: landingURL,
+	}
+	_, _, err := dc.request(http.MethodPut, fmt.Sprintf("%s/%s", dataciteDOIPath, doi), attr)
+	return err
+}
+
+// Publish makes a DOI findable.
+func (dc *DataCiteClient) Publish(doi string) error {
+	_, _, err := dc.request(http.MethodPut, fmt.Sprintf("%s/%s", dataciteDOIPath, doi), &dataciteAttributes{Event: "publish"})
+	return err
+}
+
+// landingPageURL returns the URL the landing page of a DOI is served from.
+func landingPageURL(conf *Configuration, doi string) (string, error) {
+	base, err := url.Parse(conf.Storage.StoreURL)
+	if err != nil {
+		return "", err
+	}
+	return base.JoinPath(doi).String(), nil
+}
+
+// mintDOI registers the DOI of a prepared dataset at DataCite. A draft DOI is
+// created if it does not exist yet, the curated doi.xml file of the dataset is
+// uploaded together with the landing page URL and the DOI is published.
+func mintDOI(ctx context.Context, conf *Configuration, doi string) error {
+	dc := newDataCiteClient(conf)
+	if dc == nil {
+		return fmt.Errorf("DataCite registration is not configured")
+	}
+
+	xml, err := os.ReadFile(filepath.Join(conf.Storage.TargetDirectory, doi, "doi.xml"))
+	if err != nil {
+		return fmt.Errorf("failed to read DataCite XML file: %s", err.Error())
+	}
+	landingURL, err := landingPageURL(conf, doi)
+	if err != nil {
+		return fmt.Errorf("failed to create landing page URL: %s", err.Error())
+	}
+
+	state, err := dc.State(doi)
+	if err != nil {
+		return fmt.Errorf("failed to check DOI state: %s", err.Error())
+	}
+	if state == "" {
+		logger(ctx).Info("Creating draft DOI")
+		if err := dc.CreateDraft(doi); err != nil {
+			return fmt.Errorf("failed to create draft DOI: %s", err.Error())
+		}
+	}
+	logger(ctx).Info("Uploading DOI metadata", "url", landingURL)
+	if err := dc.UploadMetadata(doi, xml, landingURL); err != nil {
+		return fmt.Errorf("failed to upload DOI metadata: %s", err.Error())
+	}
+	if state != "findable" {
+		logger(ctx).Info("Publishing DOI")
+		if err := dc.Publish(doi); err != nil {
+			return fmt.Errorf("failed to publish DOI: %s", err.Error())
+		}
+	}
+	return nil
+}
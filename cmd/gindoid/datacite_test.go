@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dataciteTestConf returns a configuration using the DataCite API stand-in
+// server and a target directory holding the doi.xml file of the provided DOI.
+func dataciteTestConf(t *testing.T, apiurl string, doi string) *Configuration {
+	conf := &Configuration{}
+	conf.DataCite.URL = apiurl
+	conf.DataCite.Username = "repo"
+	conf.DataCite.Password = "secret"
+	conf.Storage.StoreURL = "https://doi.example.org/"
+	conf.Storage.TargetDirectory = t.TempDir()
+	xmldir := filepath.Join(conf.Storage.TargetDirectory, doi)
+	if err := os.MkdirAll(xmldir, 0777); err != nil {
+		t.Fatalf("Error creating target directory: %q", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(xmldir, "doi.xml"), []byte(validTestDataciteXML), 0666); err != nil {
+		t.Fatalf("Error writing doi.xml: %q", err.Error())
+	}
+	return conf
+}
+
+func TestNewDataCiteClient(t *testing.T) {
+	conf := &Configuration{}
+	if dc := newDataCiteClient(conf); dc != nil {
+		t.Fatal("Expected disabled DataCite client without username")
+	}
+	if err := mintDOI(context.Background(), conf, "10.12751/g-node.noex1st"); err == nil {
+		t.Fatal("Expected error on missing DataCite configuration")
+	}
+	conf.DataCite.URL = "https://api.test.datacite.org"
+	conf.DataCite.Username = "repo"
+	dc := newDataCiteClient(conf)
+	if dc == nil || dc.URL != conf.DataCite.URL || dc.Username != "repo" {
+		t.Fatalf("Unexpected DataCite client: %v", dc)
+	}
+}
+
+func TestMintDOI(t *testing.T) {
+	server, stub := serveDataciteAPI()
+	defer server.Close()
+
+	doi := "10.12751/g-node.noex1st"
+	conf := dataciteTestConf(t, server.URL, doi)
+
+	// check invalid credentials
+	conf.DataCite.Password = "wrong"
+	if err := mintDOI(context.Background(), conf, doi); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Expected unauthorized error but got: %v", err)
+	}
+	conf.DataCite.Password = "secret"
+
+	// check missing XML file
+	if err := mintDOI(context.Background(), conf, "10.12751/g-node.missing"); err == nil {
+		t.Fatal("Expected error on missing doi.xml file")
+	}
+
+	// check full registration
+	if err := mintDOI(context.Background(), conf, doi); err != nil {
+		t.Fatalf("Error registering DOI: %q", err.Error())
+	}
+	registered, ok := stub.dois[doi]
+	if !ok {
+		t.Fatal("DOI was not created")
+	}
+	if registered.State != "findable" {
+		t.Fatalf("Expected findable DOI but got %q", registered.State)
+	}
+	if registered.URL != "https://doi.example.org/10.12751/g-node.noex1st" {
+		t.Fatalf("Unexpected landing page URL %q", registered.URL)
+	}
+	xml, err := base64.StdEncoding.DecodeString(registered.XML)
+	if err != nil || string(xml) != validTestDataciteXML {
+		t.Fatalf("Unexpected uploaded XML (%v): %q", err, string(xml))
+	}
+
+	// check metadata update of a published DOI; no new draft and no
+	// second publish event
+	stub.requests = nil
+	if err := mintDOI(context.Background(), conf, doi); err != nil {
+		t.Fatalf("Error updating DOI: %q", err.Error())
+	}
+	expected := []string{"GET /dois/" + doi, "PUT /dois/" + doi}
+	if strings.Join(stub.requests, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Unexpected update requests: %v", stub.requests)
+	}
+}
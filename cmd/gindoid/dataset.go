@@ -1,22 +1,25 @@
 package main
 
 import (
-	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/G-Node/gin-cli/ginclient"
-	"github.com/G-Node/gin-cli/git"
 	"github.com/G-Node/libgin/libgin"
 	humanize "github.com/dustin/go-humanize"
 	"github.com/gogs/go-gogs-client"
@@ -26,18 +29,34 @@ import (
 const (
 	tmpdir      = "tmp"
 	doixmlfname = "datacite.xml"
+	// defaultRef is the branch registered if a request does not specify a
+	// revision and the default branch of the repository cannot be determined.
+	defaultRef = "master"
+)
+
+var (
+	// refRegexp matches branch and tag names and commit hashes accepted in
+	// registration requests.
+	refRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._/-]*$`)
+	// commitRegexp matches full commit hashes.
+	commitRegexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
 )
 
 // createRegisteredDataset starts the process of registering a dataset. It's
 // the top level function for the dataset registration and calls all other
-// individual functions.
-func createRegisteredDataset(job *RegistrationJob) error {
+// individual functions. The job is aborted if the context is done; stages
+// exceeding their timeout fail with a cancelledError, which is returned once
+// the remaining stages have been completed.
+func createRegisteredDataset(ctx context.Context, job *RegistrationJob) error {
 	conf := job.Config
 	repopath := job.Metadata.SourceRepository
 	jobname := job.Metadata.Identifier.ID
+	timer := new(stageTimer)
+	defer timer.finish()
+	progress := timer.track(jobProgress(job))
 
 	preperrors := make([]string, 0, 7)
-	err := prepDir(job)
+	err := prepDir(ctx, job)
 	if err != nil {
 		preperrors = append(preperrors, fmt.Sprintf("Error preparing data directory : %q", err.Error()))
 	}
@@ -55,42 +74,106 @@ func createRegisteredDataset(job *RegistrationJob) error {
 	forkURL := ginurl.String()
 
 	preppath := filepath.Join(conf.Storage.PreparationDirectory, jobname)
-	zipfname, zipsize, err := cloneAndZip(repopath, jobname, preppath, targetpath, conf)
-	var archiveURL string
+	var parts []archivePart
+	switch job.Retry {
+	case RetryLandingPage, RetryXML:
+		// reuse the archive of the previous run
+		parts, err = existingArchive(ctx, jobname, targetpath)
+	case RetryZip:
+		// reuse the clone of the previous run if it is available
+		if _, staterr := os.Stat(cloneDir(job)); staterr == nil {
+			parts, err = zipRepo(ctx, repopath, jobname, preppath, targetpath, job.Metadata.DataCite, conf, progress)
+			break
+		}
+		logger(ctx).Info("No clone available; cloning repository")
+		fallthrough
+	default:
+		if job.Retry != "" {
+			cleanPreparation(ctx, job)
+		}
+		job.Download = new(downloadStats)
+		parts, err = cloneAndZip(ctx, repopath, job.revision(), jobname, preppath, targetpath, job.Metadata.DataCite, conf, job.Download, progress)
+	}
+	if _, ok := err.(*insufficientSpaceError); ok {
+		// the job is deferred until there is enough disk space; the clone
+		// is removed to free the space it occupies
+		cleanPreparation(ctx, job)
+		return err
+	}
+	cancelErr, cancelled := err.(*cancelledError)
+	if cancelled && ctx.Err() != nil {
+		// the job has been cancelled; skip the remaining stages
+		return err
+	}
+	if _, staterr := os.Stat(cloneDir(job)); staterr == nil && job.Retry != RetryLandingPage && job.Retry != RetryXML {
+		// report commits pushed between request and clone
+		if issues := checkArchivedRevision(ctx, job); len(issues) > 0 {
+			logger(ctx).Warn("Revision issues", "issues", issues)
+			preperrors = append(preperrors, issues...)
+		}
+	}
+	var archiveURLs []string
 	if err != nil {
 		// failed to clone and zip
 		// save the error for reporting and continue with the XML prep
 		preperrors = append(preperrors, err.Error())
 	} else if storeURL, err := url.Parse(conf.Storage.StoreURL); err == nil {
-		storeURL.Path = path.Join(job.Metadata.Identifier.ID, zipfname)
-		archiveURL = storeURL.String()
-		job.Metadata.Sizes = &[]string{humanize.IBytes(uint64(zipsize))}
+		var zipsize int64
+		for _, part := range parts {
+			storeURL.Path = path.Join(job.Metadata.Identifier.ID, part.Name)
+			archiveURLs = append(archiveURLs, storeURL.String())
+			zipsize += part.Size
+		}
+		// the first size is always the total archive size; the sizes of
+		// multiple parts follow
+		sizes := []string{humanize.IBytes(uint64(zipsize))}
+		if len(parts) > 1 {
+			for _, part := range parts {
+				sizes = append(sizes, fmt.Sprintf("%s: %s", part.Name, part.HumanSize()))
+			}
+		}
+		job.Metadata.Sizes = &sizes
+		updateJob(job, func(rec *JobRecord) { rec.ZipSize = zipsize })
 	} else {
 		preperrors = append(preperrors, fmt.Sprintf("zip file created, but failed to parse StoreURL: %s", err.Error()))
 	}
-	job.Metadata.AddURLs(repoURL, forkURL, archiveURL)
+	if len(archiveURLs) == 1 {
+		job.Metadata.AddURLs(repoURL, forkURL, archiveURLs[0])
+	} else {
+		// AddURLs only supports a single archive and would replace the sizes
+		job.Metadata.AddURLs(repoURL, forkURL, "")
+		for _, archiveURL := range archiveURLs {
+			relatedIdentifier := libgin.RelatedIdentifier{Identifier: archiveURL, Type: "URL", RelationType: "IsVariantFormOf"}
+			job.Metadata.RelatedIdentifiers = append(job.Metadata.RelatedIdentifiers, relatedIdentifier)
+		}
+	}
 
 	// Check if there are older versions of the same dataset
-	if oldID := getPreviousDOI(job); oldID != "" {
+	if oldID := getPreviousDOI(ctx, job); oldID != "" {
 		relatedIdentifier := libgin.RelatedIdentifier{Identifier: oldID, Type: "DOI", RelationType: "IsNewVersionOf"}
 		job.Metadata.RelatedIdentifiers = append(job.Metadata.RelatedIdentifiers, relatedIdentifier)
 	}
 
-	dynurl := GetGINURL(conf)
-	err = createLandingPage(job.Metadata, filepath.Join(conf.Storage.TargetDirectory, job.Metadata.Identifier.ID, "index.html"), dynurl)
-	if err != nil {
-		// Landing page creation failed; append the error for reporting and continue with the XML prep
-		preperrors = append(preperrors, fmt.Sprintf("Failed to create the landing page: %q", err.Error()))
+	if job.Retry != RetryXML {
+		progress(JobLandingPage, "creating landing page")
+		dynurl := GetGINURL(conf)
+		err = createLandingPage(ctx, job.Metadata, filepath.Join(conf.Storage.TargetDirectory, job.Metadata.Identifier.ID, "index.html"), dynurl)
+		if err != nil {
+			// Landing page creation failed; append the error for reporting and continue with the XML prep
+			preperrors = append(preperrors, fmt.Sprintf("Failed to create the landing page: %q", err.Error()))
+		}
 	}
 
+	progress(JobLandingPage, "creating DataCite XML file")
 	fp, err := os.Create(filepath.Join(targetpath, "doi.xml"))
 	if err != nil {
-		log.Print("Could not create the metadata template")
+		logger(ctx).Error("Could not create the metadata template", "error", err.Error())
 		// XML Creation failed; return with error
 		preperrors = append(preperrors, fmt.Sprintf("Failed to create the XML metadata template: %s", err))
-		mailerr := notifyAdmin(job, preperrors, nil, false, "")
+		recordReport(job, preperrors, nil)
+		mailerr := notifyAdmin(ctx, job, preperrors, nil, false, "")
 		if mailerr != nil {
-			log.Printf("Failed to send notification email: %s", mailerr.Error())
+			logger(ctx).Error("Failed to send notification email", "error", mailerr.Error())
 		}
 		return err
 	}
@@ -98,115 +181,112 @@ func createRegisteredDataset(job *RegistrationJob) error {
 
 	data, err := job.Metadata.DataCite.Marshal()
 	if err != nil {
-		log.Print("Could not render the metadata file")
+		logger(ctx).Error("Could not render the metadata file", "error", err.Error())
 		preperrors = append(preperrors, fmt.Sprintf("Failed to render the XML metadata: %s", err))
-		mailerr := notifyAdmin(job, preperrors, nil, false, "")
+		recordReport(job, preperrors, nil)
+		mailerr := notifyAdmin(ctx, job, preperrors, nil, false, "")
 		if mailerr != nil {
-			log.Printf("Failed to send notification email: %s", mailerr.Error())
+			logger(ctx).Error("Failed to send notification email", "error", mailerr.Error())
 		}
 		return err
 	}
 	_, err = fp.Write([]byte(data))
 	if err != nil {
-		log.Print("Could not write to the metadata file")
+		logger(ctx).Error("Could not write to the metadata file", "error", err.Error())
 		preperrors = append(preperrors, fmt.Sprintf("Failed to write the metadata XML file: %s", err))
 	}
 
-	warnings := collectWarnings(job)
+	warnings := collectWarnings(ctx, job)
+	recordReport(job, preperrors, warnings)
 
 	// Send email with either all errors and warnings or preparation success
-	mailerr := notifyAdmin(job, preperrors, warnings, false, "")
+	mailerr := notifyAdmin(ctx, job, preperrors, warnings, false, "")
 	if mailerr != nil {
-		log.Printf("Failed to send notification email: %s", mailerr.Error())
+		logger(ctx).Error("Failed to send notification email", "error", mailerr.Error())
 	}
 
 	// prepare checklist and yaml config files for the manual steps
 	// of the registration process in the preparation directory.
 	listerr := mkchecklistserver(job.Metadata, preppath, job.Config.Storage.XMLURL)
 	if listerr != nil {
-		log.Printf("Encountered an error writing registration checklist files: %s", err.Error())
+		logger(ctx).Error("Encountered an error writing registration checklist files", "error", listerr.Error())
 	}
 
-	return err
-}
-
-// handleLockedAnnex receives the preparation directory, the directory of
-// a git annex repository containing locked annex content and the name
-// of said repository.
-// It checks whether the total annex file contant size is below a specified
-// size threshold. If this is the case the git annex repository is cloned
-// in to a secondary local directory in the preparation directory and all
-// locked annex content is unlocked and the function returns the full
-// path to the secondary local directory.
-// If the size is above the specified threshold or if any issue arises
-// during the clone and unlock procedure, the function stops and returns
-// an appropriate error.
-func handleLockedAnnex(preppath, repodir, reponame string, cutoff float64) (string, error) {
-	reposize, err := annexSize(repodir)
-	if err != nil {
-		return "", fmt.Errorf("error reading annex size %q", err.Error())
-	}
-
-	// check if the repo is eligible for local clone and unlock;
-	// repos above a certain size threshold should not be automatically
-	// cloned a second time locally.
-	if !acceptedAnnexSize(reposize, cutoff) {
-		return "", fmt.Errorf("unsupported repo size (%s)", reposize)
-	}
-
-	// local clone and unlock of repo
-	clonepath, err := unlockAnnexClone(reponame, preppath, repodir)
-	if err != nil {
-		return "", fmt.Errorf("clone/unlock error: %q", err.Error())
+	if err == nil && cancelled {
+		// report the stage that exceeded its timeout as the job failure
+		err = cancelErr
+	} else if err == nil && len(preperrors) > 0 {
+		err = fmt.Errorf("%d errors during the dataset preparation", len(preperrors))
 	}
-
-	// replace directory from where to create the zip from with
-	// the cloned and unlocked repo
-	return clonepath, nil
+	return err
 }
 
 // cloneAndZip clones the source repository into a temporary directory under
-// preppath, zips the contents at the targetpath, and returns the archive filename
-// and its size in bytes.
+// preppath, checks out the requested revision, zips the contents at the
+// targetpath, and returns the archive file or, if the archive is split, all
+// archive parts.
 // If the cloned repository contains missing annex content, the zip file is not created and
 // the function returns an appropriate error.
-// If the cloned repository contains locked annex content and the size of the repository
-// content is below a specific threshold, a secondary repository clone is created
-// and the zip file is created from this repository to ensure the originally locked content
-// is included. If the content size is above the size threshold or if any issue arises
-// during the cloning process, the zip file creation is skipped and the function
-// returns with an appropriate error.
-func cloneAndZip(repopath string, jobname string, preppath string, targetpath string, conf *Configuration) (string, int64, error) {
-	log.Print("Start clone and zip")
+// Locked annex files are archived with the content of their annex objects,
+// which is read directly from the annex object store of the cloned repository.
+// The annex download statistics are recorded in stats.
+// Progress of the individual stages is reported to the provided progressFunc.
+// Each stage is aborted if the context is done or its timeout is exceeded.
+func cloneAndZip(ctx context.Context, repopath string, revision string, jobname string, preppath string, targetpath string, datacite *libgin.DataCite, conf *Configuration, stats *downloadStats, progress progressFunc) ([]archivePart, error) {
+	logger(ctx).Info("Start clone and zip")
 	// Clone at preppath (will create subdirectories '[doi-org-id]/[doi-jobname]/[reponame]')
 	if err := os.MkdirAll(preppath, 0777); err != nil {
 		errmsg := fmt.Sprintf("failed to create temporary clone directory: %s", tmpdir)
-		log.Print(errmsg)
-		return "", -1, fmt.Errorf(errmsg)
+		logger(ctx).Error(errmsg)
+		return nil, fmt.Errorf(errmsg)
 	}
+	// the disk space reserved while cloning is released once the content
+	// has been written
+	defer releaseSpace(conf, preppath)
 
 	// Clone repository at the preparation path
-	if err := cloneRepo(repopath, preppath, conf); err != nil {
-		log.Println("Repository cloning failed")
-		return "", -1, fmt.Errorf("failed to clone repository '%s': %v", repopath, err)
+	if err := cloneRepo(ctx, repopath, revision, preppath, conf, stats, progress); err != nil {
+		logger(ctx).Error("Repository cloning failed", "error", err.Error())
+		switch err.(type) {
+		case *insufficientSpaceError, *cancelledError:
+			// keep the error type for the job deferral and cancellation
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to clone repository '%s': %v", repopath, err)
 	}
-	log.Println("Repository successfully cloned")
+	logger(ctx).Info("Repository successfully cloned")
+
+	return zipRepo(ctx, repopath, jobname, preppath, targetpath, datacite, conf, progress)
+}
 
+// zipRepo zips the content of a repository that has been cloned to preppath
+// into an archive at the targetpath and returns the archive file or all
+// archive parts. The annex content of the cloned repository is handled as
+// described for cloneAndZip.
+// The archive format is selected by the service configuration; BagIt bags are
+// populated with the provided DataCite metadata. If a bag directory is
+// configured, the content is additionally stored there as BagIt bag directory.
+// Archiving is aborted if the context is done or the zip timeout of the
+// configuration is exceeded; a cancelledError is returned in this case.
+func zipRepo(ctx context.Context, repopath string, jobname string, preppath string, targetpath string, datacite *libgin.DataCite, conf *Configuration, progress progressFunc) ([]archivePart, error) {
 	// Zip repository content to the target path
 	repoparts := strings.SplitN(repopath, "/", 2)
 	reponame := strings.ToLower(repoparts[1]) // clone directory is always lowercase
 	repodir := filepath.Join(preppath, reponame)
+	ctx, cancel := stageContext(ctx, conf.Timeouts.Zip)
+	defer cancel()
 
 	// Check for missing or locked annex content. Log any errors that
 	// occur during the checks, but continue to allow a zip creation attempt.
-	log.Printf("Checking missing and locked annex content of repo at %q", repodir)
-	hasmissing, misslist, err := missingAnnexContent(repodir)
+	progress(JobDownloading, "checking annex content")
+	logger(ctx).Info("Checking missing and locked annex content", "dir", repodir)
+	hasmissing, misslist, err := missingAnnexContent(ctx, repodir)
 	if err != nil {
-		log.Printf("Error on missing annex content check: %q", err.Error())
+		logger(ctx).Error("Error on missing annex content check", "error", err.Error())
 	}
-	haslocked, locklist, err := lockedAnnexContent(repodir)
+	haslocked, locklist, err := lockedAnnexContent(ctx, repodir)
 	if err != nil {
-		log.Printf("Error on locked annex content check: %q", err.Error())
+		logger(ctx).Error("Error on locked annex content check", "error", err.Error())
 	}
 
 	// Skip the zip creation on missing annex content and also report any locked content.
@@ -218,134 +298,303 @@ func cloneAndZip(repopath string, jobname string, preppath string, targetpath st
 			annexIssues += fmt.Sprintf("locked annex content in %d files\n", len(splitlock))
 		}
 
-		log.Printf("Annex content issues; skipping zip creation (missing %t, locked %t)", hasmissing, haslocked)
-		return "", -1, fmt.Errorf("annex content issues, skipping zip creation\n%s", annexIssues)
+		logger(ctx).Warn("Annex content issues; skipping zip creation", "missing", hasmissing, "locked", haslocked)
+		return nil, fmt.Errorf("annex content issues, skipping zip creation\n%s", annexIssues)
 	}
 
-	// If the repo has locked content and its size permits it,
-	// locally clone and unlock all repo files in a secondary
-	// directory. Replace the "repodir" variable with the secondary
-	// repo directory creating the zip file with all unlocked files.
+	// Locked annex files are symlinks into the annex object store; the
+	// archive writers read the annex object content through these links.
 	if haslocked {
 		splitlock := strings.Split(strings.TrimSpace(locklist), "\n")
-		log.Printf("Locked content found in %d files", len(splitlock))
-
-		// overwrite the "repodir" variable with the directory of the cloned
-		// repository containing the unlocked annex content.
-		repodir, err = handleLockedAnnex(preppath, repodir, reponame, conf.LockedContentCutoffSize)
-		if err != nil {
-			log.Printf("Skipping zip creation; %s", err.Error())
-			return "", -1, fmt.Errorf("%d locked annex files; skipping zip creation; %s", len(splitlock), err.Error())
-		}
+		logger(ctx).Info("Locked content found; archiving annex object content", "files", len(splitlock))
 	}
 
-	log.Printf("Preparing zip file for %s", jobname)
-	// use DOI with / replacement for zip filename
-	zipbasename := strings.ReplaceAll(jobname, "/", "_") + ".zip"
+	logger(ctx).Info("Preparing zip file")
+	format := conf.Storage.ArchiveFormat
+	zipbasename := archiveName(jobname, format)
 	zipfilename := filepath.Join(targetpath, zipbasename)
 	// exclude the git folder from the zip file
 	exclude := []string{".git"}
-	zipsize, err := runzip(repodir, zipfilename, exclude)
+	keys := annexKeys(ctx, repodir)
+	start := time.Now()
+	var parts []archivePart
+	switch format {
+	case ArchiveBagIt:
+		if conf.Storage.ArchivePartSize > 0 {
+			logger(ctx).Info("BagIt bags are not split into parts; creating a single archive")
+		}
+		var zipsize int64
+		zipsize, err = runbag(ctx, repodir, zipfilename, exclude, keys, datacite, progress)
+		parts = []archivePart{{Name: zipbasename, Size: zipsize, Checksum: readArchiveChecksum(ctx, zipfilename)}}
+	default:
+		parts, err = runzip(ctx, repodir, zipfilename, format, conf.Storage.StoredExtensions, conf.Storage.ArchivePartSize, exclude, keys, progress)
+	}
 	if err != nil {
-		log.Print("Could not zip the data")
-		return "", -1, fmt.Errorf("failed to create the zip file: %v", err)
+		logger(ctx).Error("Could not zip the data", "error", err.Error())
+		if cerr := stageError(ctx, JobZipping, conf.Timeouts.Zip, err); cerr != err {
+			return nil, cerr
+		}
+		return nil, fmt.Errorf("failed to create the zip file: %v", err)
+	}
+	var zipsize int64
+	for _, part := range parts {
+		zipsize += part.Size
+	}
+	logger(ctx).Info("Archive created", "size", zipsize, "parts", len(parts))
+	metrics.archiveSeconds.add("", time.Since(start).Seconds())
+	metrics.archiveBytes.add("", float64(zipsize))
+	metrics.archiveSize.observe("", float64(zipsize))
+	// archives of a previous run with a different format or partitioning
+	// would shadow the new archive on the landing page
+	removeArchives(ctx, targetpath, jobname, parts)
+
+	if conf.Storage.BagDirectory != "" {
+		progress(JobZipping, "exporting BagIt bag")
+		bagdir := filepath.Join(conf.Storage.BagDirectory, strings.ReplaceAll(jobname, "/", "_"))
+		if err := exportBag(ctx, repodir, bagdir, exclude, keys, datacite); err != nil {
+			logger(ctx).Error("Could not export the bag", "error", err.Error())
+			if cerr := stageError(ctx, JobZipping, conf.Timeouts.Zip, err); cerr != err {
+				return nil, cerr
+			}
+			return nil, fmt.Errorf("failed to export the BagIt bag: %v", err)
+		}
 	}
-	log.Printf("Archive size: %d", zipsize)
-	return zipbasename, zipsize, nil
+	return parts, nil
 }
 
-// getRepoCommit uses a gin client connection to query the latest commit
-// of a provided gin repository and returns either an error or
-// the commit hash as a string.
-func getRepoCommit(client *ginclient.Client, repo string) (string, error) {
-	reqpath := fmt.Sprintf("api/v1/repos/%s/commits/refs/heads/master", repo)
+// archiveName returns the file name of the dataset archive of a job in the
+// given archive format.
+func archiveName(jobname string, format ArchiveFormat) string {
+	// use DOI with / replacement for zip filename
+	return strings.ReplaceAll(jobname, "/", "_") + format.extension()
+}
+
+// existingArchive returns the dataset archive or archive parts created by a
+// previous run of a job at the targetpath.
+func existingArchive(ctx context.Context, jobname string, targetpath string) ([]archivePart, error) {
+	parts := findArchives(ctx, jobname, targetpath)
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no archive from a previous run available in %s", targetpath)
+	}
+	return parts, nil
+}
+
+// getRepoCommit uses a gin client connection to query the commit a branch
+// or tag of a provided gin repository points to and returns either an error
+// or the commit hash as a string. Full commit hashes are returned unchanged.
+func getRepoCommit(client *ginclient.Client, repo string, ref string) (string, error) {
+	if commitRegexp.MatchString(ref) {
+		return ref, nil
+	}
+	reqpath := fmt.Sprintf("api/v1/repos/%s/commits/%s", repo, ref)
 	resp, err := client.Get(reqpath)
 	if err != nil {
-		return "", fmt.Errorf("failed to get latest commit hash for %q: %s", repo, err.Error())
+		return "", fmt.Errorf("failed to get commit hash of %q for %q: %s", ref, repo, err.Error())
 	}
+	defer resp.Body.Close()
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read latest commit hash from response for %q: %s", repo, err.Error())
+		return "", fmt.Errorf("failed to read commit hash of %q from response for %q: %s", ref, repo, err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get commit hash of %q for %q: [%d] %s", ref, repo, resp.StatusCode, string(data))
+	}
+	commit := strings.TrimSpace(string(data))
+	if !commitRegexp.MatchString(commit) {
+		return "", fmt.Errorf("invalid commit hash of %q for %q: %q", ref, repo, commit)
+	}
+	return commit, nil
+}
+
+// getDefaultBranch uses a gin client connection to query the default branch
+// of a provided gin repository and returns either an error or the branch name.
+func getDefaultBranch(client *ginclient.Client, repo string) (string, error) {
+	repoinfo, err := client.GetRepo(repo)
+	if err != nil {
+		return "", fmt.Errorf("failed to get repository information for %q: %s", repo, err.Error())
+	}
+	if repoinfo.DefaultBranch == "" {
+		return "", fmt.Errorf("no default branch set for %q", repo)
 	}
-	return string(data), nil
+	return repoinfo.DefaultBranch, nil
 }
 
-// changedirlog logs if a change directory action results in an error;
-// used to log errors when defering directory changes.
-func changedirlog(todir string, lognote string) {
-	err := os.Chdir(todir)
+// repoDefaultBranch returns the default branch of a repository. If the
+// default branch cannot be determined, the error is logged and defaultRef is
+// returned.
+func repoDefaultBranch(ctx context.Context, conf *Configuration, repo string) string {
+	if conf.GIN.Session == nil {
+		return defaultRef
+	}
+	branch, err := getDefaultBranch(conf.GIN.Session, repo)
 	if err != nil {
-		log.Printf("%s: %s; could not change to dir %s", err.Error(), lognote, todir)
+		logger(ctx).Warn("Could not read default branch", "repo", repo, "branch", defaultRef, "error", err.Error())
+		return defaultRef
 	}
+	return branch
+}
+
+// validRef checks whether a ref provided with a registration request is a
+// plausible branch name, tag name or commit hash. Refs that could be
+// interpreted as command line options or that navigate paths are rejected.
+func validRef(ref string) bool {
+	return refRegexp.MatchString(ref) &&
+		!strings.Contains(ref, "..") &&
+		!strings.Contains(ref, "//") &&
+		!strings.HasSuffix(ref, "/") &&
+		!strings.HasSuffix(ref, ".lock")
 }
 
-// runzip zips a source directory into a file with the given filename.  Any directories
-// or files handed over via the exclude parameter will not be zipped.
-func runzip(source, zipfilename string, exclude []string) (int64, error) {
+// runzip archives a source directory into a file with the given filename
+// using the provided archive format; stored lists the file extensions that
+// are not compressed in compressed zip archives.  Any directories
+// or files handed over via the exclude parameter will not be archived.
+// If partsize is larger than zero and the content exceeds it, the content is
+// split into multiple archive parts of at most partsize bytes each, unless a
+// single file is larger. The written archive or archive parts are returned.
+// A manifest of the archived files is added to the archive and written next to
+// the archive together with the SHA-256 checksum of the archive; annexKeys
+// provides the git annex keys of the files for the manifest.
+// The number of archived files is reported to the provided progressFunc.
+// Archiving is aborted if the context is done.
+func runzip(ctx context.Context, source, zipfilename string, format ArchiveFormat, stored []string, partsize int64, exclude []string, annexKeys map[string]string, progress progressFunc) ([]archivePart, error) {
 	fn := fmt.Sprintf("runzip(%s, %s)", source, zipfilename) // keep original args for errmsg
 	source, err := filepath.Abs(source)
 	if err != nil {
-		log.Printf("%s: Failed to get abs path for source directory in function '%s': %v", lpStorage, fn, err)
-		return -1, err
+		logger(ctx).Error("Failed to get abs path for source directory", "location", lpStorage, "function", fn, "error", err.Error())
+		return nil, err
 	}
 
 	zipfilename, err = filepath.Abs(zipfilename)
 	if err != nil {
-		log.Printf("%s: Failed to get abs path for target zip file in function '%s': %v", lpStorage, fn, err)
-		return -1, err
+		logger(ctx).Error("Failed to get abs path for target zip file", "location", lpStorage, "function", fn, "error", err.Error())
+		return nil, err
+	}
+
+	// the paths in the archive are relative to the repository root
+	logger(ctx).Debug("runzip in source dir", "dir", source)
+	if partsize > 0 {
+		plan, err := planParts(source, exclude, partsize)
+		if err != nil {
+			logger(ctx).Error("Failed to plan archive parts", "location", lpStorage, "function", fn, "error", err.Error())
+			return nil, err
+		}
+		if len(plan) > 1 {
+			logger(ctx).Info("Splitting archive into parts", "parts", len(plan))
+			parts, err := writeParts(ctx, source, plan, zipfilename, format, stored, exclude, annexKeys, progress)
+			if err != nil {
+				logger(ctx).Error("Failed to create archive parts", "location", lpStorage, "function", fn, "error", err.Error())
+				return nil, err
+			}
+			return parts, nil
+		}
+	}
+
+	progress(JobZipping, fmt.Sprintf("creating %s archive", format))
+	size, err := writeArchive(zipfilename, func(dest io.Writer) ([]manifestEntry, error) {
+		aw, err := newArchiveWriter(dest, format, stored)
+		if err != nil {
+			return nil, err
+		}
+		return makeArchive(ctx, aw, source, exclude, annexKeys, zipProgress(progress), true, ".")
+	})
+	if err != nil {
+		logger(ctx).Error("Failed to create zip file", "location", lpStorage, "function", fn, "error", err.Error())
+		return nil, err
+	}
+	return []archivePart{{Name: filepath.Base(zipfilename), Size: size, Checksum: readArchiveChecksum(ctx, zipfilename)}}, nil
+}
+
+// zipProgress returns a function reporting the number and size of the files
+// added to an archive to the provided progressFunc.
+func zipProgress(progress progressFunc) func(manifestEntry) {
+	var nfiles int
+	var nbytes int64
+	return func(entry manifestEntry) {
+		nfiles++
+		nbytes += entry.Size
+		progress(JobZipping, fmt.Sprintf("added %d files (%s)", nfiles, humanize.IBytes(uint64(nbytes))))
 	}
+}
 
-	// Create zip file IO writer for MakeZip function
+// writeArchive creates the archive file zipfilename and fills it using the
+// provided write function, which returns the manifest of the archived files.
+// The manifest and the SHA-256 checksum of the archive are written next to
+// the archive. Returns the size of the archive in bytes.
+func writeArchive(zipfilename string, write func(io.Writer) ([]manifestEntry, error)) (int64, error) {
 	zipfp, err := os.Create(zipfilename)
 	if err != nil {
-		log.Printf("%s: Failed to create zip file for writing in function '%s': %v", lpStorage, fn, err)
-		return -1, err
+		return -1, fmt.Errorf("failed to create archive file: %s", err.Error())
 	}
 	defer zipfp.Close()
 
-	// Change into clone directory to make the paths in the zip archive repo
-	// root-relative. Switch back to root once done.
-	defer changedirlog("/", "runzip")
-	if err := os.Chdir(source); err != nil {
-		log.Printf("%s: Failed to change to source directory to make zip file in function '%s': %v", lpStorage, fn, err)
+	// calculate the archive checksum while writing the archive
+	hasher := sha256.New()
+	manifest, err := write(io.MultiWriter(zipfp, hasher))
+	if err != nil {
 		return -1, err
 	}
-	log.Printf("runzip in source dir %s", source)
 
-	if err := MakeZip(zipfp, exclude, "."); err != nil {
-		log.Printf("%s: Failed to create zip file in function '%s': %v", lpStorage, fn, err)
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if err := writeManifest(zipfilename, manifest, checksum); err != nil {
 		return -1, err
 	}
 
-	stat, _ := zipfp.Stat()
+	stat, err := zipfp.Stat()
+	if err != nil {
+		return -1, fmt.Errorf("failed to read archive file size: %s", err.Error())
+	}
 	return stat.Size(), nil
 }
 
 // createLandingPage renders and writes a registered dataset landing page based
-// on the LandingPage template.
-func createLandingPage(metadata *libgin.RepositoryMetadata, targetfile string, ginurl string) error {
+// on the LandingPage template. The checksum of the dataset archive is included
+// if a checksum file is available next to the landing page. Archives split into
+// multiple parts are listed with the size and checksum of each part.
+func createLandingPage(ctx context.Context, metadata *libgin.RepositoryMetadata, targetfile string, ginurl string) error {
 	tmpl, err := prepareTemplates("DOIInfo", "LandingPage")
 	if err != nil {
 		return err
 	}
+	// Clone template once to avoid race condition when setting injected
+	// functions
+	tmpl = template.Must(tmpl.Clone())
 	// Overwrite default GIN server URL with config GIN server URL
-	tmpl = injectDynamicGINURL(tmpl, ginurl)
+	if ginurl != "" {
+		tmpl = injectFunc(tmpl, "GINServerURL", func() string { return ginurl })
+	}
+	// Link the archive next to the landing page in its archive format and add
+	// its checksum if available
+	// or list all parts of a split archive
+	targetdir := filepath.Dir(targetfile)
+	parts := findArchives(ctx, metadata.Identifier.ID, targetdir)
+	if len(parts) == 1 {
+		ext := strings.TrimPrefix(parts[0].Name, strings.ReplaceAll(metadata.Identifier.ID, "/", "_")+".")
+		if ext != "" && ext != ArchiveExt() {
+			tmpl = injectFunc(tmpl, "ArchiveExt", func() string { return ext })
+		}
+		if checksum := parts[0].Checksum; checksum != "" {
+			tmpl = injectFunc(tmpl, "ArchiveChecksum", func() string { return checksum })
+		}
+	} else if len(parts) > 1 {
+		tmpl = injectFunc(tmpl, "ArchiveParts", func() []archivePart { return parts })
+	}
 
 	fp, err := os.Create(targetfile)
 	if err != nil {
-		log.Printf("Could not create the landing page file: %s", err.Error())
+		logger(ctx).Error("Could not create the landing page file", "error", err.Error())
 		return err
 	}
 	defer fp.Close()
 	if err := tmpl.Execute(fp, metadata); err != nil {
-		log.Printf("Error rendering the landing page: %s", err.Error())
+		logger(ctx).Error("Error rendering the landing page", "error", err.Error())
 		return err
 	}
 	return nil
 }
 
 // prepDir creates the directories where the dataset will be cloned and archived.
-func prepDir(job *RegistrationJob) error {
+func prepDir(ctx context.Context, job *RegistrationJob) error {
 	conf := job.Config
 	metadata := job.Metadata
 	prepdir := conf.Storage.PreparationDirectory
@@ -354,112 +603,230 @@ func prepDir(job *RegistrationJob) error {
 
 	err := os.MkdirAll(filepath.Join(prepdir, doi), os.ModePerm)
 	if err != nil {
-		log.Print("Could not create the preparation directory")
+		logger(ctx).Error("Could not create the preparation directory", "error", err.Error())
 		return err
 	}
 	err = os.MkdirAll(filepath.Join(storagedir, doi), os.ModePerm)
 	if err != nil {
-		log.Print("Could not create the target directory")
+		logger(ctx).Error("Could not create the target directory", "error", err.Error())
 		return err
 	}
 	// Deny access per default
 	file, err := os.Create(filepath.Join(storagedir, doi, ".htaccess"))
 	if err != nil {
-		log.Print("Could not create .htaccess")
+		logger(ctx).Error("Could not create .htaccess", "error", err.Error())
 		return err
 	}
 	defer file.Close()
 	// todo check
 	_, err = file.Write([]byte("deny from all"))
 	if err != nil {
-		log.Print("Could not write to .htaccess")
+		logger(ctx).Error("Could not write to .htaccess", "error", err.Error())
 		return err
 	}
 	return nil
 }
 
 // cloneRepo clones a git repository (with git-annex) specified by URI to the
-// destination directory.
-func cloneRepo(URI string, destdir string, conf *Configuration) error {
-	// NOTE: cloneRepo changes the working directory to the cloned repository
-	// See: https://github.com/G-Node/gin-cli/issues/225
-	// This will need to change when that issue is fixed
-	// Switch back to root once done.
-	defer changedirlog("/", "cloneRepo")
-	err := os.Chdir(destdir)
+// destination directory and checks out the provided revision before the annex
+// content is downloaded. Before the download, the disk space required for the
+// annex content and the archive is checked; if it is not available, an
+// insufficientSpaceError is returned. The annex download statistics are
+// recorded in stats. The repository is cloned into a directory named after the
+// lowercase repository name; the working directory of the process is not
+// changed, so several jobs can clone at the same time. Repositories without a
+// git-annex branch are cloned as plain git repositories.
+// Clone and annex download status messages are reported to the provided
+// progressFunc. Cloning and downloading are aborted if the context is done or
+// the respective timeout of the configuration is exceeded; a cancelledError
+// is returned in this case.
+func cloneRepo(ctx context.Context, URI string, revision string, destdir string, conf *Configuration, stats *downloadStats, progress progressFunc) error {
+	clonectx, cancel := stageContext(ctx, conf.Timeouts.Clone)
+	defer cancel()
+	start := time.Now()
+	repodir, hasannex, err := cloneRevision(clonectx, URI, revision, destdir, conf, progress)
 	if err != nil {
-		return err
+		return stageError(clonectx, JobCloning, conf.Timeouts.Clone, err)
+	}
+	metrics.cloneSeconds.add("", time.Since(start).Seconds())
+	if size, err := dirSize(repodir); err == nil {
+		metrics.cloneBytes.add("", float64(size))
+	}
+	if !hasannex {
+		return nil
 	}
-	log.Printf("Cloning %s to directory %s", URI, destdir)
 
-	// git clone repository
-	clonechan := make(chan git.RepoFileStatus)
-	go conf.GIN.Session.CloneRepo(strings.ToLower(URI), clonechan)
-	for stat := range clonechan {
-		log.Print(stat)
-		if stat.Err != nil {
-			log.Printf("Repository cloning failed: %s", stat.Err)
-			return stat.Err
+	// download the annex content in parallel; replaces the previous
+	// sequential git annex get rounds which could stop silently if the
+	// download rate dropped too low
+	logger(ctx).Info("Annex content download")
+	progress(JobDownloading, "downloading annex content")
+	if stats == nil {
+		stats = new(downloadStats)
+	}
+	downloadctx, cancel := stageContext(ctx, conf.Timeouts.Download)
+	defer cancel()
+	if err := downloadAnnexContent(downloadctx, repodir, conf, stats, progress); err != nil {
+		logger(ctx).Error("Repository cloning failed during annex get", "error", err.Error())
+		if cerr := stageError(downloadctx, JobDownloading, conf.Timeouts.Download, err); cerr != err {
+			return cerr
 		}
+		return fmt.Errorf("annex content download: %s", err.Error())
 	}
+	metrics.downloadBytes.add("", float64(stats.Bytes))
+	metrics.downloadSeconds.add("", stats.Duration.Seconds())
+	return nil
+}
 
-	// check server side missing git annex content
-	log.Printf("Check missing content in origin repository")
+// cloneRevision implements the cloning stage of cloneRepo. It clones the
+// repository, checks out the revision and checks the missing annex content
+// of the origin repository and the disk space. Returns the clone directory
+// and whether the repository uses git annex.
+func cloneRevision(ctx context.Context, URI string, revision string, destdir string, conf *Configuration, progress progressFunc) (string, bool, error) {
 	repoparts := strings.SplitN(URI, "/", 2)
-	reponame := strings.ToLower(repoparts[1]) // clone directory is always lowercase
+	reponame := strings.ToLower(repoparts[len(repoparts)-1]) // clone directory is always lowercase
 	repodir := filepath.Join(destdir, reponame)
+	logger(ctx).Info("Cloning repository", "uri", URI, "dir", repodir)
+	progress(JobCloning, "cloning repository")
+
+	// git clone repository
+	if err := cloneGitRepo(ctx, cloneURL(conf, URI), repodir, progress); err != nil {
+		logger(ctx).Error("Repository cloning failed", "error", err.Error())
+		return repodir, false, err
+	}
+	hasannex := annexBranch(ctx, repodir)
+	if hasannex {
+		progress(JobCloning, "initialising annex")
+		if err := initAnnexClone(ctx, repodir, conf.GIN.Username); err != nil {
+			logger(ctx).Error("Repository cloning failed", "error", err.Error())
+			return repodir, hasannex, err
+		}
+	}
 
-	if _, err := os.Stat(repodir); os.IsNotExist(err) {
-		log.Printf("path not found %q", repodir)
+	// check out the requested revision unless the clone is already at the
+	// requested commit; the annex content is only downloaded for the files
+	// of this revision
+	if head, _, err := remoteGitCMD(ctx, repodir, false, "rev-parse", "HEAD"); err == nil && strings.TrimSpace(head) == revision {
+		logger(ctx).Info("Clone is at the requested commit", "commit", revision)
+	} else {
+		progress(JobCloning, fmt.Sprintf("checking out %s", revision))
+		if err := checkoutRevision(ctx, repodir, revision); err != nil {
+			return repodir, hasannex, err
+		}
+	}
+
+	// check server side missing git annex content
+	logger(ctx).Info("Check missing content in origin repository")
+	if !hasannex {
+		logger(ctx).Info("Repository does not use git annex")
 	} else {
-		stdout, stderr, err := remoteGitCMD(repodir, true, "find", "--not", "--in=origin")
+		stdout, stderr, err := remoteGitCMD(ctx, repodir, true, "find", "--not", "--in=origin")
 		if err != nil {
-			log.Printf("Error checking missing annex content: %q", err.Error())
+			logger(ctx).Error("Error checking missing annex content", "error", err.Error())
 		} else if stderr != "" {
-			log.Printf("git annex error checking missing content: %q", stderr)
+			logger(ctx).Error("git annex error checking missing content", "stderr", stderr)
 		} else if stdout != "" {
 			splitmis := strings.Split(strings.TrimSpace(stdout), "\n")
-			log.Printf("Server repo is missing annex content in %d files", len(splitmis))
-			return fmt.Errorf("\nmissing annex content in %d files; skipping annex content download and zip creation", len(splitmis))
+			logger(ctx).Warn("Server repo is missing annex content", "files", len(splitmis))
+			return repodir, hasannex, fmt.Errorf("\nmissing annex content in %d files; skipping annex content download and zip creation", len(splitmis))
 		}
 	}
 
-	// git annex get-content
-	log.Print("Primary annex content download")
-	downloadchan := make(chan git.RepoFileStatus)
-	go conf.GIN.Session.GetContent(nil, downloadchan)
-	for stat := range downloadchan {
-		log.Print(stat)
-		if stat.Err != nil {
-			log.Printf("Repository cloning failed during annex get: %s, %s", stat.FileName, stat.Err)
-			return fmt.Errorf("annex content of %q: %q", stat.FileName, stat.Err)
-		}
+	// check that the annex content and the archive fit into the storage
+	// directories before the annex content is downloaded
+	progress(JobCloning, "checking disk space")
+	prepbytes, targetbytes, err := estimateSpace(ctx, repodir)
+	if err != nil {
+		logger(ctx).Warn("Could not estimate the required disk space", "error", err.Error())
+	} else if err := checkDiskSpace(ctx, conf, destdir, prepbytes, targetbytes); err != nil {
+		logger(ctx).Warn("Skipping annex content download", "reason", err.Error())
+		return repodir, hasannex, err
 	}
+	return repodir, hasannex, nil
+}
 
-	// Add a second round of content get since git annex can stop
-	// content download silently if the download rate drops too low.
-	log.Print("Secondary annex content download")
-	downloadchan = make(chan git.RepoFileStatus)
-	go conf.GIN.Session.GetContent(nil, downloadchan)
-	for stat := range downloadchan {
-		log.Print(stat)
-		if stat.Err != nil {
-			log.Printf("Repository cloning failed during annex get: %s, %s", stat.FileName, stat.Err)
-			return fmt.Errorf("annex content of %q: %q", stat.FileName, stat.Err)
-		}
+// checkoutRevision checks out the provided branch, tag or commit in the
+// repository at repodir as a detached HEAD.
+func checkoutRevision(ctx context.Context, repodir string, revision string) error {
+	logger(ctx).Info("Checking out revision", "revision", revision, "dir", repodir)
+	_, stderr, err := remoteGitCMD(ctx, repodir, false, "checkout", "--quiet", "--detach", revision, "--")
+	if err != nil {
+		return fmt.Errorf("failed to check out revision %q: %s: %s", revision, err.Error(), stderr)
 	}
 	return nil
 }
 
-// repoFileURL returns the full URL to a file on the master branch of a
-// repository.
-func repoFileURL(conf *Configuration, repopath string, filename string) string {
+// cloneDefaultBranch returns the default branch of the origin of the clone
+// at repodir. If the clone does not record it, the default branch is
+// requested from GIN.
+func cloneDefaultBranch(ctx context.Context, conf *Configuration, repodir string, repo string) string {
+	stdout, _, err := remoteGitCMD(ctx, repodir, false, "symbolic-ref", "--quiet", "refs/remotes/origin/HEAD")
+	if branch := strings.TrimPrefix(strings.TrimSpace(stdout), "refs/remotes/origin/"); err == nil && branch != "" {
+		return branch
+	}
+	return repoDefaultBranch(ctx, conf, repo)
+}
+
+// resolveRef returns the commit a branch, tag or commit hash points to in the
+// clone at repodir. Remote branches take precedence over local branches,
+// since a fresh clone only has a local branch for the default branch.
+func resolveRef(ctx context.Context, repodir string, ref string) (string, error) {
+	for _, name := range []string{fmt.Sprintf("refs/remotes/origin/%s", ref), ref} {
+		stdout, _, err := remoteGitCMD(ctx, repodir, false, "rev-parse", "--verify", "--quiet", name+"^{commit}")
+		if err == nil {
+			return strings.TrimSpace(stdout), nil
+		}
+	}
+	return "", fmt.Errorf("ref %q not found", ref)
+}
+
+// checkArchivedRevision verifies that the clone of the job repository is at
+// the commit recorded at request time and that the requested ref still points
+// to this commit. If no commit was recorded, the checked out commit is
+// recorded for the job. Returns a description of each discrepancy found.
+func checkArchivedRevision(ctx context.Context, job *RegistrationJob) []string {
+	repodir := cloneDir(job)
+	issues := make([]string, 0, 2)
+	stdout, stderr, err := remoteGitCMD(ctx, repodir, false, "rev-parse", "HEAD")
+	if err != nil {
+		return append(issues, fmt.Sprintf("Failed to read the archived commit: %s: %s", err.Error(), stderr))
+	}
+	head := strings.TrimSpace(stdout)
+
+	if job.Commit == "" {
+		logger(ctx).Info("No commit recorded; recording archived commit", "commit", head)
+		job.Commit = head
+		updateJob(job, func(rec *JobRecord) { rec.CommitHash = head })
+		return issues
+	}
+	if head != job.Commit {
+		issues = append(issues, fmt.Sprintf("Archived commit %s differs from the commit %s recorded at request time", head, job.Commit))
+	}
+
+	ref := job.Ref
+	if ref == "" {
+		// jobs recorded before the ref was part of the request archive the
+		// default branch
+		ref = cloneDefaultBranch(ctx, job.Config, repodir, job.Metadata.SourceRepository)
+	}
+	refhead, err := resolveRef(ctx, repodir, ref)
+	if err != nil {
+		issues = append(issues, fmt.Sprintf("Requested ref %q no longer exists; archived the commit %s recorded at request time", ref, job.Commit))
+	} else if refhead != job.Commit {
+		issues = append(issues, fmt.Sprintf("Requested ref %q moved from %s to %s between request and archiving; archived the commit %s recorded at request time", ref, job.Commit, refhead, job.Commit))
+	}
+	return issues
+}
+
+// repoFileURL returns the full URL to a file at the provided revision (branch,
+// tag or commit) of a repository.
+func repoFileURL(conf *Configuration, repopath string, revision string, filename string) string {
 	u, err := url.Parse(GetGINURL(conf))
 	if err != nil {
 		// not configured properly; return nothing
 		return ""
 	}
-	fetchRepoPath := fmt.Sprintf("%s/raw/master/%s", repopath, filename)
+	fetchRepoPath := fmt.Sprintf("%s/raw/%s/%s", repopath, revision, filename)
 	u.Path = fetchRepoPath
 	return u.String()
 }
@@ -482,7 +849,7 @@ type RegistrationRequest struct {
 	// Encrypted request data from GIN.
 	EncryptedRequestData string
 	// Decrypted and unmarshalled request data.
-	*libgin.DOIRequestData
+	*DOIRequestData
 	// Used to display error or warning messages to the user through the templates.
 	Message template.HTML
 	// Metadata for the repository being registered
@@ -509,32 +876,37 @@ func (d *RegistrationRequest) AsHTML() template.HTML {
 }
 
 // readAndValidate loads and checks LICENSE file and datacite.yml file for a
-// given repository and ensures a master branch is available. The function tries
-// to collect as many issues as possible and returns the RepositoryYAML struct or
-// an error message if the retrieval, parsing, or validation fails.
+// given repository at the provided revision (branch, tag or commit) and ensures
+// the revision is available. The function tries to collect as many issues as
+// possible and returns the RepositoryYAML struct or an error message if the
+// retrieval, parsing, or validation fails.
 // The message is appropriate for display to the user.
-func readAndValidate(conf *Configuration, repository string) (*libgin.RepositoryYAML, error) {
+func readAndValidate(conf *Configuration, repository string, revision string) (*libgin.RepositoryYAML, error) {
 	// Fail registration on missing LICENSE file; do not yet return and check datacite.yml
 	collecterr := make([]string, 0)
-	checkMasterURL := fmt.Sprintf("%s/%s/src/master", GetGINURL(conf), repository)
-	masterExists := URLexists(checkMasterURL)
-	if !masterExists {
-		log.Printf("Failed to access master branch at URL: %s", checkMasterURL)
-		collecterr = append(collecterr, fmt.Sprintf("<p>%s</p>", msgNoMaster))
+	checkRevisionURL := fmt.Sprintf("%s/%s/src/%s", GetGINURL(conf), repository, revision)
+	revisionExists := URLexists(checkRevisionURL)
+	if !revisionExists {
+		log.Printf("Failed to access revision %q at URL: %s", revision, checkRevisionURL)
+		collecterr = append(collecterr, fmt.Sprintf("<p>%s</p>", fmt.Sprintf(msgNoRevision, template.HTMLEscapeString(revision))))
+		metrics.validationFailures.inc("no_revision")
 	}
+	msgInvalidDOIRev := fmt.Sprintf(msgInvalidDOI, template.HTMLEscapeString(revision))
 
-	_, err := readFileAtURL(repoFileURL(conf, repository, "LICENSE"))
+	_, err := readFileAtURL(repoFileURL(conf, repository, revision, "LICENSE"))
 	if err != nil {
 		log.Printf("Failed to fetch LICENSE: %s", err.Error())
-		collecterr = append(collecterr, fmt.Sprintf("<p>%s</p>", msgNoLicenseFile))
+		collecterr = append(collecterr, fmt.Sprintf("<p>%s</p>", fmt.Sprintf(msgNoLicenseFile, template.HTMLEscapeString(revision))))
+		metrics.validationFailures.inc("no_license_file")
 	}
 
 	// Fail registration on missing datacite.yaml file; can happen if the datacite.yml file
 	// is removed and the user clicks the register button on a stale page
-	dataciteText, err := readFileAtURL(repoFileURL(conf, repository, "datacite.yml"))
+	dataciteText, err := readFileAtURL(repoFileURL(conf, repository, revision, "datacite.yml"))
 	if err != nil {
 		log.Printf("Failed to fetch datacite.yml: %s", err.Error())
-		collecterr = append(collecterr, fmt.Sprintf("<p>%s</p>", msgInvalidDOI))
+		collecterr = append(collecterr, fmt.Sprintf("<p>%s</p>", msgInvalidDOIRev))
+		metrics.validationFailures.inc("no_datacite")
 		return nil, fmt.Errorf(strings.Join(collecterr, "<br>"))
 	}
 
@@ -542,14 +914,18 @@ func readAndValidate(conf *Configuration, repository string) (*libgin.Repository
 	repoMetadata, err := readRepoYAML(dataciteText)
 	if err != nil {
 		log.Printf("DOI file invalid: %s", err.Error())
-		collecterr = append(collecterr, fmt.Sprintf("<p>%s<br>Error details: <i>%s</i></p>", msgInvalidDOI, err.Error()))
+		collecterr = append(collecterr, fmt.Sprintf("<p>%s<br>Error details: <i>%s</i></p>", msgInvalidDOIRev, err.Error()))
+		metrics.validationFailures.inc("invalid_datacite")
 		return nil, fmt.Errorf(strings.Join(collecterr, "<br>"))
 	}
 	// Fail registration if any required validation fails
 	if msgs := validateDataCite(repoMetadata); len(msgs) > 0 {
 		log.Print("DOI file contains validation issues")
+		for _, msg := range msgs {
+			metrics.validationFailures.inc(validationType(msg))
+		}
 		fmtstring := "%s<div align='left' style='padding-left: 50px;'><i><ul><li>%s</li></ul></i></div>"
-		collecterr = append(collecterr, fmt.Sprintf(fmtstring, msgInvalidDOI, strings.Join(msgs, "</li><li>")))
+		collecterr = append(collecterr, fmt.Sprintf(fmtstring, msgInvalidDOIRev, strings.Join(msgs, "</li><li>")))
 	}
 
 	if len(collecterr) > 0 {
@@ -563,21 +939,21 @@ func readAndValidate(conf *Configuration, repository string) (*libgin.Repository
 // registered DOI under the service's user, which indicates that it already has
 // been registered and this is a new version of the same dataset. If at any
 // point it fails with an error, it logs the error and returns an empty string.
-func getPreviousDOI(job *RegistrationJob) string {
+func getPreviousDOI(ctx context.Context, job *RegistrationJob) string {
 	// We could infer the repository's fork path by replacing the owner in the
 	// string with 'doi' (or the service's user), but it might be the case that
 	// a DOI owned repository already exists with the same name and is *not* a
 	// fork of this one (repo name collision).
 	client := job.Config.GIN.Session
 	repo := job.Metadata.SourceRepository
-	forks, err := getRepoForks(client, repo)
+	forks, err := getRepoForks(ctx, job.Config, repo)
 	if err != nil {
 		return ""
 	}
 	for _, fork := range forks {
 		if strings.ToLower(fork.Owner.UserName) == client.Username {
 			// fork owned by DOI user: Check for tags
-			prevDOI, err := getLatestDOITag(client, &fork, job.Config.DOIBase)
+			prevDOI, err := getLatestDOITag(ctx, job.Config, &fork, job.Config.DOIBase)
 			if err != nil {
 				return ""
 			}
@@ -588,46 +964,36 @@ func getPreviousDOI(job *RegistrationJob) string {
 }
 
 // getRepoForks returns a list of forks for the repository.
-func getRepoForks(client *ginclient.Client, repo string) ([]gogs.Repository, error) {
+func getRepoForks(ctx context.Context, conf *Configuration, repo string) ([]gogs.Repository, error) {
 	reqpath := fmt.Sprintf("api/v1/repos/%s/forks", repo)
-	resp, err := client.Get(reqpath)
+	_, data, err := ginRequest(ctx, conf, http.MethodGet, reqpath, nil)
 	if err != nil {
-		log.Printf("Failed get forks for %q: %s", repo, err.Error())
-		return nil, err
-	}
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Failed read forks from response for %q: %s", repo, err.Error())
+		logger(ctx).Error("Failed to get forks", "repo", repo, "error", err.Error())
 		return nil, err
 	}
 	forks := make([]gogs.Repository, 0)
 	err = json.Unmarshal(data, &forks)
 	if err != nil {
-		log.Printf("Failed to unmarshal forks for %q: %s", repo, err.Error())
+		logger(ctx).Error("Failed to unmarshal forks", "repo", repo, "error", err.Error())
 	}
 	return forks, err
 }
 
 // getLatestDOITag returns the most recent repository tag that matches our DOI
 // prefix.
-func getLatestDOITag(client *ginclient.Client, repo *gogs.Repository, doiBase string) (string, error) {
+func getLatestDOITag(ctx context.Context, conf *Configuration, repo *gogs.Repository, doiBase string) (string, error) {
 	// NOTE: The following API endpoint isn't available on GIN, but it has been
 	// added to GOGS upstream. This wont work until we update GIN Web.
 	reqpath := fmt.Sprintf("api/v1/repos/%s/releases", repo.FullName)
-	resp, err := client.Get(reqpath)
-	if err != nil {
-		log.Printf("Failed to get releases for %q: %s", repo.FullName, err.Error())
-		return "", err
-	}
-	data, err := ioutil.ReadAll(resp.Body)
+	_, data, err := ginRequest(ctx, conf, http.MethodGet, reqpath, nil)
 	if err != nil {
-		log.Printf("Failed to read releases from response for %q: %s", repo.FullName, err.Error())
+		logger(ctx).Error("Failed to get releases", "repo", repo.FullName, "error", err.Error())
 		return "", err
 	}
 	tags := make([]gogs.Release, 0)
 	err = json.Unmarshal(data, &tags)
 	if err != nil {
-		log.Printf("Failed to unmarshal releases for %q: %s", repo.FullName, err.Error())
+		logger(ctx).Error("Failed to unmarshal releases", "repo", repo.FullName, "error", err.Error())
 		return "", err
 	}
 	var latestTime int64
@@ -647,29 +1013,53 @@ func getLatestDOITag(client *ginclient.Client, repo *gogs.Repository, doiBase st
 // MakeZip recursively writes all the files found under the provided sources to
 // the dest io.Writer in ZIP format.  Any directories listed in source are
 // archived recursively.  Empty directories and directories and files specified
-// via the exclude parameter are ignored.
+// via the exclude parameter are ignored. The sources and the excluded paths
+// are relative to the root directory, which is the root of the archive; the
+// working directory of the process is not used.
 // The zip file has no compression by design since most zipped files are large
 // binary files that do not compress well, while it might take a decent amount
 // of time in addition.
-func MakeZip(dest io.Writer, exclude []string, source ...string) error {
-	// NOTE: Does not support commits other than master.
+func MakeZip(dest io.Writer, root string, exclude []string, source ...string) error {
+	aw, err := newArchiveWriter(dest, ArchiveZip, nil)
+	if err != nil {
+		return err
+	}
+	_, err = makeArchive(context.Background(), aw, root, exclude, nil, nil, false, source...)
+	return err
+}
 
+// makeArchive implements MakeZip for all archive formats. It writes the files
+// to the provided archiveWriter and returns the manifest of all files written
+// to the archive. annexKeys maps file paths to git annex keys for the
+// manifest; symlinks into the annex object store are annotated with the key
+// from their target. If added is not nil, it is called for each archived
+// file. If withManifest is set, the manifest is added to the archive as well.
+// Archiving is aborted if the context is done.
+func makeArchive(ctx context.Context, aw archiveWriter, root string, exclude []string, annexKeys map[string]string, added func(manifestEntry), withManifest bool, source ...string) ([]manifestEntry, error) {
 	// check sources
 	for _, src := range source {
-		if _, err := os.Stat(src); err != nil {
-			return fmt.Errorf("cannot access '%s': %s", src, err.Error())
+		if _, err := os.Stat(filepath.Join(root, src)); err != nil {
+			return nil, fmt.Errorf("cannot access '%s': %s", src, err.Error())
 		}
 	}
 
-	zipwriter := zip.NewWriter(dest)
-	defer zipwriter.Close()
+	defer aw.Close()
 
-	walker := func(path string, fi os.FileInfo, err error) error {
+	manifest := make([]manifestEntry, 0)
+	walker := func(fpath string, fi os.FileInfo, err error) error {
 
 		// return on any error
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// paths are root-relative in the archive and in the exclude list
+		path, err := filepath.Rel(root, fpath)
+		if err != nil {
+			return err
+		}
 
 		// return with specific SkipDir error when encountering an excluded directory or file;
 		// if it is a direcory, the directory content will be excluded as well.
@@ -679,59 +1069,86 @@ func MakeZip(dest io.Writer, exclude []string, source ...string) error {
 			}
 		}
 
-		// create a new dir/file header
-		header, err := zip.FileInfoHeader(fi)
-		if err != nil {
-			return err
-		}
-
-		// update the name to correctly reflect the desired destination when unzipping
-		// header.Name = strings.TrimPrefix(strings.Replace(file, src, "", -1), string(filepath.Separator))
-		header.Name = path
-
 		if fi.Mode().IsDir() {
 			return nil
 		}
 
-		// write the header
-		w, err := zipwriter.CreateHeader(header)
-		if err != nil {
-			return err
-		}
-
+		// the path in the archive is the desired destination when unpacking
+		entry := manifestEntry{Path: filepath.ToSlash(path), AnnexKey: annexKeys[filepath.ToSlash(path)]}
+		archentry := archiveEntry{Path: entry.Path, Size: fi.Size(), Mode: fi.Mode(), Modified: fi.ModTime()}
+		hasher := sha256.New()
+		var content io.Reader
 		// Dereference symlinks
 		if fi.Mode()&os.ModeSymlink != 0 {
-			data, err := os.Readlink(path)
+			data, err := os.Readlink(fpath)
 			if err != nil {
 				return err
 			}
-			if _, err := io.Copy(w, strings.NewReader(data)); err != nil {
+			if entry.AnnexKey == "" && strings.Contains(filepath.ToSlash(data), "annex/objects/") {
+				entry.AnnexKey = filepath.Base(data)
+			}
+			if objinfo, ok := annexObject(fpath, data); ok {
+				// locked annex file; archive the content of the annex object
+				f, err := os.Open(fpath)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				archentry.Size = objinfo.Size()
+				archentry.Mode = annexObjectMode(objinfo)
+				content = f
+			} else {
+				archentry.Size = int64(len(data))
+				archentry.Linkname = data
+				content = strings.NewReader(data)
+			}
+		} else {
+			// open files for archiving
+			f, err := os.Open(fpath)
+			if err != nil {
 				return err
 			}
-			return nil
+			defer f.Close()
+			content = f
 		}
 
-		// open files for zipping
-		f, err := os.Open(path)
+		// write the header
+		w, err := aw.create(archentry)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
 
-		// copy file data into zip writer
-		if _, err := io.Copy(w, f); err != nil {
+		// copy file data into the archive writer
+		size, err := io.Copy(io.MultiWriter(w, hasher), contextReader{ctx, content})
+		if err != nil {
 			return err
 		}
+		entry.Size = size
+		entry.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+		manifest = append(manifest, entry)
 
+		if added != nil {
+			added(entry)
+		}
 		return nil
 	}
 
 	// walk path
 	for _, src := range source {
-		err := filepath.Walk(src, walker)
+		err := filepath.Walk(filepath.Join(root, src), walker)
 		if err != nil {
-			return fmt.Errorf("error adding %s to zip file: %s", src, err.Error())
+			return nil, fmt.Errorf("error adding %s to archive: %s", src, err.Error())
 		}
 	}
-	return nil
+
+	if withManifest {
+		if err := addManifest(ctx, aw, manifest); err != nil {
+			return nil, fmt.Errorf("error adding manifest to archive: %s", err.Error())
+		}
+	}
+	// close explicitly to catch errors finishing the archive
+	if err := aw.Close(); err != nil {
+		return nil, fmt.Errorf("error finishing archive: %s", err.Error())
+	}
+	return manifest, nil
 }
@@ -2,11 +2,18 @@ package main
 
 import (
 	"archive/zip"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/G-Node/gin-cli/ginclient"
+	ginweb "github.com/G-Node/gin-cli/web"
 )
 
 func TestMakeZip(t *testing.T) {
@@ -90,18 +97,8 @@ func TestMakeZip(t *testing.T) {
 		}
 		defer zipfp.Close()
 
-		origdir, err := os.Getwd()
-		if err != nil {
-			return fmt.Errorf("Failed to get working directory in function '%s': %v", fn, err)
-		}
-		defer os.Chdir(origdir)
-
-		if err := os.Chdir(source); err != nil {
-			return fmt.Errorf("Failed to change to source directory to make zip file in function '%s': %v", fn, err)
-		}
-
-		if err := MakeZip(zipfp, exclude, "."); err != nil {
-			return fmt.Errorf("Failed to change to source directory to make zip file in function '%s': %v", fn, err)
+		if err := MakeZip(zipfp, source, exclude, "."); err != nil {
+			return fmt.Errorf("Failed to make zip file in function '%s': %v", fn, err)
 		}
 		return nil
 	}
@@ -155,3 +152,293 @@ func TestReadRepoYAML(t *testing.T) {
 		t.Fatalf("Could not read YAML")
 	}
 }
+
+func TestValidRef(t *testing.T) {
+	for _, ref := range []string{"master", "main", "v1.0", "feature/data-2", "0123456789abcdef0123456789abcdef01234567"} {
+		if !validRef(ref) {
+			t.Fatalf("Expected valid ref %q", ref)
+		}
+	}
+	for _, ref := range []string{"", "-b", "--upload-pack=x", "../master", "a..b", "a//b", "dev/", "v1.lock", "a b", "a;b", ".hidden"} {
+		if validRef(ref) {
+			t.Fatalf("Expected invalid ref %q", ref)
+		}
+	}
+}
+
+func TestGetRepoCommit(t *testing.T) {
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/v1/repos/user/repo/commits/v1.0":
+			_, _ = rw.Write([]byte(commit))
+		case "/api/v1/repos/user/repo/commits/broken":
+			_, _ = rw.Write([]byte("<html>not a commit</html>"))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client := &ginclient.Client{Client: ginweb.New(server.URL)}
+
+	hash, err := getRepoCommit(client, "user/repo", "v1.0")
+	if err != nil {
+		t.Fatalf("Error resolving ref: %s", err.Error())
+	}
+	if hash != commit {
+		t.Fatalf("Unexpected commit hash: %q", hash)
+	}
+
+	// full commit hashes are not resolved
+	hash, err = getRepoCommit(client, "user/other", commit)
+	if err != nil || hash != commit {
+		t.Fatalf("Unexpected commit hash %q or error: %v", hash, err)
+	}
+
+	if _, err = getRepoCommit(client, "user/repo", "missing"); err == nil {
+		t.Fatal("Expected error on missing ref")
+	}
+	if _, err = getRepoCommit(client, "user/repo", "broken"); err == nil {
+		t.Fatal("Expected error on invalid commit hash")
+	}
+}
+
+func TestCheckoutRevision(t *testing.T) {
+	root := t.TempDir()
+	repodir := filepath.Join(root, "repo")
+	initTestRepo(t, repodir, filepath.Join(root, "remote.git"))
+	first, _, err := remoteGitCMD(context.Background(), repodir, false, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatalf("Error reading commit: %s", err.Error())
+	}
+	first = strings.TrimSpace(first)
+	if _, stderr, err := remoteGitCMD(context.Background(), repodir, false, "tag", "v1.0"); err != nil {
+		t.Fatalf("Error tagging commit: %s: %s", err.Error(), stderr)
+	}
+	if _, stderr, err := remoteGitCMD(context.Background(), repodir, false, "-c", "user.name=test", "-c", "user.email=test@example.org", "commit", "--allow-empty", "-m", "second"); err != nil {
+		t.Fatalf("Error committing: %s: %s", err.Error(), stderr)
+	}
+
+	for _, rev := range []string{"v1.0", first} {
+		if err := checkoutRevision(context.Background(), repodir, rev); err != nil {
+			t.Fatalf("Error checking out %q: %s", rev, err.Error())
+		}
+		head, _, err := remoteGitCMD(context.Background(), repodir, false, "rev-parse", "HEAD")
+		if err != nil {
+			t.Fatalf("Error reading commit: %s", err.Error())
+		}
+		if strings.TrimSpace(head) != first {
+			t.Fatalf("Unexpected HEAD after checking out %q: %q", rev, head)
+		}
+	}
+
+	if err := checkoutRevision(context.Background(), repodir, "missing"); err == nil {
+		t.Fatal("Expected error on missing revision")
+	}
+}
+
+// mainBranchRepo creates a clone of the test repository in contrib/test.git
+// whose default branch is 'main' instead of 'master' and adds a commit with
+// a .gitmodules file on top. Returns the path of the clone.
+func mainBranchRepo(t *testing.T) string {
+	root := t.TempDir()
+	fixture, err := filepath.Abs(filepath.Join("..", "..", "contrib", "test.git"))
+	if err != nil {
+		t.Fatalf("Error resolving test repository path: %s", err.Error())
+	}
+	repodir := filepath.Join(root, "test")
+	if _, stderr, err := remoteGitCMD(context.Background(), root, false, "clone", "--quiet", fixture, repodir); err != nil {
+		t.Fatalf("Error cloning test repository: %s: %s", err.Error(), stderr)
+	}
+	if err := os.WriteFile(filepath.Join(repodir, ".gitmodules"), []byte("[submodule \"sub\"]\n"), 0666); err != nil {
+		t.Fatalf("Error writing file: %s", err.Error())
+	}
+	for _, args := range [][]string{
+		{"branch", "--move", "master", "main"},
+		{"add", ".gitmodules"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.org", "commit", "--quiet", "-m", "add submodules"},
+	} {
+		if _, stderr, err := remoteGitCMD(context.Background(), repodir, false, args...); err != nil {
+			t.Fatalf("Error running git %v: %s: %s", args, err.Error(), stderr)
+		}
+	}
+	return repodir
+}
+
+func TestDefaultBranch(t *testing.T) {
+	repodir := mainBranchRepo(t)
+	repo := "owner/test"
+	server := serveGitRepo(repo, repodir)
+	defer server.Close()
+	client := &ginclient.Client{Client: ginweb.New(server.URL)}
+
+	branch, err := getDefaultBranch(client, repo)
+	if err != nil {
+		t.Fatalf("Error getting default branch: %s", err.Error())
+	}
+	if branch != "main" {
+		t.Fatalf("Unexpected default branch: %q", branch)
+	}
+	if _, err := getDefaultBranch(client, "owner/missing"); err == nil {
+		t.Fatal("Expected error on missing repository")
+	}
+
+	conf := &Configuration{}
+	if branch := repoDefaultBranch(context.Background(), conf, repo); branch != defaultRef {
+		t.Fatalf("Expected fallback branch without GIN session, got %q", branch)
+	}
+	conf.GIN.Session = client
+	if branch := repoDefaultBranch(context.Background(), conf, repo); branch != "main" {
+		t.Fatalf("Unexpected default branch: %q", branch)
+	}
+	if branch := repoDefaultBranch(context.Background(), conf, "owner/missing"); branch != defaultRef {
+		t.Fatalf("Expected fallback branch on missing repository, got %q", branch)
+	}
+
+	// the default branch resolves to the latest commit
+	head, _, err := remoteGitCMD(context.Background(), repodir, false, "rev-parse", "main")
+	if err != nil {
+		t.Fatalf("Error reading commit: %s", err.Error())
+	}
+	commit, err := getRepoCommit(client, repo, branch)
+	if err != nil {
+		t.Fatalf("Error resolving default branch: %s", err.Error())
+	}
+	if commit != strings.TrimSpace(head) {
+		t.Fatalf("Unexpected commit %q; expected %q", commit, head)
+	}
+	if _, err := getRepoCommit(client, repo, "master"); err == nil {
+		t.Fatal("Expected error on missing master branch")
+	}
+
+	// submodules are only found at the revisions that contain them
+	if !HasGitModules(server.URL, repo, branch) {
+		t.Fatal("Expected .gitmodules on default branch")
+	}
+	if !HasGitModules(server.URL, repo, commit) {
+		t.Fatal("Expected .gitmodules at latest commit")
+	}
+	if HasGitModules(server.URL, repo, "master") {
+		t.Fatal("Unexpected .gitmodules on missing master branch")
+	}
+	if HasGitModules(server.URL, repo, "main~1") {
+		t.Fatal("Unexpected .gitmodules at previous commit")
+	}
+}
+
+func TestCloneDefaultBranch(t *testing.T) {
+	root := t.TempDir()
+	srcdir := filepath.Join(root, "src")
+	remotedir := filepath.Join(root, "remote.git")
+	initTestRepo(t, srcdir, remotedir)
+	// the remote repository uses 'main' as default branch
+	if _, stderr, err := remoteGitCMD(context.Background(), srcdir, false, "push", "origin", "HEAD:refs/heads/main"); err != nil {
+		t.Fatalf("Error pushing: %s: %s", err.Error(), stderr)
+	}
+	if _, stderr, err := remoteGitCMD(context.Background(), remotedir, false, "symbolic-ref", "HEAD", "refs/heads/main"); err != nil {
+		t.Fatalf("Error setting default branch: %s: %s", err.Error(), stderr)
+	}
+
+	conf := &Configuration{}
+	conf.Storage.PreparationDirectory = filepath.Join(root, "prep")
+	job := testJob("10.12751/g-node.rev002", "owner/Repo", conf)
+	clonedir := cloneDir(job)
+	if err := os.MkdirAll(filepath.Dir(clonedir), 0777); err != nil {
+		t.Fatalf("Error creating preparation directory: %s", err.Error())
+	}
+	if _, stderr, err := remoteGitCMD(context.Background(), root, false, "clone", "--quiet", remotedir, clonedir); err != nil {
+		t.Fatalf("Error cloning repository: %s: %s", err.Error(), stderr)
+	}
+	if branch := cloneDefaultBranch(context.Background(), conf, clonedir, job.Metadata.SourceRepository); branch != "main" {
+		t.Fatalf("Unexpected default branch %q", branch)
+	}
+
+	// jobs without a recorded ref are checked against the default branch
+	head, _, err := remoteGitCMD(context.Background(), clonedir, false, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatalf("Error reading commit: %s", err.Error())
+	}
+	job.Commit = strings.TrimSpace(head)
+	if issues := checkArchivedRevision(context.Background(), job); len(issues) != 0 {
+		t.Fatalf("Unexpected issues: %v", issues)
+	}
+
+	// clones without a recorded default branch fall back to the GIN default
+	if _, stderr, err := remoteGitCMD(context.Background(), clonedir, false, "remote", "set-head", "origin", "--delete"); err != nil {
+		t.Fatalf("Error removing origin HEAD: %s: %s", err.Error(), stderr)
+	}
+	if branch := cloneDefaultBranch(context.Background(), conf, clonedir, job.Metadata.SourceRepository); branch != defaultRef {
+		t.Fatalf("Unexpected fallback branch %q", branch)
+	}
+}
+
+func TestCheckArchivedRevision(t *testing.T) {
+	root := t.TempDir()
+	srcdir := filepath.Join(root, "src")
+	remotedir := filepath.Join(root, "remote.git")
+	initTestRepo(t, srcdir, remotedir)
+	first, _, err := remoteGitCMD(context.Background(), srcdir, false, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatalf("Error reading commit: %s", err.Error())
+	}
+	first = strings.TrimSpace(first)
+
+	conf := &Configuration{}
+	conf.Storage.PreparationDirectory = filepath.Join(root, "prep")
+	job := testJob("10.12751/g-node.rev001", "owner/Repo", conf)
+	job.Ref = "master"
+	job.Commit = first
+	clonedir := cloneDir(job)
+	if err := os.MkdirAll(filepath.Dir(clonedir), 0777); err != nil {
+		t.Fatalf("Error creating preparation directory: %s", err.Error())
+	}
+	if _, stderr, err := remoteGitCMD(context.Background(), root, false, "clone", "--quiet", remotedir, clonedir); err != nil {
+		t.Fatalf("Error cloning repository: %s: %s", err.Error(), stderr)
+	}
+
+	// clone matches the recorded commit
+	if issues := checkArchivedRevision(context.Background(), job); len(issues) != 0 {
+		t.Fatalf("Unexpected issues: %v", issues)
+	}
+
+	// a commit pushed after the request is reported, while the recorded
+	// commit remains checked out
+	push := [][]string{
+		{"-c", "user.name=test", "-c", "user.email=test@example.org", "commit", "--allow-empty", "-m", "second"},
+		{"push", "origin", "HEAD:refs/heads/master"},
+	}
+	for _, args := range push {
+		if _, stderr, err := remoteGitCMD(context.Background(), srcdir, false, args...); err != nil {
+			t.Fatalf("Error running git %v: %s: %s", args, err.Error(), stderr)
+		}
+	}
+	if _, stderr, err := remoteGitCMD(context.Background(), clonedir, false, "fetch", "--quiet", "origin"); err != nil {
+		t.Fatalf("Error fetching: %s: %s", err.Error(), stderr)
+	}
+	if issues := checkArchivedRevision(context.Background(), job); len(issues) != 1 || !strings.Contains(issues[0], "moved from "+first) {
+		t.Fatalf("Expected moved ref issue, got: %v", issues)
+	}
+
+	// checking out a different commit is reported
+	if err := checkoutRevision(context.Background(), clonedir, "origin/master"); err != nil {
+		t.Fatalf("Error checking out: %s", err.Error())
+	}
+	if issues := checkArchivedRevision(context.Background(), job); len(issues) != 2 || !strings.Contains(issues[0], "differs from the commit "+first) {
+		t.Fatalf("Expected archived commit issue, got: %v", issues)
+	}
+
+	// missing ref is reported
+	job.Ref = "missing"
+	if issues := checkArchivedRevision(context.Background(), job); len(issues) != 2 || !strings.Contains(issues[1], "no longer exists") {
+		t.Fatalf("Expected missing ref issue, got: %v", issues)
+	}
+
+	// without a recorded commit the archived commit is recorded
+	job.Commit = ""
+	if issues := checkArchivedRevision(context.Background(), job); len(issues) != 0 {
+		t.Fatalf("Unexpected issues: %v", issues)
+	}
+	if job.Commit == "" || job.Commit == first {
+		t.Fatalf("Archived commit not recorded: %q", job.Commit)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gingit "github.com/G-Node/gin-cli/git"
+	humanize "github.com/dustin/go-humanize"
+)
+
+// downloadBackoff is the delay before the first retry of a failed annex
+// content download; it doubles with every further retry.
+var downloadBackoff = 5 * time.Second
+
+// downloadStats summarises the annex content download of a job.
+type downloadStats struct {
+	// Number of files and bytes downloaded
+	Files int
+	Bytes int64
+	// Duration of the download
+	Duration time.Duration
+	// Files that were downloaded after one or more retries
+	Retried []string
+	// Files that could not be downloaded
+	Failed []string
+}
+
+// Throughput returns the average download rate in human readable form.
+func (stats *downloadStats) Throughput() string {
+	if stats.Duration <= 0 {
+		return "n/a"
+	}
+	rate := float64(stats.Bytes) / stats.Duration.Seconds()
+	return fmt.Sprintf("%s/s", humanize.IBytes(uint64(rate)))
+}
+
+// Summary returns the download statistics as lines for the admin
+// notification.
+func (stats *downloadStats) Summary() []string {
+	summary := []string{
+		fmt.Sprintf("Downloaded %d annex files (%s) in %s at %s", stats.Files, humanize.IBytes(uint64(stats.Bytes)), stats.Duration.Round(time.Second), stats.Throughput()),
+	}
+	if len(stats.Retried) > 0 {
+		summary = append(summary, fmt.Sprintf("Retried annex downloads of %d files: %s", len(stats.Retried), strings.Join(stats.Retried, ", ")))
+	}
+	if len(stats.Failed) > 0 {
+		summary = append(summary, fmt.Sprintf("Failed annex downloads of %d files: %s", len(stats.Failed), strings.Join(stats.Failed, ", ")))
+	}
+	return summary
+}
+
+// annexFile is a file of a git annex repository with its content size.
+type annexFile struct {
+	Name string
+	Size int64
+}
+
+// missingAnnexFiles lists the annex files of the repository at repodir whose
+// content is not available locally.
+func missingAnnexFiles(ctx context.Context, repodir string) ([]annexFile, error) {
+	stdout, stderr, err := remoteGitCMD(ctx, repodir, true, "find", "--not", "--in=here", "--format=${file}\t${bytesize}\n")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err.Error(), stderr)
+	}
+	files := make([]annexFile, 0)
+	for _, line := range strings.Split(stdout, "\n") {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		// the size of keys without size information is unknown
+		size, _ := strconv.ParseInt(parts[1], 10, 64)
+		files = append(files, annexFile{Name: parts[0], Size: size})
+	}
+	return files, nil
+}
+
+// activityWriter signals every write of a command to a channel without
+// blocking the command.
+type activityWriter chan struct{}
+
+func (w activityWriter) Write(p []byte) (int, error) {
+	select {
+	case w <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// annexGetFile downloads the annex content of a single file of the
+// repository at repodir. git annex reports the transfer progress
+// continuously; if it does not report any progress for the duration of
+// stall, the download is considered stalled and aborted. The download is also
+// aborted if the context is done.
+func annexGetFile(ctx context.Context, repodir string, fname string, stall time.Duration) error {
+	cmd := gingit.AnnexCommand("version")
+	cmd.Args = []string{"git", "-C", repodir, "annex", "get", "--json-progress", "--", fname}
+	activity := make(activityWriter, 1)
+	var stderr strings.Builder
+	cmd.Stdout = activity
+	cmd.Stderr = &stderr
+	if err := startCommand(ctx, cmd.Cmd); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(stall)
+	defer timer.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(stderr.String()))
+			}
+			return nil
+		case <-activity:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(stall)
+		case <-timer.C:
+			logger(ctx).Warn("Annex download stalled; aborting", "file", fname, "stall", stall)
+			killCommand(cmd.Cmd)
+			<-done
+			return fmt.Errorf("download stalled for %s", stall)
+		case <-ctx.Done():
+			logger(ctx).Warn("Annex download cancelled", "file", fname)
+			killCommand(cmd.Cmd)
+			<-done
+			return fmt.Errorf("download aborted: %s", ctx.Err().Error())
+		}
+	}
+}
+
+// downloadAnnexContent downloads the missing annex content of the repository
+// at repodir using the configured number of parallel downloads. Failed
+// downloads are retried with increasing delays. Once all downloads are done,
+// the repository is checked for missing annex content. The download
+// statistics are recorded in stats; progress is reported to the provided
+// progressFunc. The downloads are aborted if the context is done.
+func downloadAnnexContent(ctx context.Context, repodir string, conf *Configuration, stats *downloadStats, progress progressFunc) error {
+	files, err := missingAnnexFiles(ctx, repodir)
+	if err != nil {
+		return fmt.Errorf("failed to list missing annex content: %s", err.Error())
+	}
+	var total int64
+	for _, file := range files {
+		total += file.Size
+	}
+	jobs := conf.Download.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	logger(ctx).Info("Downloading annex content", "files", len(files), "size", humanize.IBytes(uint64(total)), "jobs", jobs)
+
+	start := time.Now()
+	var mutex sync.Mutex
+	finished := func(file annexFile, attempts int, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			stats.Failed = append(stats.Failed, file.Name)
+			return
+		}
+		stats.Files++
+		stats.Bytes += file.Size
+		if attempts > 1 {
+			stats.Retried = append(stats.Retried, file.Name)
+		}
+		elapsed := time.Since(start)
+		rate := float64(stats.Bytes) / elapsed.Seconds()
+		progress(JobDownloading, fmt.Sprintf("downloaded %d of %d files (%s of %s, %s/s)", stats.Files, len(files), humanize.IBytes(uint64(stats.Bytes)), humanize.IBytes(uint64(total)), humanize.IBytes(uint64(rate))))
+	}
+
+	queue := make(chan annexFile)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range queue {
+				attempts, err := annexGetRetry(ctx, repodir, file.Name, conf.Download.Retries, conf.Download.StallTimeout)
+				finished(file, attempts, err)
+			}
+		}()
+	}
+queueing:
+	for _, file := range files {
+		select {
+		case queue <- file:
+		case <-ctx.Done():
+			break queueing
+		}
+	}
+	close(queue)
+	wg.Wait()
+	stats.Duration = time.Since(start)
+	logger(ctx).Info("Annex download finished", "summary", strings.Join(stats.Summary(), "; "))
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("annex download aborted: %s", err.Error())
+	}
+
+	// verify that all content is available
+	hasmissing, misslist, err := missingAnnexContent(ctx, repodir)
+	if err != nil {
+		return fmt.Errorf("failed to verify annex content: %s", err.Error())
+	}
+	if hasmissing {
+		splitmis := strings.Split(strings.TrimSpace(misslist), "\n")
+		return fmt.Errorf("annex content still missing in %d files after download", len(splitmis))
+	}
+	return nil
+}
+
+// annexGetRetry downloads the annex content of a single file and retries
+// failed downloads up to the given number of times. Returns the number of
+// attempts and the error of the last attempt. Retries are stopped if the
+// context is done.
+func annexGetRetry(ctx context.Context, repodir string, fname string, retries int, stall time.Duration) (int, error) {
+	var err error
+	backoff := downloadBackoff
+	for attempt := 1; ; attempt++ {
+		if err = annexGetFile(ctx, repodir, fname, stall); err == nil {
+			return attempt, nil
+		}
+		if attempt > retries || ctx.Err() != nil {
+			logger(ctx).Error("Annex download failed", "file", fname, "attempts", attempt, "error", err.Error())
+			return attempt, err
+		}
+		logger(ctx).Warn("Annex download failed; retrying", "file", fname, "attempt", attempt, "error", err.Error(), "backoff", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return attempt, err
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeAnnexScript emulates the git annex commands used for the annex content
+// download. Files with missing content are marker files in .missing/ of the
+// repository containing the file size. The download behaviour depends on the
+// file name prefix: 'stall' never reports progress, 'fail' always fails and
+// 'flaky' fails on the first attempt.
+const fakeAnnexScript = `#!/bin/sh
+dir="$2"
+shift 3
+case "$1" in
+find)
+	fmt=no
+	for arg in "$@"; do
+		case "$arg" in --format=*) fmt=yes;; esac
+	done
+	for marker in "$dir"/.missing/*; do
+		[ -f "$marker" ] || continue
+		name=$(basename "$marker")
+		if [ $fmt = yes ]; then
+			printf '%s\t%s\n' "$name" "$(cat "$marker")"
+		else
+			printf '%s\n' "$name"
+		fi
+	done
+	;;
+get)
+	fname="$4"
+	case "$fname" in
+	stall*) exec sleep 5;;
+	fail*) echo "failed to get $fname" >&2; exit 1;;
+	flaky*)
+		if [ ! -f "$dir/.tried-$fname" ]; then
+			touch "$dir/.tried-$fname"
+			exit 1
+		fi;;
+	esac
+	echo '{"byte-progress":1}'
+	rm "$dir/.missing/$fname"
+	;;
+esac
+`
+
+// fakeAnnexRepo sets up a fake git command and a repository directory with
+// the given missing files and their sizes.
+func fakeAnnexRepo(t *testing.T, missing map[string]string) string {
+	bindir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bindir, "git"), []byte(fakeAnnexScript), 0755); err != nil {
+		t.Fatalf("Error writing fake git command: %s", err.Error())
+	}
+	t.Setenv("PATH", bindir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	repodir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repodir, ".missing"), 0777); err != nil {
+		t.Fatalf("Error creating repository directory: %s", err.Error())
+	}
+	for fname, size := range missing {
+		if err := os.WriteFile(filepath.Join(repodir, ".missing", fname), []byte(size), 0666); err != nil {
+			t.Fatalf("Error writing marker file: %s", err.Error())
+		}
+	}
+	return repodir
+}
+
+func downloadConf(jobs, retries int, stall time.Duration) *Configuration {
+	conf := new(Configuration)
+	conf.Download.Jobs = jobs
+	conf.Download.Retries = retries
+	conf.Download.StallTimeout = stall
+	return conf
+}
+
+func TestDownloadAnnexContent(t *testing.T) {
+	backoff := downloadBackoff
+	downloadBackoff = 10 * time.Millisecond
+	defer func() { downloadBackoff = backoff }()
+
+	repodir := fakeAnnexRepo(t, map[string]string{
+		"ok1.dat":   "100",
+		"ok2.dat":   "200",
+		"ok3.dat":   "300",
+		"flaky.dat": "1000",
+	})
+	files, err := missingAnnexFiles(context.Background(), repodir)
+	if err != nil {
+		t.Fatalf("Error listing missing files: %s", err.Error())
+	}
+	if len(files) != 4 {
+		t.Fatalf("Unexpected missing files: %v", files)
+	}
+
+	stats := new(downloadStats)
+	var messages []string
+	progress := func(state JobState, msg string) {
+		messages = append(messages, msg)
+	}
+	if err := downloadAnnexContent(context.Background(), repodir, downloadConf(3, 2, 5*time.Second), stats, progress); err != nil {
+		t.Fatalf("Unexpected download error: %s", err.Error())
+	}
+	if stats.Files != 4 || stats.Bytes != 1600 || len(stats.Failed) != 0 {
+		t.Fatalf("Unexpected download stats: %+v", stats)
+	}
+	if len(stats.Retried) != 1 || stats.Retried[0] != "flaky.dat" {
+		t.Fatalf("Unexpected retried files: %v", stats.Retried)
+	}
+	if len(messages) != 4 || !strings.HasPrefix(messages[3], "downloaded 4 of 4 files") {
+		t.Fatalf("Unexpected progress messages: %v", messages)
+	}
+	summary := strings.Join(stats.Summary(), "\n")
+	if !strings.Contains(summary, "Downloaded 4 annex files") || !strings.Contains(summary, "Retried annex downloads of 1 files: flaky.dat") {
+		t.Fatalf("Unexpected download summary: %q", summary)
+	}
+}
+
+func TestDownloadAnnexContentFailures(t *testing.T) {
+	backoff := downloadBackoff
+	downloadBackoff = 10 * time.Millisecond
+	defer func() { downloadBackoff = backoff }()
+
+	repodir := fakeAnnexRepo(t, map[string]string{
+		"ok.dat":    "100",
+		"fail.dat":  "100",
+		"stall.dat": "100",
+	})
+	stats := new(downloadStats)
+	progress := func(JobState, string) {}
+	start := time.Now()
+	err := downloadAnnexContent(context.Background(), repodir, downloadConf(2, 1, 200*time.Millisecond), stats, progress)
+	if err == nil || !strings.Contains(err.Error(), "still missing in 2 files") {
+		t.Fatalf("Unexpected download error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Fatalf("Stalled download was not aborted: %s", elapsed)
+	}
+	if stats.Files != 1 || len(stats.Failed) != 2 {
+		t.Fatalf("Unexpected download stats: %+v", stats)
+	}
+	if summary := strings.Join(stats.Summary(), "\n"); !strings.Contains(summary, "Failed annex downloads of 2 files") {
+		t.Fatalf("Unexpected download summary: %q", summary)
+	}
+
+	// stall detection of a single download
+	err = annexGetFile(context.Background(), repodir, "stall.dat", 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "stalled") {
+		t.Fatalf("Unexpected stalled download error: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"log"
@@ -31,43 +32,13 @@ func mkhtml(xmlFiles []string, outpath string) {
 			continue
 		}
 
-		datacite := new(libgin.DataCite)
-		err = xml.Unmarshal(contents, datacite)
+		metadata, warnings, err := landingPageMetadata(contents)
 		if err != nil {
 			fmt.Printf("Failed to unmarshal contents of %q: %s\n", filearg, err.Error())
 			continue
 		}
-		metadata := &libgin.RepositoryMetadata{
-			DataCite: datacite,
-		}
-
-		// check missing titles and rightslist; initialize empty
-		// and notify without failing to avoid broken html files.
-		if len(metadata.Titles) < 1 {
-			metadata.Titles = []string{""}
-			fmt.Printf("Warning: no titles found in file %q\n", filearg)
-		}
-		if len(metadata.RightsList) < 1 {
-			metadata.RightsList = []libgin.Rights{{Name: "", URL: ""}}
-			fmt.Printf("Warning: no Rights found in file %q\n", filearg)
-		}
-
-		// find URLs in RelatedIdentifiers
-		for _, relid := range metadata.RelatedIdentifiers {
-			switch u := strings.ToLower(relid.Identifier); {
-			case strings.HasPrefix(u, "https://gin.g-node.org/doi/"):
-				// fork URL
-				metadata.ForkRepository = strings.TrimPrefix(relid.Identifier, "https://gin.g-node.org/")
-			case strings.HasPrefix(u, "https://web.gin.g-node.org/doi"):
-				// fork URL (old)
-				metadata.ForkRepository = strings.TrimPrefix(relid.Identifier, "https://web.gin.g-node.org/")
-			case strings.HasPrefix(u, "https://gin.g-node.org/"):
-				// repo URL
-				metadata.SourceRepository = strings.TrimPrefix(relid.Identifier, "https://gin.g-node.org/")
-			case strings.HasPrefix(u, "https://web.gin.g-node.org/"):
-				// repo URL (old)
-				metadata.SourceRepository = strings.TrimPrefix(relid.Identifier, "https://web.gin.g-node.org/")
-			}
+		for _, warning := range warnings {
+			fmt.Printf("Warning: %s in file %q\n", warning, filearg)
 		}
 
 		dname := filepath.Join(outpath, metadata.Identifier.ID)
@@ -82,7 +53,7 @@ func mkhtml(xmlFiles []string, outpath string) {
 			fname = filepath.Join(outpath, fmt.Sprintf("%s-index.html", metadata.Identifier.ID))
 		}
 
-		if err := createLandingPage(metadata, fname, ""); err != nil {
+		if err := createLandingPage(context.Background(), metadata, fname, ""); err != nil {
 			fmt.Printf("Failed to render landing page for %q: %s\n", filearg, err.Error())
 			continue
 		}
@@ -95,6 +66,48 @@ func mkhtml(xmlFiles []string, outpath string) {
 	fmt.Printf("%d/%d jobs completed successfully\n", success, len(xmlFiles))
 }
 
+// landingPageMetadata reads the DataCite XML of a dataset and returns the
+// metadata for rendering its landing page. Missing titles and rights are
+// initialised empty to avoid broken pages and reported as warnings.
+func landingPageMetadata(contents []byte) (*libgin.RepositoryMetadata, []string, error) {
+	datacite := new(libgin.DataCite)
+	if err := xml.Unmarshal(contents, datacite); err != nil {
+		return nil, nil, err
+	}
+	metadata := &libgin.RepositoryMetadata{
+		DataCite: datacite,
+	}
+
+	var warnings []string
+	if len(metadata.Titles) < 1 {
+		metadata.Titles = []string{""}
+		warnings = append(warnings, "no titles found")
+	}
+	if len(metadata.RightsList) < 1 {
+		metadata.RightsList = []libgin.Rights{{Name: "", URL: ""}}
+		warnings = append(warnings, "no Rights found")
+	}
+
+	// find URLs in RelatedIdentifiers
+	for _, relid := range metadata.RelatedIdentifiers {
+		switch u := strings.ToLower(relid.Identifier); {
+		case strings.HasPrefix(u, "https://gin.g-node.org/doi/"):
+			// fork URL
+			metadata.ForkRepository = strings.TrimPrefix(relid.Identifier, "https://gin.g-node.org/")
+		case strings.HasPrefix(u, "https://web.gin.g-node.org/doi"):
+			// fork URL (old)
+			metadata.ForkRepository = strings.TrimPrefix(relid.Identifier, "https://web.gin.g-node.org/")
+		case strings.HasPrefix(u, "https://gin.g-node.org/"):
+			// repo URL
+			metadata.SourceRepository = strings.TrimPrefix(relid.Identifier, "https://gin.g-node.org/")
+		case strings.HasPrefix(u, "https://web.gin.g-node.org/"):
+			// repo URL (old)
+			metadata.SourceRepository = strings.TrimPrefix(relid.Identifier, "https://web.gin.g-node.org/")
+		}
+	}
+	return metadata, warnings, nil
+}
+
 // clihtml handles command line arguments and passes them
 // to the mkhtml function.
 // An optional output file path can be passed via the command
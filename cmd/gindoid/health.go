@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// healthTimeout limits the time all checks of a health or readiness request
+// may take.
+const healthTimeout = 10 * time.Second
+
+// healthCacheTTL is the time the results of the readiness checks of external
+// services and storage directories are reused, so frequent probes do not
+// open GIN and mail server sessions and write files on every request.
+const healthCacheTTL = 30 * time.Second
+
+// healthCheck is a named check of a service dependency. The check returns
+// an informational message if the dependency is available or an error
+// describing why it is not.
+type healthCheck struct {
+	Name  string
+	Check func(ctx context.Context) (string, error)
+}
+
+// healthResult is the result of a single healthCheck.
+type healthResult struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// healthReport is the response of the health and readiness endpoints.
+type healthReport struct {
+	Status string         `json:"status"`
+	Checks []healthResult `json:"checks"`
+}
+
+// livenessChecks returns the checks of the local dependencies of the
+// service, which do not depend on other services: git, git annex and
+// writable storage directories.
+func livenessChecks(conf *Configuration) []healthCheck {
+	return []healthCheck{
+		{"git", checkGit},
+		{"git-annex", checkAnnex},
+		{"preparation", directoryCheck(conf.Storage.PreparationDirectory, 0)},
+		{"target", directoryCheck(conf.Storage.TargetDirectory, 0)},
+	}
+}
+
+// readinessChecks returns the checks of all dependencies required to accept
+// and process registration requests: the local dependencies including the
+// free space of the storage directories, the GIN session and the mail server.
+// The service is not ready while it shuts down. The results of the GIN, mail
+// server and directory checks are cached for healthCacheTTL.
+func readinessChecks(conf *Configuration, shuttingdown func() bool) []healthCheck {
+	minfree := conf.Storage.MinFreeSpace
+	return []healthCheck{
+		{"shutdown", func(context.Context) (string, error) {
+			if shuttingdown() {
+				return "", fmt.Errorf("service is shutting down")
+			}
+			return "", nil
+		}},
+		{"gin", cachedCheck(func(ctx context.Context) (string, error) { return checkGINSession(ctx, conf) }, healthCacheTTL)},
+		{"git", checkGit},
+		{"git-annex", checkAnnex},
+		{"preparation", cachedCheck(directoryCheck(conf.Storage.PreparationDirectory, minfree), healthCacheTTL)},
+		{"target", cachedCheck(directoryCheck(conf.Storage.TargetDirectory, minfree), healthCacheTTL)},
+		{"smtp", cachedCheck(func(ctx context.Context) (string, error) { return checkMailServer(ctx, conf) }, healthCacheTTL)},
+	}
+}
+
+// cachedCheck returns a check that reuses the result of the provided check
+// for the ttl. Concurrent requests wait for a single run of the check.
+// Results of checks that were aborted by the request context are not cached.
+func cachedCheck(check func(context.Context) (string, error), ttl time.Duration) func(context.Context) (string, error) {
+	var mu sync.Mutex
+	var checked time.Time
+	var msg string
+	var err error
+	return func(ctx context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !checked.IsZero() && time.Since(checked) < ttl {
+			return msg, err
+		}
+		m, e := check(ctx)
+		if ctx.Err() != nil {
+			return m, e
+		}
+		msg, err, checked = m, e, time.Now()
+		return msg, err
+	}
+}
+
+// runHealthChecks runs all checks concurrently and returns their results in
+// the order of the checks.
+func runHealthChecks(ctx context.Context, checks []healthCheck) healthReport {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	report := healthReport{Status: "ok", Checks: make([]healthResult, len(checks))}
+	var wg sync.WaitGroup
+	for idx, check := range checks {
+		wg.Add(1)
+		go func(idx int, check healthCheck) {
+			defer wg.Done()
+			msg, err := check.Check(ctx)
+			result := healthResult{Name: check.Name, OK: err == nil, Message: msg}
+			if err != nil {
+				result.Message = err.Error()
+			}
+			report.Checks[idx] = result
+		}(idx, check)
+	}
+	wg.Wait()
+	for _, result := range report.Checks {
+		if !result.OK {
+			report.Status = "failing"
+		}
+	}
+	return report
+}
+
+// serveHealth runs the checks and writes their results as JSON. The response
+// status is 200 if all checks pass and 503 otherwise. Failed checks are
+// logged.
+func serveHealth(w http.ResponseWriter, r *http.Request, checks []healthCheck) {
+	report := runHealthChecks(r.Context(), checks)
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+		for _, result := range report.Checks {
+			if !result.OK {
+				logger(r.Context()).Warn("Health check failed", "path", r.URL.Path, "check", result.Name, "error", result.Message)
+			}
+		}
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// checkGINSession checks that the service is logged in to GIN by requesting
+// the user of the session token.
+func checkGINSession(ctx context.Context, conf *Configuration) (string, error) {
+	if conf.GIN.Session == nil || conf.GIN.Session.Token == "" {
+		return "", fmt.Errorf("not logged in to GIN")
+	}
+	status, _, err := ginRequest(ctx, conf, http.MethodGet, "api/v1/user", nil)
+	if err != nil {
+		return "", fmt.Errorf("GIN is not reachable: %s", err.Error())
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("GIN session is not valid: [%d] %s", status, http.StatusText(status))
+	}
+	return fmt.Sprintf("logged in as %s", conf.GIN.Username), nil
+}
+
+// checkGit checks that git can be run and returns its version.
+func checkGit(ctx context.Context) (string, error) {
+	stdout, stderr, err := runCommand(ctx, exec.Command("git", "--version"))
+	if err != nil {
+		return "", fmt.Errorf("git is not available: %s %s", err.Error(), strings.TrimSpace(string(stderr)))
+	}
+	return strings.TrimSpace(string(stdout)), nil
+}
+
+// checkAnnex checks that git annex is available.
+func checkAnnex(context.Context) (string, error) {
+	ok, err := annexAvailable()
+	if err != nil {
+		return "", fmt.Errorf("git annex is not available: %s", err.Error())
+	}
+	if !ok {
+		return "", fmt.Errorf("git annex is not installed")
+	}
+	return "", nil
+}
+
+// directoryCheck returns a check that the directory is writable and the
+// file system holding it has at least minfree bytes of free space.
+func directoryCheck(dir string, minfree int64) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		if dir == "" {
+			return "", fmt.Errorf("directory is not configured")
+		}
+		fp, err := os.CreateTemp(dir, ".healthcheck-")
+		if err != nil {
+			return "", fmt.Errorf("directory is not writable: %s", err.Error())
+		}
+		fp.Close()
+		os.Remove(fp.Name())
+		free, _, err := diskSpace(dir)
+		if err != nil {
+			return "", err
+		}
+		if free < minfree {
+			return "", fmt.Errorf("%s free, %s required", humanize.IBytes(uint64(free)), humanize.IBytes(uint64(minfree)))
+		}
+		return fmt.Sprintf("%s free", humanize.IBytes(uint64(free))), nil
+	}
+}
+
+// checkMailServer checks that the configured SMTP server accepts
+// connections. Sending mail is disabled if no server is configured; this is
+// reported but not considered a failure.
+func checkMailServer(ctx context.Context, conf *Configuration) (string, error) {
+	if conf.Email.Server == "" {
+		return "not configured", nil
+	}
+	c, done, err := dialMail(ctx, conf)
+	if err != nil {
+		return "", fmt.Errorf("mail server is not reachable: %s", err.Error())
+	}
+	defer done()
+	defer c.Close()
+	if err := c.Quit(); err != nil {
+		return "", fmt.Errorf("mail server did not close the session: %s", err.Error())
+	}
+	return conf.Email.Server, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/G-Node/gin-cli/ginclient"
+	ginweb "github.com/G-Node/gin-cli/web"
+)
+
+func TestDirectoryCheck(t *testing.T) {
+	dir := t.TempDir()
+	if msg, err := directoryCheck(dir, 0)(context.Background()); err != nil || !strings.HasSuffix(msg, "free") {
+		t.Fatalf("Unexpected result for writable directory: %q, %v", msg, err)
+	}
+	if _, err := directoryCheck(dir, 1<<62)(context.Background()); err == nil || !strings.Contains(err.Error(), "required") {
+		t.Fatalf("Unexpected result for directory without enough space: %v", err)
+	}
+	if _, err := directoryCheck(filepath.Join(dir, "missing"), 0)(context.Background()); err == nil || !strings.Contains(err.Error(), "not writable") {
+		t.Fatalf("Unexpected result for missing directory: %v", err)
+	}
+	if _, err := directoryCheck("", 0)(context.Background()); err == nil {
+		t.Fatal("Unexpected success for unconfigured directory")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, ".healthcheck-*")); len(matches) != 0 {
+		t.Fatalf("Check files were not removed: %v", matches)
+	}
+}
+
+func TestCheckGINSession(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v1/user" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Header.Get("Authorization") != "token valid" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(rw, `{"username": "doi"}`)
+	}))
+	defer server.Close()
+
+	conf := &Configuration{}
+	if _, err := checkGINSession(context.Background(), conf); err == nil {
+		t.Fatal("Unexpected success without GIN session")
+	}
+	conf.GIN.Username = "doi"
+	conf.GIN.Session = &ginclient.Client{Client: ginweb.New(server.URL)}
+	if _, err := checkGINSession(context.Background(), conf); err == nil {
+		t.Fatal("Unexpected success without login")
+	}
+	conf.GIN.Session.Token = "expired"
+	if _, err := checkGINSession(context.Background(), conf); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Unexpected result for invalid token: %v", err)
+	}
+	conf.GIN.Session.Token = "valid"
+	if msg, err := checkGINSession(context.Background(), conf); err != nil || msg != "logged in as doi" {
+		t.Fatalf("Unexpected result for valid session: %q, %v", msg, err)
+	}
+}
+
+// serveSMTP starts a minimal SMTP server that greets clients and ends the
+// session on QUIT. It returns the server address.
+func serveSMTP(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting SMTP server: %s", err.Error())
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.HasPrefix(strings.ToUpper(line), "QUIT") {
+						fmt.Fprint(conn, "221 Bye\r\n")
+						return
+					}
+					fmt.Fprint(conn, "250 OK\r\n")
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestCheckMailServer(t *testing.T) {
+	conf := &Configuration{}
+	if msg, err := checkMailServer(context.Background(), conf); err != nil || msg != "not configured" {
+		t.Fatalf("Unexpected result without mail server: %q, %v", msg, err)
+	}
+	conf.Email.Server = serveSMTP(t)
+	if _, err := checkMailServer(context.Background(), conf); err != nil {
+		t.Fatalf("Unexpected error for reachable mail server: %s", err.Error())
+	}
+	conf.Email.Server = "127.0.0.1:1"
+	if _, err := checkMailServer(context.Background(), conf); err == nil {
+		t.Fatal("Unexpected success for unreachable mail server")
+	}
+}
+
+func TestCachedCheck(t *testing.T) {
+	calls := 0
+	check := cachedCheck(func(context.Context) (string, error) {
+		calls++
+		return "", fmt.Errorf("check %d failed", calls)
+	}, time.Hour)
+	for i := 0; i < 3; i++ {
+		if _, err := check(context.Background()); err == nil || err.Error() != "check 1 failed" {
+			t.Fatalf("Unexpected cached result: %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("Check run %d times", calls)
+	}
+
+	// aborted checks are not cached
+	calls = 0
+	check = cachedCheck(func(context.Context) (string, error) {
+		calls++
+		return "", fmt.Errorf("check %d failed", calls)
+	}, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	check(ctx)
+	if _, err := check(context.Background()); err == nil || err.Error() != "check 2 failed" {
+		t.Fatalf("Aborted check was cached: %v", err)
+	}
+
+	// expired results are checked again
+	check = cachedCheck(func(context.Context) (string, error) {
+		calls++
+		return fmt.Sprintf("check %d", calls), nil
+	}, 0)
+	check(context.Background())
+	if msg, _ := check(context.Background()); msg != "check 4" {
+		t.Fatalf("Expired result was reused: %q", msg)
+	}
+}
+
+func TestServeHealth(t *testing.T) {
+	shutdown := false
+	conf := &Configuration{}
+	conf.Storage.PreparationDirectory = t.TempDir()
+	conf.Storage.TargetDirectory = t.TempDir()
+	checks := readinessChecks(conf, func() bool { return shutdown })
+	names := make([]string, len(checks))
+	for idx, check := range checks {
+		names[idx] = check.Name
+	}
+	if strings.Join(names, ",") != "shutdown,gin,git,git-annex,preparation,target,smtp" {
+		t.Fatalf("Unexpected readiness checks: %v", names)
+	}
+
+	request := func(checks []healthCheck) (int, healthReport) {
+		w := httptest.NewRecorder()
+		serveHealth(w, httptest.NewRequest("GET", "/readyz", nil), checks)
+		var report healthReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Error decoding health report %q: %s", w.Body.String(), err.Error())
+		}
+		return w.Code, report
+	}
+
+	// the readiness fails without GIN session
+	code, report := request(checks)
+	if code != http.StatusServiceUnavailable || report.Status != "failing" || len(report.Checks) != len(checks) {
+		t.Fatalf("Unexpected readiness [%d]: %+v", code, report)
+	}
+	for idx, result := range report.Checks {
+		if result.Name != names[idx] {
+			t.Fatalf("Unexpected order of check results: %+v", report.Checks)
+		}
+		switch result.Name {
+		case "shutdown", "preparation", "target", "smtp":
+			if !result.OK {
+				t.Fatalf("Unexpected failed check: %+v", result)
+			}
+		case "gin":
+			if result.OK || result.Message != "not logged in to GIN" {
+				t.Fatalf("Unexpected GIN check result: %+v", result)
+			}
+		}
+	}
+
+	// only the selected checks are run
+	code, report = request(checks[:1])
+	if code != http.StatusOK || report.Status != "ok" || len(report.Checks) != 1 {
+		t.Fatalf("Unexpected readiness [%d]: %+v", code, report)
+	}
+	shutdown = true
+	code, report = request(checks[:1])
+	if code != http.StatusServiceUnavailable || report.Checks[0].Message != "service is shutting down" {
+		t.Fatalf("Unexpected readiness during shutdown [%d]: %+v", code, report)
+	}
+
+	// the liveness does not depend on external services
+	for _, check := range livenessChecks(conf) {
+		if check.Name == "gin" || check.Name == "smtp" || check.Name == "shutdown" {
+			t.Fatalf("Unexpected liveness check %q", check.Name)
+		}
+	}
+}
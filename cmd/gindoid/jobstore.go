@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/G-Node/libgin/libgin"
+)
+
+// jobstoredir is the name of the directory below the preparation directory
+// where the registration job records are kept.
+const jobstoredir = "jobs"
+
+// JobState describes the processing state of a registration job.
+type JobState string
+
+const (
+	// JobQueued marks a job that has been accepted but not yet picked up by a worker.
+	JobQueued JobState = "queued"
+	// JobDeferred marks a job that did not fit into the available disk space
+	// and is queued again later.
+	JobDeferred JobState = "deferred"
+	// JobRunning marks a job that has been picked up by a worker and is
+	// preparing its directories.
+	JobRunning JobState = "running"
+	// JobCloning marks a job that is cloning the source repository.
+	JobCloning JobState = "cloning"
+	// JobDownloading marks a job that is downloading the git annex content
+	// of the cloned repository.
+	JobDownloading JobState = "downloading annex"
+	// JobZipping marks a job that is creating the dataset archive.
+	JobZipping JobState = "zipping"
+	// JobLandingPage marks a job that is creating the landing page and the
+	// DataCite XML file.
+	JobLandingPage JobState = "landing page"
+	// JobDone marks a job that has been processed and awaits curator review.
+	JobDone JobState = "done"
+	// JobFailed marks a job that ended with an error.
+	JobFailed JobState = "failed"
+	// JobChangesRequested marks a job where the curators have asked the
+	// requester for changes to the repository.
+	JobChangesRequested JobState = "changes requested"
+	// JobRejected marks a job the curators have rejected.
+	JobRejected JobState = "rejected"
+	// JobPublishing marks an approved job that is being published.
+	JobPublishing JobState = "publishing"
+	// JobPublished marks a job whose dataset has been published.
+	JobPublished JobState = "published"
+	// JobPublishFailed marks an approved job where the publication failed.
+	JobPublishFailed JobState = "publish failed"
+)
+
+// jobStates lists all job states in processing order.
+var jobStates = []JobState{JobQueued, JobDeferred, JobRunning, JobCloning, JobDownloading, JobZipping, JobLandingPage, JobDone, JobFailed, JobChangesRequested, JobRejected, JobPublishing, JobPublished, JobPublishFailed}
+
+// Finished returns true if a job in this state will not be processed by a
+// worker again without curator action.
+func (s JobState) Finished() bool {
+	switch s {
+	case JobDone, JobFailed, JobChangesRequested, JobRejected, JobPublishing, JobPublished, JobPublishFailed:
+		return true
+	}
+	return false
+}
+
+// Retryable returns true if a job in this state can be re-run by the
+// curators.
+func (s JobState) Retryable() bool {
+	switch s {
+	case JobDone, JobFailed, JobChangesRequested, JobPublishFailed:
+		return true
+	}
+	return false
+}
+
+// Reviewable returns true if the curators can approve, reject or request
+// changes for a job in this state.
+func (s JobState) Reviewable() bool {
+	return s == JobDone || s == JobPublishFailed
+}
+
+// JobTransition records a single state change of a registration job.
+type JobTransition struct {
+	State JobState  `json:"state"`
+	Time  time.Time `json:"time"`
+	// Optional note explaining the state change, e.g. an error message.
+	Note string `json:"note,omitempty"`
+}
+
+// JobRecord is the persistent representation of a RegistrationJob.
+// It holds a snapshot of the job metadata taken at submission time,
+// which is sufficient to restart the job, and the full state history.
+type JobRecord struct {
+	Metadata *libgin.RepositoryMetadata
+	State    JobState
+	Created  time.Time
+	Updated  time.Time
+	History  []JobTransition
+	// Ref is the requested branch, tag or commit of the source repository.
+	Ref string `json:",omitempty"`
+	// CommitHash is the commit Ref pointed to at the time of the request.
+	CommitHash string `json:",omitempty"`
+	// ZipSize is the size of the created archive in bytes.
+	ZipSize int64 `json:",omitempty"`
+	// Errors and Warnings hold the issues reported to the admins after the
+	// dataset preparation.
+	Errors   []string `json:",omitempty"`
+	Warnings []string `json:",omitempty"`
+	// Registered is the time the DOI was registered at DataCite.
+	Registered *time.Time `json:",omitempty"`
+	// Progress holds the latest progress message of the current state.
+	// It is updated frequently and therefore not persisted.
+	Progress string `json:"-"`
+}
+
+// JobStore keeps track of all registration jobs and persists them as one
+// JSON file per job in a directory, so that queued and interrupted jobs
+// survive a restart of the service.
+type JobStore struct {
+	dir     string
+	mu      sync.Mutex
+	records map[string]*JobRecord
+}
+
+// newJobStore opens the job store at the given directory, creating the
+// directory if it does not exist, and loads all previously recorded jobs.
+// Job files that cannot be read are logged and skipped.
+func newJobStore(dir string) (*JobStore, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("failed to create job store directory %q: %s", dir, err.Error())
+	}
+	store := &JobStore{
+		dir:     dir,
+		records: make(map[string]*JobRecord),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job store directory %q: %s", dir, err.Error())
+	}
+	for _, fi := range files {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			log.Printf("Failed to read job file %q: %s", fi.Name(), err.Error())
+			continue
+		}
+		rec := new(JobRecord)
+		if err := json.Unmarshal(data, rec); err != nil {
+			log.Printf("Failed to unmarshal job file %q: %s", fi.Name(), err.Error())
+			continue
+		}
+		if rec.Metadata == nil || rec.Metadata.DataCite == nil {
+			log.Printf("Skipping job file %q: missing job metadata", fi.Name())
+			continue
+		}
+		store.records[rec.Metadata.Identifier.ID] = rec
+	}
+	log.Printf("Loaded %d registration jobs from %q", len(store.records), dir)
+	return store, nil
+}
+
+// newJob creates a RegistrationJob from a copy of the metadata of the
+// record, so the job can be processed without changing the record.
+func (rec JobRecord) newJob(conf *Configuration) (*RegistrationJob, error) {
+	md, err := copyMetadata(rec.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &RegistrationJob{Metadata: md, Config: conf, Ref: rec.Ref, Commit: rec.CommitHash}, nil
+}
+
+// jobfilename returns the file name used to store the record of the job
+// with the provided DOI.
+func jobfilename(doi string) string {
+	return strings.ReplaceAll(doi, "/", "_") + ".json"
+}
+
+// copyMetadata returns a deep copy of the provided metadata by running it
+// through a JSON round trip.
+func copyMetadata(md *libgin.RepositoryMetadata) (*libgin.RepositoryMetadata, error) {
+	data, err := json.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+	mdcopy := new(libgin.RepositoryMetadata)
+	if err := json.Unmarshal(data, mdcopy); err != nil {
+		return nil, err
+	}
+	return mdcopy, nil
+}
+
+// save writes a job record to its file in the store directory. The file is
+// written to a temporary file first and then moved in place to avoid
+// leaving a truncated record behind if the service stops while writing.
+// The caller must hold the store lock.
+func (s *JobStore) save(rec *JobRecord) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	fname := filepath.Join(s.dir, jobfilename(rec.Metadata.Identifier.ID))
+	tmpfname := fname + ".tmp"
+	if err := ioutil.WriteFile(tmpfname, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpfname, fname)
+}
+
+// Add records a new job in the JobQueued state. The job metadata is copied,
+// so later changes to the job do not affect the stored record.
+func (s *JobStore) Add(job *RegistrationJob) error {
+	md, err := copyMetadata(job.Metadata)
+	if err != nil {
+		return fmt.Errorf("failed to copy job metadata: %s", err.Error())
+	}
+	if md.DataCite == nil || md.Identifier.ID == "" {
+		return fmt.Errorf("cannot store job without identifier")
+	}
+
+	now := time.Now()
+	rec := &JobRecord{
+		Metadata:   md,
+		State:      JobQueued,
+		Created:    now,
+		Updated:    now,
+		History:    []JobTransition{{State: JobQueued, Time: now}},
+		Ref:        job.Ref,
+		CommitHash: job.Commit,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[md.Identifier.ID] = rec
+	return s.save(rec)
+}
+
+// SetState records a state change for the job with the provided DOI.
+// The optional note is stored with the transition.
+func (s *JobStore) SetState(doi string, state JobState, note string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[doi]
+	if !ok {
+		return fmt.Errorf("unknown job %q", doi)
+	}
+	now := time.Now()
+	rec.State = state
+	rec.Updated = now
+	rec.Progress = ""
+	rec.History = append(rec.History, JobTransition{State: state, Time: now, Note: note})
+	return s.save(rec)
+}
+
+// jobStateError is returned by Transition if a job is not in a state the
+// transition can start from.
+type jobStateError struct {
+	DOI   string
+	State JobState
+}
+
+func (e *jobStateError) Error() string {
+	return fmt.Sprintf("job %s is %s", e.DOI, e.State)
+}
+
+// Transition changes the state of the job with the provided DOI to the new
+// state if the from function accepts the current state of the job. The check
+// and the state change are done under the store lock, so concurrent requests
+// cannot both change the state of the same job. A *jobStateError is returned
+// if the current state is not accepted. On success, a copy of the updated
+// record is returned.
+func (s *JobStore) Transition(doi string, from func(JobState) bool, state JobState, note string) (JobRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[doi]
+	if !ok {
+		return JobRecord{}, fmt.Errorf("unknown job %q", doi)
+	}
+	if !from(rec.State) {
+		return JobRecord{}, &jobStateError{DOI: doi, State: rec.State}
+	}
+	now := time.Now()
+	rec.State = state
+	rec.Updated = now
+	rec.Progress = ""
+	rec.History = append(rec.History, JobTransition{State: state, Time: now, Note: note})
+	if err := s.save(rec); err != nil {
+		return JobRecord{}, err
+	}
+	reccopy := *rec
+	reccopy.History = append([]JobTransition(nil), rec.History...)
+	return reccopy, nil
+}
+
+// Update applies the provided function to the record of the job with the
+// provided DOI and persists the changed record. The function must not keep
+// a reference to the record.
+func (s *JobStore) Update(doi string, update func(rec *JobRecord)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[doi]
+	if !ok {
+		return fmt.Errorf("unknown job %q", doi)
+	}
+	update(rec)
+	rec.Updated = time.Now()
+	return s.save(rec)
+}
+
+// SetProgress updates the progress message of the job with the provided
+// DOI. The message is only kept in memory.
+func (s *JobStore) SetProgress(doi string, msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.records[doi]; ok {
+		rec.Progress = msg
+	}
+}
+
+// Get returns a copy of the record of the job with the provided DOI.
+func (s *JobStore) Get(doi string) (JobRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[doi]
+	if !ok {
+		return JobRecord{}, false
+	}
+	reccopy := *rec
+	reccopy.History = append([]JobTransition(nil), rec.History...)
+	return reccopy, true
+}
+
+// List returns copies of all job records ordered by creation time.
+func (s *JobStore) List() []JobRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]JobRecord, 0, len(s.records))
+	for _, rec := range s.records {
+		reccopy := *rec
+		reccopy.History = append([]JobTransition(nil), rec.History...)
+		list = append(list, reccopy)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// Unfinished returns copies of all job records that are neither done nor
+// failed, ordered by creation time.
+func (s *JobStore) Unfinished() []JobRecord {
+	unfinished := make([]JobRecord, 0)
+	for _, rec := range s.List() {
+		if !rec.State.Finished() {
+			unfinished = append(unfinished, rec)
+		}
+	}
+	return unfinished
+}
+
+// setJobState records a state change of a job in the job store of the job
+// configuration. Errors are logged, since a failing record must not stop
+// the registration itself. Does nothing if no job store is configured.
+func setJobState(job *RegistrationJob, state JobState, note string) {
+	if job.Config == nil || job.Config.Jobs == nil {
+		return
+	}
+	doi := job.Metadata.Identifier.ID
+	if err := job.Config.Jobs.SetState(doi, state, note); err != nil {
+		log.Printf("Failed to record state %q for job %q: %s", state, doi, err.Error())
+	}
+}
+
+// updateJob applies the provided function to the record of a job in the job
+// store of the job configuration. Errors are logged. Does nothing if no job
+// store is configured.
+func updateJob(job *RegistrationJob, update func(rec *JobRecord)) {
+	if job.Config == nil || job.Config.Jobs == nil {
+		return
+	}
+	doi := job.Metadata.Identifier.ID
+	if err := job.Config.Jobs.Update(doi, update); err != nil {
+		log.Printf("Failed to update record of job %q: %s", doi, err.Error())
+	}
+}
+
+// recordReport stores the errors and warnings of the dataset preparation
+// with the job record.
+func recordReport(job *RegistrationJob, errors, warnings []string) {
+	updateJob(job, func(rec *JobRecord) {
+		rec.Errors = append([]string(nil), errors...)
+		rec.Warnings = append([]string(nil), warnings...)
+	})
+}
+
+// progressFunc receives progress events from the individual stages of a
+// registration job. A change of state is recorded in the job history, the
+// message is kept as the current progress of the job.
+type progressFunc func(state JobState, msg string)
+
+// jobProgress returns a progressFunc that records the progress events of
+// the provided job in the job store of the job configuration.
+func jobProgress(job *RegistrationJob) progressFunc {
+	var current JobState
+	return func(state JobState, msg string) {
+		if state != current {
+			setJobState(job, state, "")
+			current = state
+		}
+		if msg != "" && job.Config != nil && job.Config.Jobs != nil {
+			job.Config.Jobs.SetProgress(job.Metadata.Identifier.ID, msg)
+		}
+	}
+}
+
+// resetPublishing marks jobs that were being published when the service
+// stopped as failed, so the curators can approve them again.
+func resetPublishing(store *JobStore) {
+	for _, rec := range store.List() {
+		if rec.State != JobPublishing {
+			continue
+		}
+		doi := rec.Metadata.Identifier.ID
+		log.Printf("Publication of %q was interrupted", doi)
+		if err := store.SetState(doi, JobPublishFailed, "interrupted by service restart"); err != nil {
+			log.Printf("Failed to update job %q: %s", doi, err.Error())
+		}
+	}
+}
+
+// resumeJobs re-enqueues all jobs in the store that have not finished.
+// Jobs that were interrupted while running have their partial clones
+// removed from the preparation directory, so they restart from the
+// beginning. The jobs are sent to the queue in the background to avoid
+// blocking on a full queue.
+func resumeJobs(store *JobStore, jobQueue chan *RegistrationJob, conf *Configuration) {
+	unfinished := store.Unfinished()
+	if len(unfinished) == 0 {
+		return
+	}
+	log.Printf("Resuming %d unfinished registration jobs", len(unfinished))
+	jobs := make([]*RegistrationJob, 0, len(unfinished))
+	for _, rec := range unfinished {
+		job, err := rec.newJob(conf)
+		if err != nil {
+			log.Printf("Failed to resume job %q: %s", rec.Metadata.Identifier.ID, err.Error())
+			continue
+		}
+		if rec.State != JobQueued {
+			cleanPreparation(context.Background(), job)
+		}
+		setJobState(job, JobQueued, "re-queued after service restart")
+		jobs = append(jobs, job)
+	}
+	go func() {
+		for _, job := range jobs {
+			log.Printf("Re-queueing job %q", job.Metadata.Identifier.ID)
+			jobQueue <- job
+		}
+	}()
+}
+
+// cloneDir returns the directory the source repository of a job is cloned
+// to. Returns an empty string if the source repository path is invalid.
+func cloneDir(job *RegistrationJob) string {
+	repoparts := strings.SplitN(job.Metadata.SourceRepository, "/", 2)
+	if len(repoparts) != 2 {
+		return ""
+	}
+	reponame := strings.ToLower(repoparts[1]) // clone directory is always lowercase
+	return filepath.Join(job.Config.Storage.PreparationDirectory, job.Metadata.Identifier.ID, reponame)
+}
+
+// cleanPreparation removes the repository clone of a job from its
+// preparation directory, so the job can be started from scratch.
+func cleanPreparation(ctx context.Context, job *RegistrationJob) {
+	repodir := cloneDir(job)
+	if repodir == "" {
+		return
+	}
+	if _, err := os.Stat(repodir); err != nil {
+		return
+	}
+	logger(ctx).Info("Removing partial clone", "dir", repodir)
+	if err := os.RemoveAll(repodir); err != nil {
+		logger(ctx).Error("Failed to remove partial clone", "dir", repodir, "error", err.Error())
+	}
+}
+
+// interruptJobs resets jobs that were still running when the service shut
+// down. Partial artefacts are removed and the jobs are re-queued, so they
+// are started from scratch on the next service start.
+func interruptJobs(jobs []*RegistrationJob) {
+	ctx := context.Background()
+	for _, job := range jobs {
+		doi := job.Metadata.Identifier.ID
+		jobctx := withLogger(ctx, logger(ctx).With("doi", doi, "repository", job.Metadata.SourceRepository))
+		logger(jobctx).Info("Interrupting job")
+		if job.Config.Jobs != nil {
+			if rec, ok := job.Config.Jobs.Get(doi); ok && rec.State == JobZipping {
+				cleanArchive(jobctx, job)
+			}
+		}
+		cleanPreparation(jobctx, job)
+		setJobState(job, JobQueued, "interrupted by service shutdown")
+	}
+}
+
+// cleanArchive removes a partially written dataset archive of a job from
+// the target directory.
+func cleanArchive(ctx context.Context, job *RegistrationJob) {
+	doi := job.Metadata.Identifier.ID
+	targetpath := filepath.Join(job.Config.Storage.TargetDirectory, doi)
+	fnames := archiveFiles(ctx, doi, targetpath)
+	if len(fnames) == 0 {
+		return
+	}
+	logger(ctx).Info("Removing partial archive", "file", filepath.Join(targetpath, fnames[0]))
+	removeArchives(ctx, targetpath, doi, nil)
+	manifest := manifestName(filepath.Join(targetpath, archiveName(doi, ArchiveZip)))
+	if err := os.Remove(manifest); err != nil && !os.IsNotExist(err) {
+		logger(ctx).Error("Failed to remove partial archive", "error", err.Error())
+	}
+}
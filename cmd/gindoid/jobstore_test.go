@@ -0,0 +1,290 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/G-Node/libgin/libgin"
+)
+
+// testJob returns a minimal RegistrationJob with the provided DOI and
+// source repository.
+func testJob(doi string, repo string, conf *Configuration) *RegistrationJob {
+	job := &RegistrationJob{
+		Metadata: new(libgin.RepositoryMetadata),
+		Config:   conf,
+	}
+	job.Metadata.DataCite = new(libgin.DataCite)
+	job.Metadata.Identifier.ID = doi
+	job.Metadata.Identifier.Type = "DOI"
+	job.Metadata.SourceRepository = repo
+	return job
+}
+
+func TestJobStore(t *testing.T) {
+	storedir := filepath.Join(t.TempDir(), jobstoredir)
+
+	store, err := newJobStore(storedir)
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	if len(store.List()) != 0 {
+		t.Fatalf("Expected empty job store but got %d jobs", len(store.List()))
+	}
+
+	// check error on missing identifier
+	if err = store.Add(testJob("", "owner/repo", nil)); err == nil {
+		t.Fatal("Expected error on job without identifier")
+	}
+
+	// check job is added in queued state and persisted to file
+	jobA := testJob("10.12751/g-node.aaaaa1", "owner/repoa", nil)
+	jobB := testJob("10.12751/g-node.bbbbb2", "owner/repob", nil)
+	if err = store.Add(jobA); err != nil {
+		t.Fatalf("Error adding job: %q", err.Error())
+	}
+	if err = store.Add(jobB); err != nil {
+		t.Fatalf("Error adding job: %q", err.Error())
+	}
+	if _, err = os.Stat(filepath.Join(storedir, "10.12751_g-node.aaaaa1.json")); err != nil {
+		t.Fatalf("Missing job file: %q", err.Error())
+	}
+	rec, ok := store.Get(jobA.Metadata.Identifier.ID)
+	if !ok {
+		t.Fatal("Could not find added job")
+	} else if rec.State != JobQueued || len(rec.History) != 1 {
+		t.Fatalf("Unexpected job state %q or history %v", rec.State, rec.History)
+	}
+
+	// check stored metadata is independent of the job
+	jobA.Metadata.SourceRepository = "changed/repo"
+	if rec, _ = store.Get(jobA.Metadata.Identifier.ID); rec.Metadata.SourceRepository != "owner/repoa" {
+		t.Fatalf("Stored metadata changed with job: %q", rec.Metadata.SourceRepository)
+	}
+
+	// check error on unknown job
+	if err = store.SetState("i/do/not/exist", JobRunning, ""); err == nil {
+		t.Fatal("Expected error on unknown job")
+	}
+
+	// check state transitions
+	if err = store.SetState(jobA.Metadata.Identifier.ID, JobRunning, "worker 1"); err != nil {
+		t.Fatalf("Error setting job state: %q", err.Error())
+	}
+	if err = store.SetState(jobB.Metadata.Identifier.ID, JobRunning, "worker 2"); err != nil {
+		t.Fatalf("Error setting job state: %q", err.Error())
+	}
+	if err = store.SetState(jobB.Metadata.Identifier.ID, JobDone, ""); err != nil {
+		t.Fatalf("Error setting job state: %q", err.Error())
+	}
+	unfinished := store.Unfinished()
+	if len(unfinished) != 1 || unfinished[0].Metadata.Identifier.ID != jobA.Metadata.Identifier.ID {
+		t.Fatalf("Unexpected unfinished jobs: %v", unfinished)
+	}
+
+	// check records are restored from disk; add an invalid file that should be skipped
+	err = os.WriteFile(filepath.Join(storedir, "invalid.json"), []byte("not json"), 0666)
+	if err != nil {
+		t.Fatalf("Error writing invalid job file: %q", err.Error())
+	}
+	restored, err := newJobStore(storedir)
+	if err != nil {
+		t.Fatalf("Error reopening job store: %q", err.Error())
+	}
+	if len(restored.List()) != 2 {
+		t.Fatalf("Expected 2 restored jobs but got %d", len(restored.List()))
+	}
+	rec, ok = restored.Get(jobA.Metadata.Identifier.ID)
+	if !ok {
+		t.Fatal("Could not find restored job")
+	} else if rec.State != JobRunning || len(rec.History) != 2 || rec.History[1].Note != "worker 1" {
+		t.Fatalf("Unexpected restored job state %q or history %v", rec.State, rec.History)
+	}
+}
+
+func TestJobStoreTransition(t *testing.T) {
+	store, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	job := testJob("10.12751/g-node.ttttt1", "owner/repo", nil)
+	if err = store.Add(job); err != nil {
+		t.Fatalf("Error adding job: %q", err.Error())
+	}
+	doi := job.Metadata.Identifier.ID
+
+	if _, err = store.Transition("i/do/not/exist", JobState.Retryable, JobQueued, ""); err == nil {
+		t.Fatal("Expected error on unknown job")
+	}
+	// a queued job cannot be re-run
+	_, err = store.Transition(doi, JobState.Retryable, JobQueued, "re-run")
+	if serr, ok := err.(*jobStateError); !ok || serr.State != JobQueued {
+		t.Fatalf("Expected state error but got %v", err)
+	}
+
+	if err = store.SetState(doi, JobFailed, ""); err != nil {
+		t.Fatalf("Error setting job state: %q", err.Error())
+	}
+	// of concurrent transitions from the same state only one succeeds
+	results := make(chan error, 10)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			_, err := store.Transition(doi, JobState.Retryable, JobQueued, "re-run")
+			results <- err
+		}()
+	}
+	succeeded := 0
+	for i := 0; i < cap(results); i++ {
+		if err := <-results; err == nil {
+			succeeded++
+		} else if _, ok := err.(*jobStateError); !ok {
+			t.Fatalf("Unexpected transition error: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("Expected a single transition but got %d", succeeded)
+	}
+	rec, _ := store.Get(doi)
+	if rec.State != JobQueued || rec.History[len(rec.History)-1].Note != "re-run" {
+		t.Fatalf("Unexpected job state %q or history %v", rec.State, rec.History)
+	}
+}
+
+func TestResumeJobs(t *testing.T) {
+	conf := &Configuration{}
+	conf.Storage.PreparationDirectory = t.TempDir()
+
+	store, err := newJobStore(filepath.Join(conf.Storage.PreparationDirectory, jobstoredir))
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf.Jobs = store
+
+	queued := testJob("10.12751/g-node.qqqqq1", "owner/queued", conf)
+	running := testJob("10.12751/g-node.rrrrr2", "owner/Running", conf)
+	done := testJob("10.12751/g-node.ddddd3", "owner/done", conf)
+	for _, job := range []*RegistrationJob{queued, running, done} {
+		if err := store.Add(job); err != nil {
+			t.Fatalf("Error adding job: %q", err.Error())
+		}
+	}
+	setJobState(running, JobRunning, "")
+	setJobState(done, JobRunning, "")
+	setJobState(done, JobDone, "")
+
+	// partial clone of the interrupted job
+	clonedir := filepath.Join(conf.Storage.PreparationDirectory, running.Metadata.Identifier.ID, "running")
+	if err := os.MkdirAll(clonedir, 0777); err != nil {
+		t.Fatalf("Error creating clone directory: %q", err.Error())
+	}
+
+	jobQueue := make(chan *RegistrationJob, 5)
+	resumeJobs(store, jobQueue, conf)
+
+	resumed := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		job := <-jobQueue
+		if job.Config != conf {
+			t.Fatal("Resumed job is missing the service configuration")
+		}
+		resumed[job.Metadata.Identifier.ID] = true
+	}
+	if !resumed[queued.Metadata.Identifier.ID] || !resumed[running.Metadata.Identifier.ID] {
+		t.Fatalf("Unexpected resumed jobs: %v", resumed)
+	}
+	if _, err := os.Stat(clonedir); !os.IsNotExist(err) {
+		t.Fatal("Partial clone of interrupted job was not removed")
+	}
+	if rec, _ := store.Get(running.Metadata.Identifier.ID); rec.State != JobQueued {
+		t.Fatalf("Expected resumed job to be queued but got %q", rec.State)
+	}
+}
+
+func TestJobProgress(t *testing.T) {
+	conf := &Configuration{}
+	store, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf.Jobs = store
+
+	job := testJob("10.12751/g-node.ppppp1", "owner/repo", conf)
+	if err = store.Add(job); err != nil {
+		t.Fatalf("Error adding job: %q", err.Error())
+	}
+	doi := job.Metadata.Identifier.ID
+
+	progress := jobProgress(job)
+	progress(JobCloning, "cloning repository")
+	progress(JobCloning, "100%")
+	rec, _ := store.Get(doi)
+	if rec.State != JobCloning || rec.Progress != "100%" {
+		t.Fatalf("Unexpected job state %q or progress %q", rec.State, rec.Progress)
+	}
+	// repeated events of the same state must not be added to the history
+	if len(rec.History) != 2 {
+		t.Fatalf("Unexpected job history: %v", rec.History)
+	}
+
+	// progress is reset on state change
+	progress(JobZipping, "")
+	rec, _ = store.Get(doi)
+	if rec.State != JobZipping || rec.Progress != "" || len(rec.History) != 3 {
+		t.Fatalf("Unexpected job state %q, progress %q or history %v", rec.State, rec.Progress, rec.History)
+	}
+
+	// check no issue on missing job store
+	jobProgress(testJob(doi, "owner/repo", &Configuration{}))(JobZipping, "no store")
+}
+
+func TestInterruptJobs(t *testing.T) {
+	conf := &Configuration{}
+	conf.Storage.PreparationDirectory = t.TempDir()
+	conf.Storage.TargetDirectory = t.TempDir()
+	store, err := newJobStore(filepath.Join(conf.Storage.PreparationDirectory, jobstoredir))
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf.Jobs = store
+
+	zipping := testJob("10.12751/g-node.zzzzz1", "owner/zipping", conf)
+	landing := testJob("10.12751/g-node.lllll2", "owner/landing", conf)
+	zipfiles := make(map[*RegistrationJob]string)
+	for _, job := range []*RegistrationJob{zipping, landing} {
+		if err := store.Add(job); err != nil {
+			t.Fatalf("Error adding job: %q", err.Error())
+		}
+		doi := job.Metadata.Identifier.ID
+		if err := os.MkdirAll(cloneDir(job), 0777); err != nil {
+			t.Fatalf("Error creating clone directory: %q", err.Error())
+		}
+		zipfiles[job] = filepath.Join(conf.Storage.TargetDirectory, doi, archiveName(doi, ArchiveZip))
+		if err := os.MkdirAll(filepath.Dir(zipfiles[job]), 0777); err != nil {
+			t.Fatalf("Error creating target directory: %q", err.Error())
+		}
+		if err := os.WriteFile(zipfiles[job], []byte("zip"), 0666); err != nil {
+			t.Fatalf("Error writing archive: %q", err.Error())
+		}
+	}
+	setJobState(zipping, JobZipping, "")
+	setJobState(landing, JobLandingPage, "")
+
+	interruptJobs([]*RegistrationJob{zipping, landing})
+
+	for _, job := range []*RegistrationJob{zipping, landing} {
+		if rec, _ := store.Get(job.Metadata.Identifier.ID); rec.State != JobQueued {
+			t.Fatalf("Expected interrupted job to be queued but got %q", rec.State)
+		}
+		if _, err := os.Stat(cloneDir(job)); !os.IsNotExist(err) {
+			t.Fatal("Clone of interrupted job was not removed")
+		}
+	}
+	// only the archive that was being written is removed
+	if _, err := os.Stat(zipfiles[zipping]); !os.IsNotExist(err) {
+		t.Fatal("Partial archive was not removed")
+	}
+	if _, err := os.Stat(zipfiles[landing]); err != nil {
+		t.Fatalf("Complete archive was removed: %q", err.Error())
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// joblogfile is the name of the log file of a registration job in the
+// preparation directory of the job.
+const joblogfile = "job.log"
+
+// LogFormat selects the output format of the service log.
+type LogFormat string
+
+const (
+	// LogText writes log records as key=value pairs.
+	LogText LogFormat = "text"
+	// LogJSON writes log records as JSON objects.
+	LogJSON LogFormat = "json"
+)
+
+// setupLogging sets up the default logger with the format and level of the
+// configuration. The output of the standard log package is passed to the same
+// handler at info level.
+func setupLogging(conf *Configuration) {
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, conf.Log.Format, conf.Log.Level)))
+}
+
+// newLogHandler returns a handler writing records of at least the given level
+// to w in the given format.
+func newLogHandler(w io.Writer, format LogFormat, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == LogJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+type loggerKey struct{}
+
+// withLogger returns a copy of the context carrying the logger.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// logger returns the logger of the context; the default logger is returned
+// if the context does not carry one.
+func logger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// jobLogger returns a copy of the context with a logger that tags all records
+// with the DOI and repository of the job and the ID of the worker processing
+// it. If job log files are enabled, the records are also appended to the log
+// file in the preparation directory of the job. The returned function closes
+// the log file.
+func jobLogger(ctx context.Context, job *RegistrationJob, workerID int) (context.Context, func()) {
+	attrs := []any{"doi", job.Metadata.Identifier.ID, "repository", job.Metadata.SourceRepository, "worker", workerID}
+	base := logger(ctx)
+	conf := job.Config
+	if conf == nil || !conf.Log.JobFiles || conf.Storage.PreparationDirectory == "" {
+		return withLogger(ctx, base.With(attrs...)), func() {}
+	}
+
+	fp, err := openJobLog(conf, job.Metadata.Identifier.ID)
+	if err != nil {
+		base.Error("Failed to open job log file", append(attrs, "error", err.Error())...)
+		return withLogger(ctx, base.With(attrs...)), func() {}
+	}
+	handler := multiHandler{base.Handler(), newLogHandler(fp, conf.Log.Format, conf.Log.Level)}
+	return withLogger(ctx, slog.New(handler).With(attrs...)), func() { fp.Close() }
+}
+
+// openJobLog opens the log file of the job with the given DOI for appending,
+// creating the preparation directory of the job if necessary.
+func openJobLog(conf *Configuration, doi string) (*os.File, error) {
+	prepdir := filepath.Join(conf.Storage.PreparationDirectory, doi)
+	if err := os.MkdirAll(prepdir, 0777); err != nil {
+		return nil, fmt.Errorf("failed to create preparation directory: %s", err.Error())
+	}
+	return os.OpenFile(filepath.Join(prepdir, joblogfile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+}
+
+// multiHandler passes log records to all of its handlers.
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range m {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, record slog.Record) error {
+	var firsterr error
+	for _, handler := range m {
+		if !handler.Enabled(ctx, record.Level) {
+			continue
+		}
+		if err := handler.Handle(ctx, record.Clone()); err != nil && firsterr == nil {
+			firsterr = err
+		}
+	}
+	return firsterr
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for idx, handler := range m {
+		handlers[idx] = handler.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for idx, handler := range m {
+		handlers[idx] = handler.WithGroup(name)
+	}
+	return handlers
+}
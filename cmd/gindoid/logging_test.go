@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decodeLogRecords decodes the JSON log records written to buf.
+func decodeLogRecords(t *testing.T, data []byte) []map[string]any {
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		record := make(map[string]any)
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Error decoding log record %q: %s", line, err.Error())
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestJobLogger(t *testing.T) {
+	var buf bytes.Buffer
+	base := slog.New(newLogHandler(&buf, LogJSON, slog.LevelInfo))
+	ctx := withLogger(context.Background(), base)
+
+	conf := &Configuration{}
+	conf.Storage.PreparationDirectory = t.TempDir()
+	conf.Log.Format = LogJSON
+	conf.Log.Level = slog.LevelDebug
+	job := testJob("10.12751/g-node.log001", "owner/logrepo", conf)
+
+	// without job log files the records are only tagged
+	jobctx, closelog := jobLogger(ctx, job, 2)
+	logger(jobctx).Info("Cloning repository", "dir", "/tmp/repo")
+	logger(jobctx).Debug("Running git command")
+	closelog()
+	records := decodeLogRecords(t, buf.Bytes())
+	if len(records) != 1 {
+		t.Fatalf("Unexpected log records: %v", records)
+	}
+	record := records[0]
+	if record["msg"] != "Cloning repository" || record["doi"] != "10.12751/g-node.log001" || record["repository"] != "owner/logrepo" || record["worker"] != float64(2) || record["dir"] != "/tmp/repo" {
+		t.Fatalf("Unexpected job log record: %v", record)
+	}
+	logfile := filepath.Join(conf.Storage.PreparationDirectory, job.Metadata.Identifier.ID, joblogfile)
+	if _, err := os.Stat(logfile); !os.IsNotExist(err) {
+		t.Fatalf("Unexpected job log file: %v", err)
+	}
+
+	// job log files receive the records at the configured level
+	buf.Reset()
+	conf.Log.JobFiles = true
+	for run := 0; run < 2; run++ {
+		jobctx, closelog = jobLogger(ctx, job, 1)
+		logger(jobctx).Info("Starting registration job", "run", run)
+		logger(jobctx).Debug("Running git command")
+		closelog()
+	}
+	if records := decodeLogRecords(t, buf.Bytes()); len(records) != 2 {
+		t.Fatalf("Unexpected service log records: %v", records)
+	}
+	data, err := os.ReadFile(logfile)
+	if err != nil {
+		t.Fatalf("Error reading job log file: %s", err.Error())
+	}
+	records = decodeLogRecords(t, data)
+	if len(records) != 4 {
+		t.Fatalf("Unexpected job log file records: %v", records)
+	}
+	for _, record := range records {
+		if record["doi"] != "10.12751/g-node.log001" || record["worker"] != float64(1) {
+			t.Fatalf("Unexpected job log file record: %v", record)
+		}
+	}
+	if records[2]["run"] != float64(1) {
+		t.Fatalf("Job log file was not appended: %v", records)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	if logger(context.Background()) != slog.Default() {
+		t.Fatal("Context without logger does not return the default logger")
+	}
+	var buf bytes.Buffer
+	newLogHandler(&buf, LogText, slog.LevelWarn).Handle(context.Background(), slog.NewRecord(time.Time{}, slog.LevelWarn, "text record", 0))
+	if !strings.Contains(buf.String(), `msg="text record"`) {
+		t.Fatalf("Unexpected text log output %q", buf.String())
+	}
+}
@@ -3,10 +3,11 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/smtp"
 	"net/url"
@@ -14,7 +15,6 @@ import (
 	"path"
 	"strings"
 
-	"github.com/G-Node/gin-cli/ginclient"
 	"github.com/gogs/go-gogs-client"
 )
 
@@ -26,7 +26,7 @@ const (
 )
 
 // notifyAdminContent prepares and returns body and subject of the DOI registration email and GIN issue.
-func notifyAdminContent(job *RegistrationJob, errors, warnings []string, fullinfo bool, commithash string) (string, string) {
+func notifyAdminContent(ctx context.Context, job *RegistrationJob, errors, warnings []string, fullinfo bool, commithash string) (string, string) {
 	urljoin := func(a, b string) string {
 		log.Printf("%s; %s", a, b)
 		fallback := fmt.Sprintf("%s/%s (fallback URL join)", a, b)
@@ -53,7 +53,14 @@ func notifyAdminContent(job *RegistrationJob, errors, warnings []string, fullinf
 
 		xmlurl := fmt.Sprintf("%s/%s/doi.xml", conf.Storage.XMLURL, doi)
 		repourl := fmt.Sprintf("%s/%s", GetGINURL(conf), repopath)
-		hashurl := fmt.Sprintf("[%s](%s/commits/master)", commithash, repourl)
+		ref := job.Ref
+		if ref == "" {
+			ref = repoDefaultBranch(ctx, conf, repopath)
+		}
+		hashurl := fmt.Sprintf("[%s](%s/commit/%s)", commithash, repourl, commithash)
+		if commithash == "" {
+			hashurl = fmt.Sprintf("unknown [%s/commits/%s]", repourl, ref)
+		}
 
 		user := job.Metadata.RequestingUser
 		username := user.Username
@@ -71,9 +78,10 @@ func notifyAdminContent(job *RegistrationJob, errors, warnings []string, fullinf
 - Email address: %s
 - DOI XML: %s
 - DOI target URL: %s
-- Latest commit hash: %s
+- Requested revision: %s
+- Commit hash: %s
 `
-		body = fmt.Sprintf(infofmt, repopath, repourl, namestr, useremail, xmlurl, doitarget, hashurl)
+		body = fmt.Sprintf(infofmt, repopath, repourl, namestr, useremail, xmlurl, doitarget, ref, hashurl)
 	}
 
 	errorlist := ""
@@ -99,7 +107,21 @@ func notifyAdminContent(job *RegistrationJob, errors, warnings []string, fullinf
 		body = "Repository cloning and ZIP creation are finished; no issues have been found.\n"
 	}
 
-	body = fmt.Sprintf("%s%s%s", body, errorlist, warninglist)
+	// Follow up notifications of re-run jobs state the stage the job was
+	// restarted from.
+	if !fullinfo && job.Retry != "" {
+		body = fmt.Sprintf("The job was re-run from stage %q.\n%s", job.Retry, body)
+	}
+
+	downloadinfo := ""
+	if !fullinfo && job.Download != nil && job.Download.Files+len(job.Download.Failed) > 0 {
+		downloadinfo = "\n\nAnnex content download\n"
+		for _, line := range job.Download.Summary() {
+			downloadinfo = fmt.Sprintf("%s- %s\n", downloadinfo, line)
+		}
+	}
+
+	body = fmt.Sprintf("%s%s%s%s", body, errorlist, warninglist, downloadinfo)
 
 	return body, subject
 }
@@ -108,9 +130,9 @@ func notifyAdminContent(job *RegistrationJob, errors, warnings []string, fullinf
 // sendMail function to send it. Also opens an issue on the XMLRepo if set.
 // If fullinfo is 'false', only errors and warnings are sent in the
 // notification.
-func notifyAdmin(job *RegistrationJob, errors, warnings []string, fullinfo bool, commithash string) error {
+func notifyAdmin(ctx context.Context, job *RegistrationJob, errors, warnings []string, fullinfo bool, commithash string) error {
 	conf := job.Config
-	body, subject := notifyAdminContent(job, errors, warnings, fullinfo, commithash)
+	body, subject := notifyAdminContent(ctx, job, errors, warnings, fullinfo, commithash)
 
 	recipients := make([]string, 0)
 	// Recipient list is read every time a sendMail() is called.
@@ -124,8 +146,8 @@ func notifyAdmin(job *RegistrationJob, errors, warnings []string, fullinfo bool,
 			recipients = append(recipients, address)
 		}
 	} else {
-		log.Printf("Email file %s could not be read: %s", conf.Email.RecipientsFile, err.Error())
-		log.Printf("Notifying %s", DEFAULTTO)
+		logger(ctx).Warn("Email file could not be read", "file", conf.Email.RecipientsFile, "error", err.Error())
+		logger(ctx).Info("Notifying default recipient", "to", DEFAULTTO)
 		recipients = []string{DEFAULTTO}
 	}
 
@@ -135,7 +157,10 @@ func notifyAdmin(job *RegistrationJob, errors, warnings []string, fullinfo bool,
 		// include xml file content
 		issueContent = fmt.Sprintf("%s\n\n-----\n\nDOI XML:\n\n```xml\n%s\n```", body, xmldata)
 	}
-	issueIndex, issueErr := createIssue(job, issueContent, conf)
+	issueIndex, issueErr := createIssue(ctx, job, issueContent, conf)
+	if issueErr != nil {
+		metrics.issueFailures.inc("")
+	}
 	issueURL, _ := url.Parse(GetGINURL(conf))
 	issueURL.Path = path.Join(conf.XMLRepo, "issues", fmt.Sprintf("%d", issueIndex))
 	if issueErr == nil {
@@ -143,7 +168,7 @@ func notifyAdmin(job *RegistrationJob, errors, warnings []string, fullinfo bool,
 	} else {
 		body = fmt.Sprintf("%s\n\n%s", body, issueErr.Error())
 	}
-	mailErr := sendMail(recipients, subject, body, conf)
+	mailErr := sendMail(ctx, recipients, subject, body, conf)
 	if issueErr != nil && mailErr != nil {
 		// both failed; return error to let the user know that the request failed
 		// The underlying errors are already logged
@@ -154,7 +179,7 @@ func notifyAdmin(job *RegistrationJob, errors, warnings []string, fullinfo bool,
 
 // notifyUser prepares an email notification to the user that successfully
 // submitted a request.
-func notifyUser(job *RegistrationJob) error {
+func notifyUser(ctx context.Context, job *RegistrationJob) error {
 	doi := job.Metadata.Identifier.ID
 	conf := job.Config
 	repopath := job.Metadata.SourceRepository
@@ -173,49 +198,80 @@ func notifyUser(job *RegistrationJob) error {
 	subject := fmt.Sprintf("DOI registration request: %s", repopath)
 	message := fmt.Sprintf(msgSubmitSuccessEmail, name, repourl, doi)
 
-	return sendMail(recipients, subject, message, conf)
+	return sendMail(ctx, recipients, subject, message, conf)
+}
+
+// requesterName returns the real name of the user that requested the DOI of
+// a job, or the username if the real name is not available.
+func requesterName(rec JobRecord) string {
+	user := rec.Metadata.RequestingUser
+	if user == nil {
+		return ""
+	}
+	if user.RealName != "" {
+		return user.RealName
+	}
+	return user.Username
+}
+
+// notifyRequester sends an email about the DOI request of a job to the user
+// that requested it. The repository name is appended to the subject.
+func notifyRequester(ctx context.Context, conf *Configuration, rec JobRecord, subject, body string) error {
+	user := rec.Metadata.RequestingUser
+	if user == nil || user.Email == "" {
+		return fmt.Errorf("no email address for the requester of %q", rec.Metadata.Identifier.ID)
+	}
+	subject = fmt.Sprintf("%s: %s", subject, rec.Metadata.SourceRepository)
+	return sendMail(ctx, []string{user.Email}, subject, body, conf)
 }
 
 // sendMail sends an email with a given subject and body. The supplied
 // configuration specifies the server to use, the from address, and a file that
-// lists the addresses of the recipients.
-func sendMail(to []string, subject, body string, conf *Configuration) error {
+// lists the addresses of the recipients. Sending is aborted if the context is
+// done or the mail timeout of the configuration is exceeded.
+func sendMail(ctx context.Context, to []string, subject, body string, conf *Configuration) (err error) {
+	defer func() {
+		if err != nil {
+			metrics.mailFailures.inc("")
+		}
+	}()
 	if conf.Email.Server == "" {
-		log.Printf("Fake mail body: %s", body)
+		logger(ctx).Info("Fake mail", "subject", subject, "body", body)
 		return nil
 	}
-	log.Print("Preparing mail")
-	c, err := smtp.Dial(conf.Email.Server)
+	logger(ctx).Debug("Preparing mail")
+	c, done, err := dialMail(ctx, conf)
 	if err != nil {
-		log.Print("Could not reach server")
+		logger(ctx).Error("Could not reach mail server", "error", err.Error())
 		return err
 	}
+	defer done()
 	defer c.Close()
 	// Set the sender and recipient.
 	err = c.Mail(conf.Email.From)
 	if err != nil {
 		// Missing sender is not too bad, log but carry on.
-		log.Printf("Error: Could not add mail sender: %q", err.Error())
+		logger(ctx).Warn("Could not add mail sender", "error", err.Error())
 	}
 
 	message := fmt.Sprintf("From: %s\nSubject: %s", conf.Email.From, subject)
 	if len(to) > 0 {
 		for _, address := range to {
 			address = strings.TrimSpace(address)
-			log.Printf("To: %s", address)
+			logger(ctx).Debug("Adding mail recipient", "to", address)
 			err = c.Rcpt(address)
 			if err != nil {
 				// Log but continue in case other recipients work out.
-				log.Printf("Error: Could not add mail recipient: %q", err.Error())
+				logger(ctx).Warn("Could not add mail recipient", "error", err.Error())
 			}
 			message = fmt.Sprintf("%s\nTo: %s", message, address)
 		}
 	} else {
-		log.Print("Potential error: Mail server configured but no recipients specified.")
-		log.Printf("Notifying %q", DEFAULTTO)
+		logger(ctx).Warn("Mail server configured but no recipients specified")
+		logger(ctx).Info("Notifying default recipient", "to", DEFAULTTO)
 		err = c.Rcpt(DEFAULTTO)
 		if err != nil {
-			log.Printf("Error: Could not add mail recipient: %q", err.Error())
+			logger(ctx).Warn("Could not add mail recipient", "error", err.Error())
 			return err
 		}
 		message = fmt.Sprintf("%s\nTo: %s", message, DEFAULTTO)
@@ -224,84 +280,112 @@ func sendMail(to []string, subject, body string, conf *Configuration) error {
 
 	message = fmt.Sprintf("%s\n\n%s", message, body)
 	// Send the email body.
-	log.Print("Sending mail")
+	logger(ctx).Info("Sending mail", "subject", subject)
 
 	wc, err := c.Data()
 	if err != nil {
-		log.Print("Could not write mail")
+		logger(ctx).Error("Could not write mail", "error", err.Error())
 		return err
 	}
 	defer wc.Close()
 	buf := bytes.NewBufferString(message)
 	if _, err = buf.WriteTo(wc); err != nil {
-		log.Print("Could not write mail")
+		logger(ctx).Error("Could not write mail", "error", err.Error())
 	}
-	log.Print("sendMail Done")
+	logger(ctx).Debug("Mail sent")
 	return nil
 }
 
+// dialMail connects to the configured mail server. The connection is closed
+// when the context is done or the mail timeout of the configuration is
+// exceeded, which aborts any SMTP command in progress. The returned function
+// releases the connection watch once the client is no longer used.
+func dialMail(ctx context.Context, conf *Configuration) (*smtp.Client, context.CancelFunc, error) {
+	var cancel context.CancelFunc
+	if conf.Timeouts.Mail > 0 {
+		ctx, cancel = context.WithTimeout(ctx, conf.Timeouts.Mail)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", conf.Email.Server)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	host, _, err := net.SplitHostPort(conf.Email.Server)
+	if err != nil {
+		host = conf.Email.Server
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return c, cancel, nil
+}
+
 // createIssue creates a new issue on the configured XMLRepo repository or
 // updates an existing one if the title matches.
 // Returns the Index of the new issue created.
-func createIssue(job *RegistrationJob, content string, conf *Configuration) (int64, error) {
+func createIssue(ctx context.Context, job *RegistrationJob, content string, conf *Configuration) (int64, error) {
 	repopath := job.Metadata.SourceRepository
 	doi := job.Metadata.Identifier.ID
 	xmlrepo := job.Config.XMLRepo
-	log.Printf("Opening issue on %s", xmlrepo)
+	logger(ctx).Info("Opening issue", "repo", xmlrepo)
 	title := fmt.Sprintf("New publication request: %s (%s)", repopath, doi)
-	client := job.Config.GIN.Session
 
 	if xmlrepo == "" {
-		log.Printf("Issue content body: %s", content)
+		logger(ctx).Info("No XML repository configured; not opening issue", "body", content)
 		return 0, nil
 	}
 
-	var resp *http.Response
+	var status int
+	var respBody []byte
 	var posterr error
 	var existingIssue int64
-	if issueID, err := getIssueID(client, xmlrepo, title); err == nil {
-		if issueID > 0 {
-			// Issue exists: Add comment
-			path := fmt.Sprintf("api/v1/repos/%s/issues/%d/comments", xmlrepo, issueID)
-			data := gogs.CreateIssueCommentOption{Body: content}
-			resp, posterr = client.Post(path, data)
-			existingIssue = issueID
-		} else {
-			// Create new issue
-			path := fmt.Sprintf("api/v1/repos/%s/issues", xmlrepo)
-			data := gogs.CreateIssueOption{
-				Title: title,
-				Body:  content,
-			}
-			resp, posterr = client.Post(path, data)
+	issueID, err := getIssueID(ctx, conf, xmlrepo, title)
+	if err != nil && ctx.Err() != nil {
+		return -1, err
+	}
+	if issueID > 0 {
+		// Issue exists: Add comment
+		path := fmt.Sprintf("api/v1/repos/%s/issues/%d/comments", xmlrepo, issueID)
+		data := gogs.CreateIssueCommentOption{Body: content}
+		status, respBody, posterr = ginRequest(ctx, conf, http.MethodPost, path, data)
+		existingIssue = issueID
+	} else {
+		// Create new issue
+		path := fmt.Sprintf("api/v1/repos/%s/issues", xmlrepo)
+		data := gogs.CreateIssueOption{
+			Title: title,
+			Body:  content,
 		}
+		status, respBody, posterr = ginRequest(ctx, conf, http.MethodPost, path, data)
 	}
 	if posterr != nil {
-		log.Printf("Failed to create issue or comment on XML repo: %s", posterr.Error())
+		logger(ctx).Error("Failed to create issue or comment on XML repo", "error", posterr.Error())
 		return -1, posterr
-	} else if resp.StatusCode != http.StatusCreated {
-		var errmsg string
-		msg, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			errmsg = fmt.Sprintf("Failed to open issue on XML repo: [%d] failed to read response body: %s", resp.StatusCode, err.Error())
-		} else {
-			errmsg = fmt.Sprintf("Failed to create issue or comment on XML repo: [%d] %s", resp.StatusCode, msg)
-		}
-		log.Print(errmsg)
+	} else if status != http.StatusCreated {
+		errmsg := fmt.Sprintf("Failed to create issue or comment on XML repo: [%d] %s", status, respBody)
+		logger(ctx).Error(errmsg)
 		return -1, fmt.Errorf(errmsg)
 	}
 	if existingIssue > 0 {
 		return existingIssue, nil
 	}
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Issue creation succeeded, but failed to read response body: %s", err.Error())
-	}
 
 	newIssue := new(gogs.Issue)
 	err = json.Unmarshal(respBody, newIssue)
 	if err != nil {
-		log.Printf("Issue creation succeeded, but failed to unmarshal response: %s", err.Error())
+		logger(ctx).Warn("Issue creation succeeded, but failed to unmarshal response", "error", err.Error())
 		// ignoring error since creation succeeded
 		return -1, nil
 	}
@@ -310,38 +394,29 @@ func createIssue(job *RegistrationJob, content string, conf *Configuration) (int
 
 // getIssueID returns the ID for an issue on a given repo that matches the
 // given title. It returns 0 if no issue matching the title is found.
-func getIssueID(client *ginclient.Client, repo, title string) (int64, error) {
+func getIssueID(ctx context.Context, conf *Configuration, repo, title string) (int64, error) {
 	path := fmt.Sprintf("api/v1/repos/%s/issues", repo)
-	resp, err := client.Get(path)
+	status, content, err := ginRequest(ctx, conf, http.MethodGet, path, nil)
 	if err != nil {
 		// log the error and return with -1 and a new issue will be created
-		log.Printf("Failed to get issues for repository %s: %s", repo, err.Error())
+		logger(ctx).Error("Failed to get issues", "repo", repo, "error", err.Error())
 		return -1, err
-	} else if resp.StatusCode != http.StatusOK {
+	} else if status != http.StatusOK {
 		// log the error and return with -1 and a new issue will be created
-		if msg, err := ioutil.ReadAll(resp.Body); err == nil {
-			log.Printf("Failed to get issues for repository %s: [%d] %s", repo, resp.StatusCode, msg)
-		} else {
-			log.Printf("Failed to get issues for repository %s: [%d] failed to read response body: %s", repo, resp.StatusCode, err.Error())
-		}
-		return -1, err
+		logger(ctx).Error("Failed to get issues", "repo", repo, "status", status, "response", string(content))
+		return -1, nil
 	}
 
 	var issues []gogs.Issue
-	content, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Failed to get issues for repository %s: %s", repo, err.Error())
-		return -1, err
-	}
 
 	if err := json.Unmarshal(content, &issues); err != nil {
-		log.Printf("Failed to get issues for repository %s: failed to unmarshal response: %s", repo, err.Error())
+		logger(ctx).Error("Failed to unmarshal issues", "repo", repo, "error", err.Error())
 		return -1, err
 	}
 
 	for _, issue := range issues {
 		if strings.EqualFold(issue.Title, title) {
-			log.Printf("Found issue matching %s: %d", title, issue.Index)
+			logger(ctx).Info("Found matching issue", "title", title, "issue", issue.Index)
 			return issue.ID, nil
 		}
 	}
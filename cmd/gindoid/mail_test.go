@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/G-Node/libgin/libgin"
 )
@@ -26,7 +28,7 @@ func TestNotifyAdminContent(t *testing.T) {
 	noissuestxt := "no issues have been found"
 
 	// A) Test 'no issues' subject and body
-	body, subj := notifyAdminContent(testjob, errlist, warnlist, full, chash)
+	body, subj := notifyAdminContent(context.Background(), testjob, errlist, warnlist, full, chash)
 	if subj != subjbase {
 		t.Fatalf("Unexpected subject: %q", subj)
 	}
@@ -41,7 +43,7 @@ func TestNotifyAdminContent(t *testing.T) {
 
 	erritem := "An error was found"
 	errlist = append(errlist, erritem)
-	body, subj = notifyAdminContent(testjob, errlist, warnlist, full, chash)
+	body, subj = notifyAdminContent(context.Background(), testjob, errlist, warnlist, full, chash)
 	if subj != subjbase {
 		t.Fatalf("Unexpected subject: %q", subj)
 	}
@@ -56,7 +58,7 @@ func TestNotifyAdminContent(t *testing.T) {
 	warnitem := "An error was found"
 	warnlist = append(warnlist, warnitem)
 	warnlist = append(warnlist, warnitem)
-	body, subj = notifyAdminContent(testjob, errlist, warnlist, full, chash)
+	body, subj = notifyAdminContent(context.Background(), testjob, errlist, warnlist, full, chash)
 	if subj != subjbase {
 		t.Fatalf("Unexpected subject: %q", subj)
 	}
@@ -68,7 +70,7 @@ func TestNotifyAdminContent(t *testing.T) {
 
 	// Test 'errors' and 'warnings' subject and body
 	errlist = append(errlist, erritem)
-	body, subj = notifyAdminContent(testjob, errlist, warnlist, full, chash)
+	body, subj = notifyAdminContent(context.Background(), testjob, errlist, warnlist, full, chash)
 	if subj != subjbase {
 		t.Fatalf("Unexpected subject: %q", subj)
 	}
@@ -78,18 +80,27 @@ func TestNotifyAdminContent(t *testing.T) {
 		t.Fatalf("Error missing in body: %q", body)
 	}
 
+	// Test annex download statistics in the body
+	testjob.Download = &downloadStats{Files: 3, Bytes: 2048, Duration: 2 * time.Second, Retried: []string{"data/flaky.dat"}}
+	body, _ = notifyAdminContent(context.Background(), testjob, nil, nil, full, chash)
+	if !strings.Contains(body, "Annex content download") || !strings.Contains(body, "Downloaded 3 annex files (2.0 KiB) in 2s at 1.0 KiB/s") ||
+		!strings.Contains(body, "data/flaky.dat") {
+		t.Fatalf("Download statistics missing in body: %q", body)
+	}
+	testjob.Download = nil
+
 	// C) Test 'full' notification subject and Body
 	errlist = []string{}
 	warnlist = []string{}
 	full = true
 
 	// test no panic on empty entries
-	_, _ = notifyAdminContent(testjob, errlist, warnlist, full, chash)
+	_, _ = notifyAdminContent(context.Background(), testjob, errlist, warnlist, full, chash)
 
 	// test id in subject
 	sourcerepo := "source_repo"
 	testjob.Metadata.SourceRepository = sourcerepo
-	_, subj = notifyAdminContent(testjob, errlist, warnlist, full, chash)
+	_, subj = notifyAdminContent(context.Background(), testjob, errlist, warnlist, full, chash)
 	if !strings.HasPrefix(subj, subjbase) || !strings.Contains(subj, sourcerepo) {
 		t.Fatalf("Unexpected subject: %q", subj)
 	}
@@ -97,8 +108,29 @@ func TestNotifyAdminContent(t *testing.T) {
 	// test urljoin
 	testjob.Config.Storage.StoreURL = "https://storage_url.org/"
 	testjob.Metadata.Identifier.ID = "/job/id"
-	body, _ = notifyAdminContent(testjob, errlist, warnlist, full, chash)
+	body, _ = notifyAdminContent(context.Background(), testjob, errlist, warnlist, full, chash)
 	if !strings.Contains(body, "new DOI registration") || !strings.Contains(body, "DOI target URL: https://storage_url.org/job/id") {
 		t.Fatalf("Unexpected body: %q", body)
 	}
+
+	// test requested revision and commit link
+	if !strings.Contains(body, "Requested revision: master") || !strings.Contains(body, "Commit hash: unknown") {
+		t.Fatalf("Unexpected revision in body: %q", body)
+	}
+	testjob.Ref = "v1.0"
+	chash = "0123456789abcdef0123456789abcdef01234567"
+	body, _ = notifyAdminContent(context.Background(), testjob, errlist, warnlist, full, chash)
+	if !strings.Contains(body, "Requested revision: v1.0") || !strings.Contains(body, "/commit/"+chash+")") {
+		t.Fatalf("Unexpected revision in body: %q", body)
+	}
+
+	// test re-run note on follow up notification only
+	testjob.Retry = RetryZip
+	if strings.Contains(body, "re-run") {
+		t.Fatalf("Unexpected re-run note in initial notification: %q", body)
+	}
+	body, _ = notifyAdminContent(context.Background(), testjob, nil, nil, false, chash)
+	if !strings.Contains(body, `re-run from stage "zip"`) || !strings.Contains(body, noissuestxt) {
+		t.Fatalf("Unexpected re-run body: %q", body)
+	}
 }
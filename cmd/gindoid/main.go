@@ -25,7 +25,7 @@ func setUpCommands(verstr string) *cobra.Command {
 		Version:               fmt.Sprintln(verstr),
 		DisableFlagsInUseLine: true,
 	}
-	cmds := make([]*cobra.Command, 8)
+	cmds := make([]*cobra.Command, 10)
 	cmds[0] = &cobra.Command{
 		Use:                   "start",
 		Short:                 "Start the GIN DOI service",
@@ -146,6 +146,50 @@ additionally try to fetch dataset 'title' and 'authors' from the corresponding G
 	}
 	cmds[7].Flags().StringP("config", "c", "", "[OPTIONAL] config yaml file")
 	cmds[7].Flags().StringP("out", "o", "", "[OPTIONAL] output file directory; must exist")
+	cmds[8] = &cobra.Command{
+		Use:   "publish <doi>",
+		Short: "Publish a prepared and reviewed DOI dataset",
+		Long: `Publish a prepared and reviewed DOI dataset.
+
+The publication runs the steps of the DOI registration checklist for a dataset 
+prepared by the DOI service: it checks that the repository has been forked to the 
+DOI GIN user, which has to be done manually, tags the release, recreates the landing page from the doi.xml file, registers the DOI at 
+DataCite (if configured), unlocks the landing page, adds the doi.xml file to the 
+XML repository and regenerates the index, keyword and sitemap pages.
+
+The command uses the same environment configuration as the service. It approves 
+the dataset via the admin interface of the running service, which requires the 
+admin credentials, and waits for the service to publish it; this is the same as 
+approving the dataset in the admin interface. The command exits with a non-zero 
+status if the dataset could not be published. By default the service is expected 
+at the configured port on localhost; a different service URL can be provided using 
+the optional '-s' argument.`,
+		Args:                  cobra.ExactArgs(1),
+		Run:                   clipublish,
+		Version:               verstr,
+		DisableFlagsInUseLine: true,
+	}
+	cmds[8].Flags().StringP("service", "s", "", "[OPTIONAL] URL of the running DOI service")
+	cmds[9] = &cobra.Command{
+		Use:   "make-bag <source directory> <xml file>",
+		Short: "Package a dataset directory as BagIt bag",
+		Long: `Package a dataset directory as BagIt bag.
+
+The command creates a BagIt bag containing all files of the source directory except 
+the '.git' directory as payload. The bag information is populated from the DataCite 
+metadata of the XML file; the command accepts an XML file path or URL. The bag is 
+named after the DOI of the XML file or the source directory, if the XML file does 
+not contain a DOI.
+
+By default the bag is created as directory. Using the optional '-z' argument, 
+the bag is created as zip file instead.`,
+		Args:                  cobra.ExactArgs(2),
+		Run:                   clibag,
+		Version:               verstr,
+		DisableFlagsInUseLine: true,
+	}
+	cmds[9].Flags().StringP("out", "o", "", "[OPTIONAL] output file directory; must exist")
+	cmds[9].Flags().BoolP("zip", "z", false, "[OPTIONAL] create the bag as zip file")
 
 	rootCmd.AddCommand(cmds...)
 	return rootCmd
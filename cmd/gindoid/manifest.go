@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// manifestfname is the name of the manifest file inside a dataset archive.
+const manifestfname = "MANIFEST.json"
+
+// manifestEntry describes a file in a dataset archive.
+type manifestEntry struct {
+	// Path of the file in the archive
+	Path string `json:"path"`
+	// Size of the file content in bytes
+	Size int64 `json:"size"`
+	// SHA256 is the hex encoded SHA-256 checksum of the file content
+	SHA256 string `json:"sha256"`
+	// AnnexKey is the git annex key of the file, if the file is annexed
+	AnnexKey string `json:"annex_key,omitempty"`
+	// Part is the file name of the archive part containing the file, if the
+	// archive is split into multiple parts
+	Part string `json:"part,omitempty"`
+}
+
+// manifestName returns the file name of the manifest stored next to an
+// archive.
+func manifestName(zipfilename string) string {
+	return trimArchiveExt(zipfilename) + ".manifest.json"
+}
+
+// checksumName returns the file name of the checksum file stored next to an
+// archive.
+func checksumName(zipfilename string) string {
+	return zipfilename + ".sha256"
+}
+
+// marshalManifest returns the JSON representation of a manifest.
+func marshalManifest(manifest []manifestEntry) ([]byte, error) {
+	return json.MarshalIndent(manifest, "", "  ")
+}
+
+// addManifest writes the manifest to an archive as manifestfname. If the
+// archive already contains a file with the same name, the manifest is not
+// added; it is still available next to the archive.
+func addManifest(ctx context.Context, aw archiveWriter, manifest []manifestEntry) error {
+	for _, entry := range manifest {
+		if entry.Path == manifestfname {
+			logger(ctx).Warn("Archive contains a manifest file; not adding the manifest", "file", manifestfname)
+			return nil
+		}
+	}
+	data, err := marshalManifest(manifest)
+	if err != nil {
+		return err
+	}
+	w, err := aw.create(archiveEntry{Path: manifestfname, Size: int64(len(data)), Mode: 0644, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// writeManifest writes the manifest and the SHA-256 checksum of an archive
+// next to the archive file.
+func writeManifest(zipfilename string, manifest []manifestEntry, checksum string) error {
+	if err := writeManifestFile(zipfilename, manifest); err != nil {
+		return err
+	}
+	return writeChecksum(zipfilename, checksum)
+}
+
+// writeManifestFile writes the manifest of an archive next to the archive
+// file.
+func writeManifestFile(zipfilename string, manifest []manifestEntry) error {
+	data, err := marshalManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(manifestName(zipfilename), data, 0666); err != nil {
+		return fmt.Errorf("failed to write manifest: %s", err.Error())
+	}
+	return nil
+}
+
+// writeChecksum writes the SHA-256 checksum of an archive next to the archive
+// file. The checksum file uses the sha256sum format, so downloads can be
+// verified with 'sha256sum -c'.
+func writeChecksum(zipfilename string, checksum string) error {
+	sumline := fmt.Sprintf("%s  %s\n", checksum, filepath.Base(zipfilename))
+	if err := ioutil.WriteFile(checksumName(zipfilename), []byte(sumline), 0666); err != nil {
+		return fmt.Errorf("failed to write checksum file: %s", err.Error())
+	}
+	return nil
+}
+
+// readArchiveChecksum returns the SHA-256 checksum of an archive from the
+// checksum file next to it. Returns an empty string if the checksum file
+// does not exist or cannot be read.
+func readArchiveChecksum(ctx context.Context, zipfilename string) string {
+	data, err := ioutil.ReadFile(checksumName(zipfilename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger(ctx).Error("Failed to read archive checksum", "error", err.Error())
+		}
+		return ""
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// annexKeys returns the git annex keys of all annexed files of the
+// repository at repodir mapped by their path relative to the repository root.
+// If the keys cannot be determined, the error is logged and an empty map is
+// returned.
+func annexKeys(ctx context.Context, repodir string) map[string]string {
+	keys := make(map[string]string)
+	stdout, stderr, err := remoteGitCMD(ctx, repodir, true, "find", "--include=*", "--format=${file}\t${key}\n")
+	if err != nil {
+		logger(ctx).Error("Failed to list annex keys", "error", err.Error(), "stderr", stderr)
+		return keys
+	}
+	for _, line := range strings.Split(stdout, "\n") {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			continue
+		}
+		keys[parts[0]] = parts[1]
+	}
+	return keys
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/G-Node/libgin/libgin"
+)
+
+func TestRunzipManifest(t *testing.T) {
+	root := t.TempDir()
+	source := filepath.Join(root, "repo")
+	if err := os.MkdirAll(filepath.Join(source, "data"), 0777); err != nil {
+		t.Fatalf("Error creating source directory: %s", err.Error())
+	}
+	files := map[string]string{
+		"README.md":     "readme",
+		"data/file.raw": "some data",
+	}
+	for fname, content := range files {
+		if err := os.WriteFile(filepath.Join(source, fname), []byte(content), 0666); err != nil {
+			t.Fatalf("Error writing file: %s", err.Error())
+		}
+	}
+	// annexed file that is still a symlink
+	linkkey := "SHA256E-s4--abcdef.raw"
+	linktarget := fmt.Sprintf("../.git/annex/objects/xx/yy/%s/%s", linkkey, linkkey)
+	if err := os.Symlink(linktarget, filepath.Join(source, "data", "link.raw")); err != nil {
+		t.Fatalf("Error creating symlink: %s", err.Error())
+	}
+
+	zipfilename := filepath.Join(root, "target", "10.12751_g-node.manif1.zip")
+	if err := os.MkdirAll(filepath.Dir(zipfilename), 0777); err != nil {
+		t.Fatalf("Error creating target directory: %s", err.Error())
+	}
+	keys := map[string]string{"data/file.raw": "SHA256E-s9--123456.raw"}
+	progress := func(JobState, string) {}
+	if _, err := runzip(context.Background(), source, zipfilename, ArchiveZip, nil, 0, nil, keys, progress); err != nil {
+		t.Fatalf("Error creating zip file: %s", err.Error())
+	}
+
+	// manifest next to the archive
+	data, err := os.ReadFile(manifestName(zipfilename))
+	if err != nil {
+		t.Fatalf("Error reading manifest: %s", err.Error())
+	}
+	var manifest []manifestEntry
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("Error reading manifest: %s", err.Error())
+	}
+	if len(manifest) != 3 {
+		t.Fatalf("Unexpected number of manifest entries: %v", manifest)
+	}
+	entries := make(map[string]manifestEntry)
+	for _, entry := range manifest {
+		entries[entry.Path] = entry
+	}
+	for fname, content := range files {
+		entry, ok := entries[fname]
+		if !ok {
+			t.Fatalf("Missing manifest entry for %q", fname)
+		}
+		sum := sha256.Sum256([]byte(content))
+		if entry.Size != int64(len(content)) || entry.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Fatalf("Unexpected manifest entry: %+v", entry)
+		}
+		if entry.AnnexKey != keys[fname] {
+			t.Fatalf("Unexpected annex key: %+v", entry)
+		}
+	}
+	if entry := entries["data/link.raw"]; entry.AnnexKey != linkkey {
+		t.Fatalf("Unexpected annex key for symlink: %+v", entry)
+	}
+
+	// archive checksum
+	zipdata, err := os.ReadFile(zipfilename)
+	if err != nil {
+		t.Fatalf("Error reading zip file: %s", err.Error())
+	}
+	zipsum := sha256.Sum256(zipdata)
+	checksum := readArchiveChecksum(context.Background(), zipfilename)
+	if checksum != hex.EncodeToString(zipsum[:]) {
+		t.Fatalf("Unexpected archive checksum: %q", checksum)
+	}
+	sumline, err := os.ReadFile(checksumName(zipfilename))
+	if err != nil || !strings.HasSuffix(string(sumline), "  10.12751_g-node.manif1.zip\n") {
+		t.Fatalf("Unexpected checksum file content %q: %v", sumline, err)
+	}
+
+	// manifest inside the archive
+	zipreader, err := zip.OpenReader(zipfilename)
+	if err != nil {
+		t.Fatalf("Error opening zip file: %s", err.Error())
+	}
+	defer zipreader.Close()
+	var found bool
+	for _, file := range zipreader.File {
+		if file.Name != manifestfname {
+			continue
+		}
+		found = true
+		fp, err := file.Open()
+		if err != nil {
+			t.Fatalf("Error opening archived manifest: %s", err.Error())
+		}
+		archived, err := io.ReadAll(fp)
+		fp.Close()
+		if err != nil || string(archived) != string(data) {
+			t.Fatalf("Archived manifest differs from manifest file: %q", archived)
+		}
+	}
+	if !found {
+		t.Fatal("Manifest missing in archive")
+	}
+
+	// missing checksum file
+	if checksum := readArchiveChecksum(context.Background(), filepath.Join(root, "missing.zip")); checksum != "" {
+		t.Fatalf("Unexpected checksum of missing archive: %q", checksum)
+	}
+}
+
+func TestLandingPageChecksum(t *testing.T) {
+	targetdir := t.TempDir()
+	metadata := new(libgin.RepositoryMetadata)
+	datacite := libgin.NewDataCite()
+	metadata.DataCite = &datacite
+	metadata.Identifier.ID = "10.12751/g-node.manif1"
+	metadata.Titles = []string{"Test title"}
+	metadata.RightsList = []libgin.Rights{{Name: "CC-BY", URL: "https://creativecommons.org/licenses/by/4.0/"}}
+	metadata.ResourceType.Value = "Dataset"
+	checksum := strings.Repeat("ab", 32)
+
+	landingpage := filepath.Join(targetdir, "index.html")
+	if err := createLandingPage(context.Background(), metadata, landingpage, ""); err != nil {
+		t.Fatalf("Error creating landing page: %s", err.Error())
+	}
+	page, _ := os.ReadFile(landingpage)
+	if strings.Contains(string(page), "Archive SHA-256") {
+		t.Fatal("Unexpected archive checksum without checksum file")
+	}
+
+	zipfilename := filepath.Join(targetdir, archiveName(metadata.Identifier.ID, ArchiveZip))
+	if err := os.WriteFile(zipfilename, []byte("archive"), 0666); err != nil {
+		t.Fatalf("Error writing archive: %s", err.Error())
+	}
+	if err := writeManifest(zipfilename, nil, checksum); err != nil {
+		t.Fatalf("Error writing manifest: %s", err.Error())
+	}
+	if err := createLandingPage(context.Background(), metadata, landingpage, ""); err != nil {
+		t.Fatalf("Error creating landing page: %s", err.Error())
+	}
+	page, _ = os.ReadFile(landingpage)
+	if !strings.Contains(string(page), checksum) || !strings.Contains(string(page), "10.12751_g-node.manif1.manifest.json") {
+		t.Fatalf("Archive checksum missing on landing page")
+	}
+}
@@ -2,7 +2,7 @@ package main
 
 const (
 	msgInvalidRequest    = `Invalid request data received.  Please note that requests should only be submitted through repository pages on <a href="https://gin.g-node.org">GIN</a>.  If you followed the instructions in the <a href="https://gin.g-node.org/G-Node/Info/wiki/DOIfile">DOI registration guide</a> and arrived at this error page, please <a href="mailto:gin@g-node.org">contact us</a> for assistance.`
-	msgInvalidDOI        = `The DOI file is missing in the <b>master</b> branch or not valid.<br>See the messages below for specific issues with the provided data.<br>Also, please see <a href="https://gin.g-node.org/G-Node/Info/wiki/DOIfile">the DOI guide</a> for detailed instructions.`
+	msgInvalidDOI        = `The DOI file is missing in the revision <b>%s</b> or not valid.<br>See the messages below for specific issues with the provided data.<br>Also, please see <a href="https://gin.g-node.org/G-Node/Info/wiki/DOIfile">the DOI guide</a> for detailed instructions.`
 	msgInvalidURI        = "Please provide a valid repository URI"
 	msgAlreadyRegistered = `<div class="content">
 								<div class="header"> A DOI is already registered for your dataset.</div>
@@ -13,10 +13,11 @@ const (
 	msgServerIsArchiving = `<div class="content">
 			<div class="header">The DOI server has started archiving your repository.</div>
 		We have reserved the following DOI for your dataset:<br>
-		<div class="ui label label-default">%s</div><br>
+		<div class="ui label label-default">%[1]s</div><br>
 		An email has been sent containing the above information to your registered address on GIN.<br>
 		Please note that the registration process includes a manual curation step. It may therefore take up to two work days until the DOI is available. If any changes to the repository should be necessary you will be contacted by the curation team.<br>
 		We will notify you via email once the process is finished.<br>
+		You can follow the preparation of your dataset on the <a href="/status/%[1]s">request status page</a>.<br>
 		<div class="ui tabs divider"> </div>
 		<b>This page can safely be closed. You do not need to keep it open.</b>
 		</div>
@@ -30,6 +31,32 @@ Please note that the registration process includes a manual curation step. It ma
 We will notify you via email once the process is finished.
 
 If you would like to make any changes to the dataset before it is published, or if you have any questions or concerns, feel free to contact us at gin@g-node.org.
+`
+	msgChangesRequestedEmail = `Dear %s,
+
+The curation team has reviewed your request to publish the GIN repository %s with the DOI %s.
+Before the dataset can be published, we kindly ask you to apply the following changes to the repository:
+
+%s
+
+Once the changes are done, please reply to this email or contact us at gin@g-node.org and we will prepare your dataset again.
+`
+	msgRejectedEmail = `Dear %s,
+
+The curation team has reviewed your request to publish the GIN repository %s with the DOI %s.
+Unfortunately, we cannot publish the dataset for the following reason:
+
+%s
+
+The reserved DOI will not be registered. If you have any questions or concerns, feel free to contact us at gin@g-node.org.
+`
+	msgPublishedEmail = `Dear %s,
+
+Your dataset from the GIN repository %s has been published with the DOI %s.
+The landing page of your dataset is available at %s
+
+Please note that it may take a few hours until the DOI resolves at doi.org.
+If you have any questions or concerns, feel free to contact us at gin@g-node.org.
 `
 	msgNotLoggedIn      = `You are not logged in with the gin service. Login <a href="http://gin.g-node.org/">here</a>`
 	msgNoToken          = "No authentication token provided"
@@ -38,15 +65,16 @@ If you would like to make any changes to the dataset before it is published, or
 	msgNoAuthors        = `No <b>authors</b> provided.`
 	msgInvalidAuthors   = "Not all authors valid. Please provide at least a last name and a first name."
 	msgNoDescription    = `No <b>description</b> provided.`
-	msgNoMaster         = "Could not access the repository <b>master</b> branch. DOI requests require the master branch of the requesting repository."
+	msgNoRevision       = "Could not access the revision <b>%s</b> of the repository. DOI requests require an existing branch, tag or commit of the requesting repository."
 	msgNoLicense        = `No valid <b>license</b> provided. Please specify a license URL and name and make sure it matches the license file in the repository.`
-	msgNoLicenseFile    = `The LICENSE file is missing in the required <b>master</b> branch. The full text of the license is required to be in the repository when publishing.<br>See the <a href="https://gin.g-node.org/G-Node/Info/wiki/Licensing">Licensing</a> help page for details and links to recommended data licenses.`
+	msgNoLicenseFile    = `The LICENSE file is missing in the revision <b>%s</b>. The full text of the license is required to be in the repository when publishing.<br>See the <a href="https://gin.g-node.org/G-Node/Info/wiki/Licensing">Licensing</a> help page for details and links to recommended data licenses.`
 	msgLicenseMismatch  = `The LICENSE file does not match the license specified in the metadata. See the <a href="https://gin.g-node.org/G-Node/Info/wiki/Licensing">Licensing</a> help page for links to full text for available licenses.`
 	msgInvalidReference = `Not all <b>Reference</b> entries are valid. Please provide the full citation and type of the reference.`
 	msgBadEncoding      = `There was an issue with the content of the DOI file (datacite.yml). This might mean that the encoding is wrong. Please see <a href="https://gin.g-node.org/G-Node/Info/wiki/DOIfile">the DOI guide</a> for detailed instructions or contact gin@g-node.org for assistance.`
 
 	msgSubmitError     = "An internal error occurred while we were processing your request.  The G-Node team has been notified of the problem and will attempt to repair it and process your request.  We may contact you for further information regarding your request.  Feel free to <a href=mailto:gin@g-node.org>contact us</a> if you would like to provide more information or ask about the status of your request."
 	msgSubmitFailed    = "An internal error occurred while we were processing your request.  Your request was not submitted and the service failed to notify the G-Node team.  Please <a href=mailto:gin@g-node.org>contact us</a> to report this error."
+	msgServiceShutdown = "The DOI service is currently restarting and cannot accept new requests.  Please try again in a few minutes.  Feel free to <a href=mailto:gin@g-node.org>contact us</a> if the problem persists."
 	msgNoTemplateError = "An internal error occurred while we were processing your request.  The G-Node team has been notified of the problem and will attempt to repair it and process your request.  We may contact you for further information regarding your request.  Feel free to contact us at gin@g-node.org if you would like to provide more information or ask about the status of your request."
 	// Log Prefixes
 	lpAuth    = "GinOAP"
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics collects the service metrics that are exposed in the Prometheus
+// text format at the /metrics endpoint.
+var metrics = newServiceMetrics()
+
+// serviceMetrics holds the counters and histograms updated by the
+// registration jobs. Gauges describing the current state of the queue and the
+// workers are read when the metrics are requested.
+type serviceMetrics struct {
+	stageDuration      *histogramVec
+	jobsFinished       *counterVec
+	cloneBytes         *counterVec
+	cloneSeconds       *counterVec
+	downloadBytes      *counterVec
+	downloadSeconds    *counterVec
+	archiveBytes       *counterVec
+	archiveSeconds     *counterVec
+	archiveSize        *histogramVec
+	mailFailures       *counterVec
+	issueFailures      *counterVec
+	validationFailures *counterVec
+}
+
+func newServiceMetrics() *serviceMetrics {
+	return &serviceMetrics{
+		stageDuration:      newHistogramVec("gindoid_job_stage_duration_seconds", "Duration of the registration job stages.", "stage", []float64{1, 10, 60, 300, 900, 1800, 3600, 7200, 14400, 43200, 86400}),
+		jobsFinished:       newCounterVec("gindoid_jobs_finished_total", "Registration jobs processed by the workers by result.", "result"),
+		cloneBytes:         newCounterVec("gindoid_clone_bytes_total", "Size of the cloned git repositories.", ""),
+		cloneSeconds:       newCounterVec("gindoid_clone_seconds_total", "Time spent cloning git repositories.", ""),
+		downloadBytes:      newCounterVec("gindoid_annex_download_bytes_total", "Size of the downloaded annex content.", ""),
+		downloadSeconds:    newCounterVec("gindoid_annex_download_seconds_total", "Time spent downloading annex content.", ""),
+		archiveBytes:       newCounterVec("gindoid_archive_bytes_total", "Size of the created dataset archives.", ""),
+		archiveSeconds:     newCounterVec("gindoid_archive_seconds_total", "Time spent creating dataset archives.", ""),
+		archiveSize:        newHistogramVec("gindoid_archive_size_bytes", "Size of the created dataset archives.", "", []float64{1e6, 1e7, 1e8, 1e9, 1e10, 1e11, 1e12}),
+		mailFailures:       newCounterVec("gindoid_mail_failures_total", "Notification emails that could not be sent.", ""),
+		issueFailures:      newCounterVec("gindoid_issue_failures_total", "Notification issues that could not be created on the XML repository.", ""),
+		validationFailures: newCounterVec("gindoid_validation_failures_total", "Failed registration request validations by message type.", "type"),
+	}
+}
+
+// write writes all collected metrics to w in the Prometheus text format.
+func (m *serviceMetrics) write(w io.Writer) {
+	m.stageDuration.write(w)
+	m.jobsFinished.write(w)
+	m.cloneBytes.write(w)
+	m.cloneSeconds.write(w)
+	m.downloadBytes.write(w)
+	m.downloadSeconds.write(w)
+	m.archiveBytes.write(w)
+	m.archiveSeconds.write(w)
+	m.archiveSize.write(w)
+	m.mailFailures.write(w)
+	m.issueFailures.write(w)
+	m.validationFailures.write(w)
+}
+
+// counterVec is a counter with an optional label. Counters without a label
+// use the empty label value.
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	label  string
+	values map[string]float64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+// add adds v to the counter with the given label value.
+func (c *counterVec) add(label string, v float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[label] += v
+}
+
+// inc increments the counter with the given label value.
+func (c *counterVec) inc(label string) {
+	c.add(label, 1)
+}
+
+// get returns the current value of the counter with the given label value.
+func (c *counterVec) get(label string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[label]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatValue(c.values[""]))
+		return
+	}
+	for _, lv := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, formatLabel(c.label, lv), formatValue(c.values[lv]))
+	}
+}
+
+// histogramVec is a histogram with an optional label.
+type histogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+// observe adds a value to the histogram with the given label value.
+func (h *histogramVec) observe(label string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, ok := h.series[label]
+	if !ok {
+		series = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[label] = series
+	}
+	for idx, upper := range h.buckets {
+		if v <= upper {
+			series.counts[idx]++
+		}
+	}
+	series.sum += v
+	series.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	labels := make([]string, 0, len(h.series))
+	for lv := range h.series {
+		labels = append(labels, lv)
+	}
+	sort.Strings(labels)
+	for _, lv := range labels {
+		series := h.series[lv]
+		prefix := ""
+		if h.label != "" {
+			prefix = formatLabel(h.label, lv) + ","
+		}
+		for idx, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, prefix, formatValue(upper), series.counts[idx])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, series.count)
+		labelset := ""
+		if h.label != "" {
+			labelset = "{" + formatLabel(h.label, lv) + "}"
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelset, formatValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelset, series.count)
+	}
+}
+
+// writeGauges writes a gauge with one value per label value.
+func writeGauges(w io.Writer, name, help, label string, values map[string]float64) {
+	writeHeader(w, name, help, "gauge")
+	for _, lv := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, formatLabel(label, lv), formatValue(values[lv]))
+	}
+}
+
+// writeGauge writes a gauge without labels.
+func writeGauge(w io.Writer, name, help string, value float64) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", name, formatValue(value))
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabel(label, value string) string {
+	return fmt.Sprintf("%s=\"%s\"", label, labelEscaper.Replace(value))
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// stageTimer measures the duration of the stages of a registration job. A
+// stage ends when the job enters the next stage or the timer is finished.
+type stageTimer struct {
+	stage JobState
+	start time.Time
+}
+
+// track returns a progressFunc that records the stage changes before passing
+// the progress events on to the provided progressFunc.
+func (t *stageTimer) track(progress progressFunc) progressFunc {
+	return func(state JobState, msg string) {
+		if state != t.stage {
+			t.finish()
+			t.stage = state
+			t.start = time.Now()
+		}
+		progress(state, msg)
+	}
+}
+
+// finish records the duration of the current stage.
+func (t *stageTimer) finish() {
+	if t.stage == "" {
+		return
+	}
+	metrics.stageDuration.observe(string(t.stage), time.Since(t.start).Seconds())
+	t.stage = ""
+}
+
+// validationType returns a short label for a datacite.yml validation message
+// for the validation failure metric.
+func validationType(msg string) string {
+	switch msg {
+	case msgNoTitle:
+		return "no_title"
+	case msgNoAuthors:
+		return "no_authors"
+	case msgInvalidAuthors:
+		return "invalid_authors"
+	case msgNoDescription:
+		return "no_description"
+	case msgNoLicense:
+		return "no_license"
+	case msgInvalidReference:
+		return "invalid_reference"
+	}
+	switch {
+	case strings.HasPrefix(msg, "<strong>ResourceType</strong>"):
+		return "invalid_resourcetype"
+	case strings.HasPrefix(msg, "Reference type"):
+		return "invalid_reftype"
+	}
+	return "other"
+}
+
+// serveMetrics writes the service metrics in the Prometheus text format.
+// The queue and worker gauges are read from the job queue, the dispatcher
+// and the job store.
+func serveMetrics(w http.ResponseWriter, jobQueue chan *RegistrationJob, dispatcher *Dispatcher, conf *Configuration) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeGauge(w, "gindoid_queue_length", "Registration jobs waiting for a worker.", float64(dispatcher.queued()))
+	writeGauge(w, "gindoid_queue_capacity", "Capacity of the job queue.", float64(cap(jobQueue)))
+	writeGauge(w, "gindoid_workers", "Number of registration workers.", float64(dispatcher.maxWorkers))
+	writeGauge(w, "gindoid_workers_busy", "Number of workers processing a registration job.", float64(dispatcher.running.count()))
+
+	if conf.Jobs != nil {
+		now := time.Now()
+		jobs := make(map[string]float64, len(jobStates))
+		oldest := make(map[string]float64)
+		for _, state := range jobStates {
+			jobs[string(state)] = 0
+		}
+		for _, rec := range conf.Jobs.List() {
+			state := string(rec.State)
+			jobs[state]++
+			if rec.State.Finished() {
+				continue
+			}
+			if age := now.Sub(rec.Updated).Seconds(); age > oldest[state] {
+				oldest[state] = age
+			}
+		}
+		writeGauges(w, "gindoid_jobs", "Registration jobs in the job store by state.", "state", jobs)
+		writeGauges(w, "gindoid_oldest_job_age_seconds", "Time since the last state change of the oldest unfinished job by state.", "state", oldest)
+	}
+	metrics.write(w)
+}
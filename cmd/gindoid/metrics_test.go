@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/G-Node/libgin/libgin"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	counter := newCounterVec("test_total", "Test counter.", "type")
+	counter.inc("b")
+	counter.add("a", 2.5)
+	counter.inc(`quo"te`)
+	hist := newHistogramVec("test_seconds", "Test histogram.", "stage", []float64{1, 10})
+	hist.observe("cloning", 0.5)
+	hist.observe("cloning", 5)
+	hist.observe("cloning", 50)
+	plain := newCounterVec("test_plain_total", "Unlabelled counter.", "")
+
+	var buf bytes.Buffer
+	counter.write(&buf)
+	hist.write(&buf)
+	plain.write(&buf)
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{type="a"} 2.5
+test_total{type="b"} 1
+test_total{type="quo\"te"} 1
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{stage="cloning",le="1"} 1
+test_seconds_bucket{stage="cloning",le="10"} 2
+test_seconds_bucket{stage="cloning",le="+Inf"} 3
+test_seconds_sum{stage="cloning"} 55.5
+test_seconds_count{stage="cloning"} 3
+# HELP test_plain_total Unlabelled counter.
+# TYPE test_plain_total counter
+test_plain_total 0
+`
+	if buf.String() != expected {
+		t.Fatalf("Unexpected metrics output:\n%s", buf.String())
+	}
+}
+
+func TestValidationType(t *testing.T) {
+	for msg, expected := range map[string]string{
+		msgNoTitle:          "no_title",
+		msgInvalidAuthors:   "invalid_authors",
+		msgInvalidReference: "invalid_reference",
+		"<strong>ResourceType</strong> must be one of the following: Dataset": "invalid_resourcetype",
+		"Reference type (<strong>RefType</strong>) must be one of":            "invalid_reftype",
+		"something else": "other",
+	} {
+		if vtype := validationType(msg); vtype != expected {
+			t.Fatalf("Unexpected validation type %q for %q", vtype, msg)
+		}
+	}
+
+	before := metrics.validationFailures.get("no_title")
+	// only the validation of registration requests is counted
+	validateDataCite(&libgin.RepositoryYAML{})
+	if _, err := readAndValidate(new(Configuration), "owner/repo", "master"); err == nil {
+		t.Fatal("Unexpected validation of an unreachable repository")
+	}
+	if metrics.validationFailures.get("no_revision") == 0 || metrics.validationFailures.get("no_datacite") == 0 {
+		t.Fatal("Validation failures of an unreachable repository were not counted")
+	}
+	if metrics.validationFailures.get("no_title") != before {
+		t.Fatal("Validation failures counted outside of a registration request")
+	}
+}
+
+func TestStageTimer(t *testing.T) {
+	var states []JobState
+	timer := new(stageTimer)
+	progress := timer.track(func(state JobState, msg string) {
+		states = append(states, state)
+	})
+	before := stageCount(JobCloning)
+	progress(JobCloning, "cloning repository")
+	progress(JobCloning, "checking out")
+	if stageCount(JobCloning) != before {
+		t.Fatal("Stage duration recorded before the stage ended")
+	}
+	progress(JobZipping, "creating archive")
+	if stageCount(JobCloning) != before+1 {
+		t.Fatal("Stage duration not recorded on stage change")
+	}
+	zipping := stageCount(JobZipping)
+	timer.finish()
+	timer.finish()
+	if stageCount(JobZipping) != zipping+1 {
+		t.Fatal("Stage duration not recorded once on finish")
+	}
+	if len(states) != 3 {
+		t.Fatalf("Progress events not passed on: %v", states)
+	}
+}
+
+func stageCount(stage JobState) uint64 {
+	metrics.stageDuration.mu.Lock()
+	defer metrics.stageDuration.mu.Unlock()
+	if series, ok := metrics.stageDuration.series[string(stage)]; ok {
+		return series.count
+	}
+	return 0
+}
+
+func TestServeMetrics(t *testing.T) {
+	conf := &Configuration{}
+	store, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf.Jobs = store
+	queued := testJob("10.12751/g-node.qqqqq1", "owner/queuedrepo", conf)
+	failed := testJob("10.12751/g-node.fffff2", "owner/failedrepo", conf)
+	for _, job := range []*RegistrationJob{queued, failed} {
+		if err := store.Add(job); err != nil {
+			t.Fatalf("Error adding job: %q", err.Error())
+		}
+	}
+	setJobState(failed, JobFailed, "")
+
+	jobQueue := make(chan *RegistrationJob, 5)
+	jobQueue <- queued
+	dispatcher := newDispatcher(jobQueue, 3)
+	// a job taken from the queue that waits for a worker
+	dispatcher.waiting.Add(1)
+	dispatcher.running.add(failed)
+	defer dispatcher.running.remove(failed)
+
+	w := httptest.NewRecorder()
+	serveMetrics(w, jobQueue, dispatcher, conf)
+	body := w.Body.String()
+	for _, expected := range []string{
+		"gindoid_queue_length 2\n",
+		"gindoid_queue_capacity 5\n",
+		"gindoid_workers 3\n",
+		"gindoid_workers_busy 1\n",
+		`gindoid_jobs{state="queued"} 1` + "\n",
+		`gindoid_jobs{state="failed"} 1` + "\n",
+		`gindoid_jobs{state="running"} 0` + "\n",
+		`gindoid_oldest_job_age_seconds{state="queued"} `,
+		"# TYPE gindoid_job_stage_duration_seconds histogram\n",
+		"# TYPE gindoid_mail_failures_total counter\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Metrics are missing %q:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, `gindoid_oldest_job_age_seconds{state="failed"}`) {
+		t.Fatal("Finished jobs are reported as unfinished")
+	}
+}
+
+func TestMailFailureMetric(t *testing.T) {
+	conf := &Configuration{}
+	conf.Email.Server = "127.0.0.1:1"
+	before := metrics.mailFailures.get("")
+	if err := sendMail(context.Background(), []string{"user@example.com"}, "subject", "body", conf); err == nil {
+		t.Fatal("Unexpected mail sent to an unreachable server")
+	}
+	if metrics.mailFailures.get("") != before+1 {
+		t.Fatal("Mail failure was not counted")
+	}
+
+	// mails are not sent without a configured server
+	conf.Email.Server = ""
+	if err := sendMail(context.Background(), nil, "subject", "body", conf); err != nil {
+		t.Fatalf("Unexpected error without mail server: %s", err.Error())
+	}
+	if metrics.mailFailures.get("") != before+1 {
+		t.Fatal("Mail without server was counted as failure")
+	}
+}
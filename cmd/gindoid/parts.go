@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// archivePart describes a file of a dataset archive. Archives that are split
+// into multiple parts consist of one independent archive file per part.
+type archivePart struct {
+	// Name is the file name of the part
+	Name string
+	// Size of the part in bytes
+	Size int64
+	// Checksum is the hex encoded SHA-256 checksum of the part
+	Checksum string
+}
+
+// HumanSize returns the size of the part in human readable form.
+func (part archivePart) HumanSize() string {
+	return humanize.IBytes(uint64(part.Size))
+}
+
+// partName returns the file name of the part with the given number of the
+// archive zipfilename.
+func partName(zipfilename string, format ArchiveFormat, number int) string {
+	return fmt.Sprintf("%s.part%03d%s", trimArchiveExt(zipfilename), number, format.extension())
+}
+
+// planParts distributes all files found under the source directory to parts
+// of at most partsize bytes and returns the source-relative file paths of each
+// part. Files are never split; a file larger than partsize is placed in a part
+// of its own. Directories and files specified via the exclude parameter
+// relative to the source directory are ignored.
+func planParts(source string, exclude []string, partsize int64) ([][]string, error) {
+	parts := make([][]string, 0)
+	var current []string
+	var currentsize int64
+	walker := func(fname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relpath, err := filepath.Rel(source, fname)
+		if err != nil {
+			return err
+		}
+		for i := range exclude {
+			if exclude[i] == relpath {
+				return filepath.SkipDir
+			}
+		}
+		if fi.Mode().IsDir() {
+			return nil
+		}
+		size := fi.Size()
+		if fi.Mode()&os.ModeSymlink != 0 {
+			// locked annex files are archived with the annex object content
+			if target, err := os.Readlink(fname); err == nil {
+				if objinfo, ok := annexObject(fname, target); ok {
+					size = objinfo.Size()
+				}
+			}
+		}
+		if len(current) > 0 && currentsize+size > partsize {
+			parts = append(parts, current)
+			current, currentsize = nil, 0
+		}
+		current = append(current, relpath)
+		currentsize += size
+		return nil
+	}
+	if err := filepath.Walk(source, walker); err != nil {
+		return nil, fmt.Errorf("error listing files of %s: %s", source, err.Error())
+	}
+	if len(current) > 0 {
+		parts = append(parts, current)
+	}
+	return parts, nil
+}
+
+// writeParts writes each planned part of the source directory as an
+// independent archive of the given format, named after zipfilename with a part number, and returns the written
+// parts. The checksum of each part is written next to the part; the manifest
+// of all parts is written next to the parts as for single archives.
+func writeParts(ctx context.Context, source string, plan [][]string, zipfilename string, format ArchiveFormat, stored []string, exclude []string, annexKeys map[string]string, progress progressFunc) ([]archivePart, error) {
+	parts := make([]archivePart, 0, len(plan))
+	manifest := make([]manifestEntry, 0)
+	added := zipProgress(progress)
+	for idx, files := range plan {
+		partfilename := partName(zipfilename, format, idx+1)
+		progress(JobZipping, fmt.Sprintf("creating archive part %d of %d", idx+1, len(plan)))
+		part, partmanifest, err := writePart(ctx, partfilename, source, files, format, stored, exclude, annexKeys, added)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write archive part %d: %s", idx+1, err.Error())
+		}
+		for _, entry := range partmanifest {
+			entry.Part = part.Name
+			manifest = append(manifest, entry)
+		}
+		parts = append(parts, part)
+	}
+	if err := writeManifestFile(zipfilename, manifest); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// writePart writes the source-relative files of a single part to
+// partfilename and returns the part and its manifest.
+func writePart(ctx context.Context, partfilename string, source string, files []string, format ArchiveFormat, stored []string, exclude []string, annexKeys map[string]string, added func(manifestEntry)) (archivePart, []manifestEntry, error) {
+	part := archivePart{Name: filepath.Base(partfilename)}
+	partfp, err := os.Create(partfilename)
+	if err != nil {
+		return part, nil, fmt.Errorf("failed to create archive file: %s", err.Error())
+	}
+	defer partfp.Close()
+
+	hasher := sha256.New()
+	aw, err := newArchiveWriter(io.MultiWriter(partfp, hasher), format, stored)
+	if err != nil {
+		return part, nil, err
+	}
+	manifest, err := makeArchive(ctx, aw, source, exclude, annexKeys, added, true, files...)
+	if err != nil {
+		return part, nil, err
+	}
+	part.Checksum = hex.EncodeToString(hasher.Sum(nil))
+	if err := writeChecksum(partfilename, part.Checksum); err != nil {
+		return part, nil, err
+	}
+	stat, err := partfp.Stat()
+	if err != nil {
+		return part, nil, fmt.Errorf("failed to read archive file size: %s", err.Error())
+	}
+	part.Size = stat.Size()
+	return part, manifest, nil
+}
+
+// archiveFiles returns the file names of all dataset archives and archive
+// parts of a job in targetpath in any archive format.
+func archiveFiles(ctx context.Context, jobname string, targetpath string) []string {
+	base := filepath.Join(targetpath, strings.ReplaceAll(jobname, "/", "_"))
+	fnames := make([]string, 0)
+	for _, ext := range archiveExtensions() {
+		if _, err := os.Stat(base + ext); err == nil {
+			fnames = append(fnames, filepath.Base(base+ext))
+		}
+		matches, err := filepath.Glob(base + ".part[0-9]*" + ext)
+		if err != nil {
+			logger(ctx).Error("Failed to list archive parts", "error", err.Error())
+			continue
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			fnames = append(fnames, filepath.Base(match))
+		}
+	}
+	return fnames
+}
+
+// findArchives returns the dataset archive of a job in targetpath
+// independent of its archive format. If the archive is split into multiple
+// parts, all parts are returned. Returns nil if there is no archive.
+func findArchives(ctx context.Context, jobname string, targetpath string) []archivePart {
+	base := strings.ReplaceAll(jobname, "/", "_")
+	var parts []archivePart
+	var partext string
+	for _, fname := range archiveFiles(ctx, jobname, targetpath) {
+		stat, err := os.Stat(filepath.Join(targetpath, fname))
+		if err != nil {
+			continue
+		}
+		part := archivePart{Name: fname, Size: stat.Size(), Checksum: readArchiveChecksum(ctx, filepath.Join(targetpath, fname))}
+		ext := strings.TrimPrefix(fname, base)
+		if !strings.HasPrefix(ext, ".part") {
+			// a single archive takes precedence
+			return []archivePart{part}
+		}
+		ext = strings.TrimLeft(strings.TrimPrefix(ext, ".part"), "0123456789")
+		if partext != "" && ext != partext {
+			// parts of an archive in a different format
+			continue
+		}
+		partext = ext
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// removeArchives removes the dataset archives and archive parts of a job in
+// targetpath and their checksum files, except for the archive files to keep.
+func removeArchives(ctx context.Context, targetpath string, jobname string, keep []archivePart) {
+	for _, fname := range archiveFiles(ctx, jobname, targetpath) {
+		kept := false
+		for _, part := range keep {
+			kept = kept || part.Name == fname
+		}
+		if kept {
+			continue
+		}
+		zipfilename := filepath.Join(targetpath, fname)
+		for _, rmname := range []string{zipfilename, checksumName(zipfilename)} {
+			if err := os.Remove(rmname); err != nil && !os.IsNotExist(err) {
+				logger(ctx).Error("Failed to remove archive", "error", err.Error())
+			}
+		}
+	}
+}
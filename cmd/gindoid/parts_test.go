@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/G-Node/libgin/libgin"
+)
+
+// partSource creates a source directory with files of the given sizes named
+// in walk order.
+func partSource(t *testing.T, sizes ...int) string {
+	files := make(map[string]string, len(sizes))
+	for idx, size := range sizes {
+		fname := string(rune('a'+idx)) + ".dat"
+		if idx == len(sizes)-1 {
+			fname = "sub/z.dat"
+		}
+		files[fname] = strings.Repeat("x", size)
+	}
+	return writeSourceFiles(t, files)
+}
+
+func TestPlanParts(t *testing.T) {
+	source := partSource(t, 40, 40, 30, 150, 10)
+	plan, err := planParts(source, nil, 100)
+	if err != nil {
+		t.Fatalf("Error planning parts: %s", err.Error())
+	}
+	// a+b fit together, c does not fit next to them, d exceeds the part
+	// size on its own, sub/z.dat follows separately
+	expected := [][]string{{"a.dat", "b.dat"}, {"c.dat"}, {"d.dat"}, {"sub/z.dat"}}
+	if len(plan) != len(expected) {
+		t.Fatalf("Unexpected number of parts: %v", plan)
+	}
+	for idx := range expected {
+		if len(plan[idx]) != len(expected[idx]) {
+			t.Fatalf("Unexpected part %d: %v", idx, plan[idx])
+		}
+		for fidx, fname := range expected[idx] {
+			if filepath.ToSlash(plan[idx][fidx]) != fname {
+				t.Fatalf("Unexpected file in part %d: %q", idx, plan[idx][fidx])
+			}
+		}
+	}
+
+	// excluded directories
+	plan, err = planParts(source, []string{"sub"}, 1000)
+	if err != nil || len(plan) != 1 || len(plan[0]) != 4 {
+		t.Fatalf("Unexpected plan with excluded directory: %v %v", plan, err)
+	}
+}
+
+func TestRunzipParts(t *testing.T) {
+	source := partSource(t, 40, 40, 30, 150, 10)
+	targetdir := t.TempDir()
+	progress := func(JobState, string) {}
+	jobname := "10.12751/g-node.part01"
+	zipfilename := filepath.Join(targetdir, archiveName(jobname, ArchiveZip))
+	parts, err := runzip(context.Background(), source, zipfilename, ArchiveZip, nil, 100, nil, nil, progress)
+	if err != nil {
+		t.Fatalf("Error creating archive parts: %s", err.Error())
+	}
+	if len(parts) != 4 {
+		t.Fatalf("Unexpected number of parts: %v", parts)
+	}
+	if _, err := os.Stat(zipfilename); !os.IsNotExist(err) {
+		t.Fatal("Unexpected single archive next to the parts")
+	}
+
+	archived := make(map[string]string)
+	for idx, part := range parts {
+		if part.Name != filepath.Base(partName(zipfilename, ArchiveZip, idx+1)) {
+			t.Fatalf("Unexpected part name %q", part.Name)
+		}
+		if checksum := readArchiveChecksum(context.Background(), filepath.Join(targetdir, part.Name)); checksum == "" || checksum != part.Checksum {
+			t.Fatalf("Unexpected checksum of part %q: %q", part.Name, checksum)
+		}
+		zipreader, err := zip.OpenReader(filepath.Join(targetdir, part.Name))
+		if err != nil {
+			t.Fatalf("Error opening part: %s", err.Error())
+		}
+		for _, file := range zipreader.File {
+			if file.Name != manifestfname {
+				archived[file.Name] = part.Name
+			}
+		}
+		zipreader.Close()
+	}
+	if len(archived) != 5 || archived["a.dat"] != archived["b.dat"] || archived["c.dat"] == archived["a.dat"] {
+		t.Fatalf("Unexpected distribution of files to parts: %v", archived)
+	}
+
+	// combined manifest
+	data, err := os.ReadFile(manifestName(zipfilename))
+	if err != nil {
+		t.Fatalf("Error reading manifest: %s", err.Error())
+	}
+	var manifest []manifestEntry
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("Error reading manifest: %s", err.Error())
+	}
+	if len(manifest) != 5 {
+		t.Fatalf("Unexpected number of manifest entries: %v", manifest)
+	}
+	for _, entry := range manifest {
+		if entry.Part != archived[entry.Path] {
+			t.Fatalf("Unexpected part in manifest entry: %+v", entry)
+		}
+	}
+
+	// archive lookup
+	found := findArchives(context.Background(), jobname, targetdir)
+	if len(found) != 4 {
+		t.Fatalf("Unexpected archive parts found: %v", found)
+	}
+	for idx := range found {
+		if found[idx] != parts[idx] {
+			t.Fatalf("Unexpected archive part found: %+v", found[idx])
+		}
+	}
+
+	// a single archive replaces the parts
+	single, err := runzip(context.Background(), source, zipfilename, ArchiveZip, nil, 0, nil, nil, progress)
+	if err != nil || len(single) != 1 {
+		t.Fatalf("Unexpected single archive: %v %v", single, err)
+	}
+	removeArchives(context.Background(), targetdir, jobname, single)
+	if files := archiveFiles(context.Background(), jobname, targetdir); len(files) != 1 || files[0] != single[0].Name {
+		t.Fatalf("Unexpected archive files after removal: %v", files)
+	}
+	if _, err := os.Stat(checksumName(filepath.Join(targetdir, parts[0].Name))); !os.IsNotExist(err) {
+		t.Fatal("Checksum file of removed part still exists")
+	}
+}
+
+func TestLandingPageParts(t *testing.T) {
+	targetdir := t.TempDir()
+	metadata := new(libgin.RepositoryMetadata)
+	datacite := libgin.NewDataCite()
+	metadata.DataCite = &datacite
+	metadata.Identifier.ID = "10.12751/g-node.part02"
+	metadata.Titles = []string{"Test title"}
+	metadata.RightsList = []libgin.Rights{{Name: "CC-BY", URL: "https://creativecommons.org/licenses/by/4.0/"}}
+	metadata.ResourceType.Value = "Dataset"
+	metadata.Sizes = &[]string{"14 B", "10.12751_g-node.part02.part001.tar.gz: 7 B", "10.12751_g-node.part02.part002.tar.gz: 7 B"}
+
+	checksum := strings.Repeat("cd", 32)
+	for idx := 1; idx <= 2; idx++ {
+		partfilename := partName(filepath.Join(targetdir, archiveName(metadata.Identifier.ID, ArchiveTarGz)), ArchiveTarGz, idx)
+		if err := os.WriteFile(partfilename, []byte("archive"), 0666); err != nil {
+			t.Fatalf("Error writing part: %s", err.Error())
+		}
+		if err := writeChecksum(partfilename, checksum); err != nil {
+			t.Fatalf("Error writing checksum: %s", err.Error())
+		}
+	}
+
+	landingpage := filepath.Join(targetdir, "index.html")
+	if err := createLandingPage(context.Background(), metadata, landingpage, ""); err != nil {
+		t.Fatalf("Error creating landing page: %s", err.Error())
+	}
+	page, _ := os.ReadFile(landingpage)
+	for _, expected := range []string{
+		"in 2 parts (14 B in total)",
+		`href="10.12751_g-node.part02.part001.tar.gz"`,
+		`href="10.12751_g-node.part02.part002.tar.gz"`,
+		"10.12751_g-node.part02.part002.tar.gz (7 B)",
+		checksum,
+	} {
+		if !strings.Contains(string(page), expected) {
+			t.Fatalf("Missing %q on landing page", expected)
+		}
+	}
+	if strings.Contains(string(page), "DOWNLOAD ARCHIVE") {
+		t.Fatal("Unexpected single archive download on landing page")
+	}
+}
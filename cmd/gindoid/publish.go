@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// xmlrepodir is the name of the directory below the preparation directory
+// holding the local clone of the XMLRepo.
+const xmlrepodir = "xmlrepo"
+
+// publishStep is a single step of the publication of a prepared dataset.
+type publishStep struct {
+	Name string
+	Run  func(ctx context.Context, conf *Configuration, rec JobRecord) error
+	// Shared marks steps that change files shared by all publications; they
+	// are run while holding sharedMu.
+	Shared bool
+}
+
+// publishSteps lists all steps required to publish a prepared dataset after
+// it has been approved by the curators, in order. The landing page and the
+// archive are only unlocked once the DOI is registered, so they stay private
+// if an earlier step fails.
+var publishSteps = []publishStep{
+	{Name: "checking repository fork", Run: checkFork},
+	{Name: "tagging release", Run: tagRelease},
+	{Name: "creating landing page", Run: publishLandingPage},
+	{Name: "registering DOI", Run: registerDOI},
+	{Name: "unlocking landing page", Run: unlockLandingPage},
+	{Name: "updating XML repository", Run: updateXMLRepo, Shared: true},
+	{Name: "updating index, keyword and sitemap pages", Run: updateIndex, Shared: true},
+}
+
+// sharedMu serialises the publication steps that change the clone of the
+// XMLRepo and the index, keyword and sitemap pages, which are shared by all
+// publications.
+var sharedMu sync.Mutex
+
+// run runs the publication step, holding sharedMu for shared steps.
+func (step publishStep) run(ctx context.Context, conf *Configuration, rec JobRecord) error {
+	if step.Shared {
+		sharedMu.Lock()
+		defer sharedMu.Unlock()
+	}
+	return step.Run(ctx, conf, rec)
+}
+
+// approveJob marks the job with the provided DOI as being published. The
+// state is checked and changed in one step, so a job approved twice is only
+// published once. A *jobStateError is returned if the job cannot be
+// published.
+func approveJob(conf *Configuration, doi string) (JobRecord, error) {
+	return conf.Jobs.Transition(doi, JobState.Reviewable, JobPublishing, "approved")
+}
+
+// publishApproved runs all publication steps for the prepared dataset of an
+// approved job and notifies the requester once the dataset is published. The
+// job state is updated along the way; if a step fails, the job is marked as
+// failed to publish and the error is returned. The publication is aborted if
+// the context is done.
+func publishApproved(ctx context.Context, conf *Configuration, rec JobRecord) error {
+	doi := rec.Metadata.Identifier.ID
+	ctx = withLogger(ctx, logger(ctx).With("doi", doi, "repository", rec.Metadata.SourceRepository))
+
+	for _, step := range publishSteps {
+		logger(ctx).Info("Publishing", "step", step.Name)
+		conf.Jobs.SetProgress(doi, step.Name)
+		if err := step.run(ctx, conf, rec); err != nil {
+			err = fmt.Errorf("%s failed: %s", step.Name, err.Error())
+			logger(ctx).Error("Failed to publish", "error", err.Error())
+			if serr := conf.Jobs.SetState(doi, JobPublishFailed, err.Error()); serr != nil {
+				logger(ctx).Error("Failed to update job", "error", serr.Error())
+			}
+			return err
+		}
+	}
+
+	if err := conf.Jobs.SetState(doi, JobPublished, ""); err != nil {
+		logger(ctx).Error("Failed to update job", "error", err.Error())
+	}
+	setReservationState(conf, doi, ReservationPublished)
+	logger(ctx).Info("Published")
+	cleanPublished(ctx, conf, doi)
+
+	landingURL, err := landingPageURL(conf, doi)
+	if err != nil {
+		landingURL = doi
+	}
+	err = notifyRequester(ctx, conf, rec, "DOI registration published", fmt.Sprintf(msgPublishedEmail, requesterName(rec), rec.Metadata.SourceRepository, doi, landingURL))
+	if err != nil {
+		logger(ctx).Error("Failed to notify requester", "error", err.Error())
+	}
+	return nil
+}
+
+// publications keeps track of the publications running in the background, so
+// the service can wait for them to finish before it shuts down.
+type publications struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+// add registers a new publication. Returns false if the service is shutting
+// down and no publications may be started.
+func (p *publications) add() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return false
+	}
+	p.wg.Add(1)
+	return true
+}
+
+// done marks a publication as finished.
+func (p *publications) done() {
+	p.wg.Done()
+}
+
+// stop prevents new publications and waits up to the timeout for the running
+// publications to finish. Returns false if publications are still running
+// when the timeout is reached.
+func (p *publications) stop(timeout time.Duration) bool {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	return waitTimeout(&p.wg, timeout)
+}
+
+// unlockLandingPage removes the .htaccess file that denies access to the
+// landing page and the archive of a prepared dataset.
+func unlockLandingPage(_ context.Context, conf *Configuration, rec JobRecord) error {
+	fname := filepath.Join(conf.Storage.TargetDirectory, rec.Metadata.Identifier.ID, ".htaccess")
+	err := os.Remove(fname)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// publishLandingPage re-creates the landing page of a dataset from the
+// doi.xml file, which may have been edited by the curators.
+func publishLandingPage(ctx context.Context, conf *Configuration, rec JobRecord) error {
+	doi := rec.Metadata.Identifier.ID
+	contents, err := readFileAtPath(filepath.Join(conf.Storage.TargetDirectory, doi, "doi.xml"))
+	if err != nil {
+		return err
+	}
+	metadata, warnings, err := landingPageMetadata(contents)
+	if err != nil {
+		return fmt.Errorf("failed to read doi.xml: %s", err.Error())
+	}
+	for _, warning := range warnings {
+		logger(ctx).Warn("Incomplete doi.xml", "warning", warning)
+	}
+	if metadata.Identifier.ID != doi {
+		return fmt.Errorf("doi.xml holds DOI %q instead of %q", metadata.Identifier.ID, doi)
+	}
+	return createLandingPage(ctx, metadata, filepath.Join(conf.Storage.TargetDirectory, doi, "index.html"), GetGINURL(conf))
+}
+
+// registerDOI registers the DOI of a dataset at DataCite and records the
+// registration time. The step is skipped if DOI registration via the
+// DataCite API is not configured.
+func registerDOI(ctx context.Context, conf *Configuration, rec JobRecord) error {
+	doi := rec.Metadata.Identifier.ID
+	if conf.DataCite.Username == "" {
+		logger(ctx).Warn("DataCite registration is not configured; the DOI has to be registered manually")
+		return nil
+	}
+	if err := mintDOI(ctx, conf, doi); err != nil {
+		return err
+	}
+	return conf.Jobs.Update(doi, func(rec *JobRecord) {
+		now := time.Now()
+		rec.Registered = &now
+	})
+}
+
+// publishedXMLFiles returns the doi.xml files of all published datasets in
+// the target directory. Datasets whose directory still holds a .htaccess
+// file are not published yet and are skipped.
+func publishedXMLFiles(targetdir string) ([]string, error) {
+	// DOI directories have the form <prefix>/<suffix>
+	xmlfiles, err := filepath.Glob(filepath.Join(targetdir, "*", "*", "doi.xml"))
+	if err != nil {
+		return nil, err
+	}
+	published := make([]string, 0, len(xmlfiles))
+	for _, xmlfile := range xmlfiles {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(xmlfile), ".htaccess")); err == nil {
+			continue
+		}
+		published = append(published, xmlfile)
+	}
+	return published, nil
+}
+
+// updateIndex regenerates the index page, the keyword pages and the sitemap
+// listing all published datasets in the target directory.
+func updateIndex(_ context.Context, conf *Configuration, rec JobRecord) error {
+	xmlfiles, err := publishedXMLFiles(conf.Storage.TargetDirectory)
+	if err != nil {
+		return err
+	}
+	mkindex(xmlfiles, conf.Storage.TargetDirectory)
+	mkkeywords(xmlfiles, conf.Storage.TargetDirectory)
+	mksitemap(xmlfiles, conf.Storage.TargetDirectory)
+	return nil
+}
+
+// forkName returns the name of the fork of the source repository of a job
+// owned by the GIN user of the service.
+func forkName(conf *Configuration, rec JobRecord) string {
+	return path.Join(conf.GIN.Username, path.Base(rec.Metadata.SourceRepository))
+}
+
+// checkFork checks that the source repository of a dataset has been forked to
+// the GIN user of the service and records the fork in the job metadata. The
+// GIN API does not support forking, so the curators fork the repository
+// manually as described in the registration checklist. The step is skipped
+// if there is no GIN session.
+func checkFork(ctx context.Context, conf *Configuration, rec JobRecord) error {
+	if conf.GIN.Session == nil {
+		logger(ctx).Info("No GIN session; skipping repository fork check")
+		return nil
+	}
+	fork := forkName(conf, rec)
+	status, msg, err := ginRequest(ctx, conf, http.MethodGet, fmt.Sprintf("api/v1/repos/%s", fork), nil)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return fmt.Errorf("fork %s does not exist; fork %s to the %s user manually and approve the dataset again", fork, rec.Metadata.SourceRepository, conf.GIN.Username)
+	default:
+		return fmt.Errorf("failed to check fork %s: [%d] %s", fork, status, msg)
+	}
+	logger(ctx).Info("Using fork", "fork", fork)
+	return conf.Jobs.Update(rec.Metadata.Identifier.ID, func(rec *JobRecord) {
+		rec.Metadata.ForkRepository = fork
+	})
+}
+
+// tagRelease creates the DOI tag at the requested commit in the clone of the
+// dataset and pushes the tag and the annex content to the fork. The step is
+// skipped if there is no GIN session.
+func tagRelease(ctx context.Context, conf *Configuration, rec JobRecord) error {
+	client := conf.GIN.Session
+	if client == nil {
+		logger(ctx).Info("No GIN session; skipping release tag")
+		return nil
+	}
+	repodir := cloneDir(&RegistrationJob{Metadata: rec.Metadata, Config: conf})
+	if _, err := os.Stat(repodir); err != nil {
+		return fmt.Errorf("clone of the dataset is not available; re-run the job from the zip stage: %s", err.Error())
+	}
+	remote := fmt.Sprintf("%s/%s.git", client.GitAddress(), forkName(conf, rec))
+	return pushDOITag(ctx, repodir, remote, rec.Metadata.Identifier.ID, rec.CommitHash)
+}
+
+// pushDOITag sets up the 'doi' remote with the provided URL in the git
+// repository, tags the commit (or HEAD if empty) with the DOI and pushes the
+// tag. If the repository uses git annex, the annex content is copied to the
+// remote as well. An existing tag with the same name is replaced.
+func pushDOITag(ctx context.Context, repodir, remoteURL, doi, commit string) error {
+	gitcmd := func(useannex bool, args ...string) error {
+		_, stderr, err := remoteGitCMD(ctx, repodir, useannex, args...)
+		if err != nil {
+			return fmt.Errorf("git %s failed: %s: %s", strings.Join(args, " "), err.Error(), strings.TrimSpace(stderr))
+		}
+		return nil
+	}
+
+	if _, _, err := remoteGitCMD(ctx, repodir, false, "remote", "get-url", "doi"); err == nil {
+		err = gitcmd(false, "remote", "set-url", "doi", remoteURL)
+		if err != nil {
+			return err
+		}
+	} else if err := gitcmd(false, "remote", "add", "doi", remoteURL); err != nil {
+		return err
+	}
+	if commit == "" {
+		commit = "HEAD"
+	}
+	if err := gitcmd(false, "tag", "--force", doi, commit); err != nil {
+		return err
+	}
+	if err := gitcmd(false, "push", "--force", "doi", fmt.Sprintf("refs/tags/%s", doi)); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(repodir, ".git", "annex")); err == nil {
+		logger(ctx).Info("Uploading annex content", "remote", remoteURL)
+		if err := gitcmd(true, "copy", "--all", "--to", "doi"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateXMLRepo adds the doi.xml file of a dataset to the XMLRepo. A local
+// clone of the XMLRepo is kept in the preparation directory. The step is
+// skipped if no XMLRepo is configured or there is no GIN session.
+func updateXMLRepo(ctx context.Context, conf *Configuration, rec JobRecord) error {
+	if conf.XMLRepo == "" || conf.GIN.Session == nil {
+		logger(ctx).Info("No XML repository configured; skipping XML file upload")
+		return nil
+	}
+	doi := rec.Metadata.Identifier.ID
+	xmlfile := filepath.Join(conf.Storage.TargetDirectory, doi, "doi.xml")
+	remote := fmt.Sprintf("%s/%s.git", conf.GIN.Session.GitAddress(), conf.XMLRepo)
+	repodir := filepath.Join(conf.Storage.PreparationDirectory, xmlrepodir)
+	return commitXMLFile(ctx, repodir, remote, xmlfile, doi, conf.GIN.Username)
+}
+
+// commitXMLFile copies the XML file of a DOI into the clone of the XML
+// repository at repodir, commits it and pushes the change to the remote.
+// The clone is created from the remote if it does not exist and is updated
+// before the file is added. The XML file is named after the DOI suffix.
+func commitXMLFile(ctx context.Context, repodir, remoteURL, xmlfile, doi, author string) error {
+	gitcmd := func(dir string, args ...string) error {
+		_, stderr, err := remoteGitCMD(ctx, dir, false, args...)
+		if err != nil {
+			return fmt.Errorf("git %s failed: %s: %s", strings.Join(args, " "), err.Error(), strings.TrimSpace(stderr))
+		}
+		return nil
+	}
+
+	if _, err := os.Stat(repodir); os.IsNotExist(err) {
+		logger(ctx).Info("Cloning XML repository", "remote", remoteURL)
+		if err := gitcmd(filepath.Dir(repodir), "clone", remoteURL, filepath.Base(repodir)); err != nil {
+			return err
+		}
+	} else if err := gitcmd(repodir, "pull", "--ff-only"); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(xmlfile)
+	if err != nil {
+		return err
+	}
+	fname := fmt.Sprintf("%s.xml", path.Base(doi))
+	if err := ioutil.WriteFile(filepath.Join(repodir, fname), data, 0664); err != nil {
+		return err
+	}
+	if err := gitcmd(repodir, "add", fname); err != nil {
+		return err
+	}
+	if stdout, _, _ := remoteGitCMD(ctx, repodir, false, "status", "--porcelain", fname); strings.TrimSpace(stdout) == "" {
+		logger(ctx).Info("XML file is unchanged", "file", fname)
+		return nil
+	}
+	identity := []string{"-c", fmt.Sprintf("user.name=%s", author), "-c", fmt.Sprintf("user.email=%s@gin-doi", author)}
+	if err := gitcmd(repodir, append(identity, "commit", "-m", fmt.Sprintf("Add %s", doi))...); err != nil {
+		return err
+	}
+	return gitcmd(repodir, "push", "origin", "HEAD")
+}
+
+// publishPollInterval is the interval in which the publish command checks
+// the state of the publication.
+const publishPollInterval = 2 * time.Second
+
+// clipublish publishes the prepared dataset of a registration job from the
+// command line. The publication is started via the admin interface of the
+// running service, so the job store of the service remains the only record
+// of the job, and the command waits for the publication to finish. The
+// command exits with a non-zero status if the dataset is not published.
+func clipublish(cmd *cobra.Command, args []string) {
+	doi := args[0]
+	conf, err := loadconfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %s", err.Error())
+	}
+	setupLogging(conf)
+	service, _ := cmd.Flags().GetString("service")
+	if service == "" {
+		service = fmt.Sprintf("http://localhost:%d", conf.Port)
+	}
+
+	log.Printf("Requesting publication of %s from %s", doi, service)
+	if err := requestPublication(service, conf, doi); err != nil {
+		log.Fatalf("Failed to publish %s: %s", doi, err.Error())
+	}
+	state, err := awaitPublication(service, doi, publishPollInterval)
+	if err != nil {
+		log.Fatalf("Failed to publish %s: %s", doi, err.Error())
+	}
+	if state != JobPublished {
+		log.Fatalf("Failed to publish %s: job is %s; see the admin interface for details", doi, state)
+	}
+	fmt.Printf("Published %s\n", doi)
+}
+
+// requestPublication approves the job with the provided DOI via the admin
+// interface of the service at the provided URL, which starts the
+// publication. The admin credentials of the configuration are used.
+func requestPublication(service string, conf *Configuration, doi string) error {
+	if conf.Admin.Password == "" {
+		return fmt.Errorf("the admin interface is disabled; admin credentials are required")
+	}
+	form := url.Values{"doi": {doi}, "action": {reviewApprove}, "csrf": {csrfToken(conf)}}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(service, "/")+"/admin/review", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(conf.Admin.Username, conf.Admin.Password)
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		// the service redirects to the admin page on success
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("service is not reachable: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("[%d] %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// awaitPublication polls the status of the job with the provided DOI at the
+// service until the publication has ended and returns the final job state.
+func awaitPublication(service string, doi string, interval time.Duration) (JobState, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	statusURL := fmt.Sprintf("%s/status/%s?format=json", strings.TrimSuffix(service, "/"), doi)
+	for {
+		resp, err := client.Get(statusURL)
+		if err != nil {
+			return "", fmt.Errorf("service is not reachable: %s", err.Error())
+		}
+		status := new(jobStatusData)
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", fmt.Errorf("failed to read job status: [%d] %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		}
+		err = json.NewDecoder(resp.Body).Decode(status)
+		resp.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to read job status: %s", err.Error())
+		}
+		if status.State != JobPublishing {
+			return status.State, nil
+		}
+		log.Printf("Publishing %s: %s", doi, status.Progress)
+		time.Sleep(interval)
+	}
+}
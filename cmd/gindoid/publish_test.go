@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/G-Node/gin-cli/ginclient"
+	ginweb "github.com/G-Node/gin-cli/web"
+)
+
+func TestPublishDataset(t *testing.T) {
+	doi := "10.12751/g-node.noex1st"
+	conf := dataciteTestConf(t, "", doi)
+	// DataCite registration is skipped without credentials
+	conf.DataCite.Username = ""
+	store, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf.Jobs = store
+
+	job := testJob(doi, "owner/repo", conf)
+	if err := store.Add(job); err != nil {
+		t.Fatalf("Error adding job: %q", err.Error())
+	}
+	publishDataset := func(ctx context.Context, conf *Configuration, doi string) error {
+		rec, err := approveJob(conf, doi)
+		if err != nil {
+			return err
+		}
+		return publishApproved(ctx, conf, rec)
+	}
+
+	// check unreviewable jobs are not published
+	if err := publishDataset(context.Background(), conf, doi); err == nil {
+		t.Fatal("Expected error on publishing a queued job")
+	}
+	if err := publishDataset(context.Background(), conf, "i/do/not/exist"); err == nil {
+		t.Fatal("Expected error on publishing an unknown job")
+	}
+	setJobState(job, JobDone, "")
+
+	// prepared but unpublished dataset that must not be listed on the index
+	otherdir := filepath.Join(conf.Storage.TargetDirectory, "10.12751", "g-node.other1")
+	if err := os.MkdirAll(otherdir, 0777); err != nil {
+		t.Fatalf("Error creating target directory: %q", err.Error())
+	}
+	otherxml := strings.ReplaceAll(validTestDataciteXML, "noex1st", "other1")
+	if err := os.WriteFile(filepath.Join(otherdir, "doi.xml"), []byte(otherxml), 0666); err != nil {
+		t.Fatalf("Error writing doi.xml: %q", err.Error())
+	}
+	for _, dir := range []string{otherdir, filepath.Join(conf.Storage.TargetDirectory, doi)} {
+		if err := os.WriteFile(filepath.Join(dir, ".htaccess"), []byte("deny from all"), 0666); err != nil {
+			t.Fatalf("Error writing .htaccess: %q", err.Error())
+		}
+	}
+
+	if err := publishDataset(context.Background(), conf, doi); err != nil {
+		t.Fatalf("Error publishing dataset: %q", err.Error())
+	}
+	if rec, _ := store.Get(doi); rec.State != JobPublished || rec.Registered != nil {
+		t.Fatalf("Unexpected job state %q or registration %v", rec.State, rec.Registered)
+	}
+	if _, err := os.Stat(filepath.Join(conf.Storage.TargetDirectory, doi, ".htaccess")); !os.IsNotExist(err) {
+		t.Fatal("Landing page was not unlocked")
+	}
+	if _, err := os.Stat(filepath.Join(conf.Storage.TargetDirectory, doi, "index.html")); err != nil {
+		t.Fatalf("Landing page was not created: %q", err.Error())
+	}
+	index, err := os.ReadFile(filepath.Join(conf.Storage.TargetDirectory, "index.html"))
+	if err != nil {
+		t.Fatalf("Index page was not created: %q", err.Error())
+	}
+	if !strings.Contains(string(index), doi) || strings.Contains(string(index), "g-node.other1") {
+		t.Fatalf("Unexpected index page content: %s", string(index))
+	}
+	for _, fname := range []string{"urls.txt", filepath.Join("keywords", "index.html")} {
+		if _, err := os.Stat(filepath.Join(conf.Storage.TargetDirectory, fname)); err != nil {
+			t.Fatalf("Missing %s: %q", fname, err.Error())
+		}
+	}
+
+	// check failing step marks the job and keeps the landing page locked
+	setJobState(job, JobDone, "")
+	htaccess := filepath.Join(conf.Storage.TargetDirectory, doi, ".htaccess")
+	if err := os.WriteFile(htaccess, []byte("deny from all"), 0666); err != nil {
+		t.Fatalf("Error writing .htaccess: %q", err.Error())
+	}
+	conf.DataCite.Username = "repo"
+	conf.DataCite.URL = "http://127.0.0.1:0"
+	if err := publishDataset(context.Background(), conf, doi); err == nil {
+		t.Fatal("Expected error on failing DOI registration")
+	}
+	if rec, _ := store.Get(doi); rec.State != JobPublishFailed {
+		t.Fatalf("Expected failed publication but got %q", rec.State)
+	}
+	if _, err := os.Stat(htaccess); err != nil {
+		t.Fatal("Landing page was unlocked before the DOI was registered")
+	}
+
+	// check an unreadable doi.xml fails the publication before registration
+	setJobState(job, JobDone, "")
+	conf.DataCite.Username = ""
+	xmlfile := filepath.Join(conf.Storage.TargetDirectory, doi, "doi.xml")
+	if err := os.WriteFile(xmlfile, []byte("<resource"), 0666); err != nil {
+		t.Fatalf("Error writing doi.xml: %q", err.Error())
+	}
+	if err := publishDataset(context.Background(), conf, doi); err == nil {
+		t.Fatal("Expected error on invalid doi.xml")
+	}
+	if rec, _ := store.Get(doi); rec.State != JobPublishFailed {
+		t.Fatalf("Expected failed publication but got %q", rec.State)
+	}
+	if _, err := os.Stat(htaccess); err != nil {
+		t.Fatal("Landing page was unlocked without landing page")
+	}
+}
+
+func TestRequestPublication(t *testing.T) {
+	doi := "10.12751/g-node.noex1st"
+	conf := dataciteTestConf(t, "", doi)
+	conf.DataCite.Username = ""
+	conf.Admin.Username = "admin"
+	conf.Admin.Password = "secret"
+	store, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf.Jobs = store
+	job := testJob(doi, "owner/repo", conf)
+	if err := store.Add(job); err != nil {
+		t.Fatalf("Error adding job: %q", err.Error())
+	}
+
+	pubs := new(publications)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/review", func(w http.ResponseWriter, r *http.Request) {
+		reviewJob(w, r, pubs, conf)
+	})
+	mux.HandleFunc("/status/", func(w http.ResponseWriter, r *http.Request) {
+		renderJobStatus(w, r, conf)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// check the service refuses to publish an unprepared job
+	if err := requestPublication(server.URL, conf, doi); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Fatalf("Expected conflict on publishing a queued job but got %v", err)
+	}
+	if _, err := awaitPublication(server.URL, "i/do/not/exist", time.Millisecond); err == nil {
+		t.Fatal("Expected error on unknown job")
+	}
+
+	// check the publication is run by the service and awaited
+	setJobState(job, JobDone, "")
+	if err := requestPublication(server.URL, conf, doi); err != nil {
+		t.Fatalf("Error requesting publication: %q", err.Error())
+	}
+	state, err := awaitPublication(server.URL, doi, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error awaiting publication: %q", err.Error())
+	}
+	if state != JobPublished {
+		t.Fatalf("Expected published job but got %q", state)
+	}
+
+	// check credentials are required
+	conf.Admin.Password = ""
+	if err := requestPublication(server.URL, conf, doi); err == nil {
+		t.Fatal("Expected error without admin credentials")
+	}
+	if err := requestPublication("http://127.0.0.1:0", conf, doi); err == nil {
+		t.Fatal("Expected error on unreachable service")
+	}
+}
+
+func TestSharedPublishSteps(t *testing.T) {
+	var mu sync.Mutex
+	active, maxactive := 0, 0
+	step := publishStep{
+		Name: "shared",
+		Run: func(context.Context, *Configuration, JobRecord) error {
+			mu.Lock()
+			active++
+			if active > maxactive {
+				maxactive = active
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+			return nil
+		},
+		Shared: true,
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			step.run(context.Background(), nil, JobRecord{})
+		}()
+	}
+	wg.Wait()
+	if maxactive != 1 {
+		t.Fatalf("Shared steps of %d publications ran at the same time", maxactive)
+	}
+	for _, step := range publishSteps {
+		if step.Name == "updating XML repository" && !step.Shared {
+			t.Fatal("XML repository update is not serialised")
+		}
+	}
+}
+
+func TestCheckFork(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		switch req.URL.Path {
+		case "/api/v1/repos/doi/forked":
+			fmt.Fprint(rw, `{"full_name": "doi/forked"}`)
+		case "/api/v1/repos/doi/broken":
+			rw.WriteHeader(http.StatusInternalServerError)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	conf := &Configuration{}
+	store, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf.Jobs = store
+	conf.GIN.Username = "doi"
+	for _, repo := range []string{"owner/forked", "owner/unforked", "owner/broken"} {
+		if err := store.Add(testJob("10.12751/g-node."+path.Base(repo), repo, conf)); err != nil {
+			t.Fatalf("Error adding job: %q", err.Error())
+		}
+	}
+	check := func(repo string) error {
+		rec, _ := store.Get("10.12751/g-node." + path.Base(repo))
+		return checkFork(context.Background(), conf, rec)
+	}
+
+	// check the step is skipped without GIN session
+	if err := check("owner/unforked"); err != nil {
+		t.Fatalf("Unexpected error without GIN session: %q", err.Error())
+	}
+
+	conf.GIN.Session = &ginclient.Client{Client: ginweb.New(server.URL)}
+	if err := check("owner/forked"); err != nil {
+		t.Fatalf("Error checking existing fork: %q", err.Error())
+	}
+	if rec, _ := store.Get("10.12751/g-node.forked"); rec.Metadata.ForkRepository != "doi/forked" {
+		t.Fatalf("Fork was not recorded: %q", rec.Metadata.ForkRepository)
+	}
+	if err := check("owner/unforked"); err == nil || !strings.Contains(err.Error(), "manually") {
+		t.Fatalf("Expected missing fork error but got %v", err)
+	}
+	if err := check("owner/broken"); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("Expected server error but got %v", err)
+	}
+	// the repository is never forked by the service
+	for _, req := range requests {
+		if !strings.HasPrefix(req, "GET ") {
+			t.Fatalf("Unexpected request %q", req)
+		}
+	}
+}
+
+func TestResetPublishing(t *testing.T) {
+	store, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf := &Configuration{Jobs: store}
+	job := testJob("10.12751/g-node.ppppp1", "owner/repo", conf)
+	if err := store.Add(job); err != nil {
+		t.Fatalf("Error adding job: %q", err.Error())
+	}
+	setJobState(job, JobPublishing, "")
+	resetPublishing(store)
+	if rec, _ := store.Get(job.Metadata.Identifier.ID); rec.State != JobPublishFailed {
+		t.Fatalf("Expected interrupted publication to fail but got %q", rec.State)
+	}
+}
+
+// initTestRepo creates a git repository with a single commit at dir and a
+// bare repository at remotedir that can be used as remote.
+func initTestRepo(t *testing.T, dir, remotedir string) {
+	for _, args := range [][]string{{"init", "--bare", remotedir}, {"init", dir}} {
+		if _, stderr, err := remoteGitCMD(context.Background(), filepath.Dir(dir), false, args...); err != nil {
+			t.Fatalf("Error running git %v: %s: %s", args, err.Error(), stderr)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README.md"), []byte("readme"), 0666); err != nil {
+		t.Fatalf("Error writing file: %q", err.Error())
+	}
+	for _, args := range [][]string{
+		{"add", "README.md"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.org", "commit", "-m", "init"},
+		{"remote", "add", "origin", remotedir},
+		{"push", "origin", "HEAD:refs/heads/master"},
+	} {
+		if _, stderr, err := remoteGitCMD(context.Background(), dir, false, args...); err != nil {
+			t.Fatalf("Error running git %v: %s: %s", args, err.Error(), stderr)
+		}
+	}
+}
+
+func TestPushDOITag(t *testing.T) {
+	root := t.TempDir()
+	repodir := filepath.Join(root, "repo")
+	forkdir := filepath.Join(root, "fork.git")
+	initTestRepo(t, repodir, forkdir)
+	doi := "10.12751/g-node.noex1st"
+
+	// push tag twice to check existing remote and tag are handled
+	for i := 0; i < 2; i++ {
+		if err := pushDOITag(context.Background(), repodir, forkdir, doi, ""); err != nil {
+			t.Fatalf("Error pushing DOI tag: %q", err.Error())
+		}
+	}
+	stdout, _, err := remoteGitCMD(context.Background(), forkdir, false, "tag", "--list")
+	if err != nil || strings.TrimSpace(stdout) != doi {
+		t.Fatalf("Unexpected fork tags (%v): %q", err, stdout)
+	}
+
+	// check invalid commit
+	if err := pushDOITag(context.Background(), repodir, forkdir, doi, "0000000000000000000000000000000000000000"); err == nil {
+		t.Fatal("Expected error on tagging invalid commit")
+	}
+}
+
+func TestCommitXMLFile(t *testing.T) {
+	root := t.TempDir()
+	origindir := filepath.Join(root, "origin")
+	remotedir := filepath.Join(root, "xmlrepo.git")
+	initTestRepo(t, origindir, remotedir)
+
+	doi := "10.12751/g-node.noex1st"
+	xmlfile := filepath.Join(root, "doi.xml")
+	if err := os.WriteFile(xmlfile, []byte(validTestDataciteXML), 0666); err != nil {
+		t.Fatalf("Error writing doi.xml: %q", err.Error())
+	}
+
+	// first call clones the repository, second call updates the clone and
+	// leaves the unchanged file alone
+	clonedir := filepath.Join(root, xmlrepodir)
+	for i := 0; i < 2; i++ {
+		if err := commitXMLFile(context.Background(), clonedir, remotedir, xmlfile, doi, "doi"); err != nil {
+			t.Fatalf("Error committing XML file: %q", err.Error())
+		}
+	}
+	stdout, _, err := remoteGitCMD(context.Background(), remotedir, false, "show", "master:g-node.noex1st.xml")
+	if err != nil || stdout != validTestDataciteXML {
+		t.Fatalf("Unexpected XML file in repository (%v): %q", err, stdout)
+	}
+	stdout, _, err = remoteGitCMD(context.Background(), remotedir, false, "log", "--format=%s", "master")
+	if err != nil || strings.Count(stdout, "Add "+doi) != 1 {
+		t.Fatalf("Unexpected XML repository log (%v): %q", err, stdout)
+	}
+}
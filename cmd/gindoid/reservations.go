@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// reservationsfile is the name of the file below the preparation directory
+// where the DOI reservations are kept.
+const reservationsfile = "reservations.json"
+
+// ReservationState describes the state of a reserved DOI.
+type ReservationState string
+
+const (
+	// ReservationReserved marks a DOI that has been handed out for a request.
+	ReservationReserved ReservationState = "reserved"
+	// ReservationReleased marks a DOI whose request has been rejected or
+	// could not be submitted. Released DOIs are not handed out again.
+	ReservationReleased ReservationState = "released"
+	// ReservationPublished marks a DOI whose dataset has been published.
+	ReservationPublished ReservationState = "published"
+)
+
+// Reservation records a DOI that has been allocated for a request.
+type Reservation struct {
+	DOI        string
+	Requester  string
+	Repository string
+	State      ReservationState
+	Created    time.Time
+	Updated    time.Time
+}
+
+// ReservationStore keeps track of all allocated DOIs, so that DOIs reserved
+// for requests that are not yet published are never handed out twice.
+// The reservations are persisted to a single JSON file.
+type ReservationStore struct {
+	file         string
+	mu           sync.Mutex
+	reservations map[string]*Reservation
+}
+
+// newReservationStore opens the reservation store at the given file,
+// loading all previous reservations if the file exists.
+func newReservationStore(file string) (*ReservationStore, error) {
+	store := &ReservationStore{
+		file:         file,
+		reservations: make(map[string]*Reservation),
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read reservations file %q: %s", file, err.Error())
+	}
+	var reservations []*Reservation
+	if err := json.Unmarshal(data, &reservations); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reservations file %q: %s", file, err.Error())
+	}
+	for _, res := range reservations {
+		store.reservations[res.DOI] = res
+	}
+	log.Printf("Loaded %d DOI reservations from %q", len(store.reservations), file)
+	return store, nil
+}
+
+// save writes all reservations to the store file. The file is written to a
+// temporary file first and then moved in place. The caller must hold the
+// store lock.
+func (s *ReservationStore) save() error {
+	reservations := make([]*Reservation, 0, len(s.reservations))
+	for _, res := range s.reservations {
+		reservations = append(reservations, res)
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].Created.Before(reservations[j].Created)
+	})
+	data, err := json.MarshalIndent(reservations, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0777); err != nil {
+		return err
+	}
+	tmpfname := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmpfname, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpfname, s.file)
+}
+
+// Reserve allocates a new DOI for the requester and repository. Candidates
+// are created by appending the result of the generate function to the
+// doibase. A candidate is rejected if it has been allocated before or if
+// isRegistered reports it as registered. Returns an error if no DOI could be
+// allocated after maxtry attempts or the reservation could not be saved.
+func (s *ReservationStore) Reserve(doibase string, generate func() string, isRegistered func(string) bool, requester, repository string, maxtry int) (string, error) {
+	for ntry := 0; ntry < maxtry; ntry++ {
+		doi := doibase + generate()
+		if _, ok := s.Get(doi); ok {
+			log.Printf("DOI %q is already reserved", doi)
+			continue
+		}
+		// checking the registration can take a while; do not hold the lock
+		if isRegistered(doi) {
+			log.Printf("DOI %q is already registered", doi)
+			continue
+		}
+
+		s.mu.Lock()
+		if _, ok := s.reservations[doi]; ok {
+			// reserved by a concurrent request in the meantime
+			s.mu.Unlock()
+			continue
+		}
+		now := time.Now()
+		s.reservations[doi] = &Reservation{
+			DOI:        doi,
+			Requester:  requester,
+			Repository: repository,
+			State:      ReservationReserved,
+			Created:    now,
+			Updated:    now,
+		}
+		// a reservation that is not persisted is lost on restart and the DOI
+		// could be handed out again
+		if err := s.save(); err != nil {
+			delete(s.reservations, doi)
+			s.mu.Unlock()
+			return "", fmt.Errorf("failed to save DOI reservation: %s", err.Error())
+		}
+		s.mu.Unlock()
+		return doi, nil
+	}
+	return "", fmt.Errorf("couldn't find a new DOI after %d tries (or the PRNG is broken)", maxtry)
+}
+
+// Add records an existing DOI allocation. Existing reservations are not
+// changed.
+func (s *ReservationStore) Add(res Reservation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.reservations[res.DOI]; ok {
+		return nil
+	}
+	s.reservations[res.DOI] = &res
+	return s.save()
+}
+
+// SetState updates the state of a reserved DOI.
+func (s *ReservationStore) SetState(doi string, state ReservationState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, ok := s.reservations[doi]
+	if !ok {
+		return fmt.Errorf("unknown DOI reservation %q", doi)
+	}
+	res.State = state
+	res.Updated = time.Now()
+	return s.save()
+}
+
+// Get returns a copy of the reservation of the provided DOI.
+func (s *ReservationStore) Get(doi string) (Reservation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, ok := s.reservations[doi]
+	if !ok {
+		return Reservation{}, false
+	}
+	return *res, true
+}
+
+// List returns copies of all reservations ordered by creation time.
+func (s *ReservationStore) List() []Reservation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reservations := make([]Reservation, 0, len(s.reservations))
+	for _, res := range s.reservations {
+		reservations = append(reservations, *res)
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].Created.Before(reservations[j].Created)
+	})
+	return reservations
+}
+
+// reservationState returns the reservation state corresponding to a job
+// state.
+func reservationState(state JobState) ReservationState {
+	switch state {
+	case JobRejected:
+		return ReservationReleased
+	case JobPublished:
+		return ReservationPublished
+	}
+	return ReservationReserved
+}
+
+// syncReservations adds reservations for all jobs in the job store that were
+// created before the reservation store was introduced.
+func syncReservations(reservations *ReservationStore, jobs *JobStore) {
+	for _, rec := range jobs.List() {
+		res := Reservation{
+			DOI:        rec.Metadata.Identifier.ID,
+			Repository: rec.Metadata.SourceRepository,
+			State:      reservationState(rec.State),
+			Created:    rec.Created,
+			Updated:    rec.Updated,
+		}
+		if rec.Metadata.RequestingUser != nil {
+			res.Requester = rec.Metadata.RequestingUser.Username
+		}
+		if err := reservations.Add(res); err != nil {
+			log.Printf("Failed to add reservation for %q: %s", res.DOI, err.Error())
+		}
+	}
+}
+
+// setReservationState updates the reservation state of a DOI if the service
+// keeps DOI reservations. Errors are logged.
+func setReservationState(conf *Configuration, doi string, state ReservationState) {
+	if conf.Reservations == nil {
+		return
+	}
+	if err := conf.Reservations.SetState(doi, state); err != nil {
+		log.Printf("Failed to update reservation of %q: %s", doi, err.Error())
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestReservationStore(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), reservationsfile)
+	store, err := newReservationStore(fname)
+	if err != nil {
+		t.Fatalf("Error creating reservation store: %q", err.Error())
+	}
+	notRegistered := func(string) bool { return false }
+
+	// generator returning the same suffix twice before a new one
+	suffixes := []string{"aaaaa1", "aaaaa1", "bbbbb2"}
+	idx := 0
+	generate := func() string {
+		suffix := suffixes[idx%len(suffixes)]
+		idx++
+		return suffix
+	}
+
+	doi, err := store.Reserve("10.12751/g-node.", generate, notRegistered, "user", "owner/repoa", 5)
+	if err != nil || doi != "10.12751/g-node.aaaaa1" {
+		t.Fatalf("Unexpected reserved DOI %q (%v)", doi, err)
+	}
+	// check reserved suffix is not handed out again
+	doi, err = store.Reserve("10.12751/g-node.", generate, notRegistered, "user", "owner/repob", 5)
+	if err != nil || doi != "10.12751/g-node.bbbbb2" {
+		t.Fatalf("Unexpected reserved DOI %q (%v)", doi, err)
+	}
+	res, ok := store.Get(doi)
+	if !ok || res.Requester != "user" || res.Repository != "owner/repob" || res.State != ReservationReserved {
+		t.Fatalf("Unexpected reservation %+v", res)
+	}
+
+	// check registered and released DOIs are skipped
+	if err := store.SetState(doi, ReservationReleased); err != nil {
+		t.Fatalf("Error releasing DOI: %q", err.Error())
+	}
+	registered := func(doi string) bool { return doi == "10.12751/g-node.ccccc3" }
+	_, err = store.Reserve("10.12751/g-node.", func() string { return "ccccc3" }, registered, "user", "owner/repoc", 3)
+	if err == nil {
+		t.Fatal("Expected error on registered DOI")
+	}
+	_, err = store.Reserve("10.12751/g-node.", func() string { return "bbbbb2" }, notRegistered, "user", "owner/repoc", 3)
+	if err == nil {
+		t.Fatal("Expected error on released DOI")
+	}
+	if err := store.SetState("10.12751/g-node.unknown", ReservationPublished); err == nil {
+		t.Fatal("Expected error on unknown DOI")
+	}
+
+	// check reservations are restored from file
+	restored, err := newReservationStore(fname)
+	if err != nil {
+		t.Fatalf("Error reopening reservation store: %q", err.Error())
+	}
+	list := restored.List()
+	if len(list) != 2 || list[0].DOI != "10.12751/g-node.aaaaa1" || list[1].State != ReservationReleased {
+		t.Fatalf("Unexpected restored reservations %+v", list)
+	}
+
+	// check invalid file
+	if err := os.WriteFile(fname, []byte("not json"), 0666); err != nil {
+		t.Fatalf("Error writing invalid file: %q", err.Error())
+	}
+	if _, err := newReservationStore(fname); err == nil {
+		t.Fatal("Expected error on invalid reservations file")
+	}
+}
+
+func TestReserveSaveFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	store, err := newReservationStore(filepath.Join(dir, reservationsfile))
+	if err != nil {
+		t.Fatalf("Error creating reservation store: %q", err.Error())
+	}
+	// a file in place of the store directory makes saving fail
+	if err := os.WriteFile(dir, []byte("not a directory"), 0666); err != nil {
+		t.Fatalf("Error writing file: %q", err.Error())
+	}
+	notRegistered := func(string) bool { return false }
+	generate := func() string { return "aaaaa1" }
+	if doi, err := store.Reserve("10.12751/g-node.", generate, notRegistered, "user", "owner/repo", 1); err == nil {
+		t.Fatalf("Expected error on unsaved reservation but got %q", doi)
+	}
+	if _, ok := store.Get("10.12751/g-node.aaaaa1"); ok {
+		t.Fatal("Unsaved reservation was kept")
+	}
+}
+
+func TestReserveConcurrent(t *testing.T) {
+	store, err := newReservationStore(filepath.Join(t.TempDir(), reservationsfile))
+	if err != nil {
+		t.Fatalf("Error creating reservation store: %q", err.Error())
+	}
+	notRegistered := func(string) bool { return false }
+
+	// all requests start with the same candidate; no DOI may be handed out twice
+	var wg sync.WaitGroup
+	dois := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			first := true
+			generate := func() string {
+				if first {
+					first = false
+					return "aaaaa1"
+				}
+				return randAlnum(6)
+			}
+			doi, err := store.Reserve("10.12751/g-node.", generate, notRegistered, "user", "owner/repo", 10)
+			if err != nil {
+				t.Errorf("Error reserving DOI: %q", err.Error())
+				return
+			}
+			dois <- doi
+		}()
+	}
+	wg.Wait()
+	close(dois)
+	seen := make(map[string]bool)
+	for doi := range dois {
+		if seen[doi] {
+			t.Fatalf("DOI %q handed out twice", doi)
+		}
+		seen[doi] = true
+	}
+	if len(store.List()) != 10 {
+		t.Fatalf("Expected 10 reservations but got %d", len(store.List()))
+	}
+}
+
+func TestSyncReservations(t *testing.T) {
+	jobs, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf := &Configuration{Jobs: jobs}
+	published := testJob("10.12751/g-node.ppppp1", "owner/published", conf)
+	queued := testJob("10.12751/g-node.qqqqq2", "owner/queued", conf)
+	for _, job := range []*RegistrationJob{published, queued} {
+		if err := jobs.Add(job); err != nil {
+			t.Fatalf("Error adding job: %q", err.Error())
+		}
+	}
+	setJobState(published, JobPublished, "")
+
+	reservations, err := newReservationStore(filepath.Join(t.TempDir(), reservationsfile))
+	if err != nil {
+		t.Fatalf("Error creating reservation store: %q", err.Error())
+	}
+	// existing reservations are kept
+	if err := reservations.Add(Reservation{DOI: queued.Metadata.Identifier.ID, Requester: "user", State: ReservationReserved}); err != nil {
+		t.Fatalf("Error adding reservation: %q", err.Error())
+	}
+	syncReservations(reservations, jobs)
+
+	if res, ok := reservations.Get(published.Metadata.Identifier.ID); !ok || res.State != ReservationPublished || res.Repository != "owner/published" {
+		t.Fatalf("Unexpected synced reservation %+v", res)
+	}
+	if res, _ := reservations.Get(queued.Metadata.Identifier.ID); res.Requester != "user" {
+		t.Fatalf("Existing reservation was changed: %+v", res)
+	}
+
+	// check state update helper
+	conf.Reservations = reservations
+	setReservationState(conf, queued.Metadata.Identifier.ID, ReservationReleased)
+	if res, _ := reservations.Get(queued.Metadata.Identifier.ID); res.State != ReservationReleased {
+		t.Fatalf("Reservation state was not updated: %q", res.State)
+	}
+	// no issue on missing reservation store
+	setReservationState(&Configuration{}, queued.Metadata.Identifier.ID, ReservationReleased)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// spaceMargin is the fraction of the estimated space of a job that is
+// additionally required as safety margin by the disk space preflight.
+const spaceMargin = 0.1
+
+// storageUsage describes the disk usage of a storage directory of the
+// service.
+type storageUsage struct {
+	// Name of the storage setting, e.g. 'preparation'
+	Name      string
+	Directory string
+	// Used is the size of the directory content in bytes
+	Used int64
+	// Free and Total are the available and total bytes of the file system
+	// holding the directory
+	Free  int64
+	Total int64
+	// Quota is the maximum size of the directory content in bytes; there is
+	// no quota if zero
+	Quota int64
+}
+
+// Available returns the bytes that can still be written to the directory
+// with respect to the free space and the quota.
+func (usage storageUsage) Available() int64 {
+	available := usage.Free
+	if usage.Quota > 0 && usage.Quota-usage.Used < available {
+		available = usage.Quota - usage.Used
+	}
+	if available < 0 {
+		return 0
+	}
+	return available
+}
+
+// HumanUsed returns the size of the directory content in human readable form.
+func (usage storageUsage) HumanUsed() string {
+	return humanize.IBytes(uint64(usage.Used))
+}
+
+// HumanFree returns the free and total space of the file system in human
+// readable form.
+func (usage storageUsage) HumanFree() string {
+	return fmt.Sprintf("%s of %s", humanize.IBytes(uint64(usage.Free)), humanize.IBytes(uint64(usage.Total)))
+}
+
+// HumanQuota returns the quota of the directory in human readable form.
+func (usage storageUsage) HumanQuota() string {
+	if usage.Quota <= 0 {
+		return "none"
+	}
+	return humanize.IBytes(uint64(usage.Quota))
+}
+
+// insufficientSpaceError is returned by the disk space preflight if a job
+// does not fit into the free space or quota of a storage directory.
+type insufficientSpaceError struct {
+	Directory string
+	Required  int64
+	Available int64
+}
+
+func (e *insufficientSpaceError) Error() string {
+	return fmt.Sprintf("insufficient disk space in %s: %s required, %s available", e.Directory, humanize.IBytes(uint64(e.Required)), humanize.IBytes(uint64(e.Available)))
+}
+
+// diskSpace returns the available and total bytes of the file system holding
+// the provided directory.
+func diskSpace(dir string) (int64, int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), int64(stat.Blocks) * int64(stat.Bsize), nil
+}
+
+// dirSize returns the size of all files below the provided directory in
+// bytes. Symlinks are not followed; directories and files specified via the
+// exclude parameter are ignored. Files removed during the walk are skipped.
+func dirSize(dir string, exclude ...string) (int64, error) {
+	var size int64
+	walker := func(fname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		for i := range exclude {
+			if exclude[i] == fname {
+				return filepath.SkipDir
+			}
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	}
+	if err := filepath.Walk(dir, walker); err != nil {
+		return 0, fmt.Errorf("error reading size of %s: %s", dir, err.Error())
+	}
+	return size, nil
+}
+
+// usageCacheTTL is the time the size of a storage directory is cached before
+// the directory is walked again.
+const usageCacheTTL = 15 * time.Minute
+
+// usageCache caches the content size of the storage directories, since
+// walking the directories takes long once they hold many datasets.
+type usageCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedUsage
+}
+
+type cachedUsage struct {
+	size int64
+	read time.Time
+}
+
+// dirUsages holds the content size of the storage directories of the
+// service.
+var dirUsages = &usageCache{ttl: usageCacheTTL, entries: make(map[string]cachedUsage)}
+
+// size returns the cached content size of the directory and walks the
+// directory if the size has not been read yet or has expired. Concurrent
+// callers wait for a single walk.
+func (c *usageCache) size(dir string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[dir]; ok && time.Since(entry.read) < c.ttl {
+		return entry.size, nil
+	}
+	size, err := dirSize(dir)
+	if err != nil {
+		return 0, err
+	}
+	c.entries[dir] = cachedUsage{size: size, read: time.Now()}
+	return size, nil
+}
+
+// invalidate removes the cached sizes of the directories, so they are read
+// again on the next use.
+func (c *usageCache) invalidate(dirs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, dir := range dirs {
+		delete(c.entries, dir)
+	}
+}
+
+// invalidateStorageUsage removes the cached content sizes of the storage
+// directories after their content changed, e.g. when a job finished.
+func invalidateStorageUsage(conf *Configuration) {
+	if conf == nil {
+		return
+	}
+	dirUsages.invalidate(conf.Storage.PreparationDirectory, conf.Storage.TargetDirectory)
+}
+
+// readStorageUsage returns the usage of a storage directory. The free space
+// is read from the file system on every call, while the content size is
+// cached.
+func readStorageUsage(name string, dir string, quota int64) (storageUsage, error) {
+	usage := storageUsage{Name: name, Directory: dir, Quota: quota}
+	var err error
+	usage.Free, usage.Total, err = diskSpace(dir)
+	if err != nil {
+		return usage, fmt.Errorf("failed to read free space of %s: %s", dir, err.Error())
+	}
+	usage.Used, err = dirUsages.size(dir)
+	if err != nil {
+		return usage, err
+	}
+	return usage, nil
+}
+
+// storageUsages returns the usage of the preparation and the target
+// directory. The content sizes are cached, so the admin page and the disk
+// space preflight do not walk the directories on every call. Directories
+// whose usage cannot be read are logged and skipped.
+func storageUsages(ctx context.Context, conf *Configuration) []storageUsage {
+	dirs := []struct {
+		name  string
+		dir   string
+		quota int64
+	}{
+		{"preparation", conf.Storage.PreparationDirectory, conf.Storage.PreparationQuota},
+		{"target", conf.Storage.TargetDirectory, conf.Storage.TargetQuota},
+	}
+	usages := make([]storageUsage, 0, len(dirs))
+	for _, d := range dirs {
+		if d.dir == "" {
+			continue
+		}
+		usage, err := readStorageUsage(d.name, d.dir, d.quota)
+		if err != nil {
+			logger(ctx).Error("Failed to read storage usage", "error", err.Error())
+			continue
+		}
+		usages = append(usages, usage)
+	}
+	return usages
+}
+
+// parseAnnexSize converts a git annex size description like
+// "12.2 gigabytes" to bytes.
+func parseAnnexSize(annexsize string) (int64, error) {
+	sizesplit := strings.Split(strings.TrimSpace(annexsize), " ")
+	if len(sizesplit) != 2 {
+		return 0, fmt.Errorf("could not parse annex size %q", annexsize)
+	}
+	units := map[string]string{
+		"byte":     "B",
+		"kilobyte": "kB",
+		"megabyte": "MB",
+		"gigabyte": "GB",
+		"terabyte": "TB",
+		"petabyte": "PB",
+	}
+	unit, ok := units[strings.TrimSuffix(sizesplit[1], "s")]
+	if !ok {
+		return 0, fmt.Errorf("unsupported annex size unit %q", sizesplit[1])
+	}
+	size, err := humanize.ParseBytes(fmt.Sprintf("%s %s", sizesplit[0], unit))
+	if err != nil {
+		return 0, fmt.Errorf("could not parse annex size %q: %s", annexsize, err.Error())
+	}
+	return int64(size), nil
+}
+
+// estimateSpace estimates the disk space a job requires to download the
+// annex content of the fresh clone at repodir and to archive the repository
+// content. The annex content is downloaded to the preparation directory; the
+// archive holds the annex content and all other files of the working tree.
+func estimateSpace(ctx context.Context, repodir string) (int64, int64, error) {
+	var annexbytes int64
+	asize, err := annexSize(ctx, repodir)
+	if err != nil {
+		// repositories without annex content only need space for the archive
+		logger(ctx).Info("Could not read annex size", "dir", repodir, "error", err.Error())
+	} else if annexbytes, err = parseAnnexSize(asize); err != nil {
+		return 0, 0, err
+	}
+	worktree, err := dirSize(repodir, filepath.Join(repodir, ".git"))
+	if err != nil {
+		return 0, 0, err
+	}
+	return annexbytes, annexbytes + worktree, nil
+}
+
+// spaceReservations holds the disk space the running jobs reserved in the
+// storage directories for the content they are about to write.
+type spaceReservations struct {
+	mu sync.Mutex
+	// jobs maps the preparation path of each job to the bytes reserved per
+	// directory
+	jobs map[string]map[string]int64
+}
+
+// reservedSpace holds the disk space reservations of the running jobs.
+var reservedSpace = &spaceReservations{jobs: make(map[string]map[string]int64)}
+
+// reserved returns the bytes reserved in the directory by all jobs except
+// the job with the provided key. The lock must be held by the caller.
+func (r *spaceReservations) reserved(dir string, except string) int64 {
+	var total int64
+	for key, dirs := range r.jobs {
+		if key != except {
+			total += dirs[dir]
+		}
+	}
+	return total
+}
+
+// release removes the reservation of a job.
+func (r *spaceReservations) release(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.jobs, key)
+}
+
+// releaseSpace releases the disk space reserved for the job preparing its
+// content at preppath once the content has been written. The cached storage
+// usage is refreshed, so it includes the written content.
+func releaseSpace(conf *Configuration, preppath string) {
+	reservedSpace.release(preppath)
+	invalidateStorageUsage(conf)
+}
+
+// neverFitsError is returned by the disk space preflight if a job requires
+// more space than a storage directory can ever provide.
+type neverFitsError struct {
+	Directory string
+	Required  int64
+	Limit     int64
+}
+
+func (e *neverFitsError) Error() string {
+	return fmt.Sprintf("dataset requires %s in %s, more than the %s the directory can hold", humanize.IBytes(uint64(e.Required)), e.Directory, humanize.IBytes(uint64(e.Limit)))
+}
+
+// checkDiskSpace checks that the preparation and the target directory can
+// hold the estimated space of a job including a safety margin. The space
+// reserved by other running jobs is not available. If the check passes, the
+// space is reserved for the job with the preparation path key until it is
+// released via releaseSpace. If a directory currently lacks the space, an
+// insufficientSpaceError is returned; if the job exceeds the total size or
+// the quota of a directory, a neverFitsError is returned.
+func checkDiskSpace(ctx context.Context, conf *Configuration, key string, prepbytes int64, targetbytes int64) error {
+	// both directories may be the same
+	required := make(map[string]int64)
+	required[conf.Storage.PreparationDirectory] += prepbytes
+	required[conf.Storage.TargetDirectory] += targetbytes
+
+	reservedSpace.mu.Lock()
+	defer reservedSpace.mu.Unlock()
+	reservation := make(map[string]int64)
+	for _, usage := range storageUsages(ctx, conf) {
+		need := int64(float64(required[usage.Directory]) * (1 + spaceMargin))
+		reserved := reservedSpace.reserved(usage.Directory, key)
+		available := usage.Available() - reserved
+		if available < 0 {
+			available = 0
+		}
+		logger(ctx).Info("Checking storage", "storage", usage.Name, "required", humanize.IBytes(uint64(need)), "used", usage.HumanUsed(), "reserved", humanize.IBytes(uint64(reserved)), "free", usage.HumanFree(), "quota", usage.HumanQuota())
+		if need > usage.Total {
+			return &neverFitsError{Directory: usage.Directory, Required: need, Limit: usage.Total}
+		}
+		if usage.Quota > 0 && need > usage.Quota {
+			return &neverFitsError{Directory: usage.Directory, Required: need, Limit: usage.Quota}
+		}
+		if need > available {
+			return &insufficientSpaceError{Directory: usage.Directory, Required: need, Available: available}
+		}
+		reservation[usage.Directory] = need
+	}
+	reservedSpace.jobs[key] = reservation
+	return nil
+}
+
+// cleanPublished removes the content of the preparation directory of a
+// published dataset, which holds the repository clone and the registration
+// checklist. The job log file is kept. Errors are logged, since they do not
+// affect the publication.
+func cleanPublished(ctx context.Context, conf *Configuration, doi string) {
+	if conf.Storage.PreparationDirectory == "" || doi == "" {
+		return
+	}
+	prepdir := filepath.Join(conf.Storage.PreparationDirectory, doi)
+	entries, err := os.ReadDir(prepdir)
+	if err != nil {
+		return
+	}
+	logger(ctx).Info("Cleaning preparation directory of published dataset", "dir", prepdir)
+	defer invalidateStorageUsage(conf)
+	for _, entry := range entries {
+		if entry.Name() == joblogfile {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(prepdir, entry.Name())); err != nil {
+			logger(ctx).Error("Failed to clean preparation directory", "dir", prepdir, "error", err.Error())
+		}
+	}
+}
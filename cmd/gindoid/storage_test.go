@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAnnexSize(t *testing.T) {
+	sizes := map[string]int64{
+		"9 bytes":        9,
+		"1 byte":         1,
+		"1 kilobyte":     1000,
+		"12.5 megabytes": 12500000,
+		"2 gigabytes":    2000000000,
+		"1.5 terabytes":  1500000000000,
+	}
+	for annexsize, expected := range sizes {
+		size, err := parseAnnexSize(annexsize)
+		if err != nil {
+			t.Fatalf("Error parsing %q: %s", annexsize, err.Error())
+		}
+		if size != expected {
+			t.Fatalf("Unexpected size of %q: %d", annexsize, size)
+		}
+	}
+	for _, invalid := range []string{"", "100kilobytes", "10 furlongs", "many gigabytes"} {
+		if _, err := parseAnnexSize(invalid); err == nil {
+			t.Fatalf("Expected error parsing %q", invalid)
+		}
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	conf := &Configuration{}
+	conf.Storage.PreparationDirectory = t.TempDir()
+	conf.Storage.TargetDirectory = t.TempDir()
+	repodir := filepath.Join(conf.Storage.PreparationDirectory, "repo")
+	if err := os.MkdirAll(filepath.Join(repodir, ".git"), 0777); err != nil {
+		t.Fatalf("Error creating repository directory: %s", err.Error())
+	}
+	for fname, size := range map[string]int{"data.csv": 1000, ".git/index": 500} {
+		if err := os.WriteFile(filepath.Join(repodir, fname), []byte(strings.Repeat("x", size)), 0666); err != nil {
+			t.Fatalf("Error writing file: %s", err.Error())
+		}
+	}
+	if size, err := dirSize(repodir, filepath.Join(repodir, ".git")); err != nil || size != 1000 {
+		t.Fatalf("Unexpected working tree size: %d %v", size, err)
+	}
+
+	usages := storageUsages(context.Background(), conf)
+	if len(usages) != 2 || usages[0].Used != 1500 || usages[1].Used != 0 {
+		t.Fatalf("Unexpected storage usage: %+v", usages)
+	}
+	if usages[0].Free <= 0 || usages[0].Total < usages[0].Free || usages[0].HumanQuota() != "none" {
+		t.Fatalf("Unexpected storage space: %+v", usages[0])
+	}
+
+	// no quotas
+	if err := checkDiskSpace(context.Background(), conf, "job1", 1000, 1000); err != nil {
+		t.Fatalf("Unexpected disk space error: %s", err.Error())
+	}
+	reservedSpace.release("job1")
+
+	// the target quota is exceeded including the safety margin
+	conf.Storage.TargetQuota = 1050
+	err := checkDiskSpace(context.Background(), conf, "job1", 1000, 1000)
+	if fitErr, ok := err.(*neverFitsError); !ok || fitErr.Directory != conf.Storage.TargetDirectory || fitErr.Required != 1100 || fitErr.Limit != 1050 {
+		t.Fatalf("Unexpected disk space error: %v", err)
+	}
+
+	// the preparation quota includes the existing content
+	conf.Storage.TargetQuota = 0
+	conf.Storage.PreparationQuota = 2000
+	err = checkDiskSpace(context.Background(), conf, "job1", 600, 0)
+	spaceErr, ok := err.(*insufficientSpaceError)
+	if !ok || spaceErr.Directory != conf.Storage.PreparationDirectory || spaceErr.Available != 500 {
+		t.Fatalf("Unexpected disk space error: %v", err)
+	}
+	if err := checkDiskSpace(context.Background(), conf, "job1", 400, 0); err != nil {
+		t.Fatalf("Unexpected disk space error: %s", err.Error())
+	}
+
+	// the space reserved by a running job is not available to other jobs
+	err = checkDiskSpace(context.Background(), conf, "job2", 400, 0)
+	if spaceErr, ok = err.(*insufficientSpaceError); !ok || spaceErr.Available != 60 {
+		t.Fatalf("Unexpected disk space error with reserved space: %v", err)
+	}
+	// a job checking again replaces its own reservation
+	if err := checkDiskSpace(context.Background(), conf, "job1", 400, 0); err != nil {
+		t.Fatalf("Unexpected disk space error: %s", err.Error())
+	}
+	releaseSpace(conf, "job1")
+	if err := checkDiskSpace(context.Background(), conf, "job2", 400, 0); err != nil {
+		t.Fatalf("Unexpected disk space error after release: %s", err.Error())
+	}
+	reservedSpace.release("job2")
+
+	// both requirements count against a shared directory
+	conf.Storage.TargetDirectory = conf.Storage.PreparationDirectory
+	if err := checkDiskSpace(context.Background(), conf, "job1", 400, 400); err == nil {
+		t.Fatal("Expected disk space error for a shared directory")
+	}
+
+	// preparation directory of a published dataset
+	doi := "10.12751/g-node.clean1"
+	prepdir := filepath.Join(conf.Storage.PreparationDirectory, doi, "repo")
+	if err := os.MkdirAll(prepdir, 0777); err != nil {
+		t.Fatalf("Error creating preparation directory: %s", err.Error())
+	}
+	joblog := filepath.Join(conf.Storage.PreparationDirectory, doi, joblogfile)
+	if err := os.WriteFile(joblog, []byte("log"), 0666); err != nil {
+		t.Fatalf("Error writing job log: %s", err.Error())
+	}
+	cleanPublished(context.Background(), conf, doi)
+	if _, err := os.Stat(prepdir); !os.IsNotExist(err) {
+		t.Fatal("Preparation directory of published dataset was not cleaned")
+	}
+	if _, err := os.Stat(joblog); err != nil {
+		t.Fatalf("Job log of published dataset was removed: %s", err.Error())
+	}
+	if _, err := os.Stat(repodir); err != nil {
+		t.Fatalf("Unrelated preparation content was removed: %s", err.Error())
+	}
+}
+
+func TestUsageCache(t *testing.T) {
+	dir := t.TempDir()
+	cache := &usageCache{ttl: time.Hour, entries: make(map[string]cachedUsage)}
+	writeFile := func(name string, size int) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(strings.Repeat("x", size)), 0666); err != nil {
+			t.Fatalf("Error writing file: %s", err.Error())
+		}
+	}
+
+	writeFile("a", 100)
+	if size, err := cache.size(dir); err != nil || size != 100 {
+		t.Fatalf("Unexpected directory size: %d %v", size, err)
+	}
+	// the cached size is used until it expires or is invalidated
+	writeFile("b", 50)
+	if size, _ := cache.size(dir); size != 100 {
+		t.Fatalf("Directory walked again: %d", size)
+	}
+	cache.invalidate(dir)
+	if size, _ := cache.size(dir); size != 150 {
+		t.Fatalf("Unexpected size after invalidation: %d", size)
+	}
+	writeFile("c", 25)
+	cache.ttl = 0
+	if size, _ := cache.size(dir); size != 175 {
+		t.Fatalf("Unexpected size after expiry: %d", size)
+	}
+}
@@ -14,7 +14,7 @@ func TestRequestFailureTemplate(t *testing.T) {
 	regRequest := new(RegistrationRequest)
 	regRequest.Message = template.HTML(msgInvalidRequest)
 	regRequest.Metadata = new(libgin.RepositoryMetadata)
-	regRequest.DOIRequestData = new(libgin.DOIRequestData) // Source repo required to render fail page
+	regRequest.DOIRequestData = new(DOIRequestData) // Source repo required to render fail page
 	tmpl, err := prepareTemplates("RequestFailurePage")
 	if err != nil {
 		t.Fatalf("Failed to parse RequestFailureP template: %s", err.Error())
@@ -54,11 +54,14 @@ func TestRequestPageTemplate(t *testing.T) {
 		t.Fatalf("Failed to read datacite.yaml")
 	}
 	regRequest := new(RegistrationRequest)
-	regRequest.DOIRequestData = &libgin.DOIRequestData{
-		Username:   "testuser",
-		Realname:   "Test User",
-		Repository: "user/test",
-		Email:      "doitest@example.org",
+	regRequest.DOIRequestData = &DOIRequestData{
+		DOIRequestData: libgin.DOIRequestData{
+			Username:   "testuser",
+			Realname:   "Test User",
+			Repository: "user/test",
+			Email:      "doitest@example.org",
+		},
+		Ref: "v1.0",
 	}
 	regRequest.Metadata = new(libgin.RepositoryMetadata)
 	regRequest.Metadata.YAMLData = doiInfo
@@ -1,9 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gogs/go-gogs-client"
 )
 
 const empty = ``
@@ -204,13 +213,185 @@ func serveDataciteServer() *httptest.Server {
 			fmt.Printf("could not write valid response: %q", err.Error())
 		}
 	})
-	mux.HandleFunc("/test/src/master/.gitmodules", func(rw http.ResponseWriter, req *http.Request) {
+	gitmodules := func(rw http.ResponseWriter, req *http.Request) {
 		rw.WriteHeader(http.StatusOK)
 		_, err := rw.Write([]byte("OK"))
 		if err != nil {
 			fmt.Printf("could not write valid response: %q", err.Error())
 		}
+	}
+	mux.HandleFunc("/test/src/master/.gitmodules", gitmodules)
+	mux.HandleFunc("/test/src/v1.0/.gitmodules", gitmodules)
+
+	return httptest.NewServer(mux)
+}
+
+// dataciteAPIStub holds the DOIs registered at a local DataCite REST API
+// test server.
+type dataciteAPIStub struct {
+	mu       sync.Mutex
+	dois     map[string]*dataciteAttributes
+	requests []string
+}
+
+// serveDataciteAPI provides a local stand-in for the DataCite REST API that
+// accepts the credentials "repo"/"secret".
+func serveDataciteAPI() (*httptest.Server, *dataciteAPIStub) {
+	stub := &dataciteAPIStub{dois: make(map[string]*dataciteAttributes)}
+	respond := func(rw http.ResponseWriter, code int, attr *dataciteAttributes) {
+		rw.Header().Set("Content-Type", "application/vnd.api+json")
+		rw.WriteHeader(code)
+		err := json.NewEncoder(rw).Encode(dataciteRequest{Data: dataciteData{Type: "dois", Attributes: *attr}})
+		if err != nil {
+			fmt.Printf("could not write valid response: %q", err.Error())
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dois", func(rw http.ResponseWriter, req *http.Request) {
+		stub.handle(rw, req, "", respond)
 	})
+	mux.HandleFunc("/dois/", func(rw http.ResponseWriter, req *http.Request) {
+		stub.handle(rw, req, strings.TrimPrefix(req.URL.Path, "/dois/"), respond)
+	})
+	return httptest.NewServer(mux), stub
+}
+
+func (stub *dataciteAPIStub) handle(rw http.ResponseWriter, req *http.Request, doi string, respond func(http.ResponseWriter, int, *dataciteAttributes)) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	stub.requests = append(stub.requests, fmt.Sprintf("%s %s", req.Method, req.URL.Path))
+
+	if user, pass, ok := req.BasicAuth(); !ok || user != "repo" || pass != "secret" {
+		http.Error(rw, `{"errors":[{"status":"401","title":"Bad credentials."}]}`, http.StatusUnauthorized)
+		return
+	}
+	var reqdata dataciteRequest
+	if req.Method != http.MethodGet {
+		if err := json.NewDecoder(req.Body).Decode(&reqdata); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	attr := reqdata.Data.Attributes
+
+	switch {
+	case req.Method == http.MethodPost && doi == "":
+		if _, ok := stub.dois[attr.DOI]; ok {
+			http.Error(rw, `{"errors":[{"title":"This DOI has already been taken"}]}`, http.StatusUnprocessableEntity)
+			return
+		}
+		stub.dois[attr.DOI] = &dataciteAttributes{DOI: attr.DOI, State: "draft"}
+		respond(rw, http.StatusCreated, stub.dois[attr.DOI])
+	case req.Method == http.MethodGet && doi != "":
+		existing, ok := stub.dois[doi]
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		respond(rw, http.StatusOK, existing)
+	case req.Method == http.MethodPut && doi != "":
+		existing, ok := stub.dois[doi]
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		if attr.XML != "" {
+			existing.XML = attr.XML
+		}
+		if attr.URL != "" {
+			existing.URL = attr.URL
+		}
+		if attr.Event == "publish" {
+			if existing.XML == "" || existing.URL == "" {
+				http.Error(rw, `{"errors":[{"title":"Metadata and URL are required"}]}`, http.StatusUnprocessableEntity)
+				return
+			}
+			existing.State = "findable"
+		}
+		respond(rw, http.StatusOK, existing)
+	default:
+		http.Error(rw, "unsupported request", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeSourceFiles creates a source directory named 'repo' in a temporary
+// directory of the test and writes the files with the provided slash
+// separated paths and contents. Returns the path of the source directory.
+func writeSourceFiles(t *testing.T, files map[string]string) string {
+	source := filepath.Join(t.TempDir(), "repo")
+	writeFiles(t, source, files)
+	return source
+}
 
+// writeFiles writes the files with the provided slash separated paths and
+// contents below dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for fname, content := range files {
+		fpath := filepath.Join(dir, filepath.FromSlash(fname))
+		if err := os.MkdirAll(filepath.Dir(fpath), 0777); err != nil {
+			t.Fatalf("Error creating source directory: %s", err.Error())
+		}
+		if err := os.WriteFile(fpath, []byte(content), 0666); err != nil {
+			t.Fatalf("Error writing file: %s", err.Error())
+		}
+	}
+}
+
+// serveGitRepo starts a local test server providing the parts of the GIN
+// API and web interface used by the service for the git repository at
+// gitdir, which is served as the repository repo:
+// repository information, ref to commit resolution, and the source and raw
+// file views ([repo]/src/[rev]/[path], [repo]/raw/[rev]/[path]).
+func serveGitRepo(repo string, gitdir string) *httptest.Server {
+	git := func(args ...string) (string, error) {
+		stdout, _, err := remoteGitCMD(context.Background(), gitdir, false, args...)
+		return stdout, err
+	}
+	// splitRevPath splits a [rev]/[path] string; revisions containing a
+	// slash are not supported
+	splitRevPath := func(revpath string) (string, string) {
+		parts := strings.SplitN(revpath, "/", 2)
+		if len(parts) == 1 {
+			return parts[0], ""
+		}
+		return parts[0], parts[1]
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(fmt.Sprintf("/api/v1/repos/%s", repo), func(rw http.ResponseWriter, req *http.Request) {
+		branch, err := git("symbolic-ref", "--short", "HEAD")
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		data, _ := json.Marshal(gogs.Repository{FullName: repo, DefaultBranch: strings.TrimSpace(branch)})
+		_, _ = rw.Write(data)
+	})
+	mux.HandleFunc(fmt.Sprintf("/api/v1/repos/%s/commits/", repo), func(rw http.ResponseWriter, req *http.Request) {
+		ref := strings.TrimPrefix(req.URL.Path, fmt.Sprintf("/api/v1/repos/%s/commits/", repo))
+		commit, err := git("rev-parse", "--verify", "--quiet", ref+"^{commit}")
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = rw.Write([]byte(strings.TrimSpace(commit)))
+	})
+	mux.HandleFunc(fmt.Sprintf("/%s/src/", repo), func(rw http.ResponseWriter, req *http.Request) {
+		rev, fpath := splitRevPath(strings.TrimPrefix(req.URL.Path, fmt.Sprintf("/%s/src/", repo)))
+		if _, err := git("cat-file", "-e", fmt.Sprintf("%s:%s", rev, fpath)); err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = rw.Write([]byte("OK"))
+	})
+	mux.HandleFunc(fmt.Sprintf("/%s/raw/", repo), func(rw http.ResponseWriter, req *http.Request) {
+		rev, fpath := splitRevPath(strings.TrimPrefix(req.URL.Path, fmt.Sprintf("/%s/raw/", repo)))
+		content, err := git("show", fmt.Sprintf("%s:%s", rev, fpath))
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = rw.Write([]byte(content))
+	})
 	return httptest.NewServer(mux)
 }
@@ -2,19 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"os/exec"
 	"regexp"
-	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	gingit "github.com/G-Node/gin-cli/git"
@@ -36,7 +39,6 @@ func randAlnum(n int) string {
 	N := len(ALNUM)
 
 	chrs := make([]byte, n)
-	rand.Seed(time.Now().UnixNano())
 	for idx := range chrs {
 		chrs[idx] = ALNUM[rand.Intn(N)]
 	}
@@ -120,6 +122,53 @@ func readFileAtURL(url string) ([]byte, error) {
 	return body, nil
 }
 
+// ginRequest sends a request to the API of the GIN server of the configured
+// GIN session and returns the status code and the body of the response. If
+// data is not nil, it is sent JSON encoded. The request is aborted if the
+// context is done or the GIN timeout of the configuration is exceeded.
+func ginRequest(ctx context.Context, conf *Configuration, method string, address string, data interface{}) (int, []byte, error) {
+	client := conf.GIN.Session
+	if client == nil {
+		return 0, nil, fmt.Errorf("no GIN session configured")
+	}
+	if conf.Timeouts.GIN > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.Timeouts.GIN)
+		defer cancel()
+	}
+	requrl, err := url.JoinPath(client.Host, address)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid GIN API address %q: %s", address, err.Error())
+	}
+	var body io.Reader
+	if data != nil {
+		datajson, err := json.Marshal(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		body = bytes.NewReader(datajson)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, requrl, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	if client.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", client.Token))
+	}
+	logger(ctx).Debug("GIN API request", "method", method, "url", requrl)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respdata, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("failed to read response body: %s", err.Error())
+	}
+	return resp.StatusCode, respdata, nil
+}
+
 // EscXML runs a string through xml.EscapeText.
 // This is a utility function for the doi.xml template.
 func EscXML(txt string) string {
@@ -174,6 +223,8 @@ var templateMap = map[string]string{
 	"Keyword":            gdtmpl.Keyword,
 	"IndexPage":          gdtmpl.IndexPage,
 	"Checklist":          gdtmpl.ChecklistFile,
+	"JobStatus":          gdtmpl.JobStatus,
+	"AdminJobList":       gdtmpl.AdminJobList,
 }
 
 // prepareTemplates initialises and parses a sequence of templates in the order
@@ -222,6 +273,9 @@ var tmplfuncs = template.FuncMap{
 	"OldVersionLink":   OldVersionLink,
 	"GINServerURL":     GINServerURL,
 	"HasGitModules":    HasGitModules,
+	"ArchiveChecksum":  ArchiveChecksum,
+	"ArchiveExt":       ArchiveExt,
+	"ArchiveParts":     ArchiveParts,
 }
 
 // FunderName splits the funder name from a funding string of the form <FunderName>; <AwardNumber>.
@@ -539,6 +593,27 @@ func GINServerURL() string {
 	return "https://gin.g-node.org"
 }
 
+// ArchiveChecksum returns the SHA-256 checksum of the dataset archive for the
+// landing page. The default function returns an empty string; the checksum
+// of an actual archive is injected via injectFunc.
+func ArchiveChecksum() string {
+	return ""
+}
+
+// ArchiveExt returns the file extension of the dataset archive for the
+// landing page. The default function returns the zip extension; the extension
+// of an actual archive is injected via injectFunc.
+func ArchiveExt() string {
+	return "zip"
+}
+
+// ArchiveParts returns the parts of a dataset archive that is split into
+// multiple parts for the landing page. The default function returns no parts;
+// the parts of an actual archive are injected via injectFunc.
+func ArchiveParts() []archivePart {
+	return nil
+}
+
 // URLexists runs a GET against an URL, returns true if
 // the return code is 200 and false otherwise.
 func URLexists(url string) bool {
@@ -556,30 +631,84 @@ func URLexists(url string) bool {
 }
 
 // HasGitModules checks whether a repository on the defined GIN
-// server features a '.gitmodules' file and returns the result as boolean.
-func HasGitModules(ginurl string, repo string) bool {
-	moduleurl := fmt.Sprintf("%s/%s/src/master/.gitmodules", ginurl, repo)
-	log.Printf("HasGitModules: checking url %s", moduleurl)
+// server features a '.gitmodules' file at the provided revision and returns
+// the result as boolean.
+func HasGitModules(ginurl string, repo string, revision string) bool {
+	return hasGitModules(context.Background(), ginurl, repo, revision)
+}
+
+// hasGitModules is HasGitModules logging to the logger of the context.
+func hasGitModules(ctx context.Context, ginurl string, repo string, revision string) bool {
+	moduleurl := fmt.Sprintf("%s/%s/src/%s/.gitmodules", ginurl, repo, revision)
+	logger(ctx).Debug("Checking for submodules", "url", moduleurl)
 
 	return URLexists(moduleurl)
 }
 
 // annexCMD runs the passed git annex command arguments.
 // The command returns stdout and stderr as strings and any error that might occur.
-func annexCMD(annexargs ...string) (string, string, error) {
-	log.Printf("Running annex command: %s\n", annexargs)
+// The command is killed if the context is done before it finishes.
+func annexCMD(ctx context.Context, annexargs ...string) (string, string, error) {
+	logger(ctx).Debug("Running annex command", "args", annexargs)
 	cmd := gingit.AnnexCommand(annexargs...)
-	stdout, stderr, err := cmd.OutputError()
+	stdout, stderr, err := runCommand(ctx, cmd.Cmd)
 
 	return string(stdout), string(stderr), err
 }
 
+// runCommand runs a command and returns its stdout and stderr. The command
+// runs in its own process group; if the context is done before the command
+// finishes, the command and all processes it started are killed and the
+// context error is returned.
+func runCommand(ctx context.Context, cmd *exec.Cmd) ([]byte, []byte, error) {
+	var bout, berr bytes.Buffer
+	cmd.Stdout = &bout
+	cmd.Stderr = &berr
+	if err := startCommand(ctx, cmd); err != nil {
+		return nil, nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return bout.Bytes(), berr.Bytes(), err
+	case <-ctx.Done():
+		killCommand(cmd)
+		<-done
+		return bout.Bytes(), berr.Bytes(), fmt.Errorf("%s aborted: %s", cmd.Args[0], ctx.Err().Error())
+	}
+}
+
+// startCommand starts a command in its own process group unless the context
+// is already done.
+func startCommand(ctx context.Context, cmd *exec.Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd.Start()
+}
+
+// killCommand kills a command started by startCommand together with all
+// processes it started, e.g. the git-annex process of a git annex command.
+func killCommand(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		log.Printf("Failed to kill process group of %v: %s", cmd.Args, err.Error())
+		cmd.Process.Kill()
+	}
+}
+
 // annexAvailable checks whether annex is available to the gin client library.
 // The function returns false with no error, if the annex command execution
 // ends with the git message that 'annex' is not a git command.
 // It will return false and the error message on any different error.
 func annexAvailable() (bool, error) {
-	_, stderr, err := annexCMD("version")
+	_, stderr, err := annexCMD(context.Background(), "version")
 	if err != nil {
 		if strings.Contains(stderr, "'annex' is not a git command") {
 			return false, nil
@@ -592,7 +721,8 @@ func annexAvailable() (bool, error) {
 // remoteGitCMD runs a git command for a given directory
 // If the useannex flag is set to true, the executed command
 // will be a git annex command instead of a regular git command.
-func remoteGitCMD(gitdir string, useannex bool, gitcmd ...string) (string, string, error) {
+// The command is killed if the context is done before it finishes.
+func remoteGitCMD(ctx context.Context, gitdir string, useannex bool, gitcmd ...string) (string, string, error) {
 	if _, err := os.Stat(gitdir); os.IsNotExist(err) {
 		return "", "", fmt.Errorf("path not found %q", gitdir)
 	}
@@ -605,8 +735,8 @@ func remoteGitCMD(gitdir string, useannex bool, gitcmd ...string) (string, strin
 		cmd = gingit.AnnexCommand("version")
 		cmd.Args = cmdstr
 	}
-	log.Printf("remoteGitCMD: %v", cmdstr)
-	stdout, stderr, err := cmd.OutputError()
+	logger(ctx).Debug("Running git command", "args", cmdstr)
+	stdout, stderr, err := runCommand(ctx, cmd.Cmd)
 
 	return string(stdout), string(stderr), err
 }
@@ -619,14 +749,14 @@ func remoteGitCMD(gitdir string, useannex bool, gitcmd ...string) (string, strin
 // If no missing content is found, the function returns false and an empty
 // string. If any issue occurs during processing, the function will return
 // false, an empty string and an appropriate error.
-func missingAnnexContent(gitdir string) (bool, string, error) {
+func missingAnnexContent(ctx context.Context, gitdir string) (bool, string, error) {
 	if _, err := os.Stat(gitdir); os.IsNotExist(err) {
 		return false, "", fmt.Errorf("path not found %q", gitdir)
 	}
 	// command should not return with an error or with any stderr content
 	// If stdout is empty, there is no missing content. If it is not empty,
 	// the number of lines correspond to the number of files with missing content.
-	stdout, stderr, err := remoteGitCMD(gitdir, true, "find", "--not", "--in=here")
+	stdout, stderr, err := remoteGitCMD(ctx, gitdir, true, "find", "--not", "--in=here")
 	if err != nil {
 		return false, "", err
 	} else if string(stderr) != "" {
@@ -644,14 +774,14 @@ func missingAnnexContent(gitdir string) (bool, string, error) {
 // If no locked files are found, the function returns false and an empty
 // string. If any issue occurs during processing, the function will return
 // false, an empty string and an appropriate error.
-func lockedAnnexContent(gitdir string) (bool, string, error) {
+func lockedAnnexContent(ctx context.Context, gitdir string) (bool, string, error) {
 	if _, err := os.Stat(gitdir); os.IsNotExist(err) {
 		return false, "", fmt.Errorf("path not found %q", gitdir)
 	}
 	// command should not return with an error or with any stderr content
 	// If stdout is empty, there is no locked content. If it is not empty,
 	// the number of lines correspond to the number of files with locked content.
-	stdout, stderr, err := remoteGitCMD(gitdir, true, "find", "--locked")
+	stdout, stderr, err := remoteGitCMD(ctx, gitdir, true, "find", "--locked")
 	if err != nil {
 		return false, "", err
 	} else if string(stderr) != "" {
@@ -667,12 +797,12 @@ func lockedAnnexContent(gitdir string) (bool, string, error) {
 // in the format "[size in float] [fully spelled unit]bytes"
 // e.g. "12.2 gigabytes". If any issue occurs while parsing the
 // annex content size, the function returns with an appropriate error.
-func annexSize(gitdir string) (string, error) {
+func annexSize(ctx context.Context, gitdir string) (string, error) {
 	if _, err := os.Stat(gitdir); os.IsNotExist(err) {
 		return "", fmt.Errorf("path not found %q", gitdir)
 	}
 	// command should not return with an error or with any stderr content
-	stdout, stderr, err := remoteGitCMD(gitdir, true, "info", "--fast", ".")
+	stdout, stderr, err := remoteGitCMD(ctx, gitdir, true, "info", "--fast", ".")
 	if err != nil {
 		return "", err
 	} else if string(stderr) != "" {
@@ -686,127 +816,3 @@ func annexSize(gitdir string) (string, error) {
 	}
 	return strings.TrimSpace(splitsizes[1]), nil
 }
-
-// unlockAnnexClone receives a directory of a git annex repository containing
-// locked annex content, the name of the repository and an output directory.
-// The function creates a local clone and annex file copy  of the primary
-// git annex content in the output directory and unlocks all annex files in
-// the secondary git annex repository.
-// When the process is successful, the full directory path of the secondary
-// repository is returned, otherwise the function ends with an appropriate
-// error.
-func unlockAnnexClone(reponame, gitcloneroot, gitrepodir string) (string, error) {
-	clonename := fmt.Sprintf("%s_unlocked", reponame)
-	clonedir := filepath.Join(gitcloneroot, clonename)
-	log.Printf("unlockAnnex: cloning %s to dir %s", gitrepodir, clonedir)
-
-	// Clone annex repository to specified clone directory
-	// Git clone outputs everything to stderr
-	stdout, stderr, err := remoteGitCMD(gitcloneroot, false, "clone", gitrepodir, clonename)
-	if err != nil {
-		return "", fmt.Errorf("error cloning annex repo %s: %q, %q", gitrepodir, err.Error(), stderr)
-	}
-	log.Printf("unlockAnnex: clone done: %q, %q", stdout, stderr)
-
-	// Make sure the git user credentials have been set; otherwise git annex copy will fail
-	_, stderr, err = remoteGitCMD(clonedir, false, "config", "user.name", "GIN-DOI-service-user")
-	if err != nil {
-		return "", fmt.Errorf("error setting git user for repo %s: %q, %q", gitrepodir, err.Error(), stderr)
-	}
-	_, stderr, err = remoteGitCMD(clonedir, false, "config", "user.email", "gin@g-node.org")
-	if err != nil {
-		return "", fmt.Errorf("error setting git email for repo %s: %q, %q", gitrepodir, err.Error(), stderr)
-	}
-
-	// Copy annex content to clone directory
-	stdout, stderr, err = remoteGitCMD(clonedir, true, "copy", "--all", "--from=origin")
-	if err != nil {
-		return "", fmt.Errorf("error on local annex (%s) content copy: %q, %q", clonedir, err.Error(), stderr)
-	} else if stderr != "" {
-		return "", fmt.Errorf("error output on local annex (%s) content copy: %q", clonedir, stderr)
-	}
-	log.Printf("unlockAnnex: local copy finished %q", stdout)
-
-	// re-check missing annex content in clone directory; should be false
-	hasmissing, missinglist, err := missingAnnexContent(clonedir)
-	if err != nil {
-		return "", fmt.Errorf("error checking missing annex after local copy (%s): %q", clonedir, err.Error())
-	} else if hasmissing {
-		return "", fmt.Errorf("missing annex content after local copy (%s): %q", clonedir, missinglist)
-	}
-
-	// unlock all locked annex files in clone directory
-	stdout, stderr, err = remoteGitCMD(clonedir, true, "unlock")
-	if err != nil {
-		return "", fmt.Errorf("error unlocking files on local copy (%s): %q, %q", clonedir, err.Error(), stderr)
-	} else if stderr != "" {
-		return "", fmt.Errorf("error unlocking files on local copy (%s): %q", clonedir, stderr)
-	}
-	log.Printf("unlockAnnex: Files unlocked in clone directory: %q", stdout)
-
-	// re-check locked content
-	haslocked, lockedlist, err := lockedAnnexContent(clonedir)
-	if err != nil {
-		return "", fmt.Errorf("error checking locked content on local copy: %q", err.Error())
-	} else if haslocked || lockedlist != "" {
-		return "", fmt.Errorf("found locked content after unlocking: %q", lockedlist)
-	}
-
-	return clonedir, nil
-}
-
-// acceptedAnnexSize parses a string containing git annex style formatted
-// repository size in the format "[size in float] [fully spelled unit]bytes"
-// e.g. "12.2 gigabytes".
-// If the string can be properly parsed, the provided unit is supported
-// and the size is below the supported threshold (currently 250.0 gigabytes)
-// the function returns true. In any other case including parsing issues,
-// the function returns false.
-func acceptedAnnexSize(annexSize string, cutoff float64) bool {
-	// acceptedGigaSize might be moved outside to become a server setting
-	acceptedGigaSize := cutoff
-
-	sizesplit := strings.Split(annexSize, " ")
-	if len(sizesplit) != 2 {
-		log.Printf("[acceptedAnnexSize] could not parse input (%s)", annexSize)
-		return false
-	}
-	// add check if sizesplit[0] is contained in accepted order
-	// since the base unit "byte" is contained in all larger units, this
-	// has to be checked specifically
-	checkUnit := strings.TrimSpace(sizesplit[1])
-	var acceptedunit bool
-	if checkUnit == "byte" || checkUnit == "bytes" {
-		acceptedunit = true
-	} else {
-		checkaccepted := []string{"kilobyte", "megabyte", "gigabyte", "terabyte"}
-		for _, check := range checkaccepted {
-			if strings.Contains(sizesplit[1], check) {
-				log.Printf("[acceptedAnnexSize] %q, %q", sizesplit[1], check)
-				acceptedunit = true
-			}
-		}
-	}
-
-	if !acceptedunit {
-		log.Printf("[acceptedAnnexSize] Unsupported size unit (%s)", annexSize)
-		return false
-	}
-
-	// make sure singular and plural are both accepted
-	if strings.Contains(sizesplit[1], "terabyte") {
-		log.Printf("[acceptedAnnexSize] Size above allowed limit (%s)", annexSize)
-		return false
-	} else if strings.Contains(sizesplit[1], "gigabyte") {
-		checksize, err := strconv.ParseFloat(sizesplit[0], 32)
-		if err != nil {
-			log.Printf("[acceptedAnnexSize] Could not parse repo size (%s) %q", annexSize, err.Error())
-			return false
-		}
-		if checksize > acceptedGigaSize {
-			log.Printf("[acceptedAnnexSize] Size above allowed limit (%s)", annexSize)
-			return false
-		}
-	}
-	return true
-}
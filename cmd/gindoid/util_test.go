@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -356,22 +357,34 @@ func TestHasGitModules(t *testing.T) {
 	}
 
 	// test non-existing URL
-	uex := HasGitModules("i/do/not", "exist")
+	uex := HasGitModules("i/do/not", "exist", "master")
 	if uex {
 		t.Fatal("Expected false on non-existing URL")
 	}
 
 	// test invalid URL
-	uex = HasGitModules(server.URL, "not/there")
+	uex = HasGitModules(server.URL, "not/there", "master")
 	if uex {
 		t.Fatal("Expected false on invalid URL")
 	}
 
 	// test valid URL
-	uex = HasGitModules(server.URL, "test")
+	uex = HasGitModules(server.URL, "test", "master")
 	if !uex {
 		t.Fatal("Expected true on valid URL")
 	}
+
+	// test valid URL at a different revision
+	uex = HasGitModules(server.URL, "test", "v1.0")
+	if !uex {
+		t.Fatal("Expected true on valid URL at revision")
+	}
+
+	// test revision without submodules
+	uex = HasGitModules(server.URL, "test", "nosubmodules")
+	if uex {
+		t.Fatal("Expected false on revision without submodules")
+	}
 }
 
 func TestRemoteGitCMD(t *testing.T) {
@@ -386,7 +399,7 @@ func TestRemoteGitCMD(t *testing.T) {
 	targetpath := t.TempDir()
 
 	// check running git command from non existing path
-	_, _, err = remoteGitCMD("/I/do/no/exist", false, "version")
+	_, _, err = remoteGitCMD(context.Background(), "/I/do/no/exist", false, "version")
 	if err == nil {
 		t.Fatal("expected error on non existing directory")
 	} else if !strings.Contains(err.Error(), "") {
@@ -394,12 +407,12 @@ func TestRemoteGitCMD(t *testing.T) {
 	}
 
 	// check running git command
-	stdout, stderr, err := remoteGitCMD(targetpath, false, "version")
+	stdout, stderr, err := remoteGitCMD(context.Background(), targetpath, false, "version")
 	if err != nil {
 		t.Fatalf("%q, %q, %q", err.Error(), stderr, stdout)
 	}
 	// check running git annex command
-	stdout, stderr, err = remoteGitCMD(targetpath, true, "version")
+	stdout, stderr, err = remoteGitCMD(context.Background(), targetpath, true, "version")
 	if err != nil {
 		t.Fatalf("%q, %q, %q", err.Error(), stderr, stdout)
 	}
@@ -417,37 +430,37 @@ func TestMissingAnnexContent(t *testing.T) {
 	targetpath := t.TempDir()
 
 	// test non existing directory error
-	_, _, err = missingAnnexContent("/home/not/exist")
+	_, _, err = missingAnnexContent(context.Background(), "/home/not/exist")
 	if err == nil {
 		t.Fatal("non existing directory should return an error")
 	}
 
 	// test non git directory error
-	ismissing, misslist, err := missingAnnexContent(targetpath)
+	ismissing, misslist, err := missingAnnexContent(context.Background(), targetpath)
 	if err == nil {
 		t.Fatalf("non git directory should return an error\nmissing: %t\n%q", ismissing, misslist)
 	}
 
 	// initialize git directory
-	stdout, stderr, err := remoteGitCMD(targetpath, false, "init")
+	stdout, stderr, err := remoteGitCMD(context.Background(), targetpath, false, "init")
 	if err != nil {
 		t.Fatalf("could not initialize git repo: %q, %q, %q", err.Error(), stdout, stderr)
 	}
 
 	// test git non annex dir error
-	ismissing, misslist, err = missingAnnexContent(targetpath)
+	ismissing, misslist, err = missingAnnexContent(context.Background(), targetpath)
 	if err == nil {
 		t.Fatalf("non git annex directory should return an error\nmissing: %t\n%q", ismissing, misslist)
 	}
 
 	// initialize annex
-	stdout, stderr, err = remoteGitCMD(targetpath, true, "init")
+	stdout, stderr, err = remoteGitCMD(context.Background(), targetpath, true, "init")
 	if err != nil {
 		t.Fatalf("could not init annex: %q, %q, %q", err.Error(), stdout, stderr)
 	}
 
 	// test git annex dir no error
-	ismissing, misslist, err = missingAnnexContent(targetpath)
+	ismissing, misslist, err = missingAnnexContent(context.Background(), targetpath)
 	if err != nil {
 		t.Fatalf("git annex directory should not return an error\n%s\n%s\n%t", err.Error(), misslist, ismissing)
 	}
@@ -461,20 +474,20 @@ func TestMissingAnnexContent(t *testing.T) {
 		t.Fatalf("Error creating annex data file %q", err.Error())
 	}
 	// add file to the annex
-	stdout, stderr, err = remoteGitCMD(targetpath, true, "add", fpath)
+	stdout, stderr, err = remoteGitCMD(context.Background(), targetpath, true, "add", fpath)
 	if err != nil {
 		t.Fatalf("error on git annex add file\n%s\n%s\n%s", err.Error(), stdout, stderr)
 	}
 	// uninit annex file so the cleanup can happen but ignore any further issues
 	// the temp folder will get cleaned up eventually anyway.
-	defer remoteGitCMD(targetpath, true, "uninit", fpath)
+	defer remoteGitCMD(context.Background(), targetpath, true, "uninit", fpath)
 
-	stdout, stderr, err = remoteGitCMD(targetpath, false, "commit", "-m", "'add annex file'")
+	stdout, stderr, err = remoteGitCMD(context.Background(), targetpath, false, "commit", "-m", "'add annex file'")
 	if err != nil {
 		t.Fatalf("error on git commit file\n%s\n%s\n%s", err.Error(), stdout, stderr)
 	}
 	// check no missing annex content
-	ismissing, misslist, err = missingAnnexContent(targetpath)
+	ismissing, misslist, err = missingAnnexContent(context.Background(), targetpath)
 	if err != nil {
 		t.Fatalf("missing annex content check should not return any issue\n%s\n%s\nmissing %t", err.Error(), misslist, ismissing)
 	} else if ismissing || misslist != "" {
@@ -482,13 +495,13 @@ func TestMissingAnnexContent(t *testing.T) {
 	}
 
 	// drop annex file content; use --force since the file content is in no other annex repo and annex thoughtfully complains
-	stdout, stderr, err = remoteGitCMD(targetpath, true, "drop", "--force", fpath)
+	stdout, stderr, err = remoteGitCMD(context.Background(), targetpath, true, "drop", "--force", fpath)
 	if err != nil {
 		t.Fatalf("error on git annex drop content\n%s\n%s\n%s", err.Error(), stdout, stderr)
 	}
 
 	// check missing annex content
-	ismissing, misslist, err = missingAnnexContent(targetpath)
+	ismissing, misslist, err = missingAnnexContent(context.Background(), targetpath)
 	if err != nil {
 		t.Fatalf("missing annex content check should not return any issue\n%s\n%t\n%s", err.Error(), ismissing, misslist)
 	} else if !ismissing || misslist == "" {
@@ -510,7 +523,7 @@ func TestLockedAnnexContent(t *testing.T) {
 	targetpath := t.TempDir()
 
 	// test non existing directory error
-	islocked, locklist, err := lockedAnnexContent("/home/not/exist")
+	islocked, locklist, err := lockedAnnexContent(context.Background(), "/home/not/exist")
 	if err == nil {
 		t.Fatalf("non existing directory should return an error (locked %t) %q", islocked, locklist)
 	} else if islocked || locklist != "" {
@@ -518,7 +531,7 @@ func TestLockedAnnexContent(t *testing.T) {
 	}
 
 	// test non git directory error
-	islocked, locklist, err = lockedAnnexContent(targetpath)
+	islocked, locklist, err = lockedAnnexContent(context.Background(), targetpath)
 	if err == nil {
 		t.Fatalf("non git directory should return an error (locked %t) %q", islocked, locklist)
 	} else if islocked || locklist != "" {
@@ -526,13 +539,13 @@ func TestLockedAnnexContent(t *testing.T) {
 	}
 
 	// initialize git directory
-	stdout, stderr, err := remoteGitCMD(targetpath, false, "init")
+	stdout, stderr, err := remoteGitCMD(context.Background(), targetpath, false, "init")
 	if err != nil {
 		t.Fatalf("could not initialize git repo: %q, %q, %q", err.Error(), stdout, stderr)
 	}
 
 	// test git non annex dir error
-	islocked, locklist, err = lockedAnnexContent(targetpath)
+	islocked, locklist, err = lockedAnnexContent(context.Background(), targetpath)
 	if err == nil {
 		t.Fatalf("non git annex directory should return an error (locked %t) %q", islocked, locklist)
 	} else if islocked || locklist != "" {
@@ -540,13 +553,13 @@ func TestLockedAnnexContent(t *testing.T) {
 	}
 
 	// initialize annex
-	stdout, stderr, err = remoteGitCMD(targetpath, true, "init")
+	stdout, stderr, err = remoteGitCMD(context.Background(), targetpath, true, "init")
 	if err != nil {
 		t.Fatalf("could not init annex: %q, %q, %q", err.Error(), stdout, stderr)
 	}
 
 	// test git annex dir no error on empty directory
-	islocked, locklist, err = lockedAnnexContent(targetpath)
+	islocked, locklist, err = lockedAnnexContent(context.Background(), targetpath)
 	if err != nil {
 		t.Fatalf("git annex directory should not return an error (locked %t) %s\n%s", islocked, locklist, err.Error())
 	} else if islocked || locklist != "" {
@@ -562,16 +575,16 @@ func TestLockedAnnexContent(t *testing.T) {
 		t.Fatalf("Error creating annex data file %q", err.Error())
 	}
 	// add file to the annex; note that this will also lock the file by annex default
-	stdout, stderr, err = remoteGitCMD(targetpath, true, "add", fpath)
+	stdout, stderr, err = remoteGitCMD(context.Background(), targetpath, true, "add", fpath)
 	if err != nil {
 		t.Fatalf("error on git annex add file\n%s\n%s\n%s", err.Error(), stdout, stderr)
 	}
 	// uninit annex file so the cleanup can happen but ignore any further issues
 	// the temp folder will get cleaned up eventually anyway.
-	defer remoteGitCMD(targetpath, true, "uninit", fpath)
+	defer remoteGitCMD(context.Background(), targetpath, true, "uninit", fpath)
 
 	// check no locked annex content
-	islocked, locklist, err = lockedAnnexContent(targetpath)
+	islocked, locklist, err = lockedAnnexContent(context.Background(), targetpath)
 	if err != nil {
 		t.Fatalf("locked annex content check should not return any issue (locked %t) %s\n%s", islocked, locklist, err.Error())
 	} else if !islocked || locklist == "" {
@@ -581,13 +594,13 @@ func TestLockedAnnexContent(t *testing.T) {
 	}
 
 	// unlock annex file content
-	stdout, stderr, err = remoteGitCMD(targetpath, true, "unlock", fpath)
+	stdout, stderr, err = remoteGitCMD(context.Background(), targetpath, true, "unlock", fpath)
 	if err != nil {
 		t.Fatalf("error on git annex lock content\n%s\n%s\n%s", err.Error(), stdout, stderr)
 	}
 
 	// check unlocked annex content
-	islocked, locklist, err = lockedAnnexContent(targetpath)
+	islocked, locklist, err = lockedAnnexContent(context.Background(), targetpath)
 	if err != nil {
 		t.Fatalf("unlocked annex content check should not return any issue (locked %t) %s\n%s", islocked, locklist, err.Error())
 	} else if islocked || locklist != "" {
@@ -607,7 +620,7 @@ func TestAnnexSize(t *testing.T) {
 	targetpath := t.TempDir()
 
 	// test non existing directory error
-	reposize, err := annexSize("/home/not/exist")
+	reposize, err := annexSize(context.Background(), "/home/not/exist")
 	if err == nil {
 		t.Fatalf("non existing directory should return an error %q", reposize)
 	} else if reposize != "" {
@@ -615,7 +628,7 @@ func TestAnnexSize(t *testing.T) {
 	}
 
 	// test non git directory error
-	reposize, err = annexSize(targetpath)
+	reposize, err = annexSize(context.Background(), targetpath)
 	if err == nil {
 		t.Fatalf("non git directory should return an error %q", reposize)
 	} else if reposize != "" {
@@ -623,13 +636,13 @@ func TestAnnexSize(t *testing.T) {
 	}
 
 	// initialize git directory
-	stdout, stderr, err := remoteGitCMD(targetpath, false, "init")
+	stdout, stderr, err := remoteGitCMD(context.Background(), targetpath, false, "init")
 	if err != nil {
 		t.Fatalf("could not initialize git repo: %q, %q, %q", err.Error(), stdout, stderr)
 	}
 
 	// test git non annex dir error
-	reposize, err = annexSize(targetpath)
+	reposize, err = annexSize(context.Background(), targetpath)
 	if err == nil {
 		t.Fatalf("non git annex directory should return an error %q", reposize)
 	} else if reposize != "" {
@@ -637,13 +650,13 @@ func TestAnnexSize(t *testing.T) {
 	}
 
 	// initialize annex
-	stdout, stderr, err = remoteGitCMD(targetpath, true, "init")
+	stdout, stderr, err = remoteGitCMD(context.Background(), targetpath, true, "init")
 	if err != nil {
 		t.Fatalf("could not init annex: %q, %q, %q", err.Error(), stdout, stderr)
 	}
 
 	// test git annex dir no error on empty directory
-	reposize, err = annexSize(targetpath)
+	reposize, err = annexSize(context.Background(), targetpath)
 	if err != nil {
 		t.Fatalf("git annex directory should not return an error %q\n%v", reposize, err)
 	} else if reposize == "" {
@@ -660,16 +673,16 @@ func TestAnnexSize(t *testing.T) {
 		t.Fatalf("Error creating annex data file %q", err.Error())
 	}
 	// add file to the annex; note that this will also lock the file by annex default
-	stdout, stderr, err = remoteGitCMD(targetpath, true, "add", fpath)
+	stdout, stderr, err = remoteGitCMD(context.Background(), targetpath, true, "add", fpath)
 	if err != nil {
 		t.Fatalf("error on git annex add file\n%s\n%s\n%s", err.Error(), stdout, stderr)
 	}
 	// uninit annex file so the cleanup can happen but ignore any further issues
 	// the temp folder will get cleaned up eventually anyway.
-	defer remoteGitCMD(targetpath, true, "uninit", fpath)
+	defer remoteGitCMD(context.Background(), targetpath, true, "uninit", fpath)
 
 	// check reposize
-	reposize, err = annexSize(targetpath)
+	reposize, err = annexSize(context.Background(), targetpath)
 	if err != nil {
 		t.Fatalf("unexpected error on annexSize %q %q", err.Error(), reposize)
 	} else if reposize == "" {
@@ -679,13 +692,13 @@ func TestAnnexSize(t *testing.T) {
 	}
 
 	// reposize should remain unchanged on unlocking files
-	stdout, stderr, err = remoteGitCMD(targetpath, true, "unlock", fpath)
+	stdout, stderr, err = remoteGitCMD(context.Background(), targetpath, true, "unlock", fpath)
 	if err != nil {
 		t.Fatalf("error on git annex lock content\n%s\n%s\n%s", err.Error(), stdout, stderr)
 	}
 
 	// check unlocked annex content
-	reposize, err = annexSize(targetpath)
+	reposize, err = annexSize(context.Background(), targetpath)
 	if err != nil {
 		t.Fatalf("unexpected error on annexSize %q %q", err.Error(), reposize)
 	} else if reposize == "" {
@@ -694,116 +707,3 @@ func TestAnnexSize(t *testing.T) {
 		t.Fatalf("expected return value '9 bytes' but got %q", reposize)
 	}
 }
-
-func TestUnlockAnnexClone(t *testing.T) {
-	// check annex is available to the test; stop the test otherwise
-	hasAnnex, err := annexAvailable()
-	if err != nil {
-		t.Fatalf("Error checking git annex: %q", err.Error())
-	} else if !hasAnnex {
-		t.Skipf("Annex is not available, skipping test...\n")
-	}
-
-	// prepare git annex directory
-	targetroot := t.TempDir()
-
-	reponame := "annextest"
-	sourcepath := filepath.Join(targetroot, reponame)
-	err = os.Mkdir(sourcepath, 0755)
-	if err != nil {
-		t.Fatalf("Could not create dir %q: %q", sourcepath, err.Error())
-	}
-
-	// initialize git directory
-	stdout, stderr, err := remoteGitCMD(sourcepath, false, "init")
-	if err != nil {
-		t.Fatalf("could not initialize git repo: %q, %q, %q", err.Error(), stdout, stderr)
-	}
-	// initialize annex
-	stdout, stderr, err = remoteGitCMD(sourcepath, true, "init")
-	if err != nil {
-		t.Fatalf("could not init annex: %q, %q, %q", err.Error(), stdout, stderr)
-	}
-	// create annex data file
-	fname := "datafile.txt"
-	fpath := filepath.Join(sourcepath, fname)
-	err = ioutil.WriteFile(fpath, []byte("some data"), 0777)
-	if err != nil {
-		t.Fatalf("Error creating annex data file %q", err.Error())
-	}
-	// add file to the annex; note that this will also lock the file by annex default
-	stdout, stderr, err = remoteGitCMD(sourcepath, true, "add", fpath)
-	if err != nil {
-		t.Fatalf("error on git annex add file\n%s\n%s\n%s", err.Error(), stdout, stderr)
-	}
-	stdout, stderr, err = remoteGitCMD(sourcepath, false, "commit", "-m", "'add annex file'")
-	if err != nil {
-		t.Fatalf("error on git commit\n%s\n%s\n%s", err.Error(), stdout, stderr)
-	}
-	// uninit annex file so the cleanup can happen but ignore any further issues
-	// the temp folder will get cleaned up eventually anyway.
-	defer remoteGitCMD(sourcepath, true, "uninit", fpath)
-
-	// test unlockAnnexClone func
-	// check error on missing directory
-	_, err = unlockAnnexClone(reponame, targetroot, "/i/do/not/exist")
-	if err == nil {
-		t.Fatal("expected clone error on missing base dir")
-	}
-
-	// check no issue on duplicateAnnex
-	_, err = unlockAnnexClone(reponame, targetroot, sourcepath)
-	if err != nil {
-		t.Fatalf("error on duplicate: %q", err.Error())
-	}
-	// uninit annex file so the cleanup can happen but ignore any further issues
-	// the temp folder will get cleaned up eventually anyway.
-	targetpath := filepath.Join(targetroot, fmt.Sprintf("%s_unlocked", reponame))
-	defer remoteGitCMD(targetpath, true, "uninit", fpath)
-}
-
-func TestAcceptedAnnexSize(t *testing.T) {
-	// check empty string
-	if acceptedAnnexSize("", 250) {
-		t.Fatal("True on empty string")
-	}
-
-	// check non-splitable string
-	if acceptedAnnexSize("100kilobytes", 250) {
-		t.Fatal("True on invalid string")
-	}
-
-	// check unsupported 'unit'
-	if acceptedAnnexSize("10.4 petabytes", 250) {
-		t.Fatal("True on unsupported unit petabytes")
-	}
-
-	// check non parseable size with threshold unit gigabytes
-	if acceptedAnnexSize("doesnotconverttofloat gigabytes", 250) {
-		t.Fatal("True on non-parsable size")
-	}
-
-	// check supported units
-	if !acceptedAnnexSize("10.4 bytes", 250) {
-		t.Fatal("False on bytes")
-	}
-	if !acceptedAnnexSize("10.4 kilobytes", 250) {
-		t.Fatal("False on kilobytes")
-	}
-	if !acceptedAnnexSize("10.4 megabytes", 250) {
-		t.Fatal("False on megabytes")
-	}
-
-	// check supported unit and supported size
-	if !acceptedAnnexSize("10.4 gigabytes", 250) {
-		t.Fatal("False on allowed gigabytes")
-	}
-
-	// check supported unit and unsupported size
-	if acceptedAnnexSize("250.1 gigabytes", 250) {
-		t.Fatal("True on unsupported size")
-	}
-	if acceptedAnnexSize("1 terabytes", 250) {
-		t.Fatal("True on terabyte")
-	}
-}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -22,12 +23,12 @@ var allowedValues = map[string][]string{
 // collectWarnings checks for non-critical missing information or issues that
 // may need admin attention. These should be sent with the followup
 // notification email.
-func collectWarnings(job *RegistrationJob) (warnings []string) {
+func collectWarnings(ctx context.Context, job *RegistrationJob) (warnings []string) {
 	// NOTE: This is a workaround for the current inability to check a
 	// potential DOI fork for previous releases.  If the repository has a DOI
 	// fork, a notice is added to the admin email to check for previous
 	// releases manually.
-	if forks, err := getRepoForks(job.Config.GIN.Session, job.Metadata.SourceRepository); err == nil {
+	if forks, err := getRepoForks(ctx, job.Config, job.Metadata.SourceRepository); err == nil {
 		for _, fork := range forks {
 			if strings.ToLower(fork.Owner.UserName) == job.Config.GIN.Session.Username {
 				warnings = append(warnings, "Repository is already forked by DOI service user: Manual check for releases is required")
@@ -36,7 +37,7 @@ func collectWarnings(job *RegistrationJob) (warnings []string) {
 		}
 	}
 
-	submod := HasGitModules(GetGINURL(job.Config), job.Metadata.SourceRepository)
+	submod := hasGitModules(ctx, GetGINURL(job.Config), job.Metadata.SourceRepository, job.revision())
 	if submod {
 		warnings = append(warnings, fmt.Sprintln("Repository contains submodules"))
 	}
@@ -52,7 +53,7 @@ func collectWarnings(job *RegistrationJob) (warnings []string) {
 	}
 
 	// Check licenses
-	repoLicURL := repoFileURL(job.Config, job.Metadata.SourceRepository, "LICENSE")
+	repoLicURL := repoFileURL(job.Config, job.Metadata.SourceRepository, job.revision(), "LICENSE")
 	warnings = licenseWarnings(job.Metadata.YAMLData, repoLicURL, warnings)
 
 	// Check if any funder IDs are missing
@@ -80,7 +81,7 @@ func collectWarnings(job *RegistrationJob) (warnings []string) {
 	reponame := strings.ToLower(repoparts[1]) // clone directory is always lowercase
 	repodir := filepath.Join(preppath, reponame)
 
-	warnings = contentSizeWarning(repodir, job.Metadata, warnings)
+	warnings = contentSizeWarning(ctx, repodir, job.Metadata, warnings)
 
 	return
 }
@@ -90,10 +91,10 @@ func collectWarnings(job *RegistrationJob) (warnings []string) {
 // the zip file size from the job metadata to a provided list of warnings.
 // If the annex size cannot be assertained, the incident is logged,
 // but no warning is added.
-func contentSizeWarning(repodir string, md *libgin.RepositoryMetadata, warnings []string) []string {
-	asize, err := annexSize(repodir)
+func contentSizeWarning(ctx context.Context, repodir string, md *libgin.RepositoryMetadata, warnings []string) []string {
+	asize, err := annexSize(ctx, repodir)
 	if err != nil {
-		log.Printf("[sizeNotice] Error: could not identify annex size: %q", err.Error())
+		logger(ctx).Error("Could not identify annex size", "error", err.Error())
 	} else {
 		zipsize := "n/a"
 		if md.DataCite != nil && md.Sizes != nil && len(*md.Sizes) > 0 {
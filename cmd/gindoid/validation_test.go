@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -252,7 +253,7 @@ func TestContentSizeWarning(t *testing.T) {
 	md := &libgin.RepositoryMetadata{}
 
 	// check nothing added on non-existing directory
-	warnings = contentSizeWarning("/tmp/I/dont/exist", md, warnings)
+	warnings = contentSizeWarning(context.Background(), "/tmp/I/dont/exist", md, warnings)
 	if len(warnings) != 0 {
 		t.Fatalf("invalid dir: expected empty warning list but got: %q", warnings)
 	}
@@ -269,24 +270,24 @@ func TestContentSizeWarning(t *testing.T) {
 	targetpath := t.TempDir()
 
 	// test no warning on non-git dir
-	warnings = contentSizeWarning(targetpath, md, warnings)
+	warnings = contentSizeWarning(context.Background(), targetpath, md, warnings)
 	if len(warnings) != 0 {
 		t.Fatalf("non git: expected empty warning list but got: %q", warnings)
 	}
 
 	// initialize git directory
-	stdout, stderr, err := remoteGitCMD(targetpath, false, "init")
+	stdout, stderr, err := remoteGitCMD(context.Background(), targetpath, false, "init")
 	if err != nil {
 		t.Fatalf("could not initialize git repo: %q, %q, %q", err.Error(), stdout, stderr)
 	}
 	// initialize annex
-	stdout, stderr, err = remoteGitCMD(targetpath, true, "init")
+	stdout, stderr, err = remoteGitCMD(context.Background(), targetpath, true, "init")
 	if err != nil {
 		t.Fatalf("could not init annex: %q, %q, %q", err.Error(), stdout, stderr)
 	}
 
 	// test no error on no annex files
-	warnings = contentSizeWarning(targetpath, md, warnings)
+	warnings = contentSizeWarning(context.Background(), targetpath, md, warnings)
 	if len(warnings) != 1 {
 		t.Fatalf("no annex files: expected warning list entry but got: %q", warnings)
 	} else if !strings.Contains(warnings[0], "n/a") || !strings.Contains(warnings[0], "Annex content size") {
@@ -302,16 +303,16 @@ func TestContentSizeWarning(t *testing.T) {
 		t.Fatalf("Error creating annex data file %q", err.Error())
 	}
 	// add file to the annex; note that this will also lock the file by annex default
-	stdout, stderr, err = remoteGitCMD(targetpath, true, "add", fpath)
+	stdout, stderr, err = remoteGitCMD(context.Background(), targetpath, true, "add", fpath)
 	if err != nil {
 		t.Fatalf("error on git annex add file\n%s\n%s\n%s", err.Error(), stdout, stderr)
 	}
 	// uninit annex file so the cleanup can happen but ignore any further issues
 	// the temp folder will get cleaned up eventually anyway.
-	defer remoteGitCMD(targetpath, true, "uninit", fpath)
+	defer remoteGitCMD(context.Background(), targetpath, true, "uninit", fpath)
 
 	// check warning but no zipsize on empty metadata
-	warnings = contentSizeWarning(targetpath, md, warnings)
+	warnings = contentSizeWarning(context.Background(), targetpath, md, warnings)
 	if len(warnings) != 1 {
 		t.Fatalf("empty metadata: expected annex size warning but got: %s", warnings)
 	} else if !strings.Contains(warnings[0], "n/a") || !strings.Contains(warnings[0], "Annex content size") {
@@ -321,7 +322,7 @@ func TestContentSizeWarning(t *testing.T) {
 	// check warning on empty metadata sizes
 	warnings = []string{}
 	md.DataCite = &libgin.DataCite{}
-	warnings = contentSizeWarning(targetpath, md, warnings)
+	warnings = contentSizeWarning(context.Background(), targetpath, md, warnings)
 	if len(warnings) != 1 {
 		t.Fatalf("empty metadata size: expected an annex size warning but got: %s", warnings)
 	}
@@ -332,7 +333,7 @@ func TestContentSizeWarning(t *testing.T) {
 	// check zip size and warning append
 	zipsize := "zipsize12"
 	md.DataCite.Sizes = &[]string{zipsize}
-	warnings = contentSizeWarning(targetpath, md, warnings)
+	warnings = contentSizeWarning(context.Background(), targetpath, md, warnings)
 	if len(warnings) != 2 {
 		t.Fatalf("valid entry: unexpected number of warnings: %q", warnings)
 	}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/G-Node/libgin/libgin"
 	"github.com/spf13/cobra"
@@ -20,6 +28,26 @@ type reqResultData struct {
 	Repository string
 }
 
+// jobStatusData holds the publicly visible processing status of a
+// registration job. It is used to render the JobStatus template and as
+// the response of JSON status requests.
+type jobStatusData struct {
+	DOI        string             `json:"doi"`
+	Repository string             `json:"repository"`
+	State      JobState           `json:"state"`
+	Progress   string             `json:"progress,omitempty"`
+	Created    time.Time          `json:"created"`
+	Updated    time.Time          `json:"updated"`
+	History    []jobStatusHistory `json:"history"`
+}
+
+// jobStatusHistory holds a single state change for the jobStatusData.
+// Transition notes are left out, since they may contain internal details.
+type jobStatusHistory struct {
+	State JobState  `json:"state"`
+	Time  time.Time `json:"time"`
+}
+
 func web(cmd *cobra.Command, args []string) {
 	log.Printf("Starting up %s", cmd.Version)
 
@@ -27,11 +55,14 @@ func web(cmd *cobra.Command, args []string) {
 	if err != nil {
 		log.Fatalf("Startup failed: %v", err)
 	}
+	setupLogging(config)
 
 	// Pretty print configuration for debugging, but hide sensitive stuff
 	cc := *config
 	cc.Key = "[HIDDEN]"
 	cc.GIN.Password = "[HIDDEN]"
+	cc.Admin.Password = "[HIDDEN]"
+	cc.DataCite.Password = "[HIDDEN]"
 	j, _ := json.MarshalIndent(cc, "", "  ")
 	log.Print(string(j))
 
@@ -41,12 +72,27 @@ func web(cmd *cobra.Command, args []string) {
 		log.Fatal(err)
 	}
 
-	defer config.GIN.Session.Logout()
+	jobstore, err := newJobStore(filepath.Join(config.Storage.PreparationDirectory, jobstoredir))
+	if err != nil {
+		log.Fatalf("Startup failed: %v", err)
+	}
+	config.Jobs = jobstore
+
+	reservations, err := newReservationStore(filepath.Join(config.Storage.PreparationDirectory, reservationsfile))
+	if err != nil {
+		log.Fatalf("Startup failed: %v", err)
+	}
+	syncReservations(reservations, jobstore)
+	config.Reservations = reservations
 
 	jobQueue := make(chan *RegistrationJob, config.MaxQueue)
 	dispatcher := newDispatcher(jobQueue, config.MaxWorkers)
 	dispatcher.run(newWorker)
 
+	// Re-enqueue jobs that were queued or running when the service stopped
+	resumeJobs(jobstore, jobQueue, config)
+	resetPublishing(jobstore)
+
 	// Start the HTTP handlers.
 
 	// Root redirects to storage URL (DOI listing page)
@@ -58,30 +104,117 @@ func web(cmd *cobra.Command, args []string) {
 		renderRequestPage(w, r, config)
 	})
 
-	// submit starts the registration job
+	// submit starts the registration job; new requests are rejected while
+	// the service shuts down
+	var shuttingdown atomic.Bool
 	http.HandleFunc("/submit", func(w http.ResponseWriter, r *http.Request) {
+		if shuttingdown.Load() {
+			log.Printf("Rejecting DOI request during shutdown")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			renderResult(w, &reqResultData{Message: template.HTML(msgServiceShutdown)}, config)
+			return
+		}
 		startDOIRegistration(w, r, jobQueue, config)
 	})
 
+	// status reports the processing status of a registration job
+	http.HandleFunc("/status/", func(w http.ResponseWriter, r *http.Request) {
+		renderJobStatus(w, r, config)
+	})
+
+	// admin lists all registration jobs for the curators
+	http.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+		renderAdminJobList(w, r, config)
+	})
+
+	// admin/retry re-runs a finished registration job
+	http.HandleFunc("/admin/retry", func(w http.ResponseWriter, r *http.Request) {
+		retryJob(w, r, jobQueue, config)
+	})
+
+	// admin/review approves, rejects or requests changes for a prepared dataset
+	pubs := new(publications)
+	http.HandleFunc("/admin/review", func(w http.ResponseWriter, r *http.Request) {
+		reviewJob(w, r, pubs, config)
+	})
+
+	// healthz reports whether the local dependencies of the service work;
+	// readyz additionally checks the external services and the free space
+	livechecks := livenessChecks(config)
+	readychecks := readinessChecks(config, shuttingdown.Load)
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, r, livechecks)
+	})
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, r, readychecks)
+	})
+
+	// metrics exposes the service metrics in the Prometheus text format
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		serveMetrics(w, jobQueue, dispatcher, config)
+	})
+
 	// assets fetches static assets using a custom FileSystem
 	assetserver := http.FileServer(newAssetFS("/assets"))
 	http.Handle("/assets/", http.StripPrefix("/assets/", assetserver))
 
-	fmt.Printf("Listening for connections on port %d\n", config.Port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.Port), nil))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", config.Port)}
+	go func() {
+		fmt.Printf("Listening for connections on port %d\n", config.Port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigchan
+	log.Printf("Received %s; shutting down", sig)
+
+	// Stop accepting new requests and drain running jobs and publications;
+	// status pages remain available until all jobs have finished or the
+	// timeout is reached.
+	shuttingdown.Store(true)
+	log.Printf("Waiting up to %s for running jobs and publications to finish", config.ShutdownTimeout)
+	pubsdone := make(chan bool, 1)
+	go func() { pubsdone <- pubs.stop(config.ShutdownTimeout) }()
+	interruptJobs(dispatcher.stop(config.ShutdownTimeout))
+	if !<-pubsdone {
+		log.Print("Publications did not finish before shutdown; they have to be approved again")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down HTTP server: %s", err.Error())
+	}
+
+	log.Print("Logging out of GIN")
+	config.GIN.Session.Logout()
+	log.Print("Shutdown complete")
+}
+
+// DOIRequestData holds the request data sent by GIN. In addition to the
+// common libgin request data it carries the revision of the repository that
+// should be registered.
+type DOIRequestData struct {
+	libgin.DOIRequestData
+	// Ref is the branch, tag or commit hash to register; defaults to the
+	// default branch of the repository if the request does not specify one.
+	Ref string `json:"ref,omitempty"`
 }
 
 // decryptRequestData decrypts the submitted data into a map.  Returns with
 // error if the decryption fails, the encrypted data is not a valid JSON
-// object, or if any of the expected keys (username, realname, repository,
-// email) are not present.
-func decryptRequestData(regrequest string, key string) (*libgin.DOIRequestData, error) {
+// object, if any of the expected keys (username, realname, repository,
+// email) are not present or if the requested ref is invalid.
+func decryptRequestData(regrequest string, key string) (*DOIRequestData, error) {
 	plaintext, err := libgin.DecryptURLString([]byte(key), regrequest)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt verification string: %s", err.Error())
 	}
 
-	data := libgin.DOIRequestData{}
+	data := DOIRequestData{}
 	err = json.Unmarshal([]byte(plaintext), &data)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal request data: %s", err.Error())
@@ -92,6 +225,10 @@ func decryptRequestData(regrequest string, key string) (*libgin.DOIRequestData,
 		return nil, fmt.Errorf("invalid request: required key is missing or empty")
 	}
 
+	if data.Ref != "" && !validRef(data.Ref) {
+		return nil, fmt.Errorf("invalid request: invalid ref %q", data.Ref)
+	}
+
 	return &data, nil
 }
 
@@ -110,6 +247,13 @@ func injectDynamicGINURL(tmpl *template.Template, ginurl string) *template.Templ
 	return tmpl
 }
 
+// injectFunc overwrites the default template function with the given name.
+// The function map of the template is changed in place, so templates that
+// are rendered concurrently must be cloned before functions are injected.
+func injectFunc(tmpl *template.Template, name string, fn interface{}) *template.Template {
+	return tmpl.Funcs(template.FuncMap{name: fn})
+}
+
 // renderRequestPage renders the page for the staging area, where information
 // is provided to the user and offers to start the DOI registration request.
 // It validates the metadata provided from the GIN repository and shows
@@ -148,11 +292,14 @@ func renderRequestPage(w http.ResponseWriter, r *http.Request, conf *Configurati
 		return
 	}
 
+	if reqdata.Ref == "" {
+		reqdata.Ref = repoDefaultBranch(r.Context(), conf, reqdata.Repository)
+	}
 	regRequest.DOIRequestData = reqdata
 	regRequest.EncryptedRequestData = encReqData // Forward it through the hidden form in the template
 	regRequest.Metadata = &libgin.RepositoryMetadata{}
 
-	repoMetadata, err := readAndValidate(conf, regRequest.Repository)
+	repoMetadata, err := readAndValidate(conf, regRequest.Repository, regRequest.Ref)
 	if err != nil {
 		regRequest.ErrorMessages = []string{err.Error()}
 		regRequest.Message = template.HTML(err.Error())
@@ -227,6 +374,9 @@ func startDOIRegistration(w http.ResponseWriter, r *http.Request, jobQueue chan
 		return
 	}
 	resData.Repository = reqdata.Repository
+	if reqdata.Ref == "" {
+		reqdata.Ref = repoDefaultBranch(r.Context(), conf, reqdata.Repository)
+	}
 
 	log.Printf("Received DOI request: %+v", reqdata)
 
@@ -250,15 +400,36 @@ func startDOIRegistration(w http.ResponseWriter, r *http.Request, jobQueue chan
 	// ensure long clone and zip processes do not obscure a commit change
 	// after the fact;
 	// on error, an empty string is returned as commithash
-	commithash, err := getRepoCommit(conf.GIN.Session, reqdata.Repository)
+	commithash, err := getRepoCommit(conf.GIN.Session, reqdata.Repository, reqdata.Ref)
 	if err != nil {
 		log.Printf("%s", err.Error())
 	}
+	// pin the job to the resolved commit, so validation and the archive
+	// match the revision at the time of the request
+	regJob.Ref = reqdata.Ref
+	regJob.Commit = commithash
+
+	// Serialise the duplicate check and the DOI reservation, so concurrent
+	// requests for the same repository cannot both pass the check.
+	unlock := submitLocks.lock(reqdata.Repository)
+	// a registration the curators requested changes for is resubmitted
+	// with its DOI instead of reserving a new one
+	existing, state, ok := existingRegistration(conf, reqdata.Repository, commithash)
+	resubmit := ok && state == JobChangesRequested
+	if ok && !resubmit {
+		unlock()
+		log.Printf("Repository %q already has the registration %q", reqdata.Repository, existing)
+		resData.Success = false
+		resData.Level = "warning"
+		resData.Message = template.HTML(fmt.Sprintf(msgAlreadyRegistered, existing, existing))
+		renderResult(w, &resData, conf)
+		return
+	}
 
 	// exiting beyond this point should trigger an email notification
 	defer func() {
 		// This is the first notification, so include the entire info
-		err := notifyAdmin(regJob, errors, nil, true, commithash)
+		err := notifyAdmin(context.Background(), regJob, errors, nil, true, commithash)
 		if err != nil {
 			// Email send failed
 			// Log the error
@@ -273,22 +444,28 @@ func startDOIRegistration(w http.ResponseWriter, r *http.Request, jobQueue chan
 		renderResult(w, &resData, conf)
 	}()
 
-	// generate random DOI (keep generating if it's already registered)
-	var doi string
-	maxtry := 5
-	for ntry := 0; doi == "" || libgin.IsRegisteredDOI(doi); ntry++ {
-		// limit to 5 attempts in case something goes wrong (a bug in the
-		// randomiser) or we somehow win the lottery and keep generating valid
-		// DOIs
-		if ntry == maxtry {
-			errors = append(errors, fmt.Sprintf("Couldn't find a new DOI after %d tries (or the PRNG is broken)", maxtry))
+	// generate random DOI (keep generating if it's already reserved or registered)
+	doi := existing
+	submitted := false
+	if resubmit {
+		unlock()
+		log.Printf("Resubmitting registration %q", doi)
+	} else {
+		doi, err = newDOI(conf, requser.Username, reqdata.Repository)
+		unlock()
+		if err != nil {
+			errors = append(errors, err.Error())
 			resData.Success = false
 			resData.Level = "warning"
 			resData.Message = template.HTML(msgSubmitError)
 			return
-
 		}
-		doi = conf.DOIBase + randAlnum(6)
+		// release the reserved DOI if the request is not submitted
+		defer func() {
+			if !submitted {
+				setReservationState(conf, doi, ReservationReleased)
+			}
+		}()
 	}
 
 	// NOTE: Delete?
@@ -304,7 +481,7 @@ func startDOIRegistration(w http.ResponseWriter, r *http.Request, jobQueue chan
 		return
 	}
 
-	repoMetadata, err := readAndValidate(conf, regJob.Metadata.SourceRepository)
+	repoMetadata, err := readAndValidate(conf, regJob.Metadata.SourceRepository, regJob.revision())
 	if err != nil {
 		errors = append(errors, err.Error())
 		resData.Success = false
@@ -335,8 +512,26 @@ func startDOIRegistration(w http.ResponseWriter, r *http.Request, jobQueue chan
 
 	log.Printf("Submitting job")
 
+	// Record the job before queueing it, so it can be resumed after a restart
+	if resubmit {
+		if err := resubmitJob(regJob); err != nil {
+			log.Printf("Failed to resubmit job: %s", err.Error())
+			errors = append(errors, fmt.Sprintf("Failed to resubmit job %s: %s", doi, err.Error()))
+			resData.Success = false
+			resData.Level = "error"
+			resData.Message = template.HTML(msgSubmitError)
+			return
+		}
+	} else if conf.Jobs != nil {
+		if err := conf.Jobs.Add(regJob); err != nil {
+			log.Printf("Failed to record job: %s", err.Error())
+			errors = append(errors, fmt.Sprintf("Failed to record job; the job will not be resumed after a service restart: %s", err.Error()))
+		}
+	}
+
 	// Add job to queue
 	jobQueue <- regJob
+	submitted = true
 
 	// Render success (deferred)
 	log.Printf("Render success")
@@ -346,12 +541,93 @@ func startDOIRegistration(w http.ResponseWriter, r *http.Request, jobQueue chan
 	resData.Message = template.HTML(message)
 
 	// Send user email notification
-	if err := notifyUser(regJob); err != nil {
+	if err := notifyUser(context.Background(), regJob); err != nil {
 		// Inform admins that user email failed
 		errors = append(errors, fmt.Sprintf("Failed to send user notification email: %s", err.Error()))
 	}
 }
 
+// resubmitJob queues the job of a registration the curators requested
+// changes for again. The record is updated with the metadata and the commit
+// of the resubmitted request and the job is run from scratch.
+func resubmitJob(job *RegistrationJob) error {
+	doi := job.Metadata.Identifier.ID
+	store := job.Config.Jobs
+	_, err := store.Transition(doi, func(s JobState) bool { return s == JobChangesRequested }, JobQueued, "resubmitted by the requester")
+	if err != nil {
+		return err
+	}
+	md, err := copyMetadata(job.Metadata)
+	if err != nil {
+		return err
+	}
+	job.Retry = RetryClone
+	return store.Update(doi, func(rec *JobRecord) {
+		rec.Metadata = md
+		rec.Ref = job.Ref
+		rec.CommitHash = job.Commit
+		rec.Errors = nil
+		rec.Warnings = nil
+	})
+}
+
+// newJobStatusData creates the public status data from a job record.
+func newJobStatusData(rec JobRecord) *jobStatusData {
+	status := &jobStatusData{
+		DOI:        rec.Metadata.Identifier.ID,
+		Repository: rec.Metadata.SourceRepository,
+		State:      rec.State,
+		Progress:   rec.Progress,
+		Created:    rec.Created,
+		Updated:    rec.Updated,
+		History:    make([]jobStatusHistory, len(rec.History)),
+	}
+	for idx, trans := range rec.History {
+		status.History[idx] = jobStatusHistory{State: trans.State, Time: trans.Time}
+	}
+	return status
+}
+
+// renderJobStatus reports the processing status of the registration job
+// with the DOI given in the request path '/status/<doi>'. The status is
+// returned as JSON if the request asks for it via the 'format=json' query
+// parameter or the Accept header, and rendered with the JobStatus template
+// otherwise.
+func renderJobStatus(w http.ResponseWriter, r *http.Request, conf *Configuration) {
+	doi := strings.Trim(strings.TrimPrefix(r.URL.Path, "/status/"), "/")
+	if doi == "" || conf.Jobs == nil {
+		http.NotFound(w, r)
+		return
+	}
+	rec, ok := conf.Jobs.Get(doi)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	status := newJobStatusData(rec)
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Printf("Failed to write job status: %s", err.Error())
+		}
+		return
+	}
+
+	tmpl, err := prepareTemplates("JobStatus")
+	if err != nil {
+		log.Printf("Failed to parse JobStatus template: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Overwrite default GIN server URL with config GIN server URL
+	tmpl = injectDynamicGINURL(tmpl, GetGINURL(conf))
+	err = tmpl.Execute(w, status)
+	if err != nil {
+		log.Printf("Error rendering JobStatus template: %v", err.Error())
+	}
+}
+
 // renderResult renders the results of a registration request using the
 // 'RequestResult' template. If it fails to parse the template, it renders
 // the Message from the result data in plain HTML.
@@ -374,3 +650,102 @@ func renderResult(w http.ResponseWriter, resData *reqResultData, conf *Configura
 		log.Printf("Error rendering RequestResult template: %v", err.Error())
 	}
 }
+
+// repoLocks serialises the registration requests of each repository.
+type repoLocks struct {
+	mu    sync.Mutex
+	locks map[string]*repoLock
+}
+
+type repoLock struct {
+	sync.Mutex
+	// refs counts the requests holding or waiting for the lock
+	refs int
+}
+
+// submitLocks serialises the duplicate check and the DOI reservation of
+// concurrent registration requests for the same repository.
+var submitLocks = &repoLocks{locks: make(map[string]*repoLock)}
+
+// lock locks the repository and returns the function unlocking it.
+// Repository names are not case sensitive.
+func (l *repoLocks) lock(repository string) func() {
+	key := strings.ToLower(repository)
+	l.mu.Lock()
+	rl, ok := l.locks[key]
+	if !ok {
+		rl = new(repoLock)
+		l.locks[key] = rl
+	}
+	rl.refs++
+	l.mu.Unlock()
+
+	rl.Lock()
+	return func() {
+		rl.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		rl.refs--
+		if rl.refs == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
+
+// existingRegistration returns the DOI and the job state of an existing
+// registration for the repository that is still pending or has been
+// published for the same commit. Failed registrations are pending, since the
+// curators can still re-run or re-publish them. Rejected registrations and
+// published registrations of a different commit, i.e. previous versions of
+// the dataset, are ignored. The state is empty if the DOI has been reserved
+// but the job has not been recorded yet.
+func existingRegistration(conf *Configuration, repository, commithash string) (string, JobState, bool) {
+	jobdois := make(map[string]bool)
+	if conf.Jobs != nil {
+		for _, rec := range conf.Jobs.List() {
+			if !strings.EqualFold(rec.Metadata.SourceRepository, repository) {
+				continue
+			}
+			jobdois[rec.Metadata.Identifier.ID] = true
+			switch rec.State {
+			case JobRejected:
+				continue
+			case JobPublished:
+				if commithash == "" || rec.CommitHash != commithash {
+					continue
+				}
+			}
+			return rec.Metadata.Identifier.ID, rec.State, true
+		}
+	}
+	// DOIs are reserved before the job is recorded
+	if conf.Reservations != nil {
+		for _, res := range conf.Reservations.List() {
+			if res.State == ReservationReserved && strings.EqualFold(res.Repository, repository) && !jobdois[res.DOI] {
+				return res.DOI, "", true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// newDOI generates a new random DOI that has not been registered yet. If the
+// service keeps DOI reservations, the DOI is reserved for the requester and
+// repository and DOIs reserved before are never returned.
+func newDOI(conf *Configuration, requester, repository string) (string, error) {
+	// limit to 5 attempts in case something goes wrong (a bug in the
+	// randomiser) or we somehow win the lottery and keep generating valid
+	// DOIs
+	maxtry := 5
+	generate := func() string { return randAlnum(6) }
+	if conf.Reservations != nil {
+		return conf.Reservations.Reserve(conf.DOIBase, generate, libgin.IsRegisteredDOI, requester, repository, maxtry)
+	}
+	for ntry := 0; ntry < maxtry; ntry++ {
+		doi := conf.DOIBase + generate()
+		if !libgin.IsRegisteredDOI(doi) {
+			return doi, nil
+		}
+	}
+	return "", fmt.Errorf("couldn't find a new DOI after %d tries (or the PRNG is broken)", maxtry)
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"html/template"
+	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/G-Node/libgin/libgin"
 )
 
 // TestInjectDynamicGINURL checks that the function injectDynamicGINURL
@@ -64,3 +70,217 @@ func TestRenderResult(t *testing.T) {
 		t.Fatal("Did not retrieve DOI request fail page")
 	}
 }
+
+func TestRenderJobStatus(t *testing.T) {
+	conf := &Configuration{}
+
+	// check not found without job store
+	w := httptest.NewRecorder()
+	renderJobStatus(w, httptest.NewRequest("GET", "/status/10.12751/g-node.sssss1", nil), conf)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected status not found without job store but got %d", w.Code)
+	}
+
+	store, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf.Jobs = store
+	job := testJob("10.12751/g-node.sssss1", "owner/repo", conf)
+	if err = store.Add(job); err != nil {
+		t.Fatalf("Error adding job: %q", err.Error())
+	}
+	setJobState(job, JobFailed, "internal error details")
+
+	// check not found on unknown and empty DOI
+	for _, reqpath := range []string{"/status/", "/status/10.12751/g-node.unknown"} {
+		w = httptest.NewRecorder()
+		renderJobStatus(w, httptest.NewRequest("GET", reqpath, nil), conf)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("Expected status not found for %q but got %d", reqpath, w.Code)
+		}
+	}
+
+	// check JSON status
+	w = httptest.NewRecorder()
+	renderJobStatus(w, httptest.NewRequest("GET", "/status/10.12751/g-node.sssss1?format=json", nil), conf)
+	status := jobStatusData{}
+	if err = json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Could not unmarshal job status: %q", err.Error())
+	}
+	if status.DOI != job.Metadata.Identifier.ID || status.Repository != "owner/repo" || status.State != JobFailed || len(status.History) != 2 {
+		t.Fatalf("Unexpected job status: %+v", status)
+	}
+	if strings.Contains(w.Body.String(), "internal error details") {
+		t.Fatal("Job status contains transition notes")
+	}
+
+	// check HTML status
+	w = httptest.NewRecorder()
+	renderJobStatus(w, httptest.NewRequest("GET", "/status/10.12751/g-node.sssss1", nil), conf)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "DOI request status") {
+		t.Fatalf("Unexpected job status page [%d]: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestExistingRegistration(t *testing.T) {
+	conf := &Configuration{}
+	if _, _, ok := existingRegistration(conf, "owner/repo", "abc"); ok {
+		t.Fatal("Unexpected registration without stores")
+	}
+
+	jobs, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf.Jobs = jobs
+	reservations, err := newReservationStore(filepath.Join(t.TempDir(), reservationsfile))
+	if err != nil {
+		t.Fatalf("Error creating reservation store: %q", err.Error())
+	}
+	conf.Reservations = reservations
+
+	rejected := testJob("10.12751/g-node.rrrrr1", "owner/rejected", conf)
+	published := testJob("10.12751/g-node.ppppp2", "owner/published", conf)
+	pending := testJob("10.12751/g-node.qqqqq3", "owner/pending", conf)
+	failed := testJob("10.12751/g-node.fffff5", "owner/failed", conf)
+	pubfailed := testJob("10.12751/g-node.fffff6", "owner/pubfailed", conf)
+	changes := testJob("10.12751/g-node.ccccc7", "owner/changes", conf)
+	for _, job := range []*RegistrationJob{rejected, published, pending, failed, pubfailed, changes} {
+		if err := jobs.Add(job); err != nil {
+			t.Fatalf("Error adding job: %q", err.Error())
+		}
+		if err := reservations.Add(Reservation{DOI: job.Metadata.Identifier.ID, Repository: job.Metadata.SourceRepository, State: ReservationReserved}); err != nil {
+			t.Fatalf("Error adding reservation: %q", err.Error())
+		}
+	}
+	setJobState(rejected, JobRejected, "")
+	setJobState(published, JobPublished, "")
+	updateJob(published, func(rec *JobRecord) { rec.CommitHash = "abc" })
+	setJobState(pending, JobDone, "")
+	setJobState(failed, JobFailed, "")
+	setJobState(pubfailed, JobPublishFailed, "")
+	setJobState(changes, JobChangesRequested, "")
+
+	// reserved DOI without a job yet
+	err = reservations.Add(Reservation{DOI: "10.12751/g-node.sssss4", Repository: "owner/Submitting", State: ReservationReserved})
+	if err != nil {
+		t.Fatalf("Error adding reservation: %q", err.Error())
+	}
+
+	for _, tc := range []struct {
+		repo   string
+		commit string
+		doi    string
+		state  JobState
+	}{
+		{"owner/rejected", "abc", "", ""},
+		{"owner/published", "def", "", ""},
+		{"owner/published", "", "", ""},
+		{"owner/published", "abc", published.Metadata.Identifier.ID, JobPublished},
+		{"Owner/Pending", "", pending.Metadata.Identifier.ID, JobDone},
+		{"owner/failed", "", failed.Metadata.Identifier.ID, JobFailed},
+		{"owner/pubfailed", "abc", pubfailed.Metadata.Identifier.ID, JobPublishFailed},
+		{"owner/changes", "", changes.Metadata.Identifier.ID, JobChangesRequested},
+		{"owner/submitting", "", "10.12751/g-node.sssss4", ""},
+		{"owner/new", "abc", "", ""},
+	} {
+		doi, state, ok := existingRegistration(conf, tc.repo, tc.commit)
+		if doi != tc.doi || state != tc.state || ok != (tc.doi != "") {
+			t.Fatalf("Unexpected registration for %s@%s: %q %q (%v)", tc.repo, tc.commit, doi, state, ok)
+		}
+	}
+}
+
+func TestResubmitJob(t *testing.T) {
+	conf := &Configuration{}
+	jobs, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf.Jobs = jobs
+	job := testJob("10.12751/g-node.ccccc1", "owner/repo", conf)
+	job.Commit = "abc"
+	if err := jobs.Add(job); err != nil {
+		t.Fatalf("Error adding job: %q", err.Error())
+	}
+	setJobState(job, JobDone, "")
+
+	resubmitted := testJob("10.12751/g-node.ccccc1", "owner/repo", conf)
+	resubmitted.Commit = "def"
+	resubmitted.Metadata.DataCite.Titles = []string{"Fixed title"}
+	if err := resubmitJob(resubmitted); err == nil {
+		t.Fatal("Resubmitted job without requested changes")
+	}
+
+	setJobState(job, JobChangesRequested, "fix the title")
+	if err := resubmitJob(resubmitted); err != nil {
+		t.Fatalf("Error resubmitting job: %q", err.Error())
+	}
+	rec, _ := jobs.Get(job.Metadata.Identifier.ID)
+	if rec.State != JobQueued || rec.CommitHash != "def" || len(rec.Metadata.DataCite.Titles) != 1 || resubmitted.Retry != RetryClone {
+		t.Fatalf("Unexpected resubmitted job: %+v", rec)
+	}
+	// a resubmission is only queued once
+	if err := resubmitJob(resubmitted); err == nil {
+		t.Fatal("Resubmitted queued job")
+	}
+}
+
+func TestRepoLocks(t *testing.T) {
+	locks := &repoLocks{locks: make(map[string]*repoLock)}
+	unlock := locks.lock("owner/repo")
+
+	// other repositories are not blocked
+	locks.lock("owner/other")()
+
+	locked := make(chan struct{})
+	go func() {
+		locks.lock("Owner/Repo")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Repository locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+	if len(locks.locks) != 0 {
+		t.Fatalf("Unreleased repository locks: %v", locks.locks)
+	}
+}
+
+func TestDecryptRequestData(t *testing.T) {
+	key := "0123456789abcdef0123456789abcdef"
+	encrypt := func(data string) string {
+		enc, err := libgin.EncryptURLString([]byte(key), data)
+		if err != nil {
+			t.Fatalf("Error encrypting request data: %s", err.Error())
+		}
+		return enc
+	}
+
+	reqdata, err := decryptRequestData(encrypt(`{"username":"user","repository":"user/repo","email":"user@example.org"}`), key)
+	if err != nil {
+		t.Fatalf("Error decrypting request data: %s", err.Error())
+	}
+	if reqdata.Repository != "user/repo" || reqdata.Ref != "" {
+		t.Fatalf("Unexpected request data: %+v", reqdata)
+	}
+
+	reqdata, err = decryptRequestData(encrypt(`{"username":"user","repository":"user/repo","email":"user@example.org","ref":"v1.0"}`), key)
+	if err != nil {
+		t.Fatalf("Error decrypting request data: %s", err.Error())
+	}
+	if reqdata.Ref != "v1.0" {
+		t.Fatalf("Unexpected ref: %q", reqdata.Ref)
+	}
+
+	if _, err = decryptRequestData(encrypt(`{"username":"user","repository":"user/repo","email":"user@example.org","ref":"--upload-pack=x"}`), key); err == nil {
+		t.Fatal("Expected error on invalid ref")
+	}
+	if _, err = decryptRequestData(encrypt(`{"username":"user","email":"user@example.org"}`), key); err == nil {
+		t.Fatal("Expected error on missing repository")
+	}
+}
@@ -6,9 +6,13 @@
 package main
 
 import (
+	"context"
 	_ "expvar"
-	"log"
+	"fmt"
 	_ "net/http/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/G-Node/libgin/libgin"
 )
@@ -18,8 +22,49 @@ import (
 type RegistrationJob struct {
 	Metadata *libgin.RepositoryMetadata
 	Config   *Configuration
+	// Retry is set when a previously processed job is run again and
+	// selects the stage the job is restarted from.
+	Retry RetryStage
+	// Ref is the requested branch, tag or commit of the source repository.
+	Ref string
+	// Commit is the commit hash Ref pointed to at the time of the request.
+	Commit string
+	// Download holds the annex content download statistics of the current
+	// run; it is not set if the repository was not cloned.
+	Download *downloadStats
 }
 
+// revision returns the revision of the source repository the job registers:
+// the commit hash if it is known, otherwise the requested ref.
+func (job *RegistrationJob) revision() string {
+	if job.Commit != "" {
+		return job.Commit
+	}
+	if job.Ref != "" {
+		return job.Ref
+	}
+	return defaultRef
+}
+
+// RetryStage selects the stage a registration job is restarted from when it
+// is run again.
+type RetryStage string
+
+const (
+	// RetryClone removes any previous clone and runs the full job.
+	RetryClone RetryStage = "clone"
+	// RetryZip reuses the previous clone and recreates the archive.
+	RetryZip RetryStage = "zip"
+	// RetryLandingPage reuses the previous archive and recreates the landing
+	// page and the DataCite XML file.
+	RetryLandingPage RetryStage = "landingpage"
+	// RetryXML only recreates the DataCite XML file.
+	RetryXML RetryStage = "xml"
+)
+
+// retryStages lists all stages a job can be restarted from.
+var retryStages = []RetryStage{RetryClone, RetryZip, RetryLandingPage, RetryXML}
+
 // newWorker creates a worker that waits for new jobs on its JobQueue starts a
 // registration process when a job is received.
 func newWorker(id int, workerPool chan chan *RegistrationJob) Worker {
@@ -38,6 +83,15 @@ type Worker struct {
 	JobQueue   chan *RegistrationJob
 	WorkerPool chan chan *RegistrationJob
 	QuitChan   chan bool
+	// Running keeps track of the jobs currently processed by all workers;
+	// it is set by the Dispatcher, which registers each job before handing
+	// it to a worker.
+	Running *runningJobs
+	// Defer queues a job again later; it is set by the Dispatcher.
+	Defer func(job *RegistrationJob)
+	// Context is passed to the registration of each job; cancelling it
+	// aborts the running job. It is set by the Dispatcher.
+	Context context.Context
 }
 
 // start the worker and wait for jobs.
@@ -49,11 +103,18 @@ func (w *Worker) start() {
 			select {
 			case job := <-w.JobQueue:
 				// Dispatcher has added a job to my jobQueue
-				err := createRegisteredDataset(job)
-				if err != nil {
-					log.Printf("Encountered issue handling request: %q", err.Error())
+				select {
+				case <-w.QuitChan:
+					// We have been asked to stop; the job remains queued
+					// and is resumed on the next service start.
+					logger(w.context()).Info("Worker stopped; leaving job queued", "doi", job.Metadata.Identifier.ID, "repository", job.Metadata.SourceRepository, "worker", w.ID)
+					if w.Running != nil {
+						w.Running.remove(job)
+					}
+					return
+				default:
 				}
-				log.Printf("Worker %d Completed %q!", w.ID, job.Metadata.SourceRepository)
+				w.run(job)
 			case <-w.QuitChan:
 				// We have been asked to stop.
 				return
@@ -62,16 +123,170 @@ func (w *Worker) start() {
 	}()
 }
 
+// context returns the context of the worker.
+func (w *Worker) context() context.Context {
+	if w.Context == nil {
+		return context.Background()
+	}
+	return w.Context
+}
+
+// run processes a single registration job.
+func (w *Worker) run(job *RegistrationJob) {
+	if w.Running != nil {
+		defer w.Running.remove(job)
+	}
+	setJobState(job, JobRunning, fmt.Sprintf("worker %d", w.ID))
+	// the job changes the content of the storage directories
+	defer invalidateStorageUsage(job.Config)
+	ctx, closelog := jobLogger(w.context(), job, w.ID)
+	defer closelog()
+	log := logger(ctx)
+	log.Info("Starting registration job")
+	err := createRegisteredDataset(ctx, job)
+	if w.Running != nil && w.Running.isAbandoned() {
+		// The service shut down before the job finished and the job has
+		// already been reset; do not record the final state.
+		log.Warn("Finished abandoned job")
+		return
+	}
+	if _, ok := err.(*insufficientSpaceError); ok && w.Defer != nil {
+		log.Info("Deferring job", "reason", err.Error())
+		setJobState(job, JobDeferred, err.Error())
+		metrics.jobsFinished.inc("deferred")
+		w.Defer(job)
+		return
+	}
+	if cerr, ok := err.(*cancelledError); ok {
+		log.Error("Job cancelled", "error", cerr.Error())
+		setJobState(job, JobFailed, cerr.Error())
+		metrics.jobsFinished.inc("cancelled")
+	} else if err != nil {
+		log.Error("Encountered issue handling request", "error", err.Error())
+		setJobState(job, JobFailed, err.Error())
+		metrics.jobsFinished.inc("failed")
+	} else {
+		setJobState(job, JobDone, "")
+		metrics.jobsFinished.inc("done")
+	}
+	log.Info("Completed registration job")
+}
+
+// runningJobs keeps track of the jobs that are currently processed by the
+// workers, so they can be drained when the service shuts down.
+type runningJobs struct {
+	mu        sync.Mutex
+	wg        sync.WaitGroup
+	jobs      map[*RegistrationJob]bool
+	closed    bool
+	abandoned bool
+}
+
+func newRunningJobs() *runningJobs {
+	return &runningJobs{jobs: make(map[*RegistrationJob]bool)}
+}
+
+// add registers a job as being processed. Returns false if no jobs are
+// accepted anymore because the service shuts down.
+func (r *runningJobs) add(job *RegistrationJob) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	r.wg.Add(1)
+	r.jobs[job] = true
+	return true
+}
+
+// remove marks the job as finished.
+func (r *runningJobs) remove(job *RegistrationJob) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.jobs[job] {
+		return
+	}
+	delete(r.jobs, job)
+	r.wg.Done()
+}
+
+// close stops accepting new jobs, so the running jobs can be waited for.
+func (r *runningJobs) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+}
+
+// count returns the number of jobs that are currently processed.
+func (r *runningJobs) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.jobs)
+}
+
+// isAbandoned returns true if the running jobs have been abandoned.
+func (r *runningJobs) isAbandoned() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.abandoned
+}
+
+// drained waits up to the timeout for all running jobs to finish and returns
+// true if they did.
+func (r *runningJobs) drained(timeout time.Duration) bool {
+	return waitTimeout(&r.wg, timeout)
+}
+
+// waitTimeout waits up to the timeout for the wait group and returns true if
+// the wait group finished.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// wait waits up to the timeout for all running jobs to finish. If the timeout
+// is reached, the jobs that are still running are marked abandoned and
+// returned.
+func (r *runningJobs) wait(timeout time.Duration) []*RegistrationJob {
+	if r.drained(timeout) {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.abandoned = true
+	jobs := make([]*RegistrationJob, 0, len(r.jobs))
+	for job := range r.jobs {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
 // newDispatcher creates and returns a new Dispatcher object that holds all
 // waiting jobs and sends the next job in the queue to the first available
 // worker.
 func newDispatcher(jobQueue chan *RegistrationJob, maxWorkers int) *Dispatcher {
 	workerPool := make(chan chan *RegistrationJob, maxWorkers)
+	ctx, cancel := context.WithCancel(context.Background())
 
 	return &Dispatcher{
+		ctx:        ctx,
+		cancel:     cancel,
 		jobQueue:   jobQueue,
 		maxWorkers: maxWorkers,
 		workerPool: workerPool,
+		running:    newRunningJobs(),
+		quit:       make(chan bool),
+		stopped:    make(chan bool),
 	}
 }
 
@@ -81,6 +296,18 @@ type Dispatcher struct {
 	workerPool chan chan *RegistrationJob
 	maxWorkers int
 	jobQueue   chan *RegistrationJob
+	workers    []Worker
+	running    *runningJobs
+	quit       chan bool
+	// stopped is closed when the dispatching has ended
+	stopped chan bool
+	// waiting counts the jobs taken from the job queue that wait for a free
+	// worker
+	waiting atomic.Int64
+	// ctx is passed to all workers and cancelled when running jobs are
+	// abandoned on stop.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // run starts the dispatcher after creating and starting a new set of workers
@@ -88,22 +315,97 @@ type Dispatcher struct {
 func (d *Dispatcher) run(makeWorker func(int, chan chan *RegistrationJob) Worker) {
 	for i := 0; i < d.maxWorkers; i++ {
 		worker := makeWorker(i+1, d.workerPool)
+		worker.Running = d.running
+		worker.Defer = d.deferJob
+		worker.Context = d.ctx
 		worker.start()
+		d.workers = append(d.workers, worker)
 	}
 
 	go d.dispatch()
 }
 
+// cancelGrace limits the time the dispatcher waits for abandoned jobs to stop
+// their processes after they have been cancelled.
+const cancelGrace = 30 * time.Second
+
+// stop stops the dispatching of queued jobs and signals all workers to stop
+// after their current job. It waits up to the timeout for running jobs to
+// finish and returns the jobs that were still running when the timeout was
+// reached. The abandoned jobs are cancelled and stop waits up to cancelGrace
+// for them to end, so their artefacts are not removed while processes still
+// write to them. Queued jobs are not processed and remain queued in the job
+// store.
+func (d *Dispatcher) stop(timeout time.Duration) []*RegistrationJob {
+	close(d.quit)
+	<-d.stopped
+	// jobs that have not been handed to a worker yet remain queued
+	d.running.close()
+	for _, worker := range d.workers {
+		close(worker.QuitChan)
+	}
+	abandoned := d.running.wait(timeout)
+	d.cancel()
+	if len(abandoned) > 0 && !d.running.drained(cancelGrace) {
+		logger(d.ctx).Warn("Cancelled jobs did not stop in time", "grace", cancelGrace.String())
+	}
+	return abandoned
+}
+
+// deferJob queues a deferred job again after the defer interval of the job
+// configuration. Jobs that are still deferred when the dispatcher stops
+// remain deferred in the job store and are resumed on the next service start.
+func (d *Dispatcher) deferJob(job *RegistrationJob) {
+	interval := job.Config.Storage.DeferInterval
+	go func() {
+		select {
+		case <-d.quit:
+			return
+		case <-time.After(interval):
+		}
+		setJobState(job, JobQueued, "re-queued after disk space deferral")
+		select {
+		case d.jobQueue <- job:
+		case <-d.quit:
+		}
+	}()
+}
+
+// queued returns the number of jobs that wait for a free worker: the jobs in
+// the job queue and the jobs the dispatcher has taken from the queue.
+func (d *Dispatcher) queued() int {
+	return len(d.jobQueue) + int(d.waiting.Load())
+}
+
 func (d *Dispatcher) dispatch() {
-	//lint:ignore S1000 rewrite to suggested range syntax leads to loop variable i captured by func literal issue.
+	defer close(d.stopped)
 	for {
 		select {
+		case <-d.quit:
+			return
 		case job := <-d.jobQueue:
+			d.waiting.Add(1)
 			go func() {
-				log.Printf("Fetching workerJobQueue for %q", job.Metadata.SourceRepository)
-				workerJobQueue := <-d.workerPool
-				log.Printf("Adding %q to workerJobQueue", job.Metadata.SourceRepository)
-				workerJobQueue <- job
+				defer d.waiting.Add(-1)
+				log := logger(d.ctx).With("doi", job.Metadata.Identifier.ID, "repository", job.Metadata.SourceRepository)
+				log.Debug("Fetching worker job queue")
+				var workerJobQueue chan *RegistrationJob
+				select {
+				case workerJobQueue = <-d.workerPool:
+				case <-d.quit:
+					return
+				}
+				// the job is registered before the hand-off, so stop
+				// waits for it once a worker may have received it
+				if !d.running.add(job) {
+					return
+				}
+				log.Debug("Adding job to worker job queue")
+				select {
+				case workerJobQueue <- job:
+				case <-d.quit:
+					d.running.remove(job)
+				}
 			}()
 		}
 	}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunningJobs(t *testing.T) {
+	running := newRunningJobs()
+
+	// check no wait without running jobs
+	if jobs := running.wait(time.Second); len(jobs) != 0 {
+		t.Fatalf("Unexpected running jobs: %v", jobs)
+	}
+
+	jobA := testJob("10.12751/g-node.aaaaa1", "owner/repoa", nil)
+	jobB := testJob("10.12751/g-node.bbbbb2", "owner/repob", nil)
+	running.add(jobA)
+	running.add(jobB)
+
+	// check jobs finishing within the timeout
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		running.remove(jobB)
+	}()
+	running.remove(jobA)
+	if jobs := running.wait(5 * time.Second); len(jobs) != 0 {
+		t.Fatalf("Expected all jobs to finish but got %v", jobs)
+	}
+	if running.isAbandoned() {
+		t.Fatal("Finished jobs marked abandoned")
+	}
+
+	// check jobs still running after the timeout are returned
+	running.add(jobA)
+	jobs := running.wait(10 * time.Millisecond)
+	if len(jobs) != 1 || jobs[0] != jobA {
+		t.Fatalf("Unexpected unfinished jobs: %v", jobs)
+	}
+	if !running.isAbandoned() {
+		t.Fatal("Unfinished jobs not marked abandoned")
+	}
+	running.remove(jobA)
+
+	// no jobs are accepted after closing
+	running.close()
+	if running.add(jobB) || running.count() != 0 {
+		t.Fatal("Job accepted after closing")
+	}
+}
+
+func TestDispatcherStop(t *testing.T) {
+	jobQueue := make(chan *RegistrationJob, 1)
+	dispatcher := newDispatcher(jobQueue, 2)
+	dispatcher.run(newWorker)
+	for _, worker := range dispatcher.workers {
+		if worker.Running != dispatcher.running {
+			t.Fatalf("Worker %d is not tracked by the dispatcher", worker.ID)
+		}
+	}
+
+	if jobs := dispatcher.stop(time.Second); len(jobs) != 0 {
+		t.Fatalf("Unexpected running jobs: %v", jobs)
+	}
+
+	// jobs queued after stopping must not be dispatched
+	job := testJob("10.12751/g-node.qqqqq1", "owner/queued", nil)
+	jobQueue <- job
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case queued := <-jobQueue:
+		if queued != job {
+			t.Fatal("Unexpected job in queue")
+		}
+	default:
+		t.Fatal("Job was dispatched after stopping")
+	}
+}
+
+func TestDispatcherStopCancelled(t *testing.T) {
+	jobQueue := make(chan *RegistrationJob, 1)
+	dispatcher := newDispatcher(jobQueue, 0)
+	dispatcher.run(newWorker)
+
+	// a job that only stops some time after it has been cancelled
+	job := testJob("10.12751/g-node.rrrrr1", "owner/running", nil)
+	dispatcher.running.add(job)
+	var stopped atomic.Bool
+	go func() {
+		<-dispatcher.ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		stopped.Store(true)
+		dispatcher.running.remove(job)
+	}()
+
+	jobs := dispatcher.stop(10 * time.Millisecond)
+	if len(jobs) != 1 || jobs[0] != job {
+		t.Fatalf("Unexpected abandoned jobs: %v", jobs)
+	}
+	if !stopped.Load() {
+		t.Fatal("Stop returned before the cancelled job ended")
+	}
+}
+
+func TestDispatcherStopHandoff(t *testing.T) {
+	jobQueue := make(chan *RegistrationJob, 1)
+	// no workers are started
+	dispatcher := newDispatcher(jobQueue, 1)
+	go dispatcher.dispatch()
+
+	// a worker that has exited after offering its queue
+	dispatcher.workerPool <- make(chan *RegistrationJob)
+	job := testJob("10.12751/g-node.hhhhh1", "owner/handoff", nil)
+	jobQueue <- job
+	deadline := time.Now().Add(5 * time.Second)
+	for dispatcher.running.count() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if dispatcher.running.count() != 1 {
+		t.Fatal("Job was not registered before the hand-off")
+	}
+
+	// the hand-off is abandoned and the job remains queued
+	if jobs := dispatcher.stop(5 * time.Second); len(jobs) != 0 {
+		t.Fatalf("Unexpected abandoned jobs: %v", jobs)
+	}
+	if dispatcher.running.count() != 0 {
+		t.Fatal("Abandoned hand-off is still registered")
+	}
+	if dispatcher.ctx.Err() == nil {
+		t.Fatal("Dispatcher context was not cancelled")
+	}
+}
+
+func TestDispatcherDeferJob(t *testing.T) {
+	conf := &Configuration{}
+	conf.Storage.DeferInterval = 10 * time.Millisecond
+	store, err := newJobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating job store: %q", err.Error())
+	}
+	conf.Jobs = store
+	job := testJob("10.12751/g-node.dfrrd1", "owner/deferred", conf)
+	if err := store.Add(job); err != nil {
+		t.Fatalf("Error adding job: %q", err.Error())
+	}
+	setJobState(job, JobDeferred, "insufficient disk space")
+
+	jobQueue := make(chan *RegistrationJob, 1)
+	dispatcher := newDispatcher(jobQueue, 1)
+	dispatcher.deferJob(job)
+	select {
+	case queued := <-jobQueue:
+		if queued != job {
+			t.Fatal("Unexpected job in queue")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Deferred job was not queued again")
+	}
+	if rec, _ := store.Get(job.Metadata.Identifier.ID); rec.State != JobQueued {
+		t.Fatalf("Unexpected state of re-queued job: %q", rec.State)
+	}
+
+	// deferred jobs are not queued after the dispatcher stopped
+	setJobState(job, JobDeferred, "insufficient disk space")
+	close(dispatcher.quit)
+	dispatcher.deferJob(job)
+	time.Sleep(50 * time.Millisecond)
+	if len(jobQueue) != 0 {
+		t.Fatal("Deferred job was queued after stopping")
+	}
+	if rec, _ := store.Get(job.Metadata.Identifier.ID); rec.State != JobDeferred {
+		t.Fatalf("Unexpected state of deferred job: %q", rec.State)
+	}
+}
+
+func TestDispatcherQueued(t *testing.T) {
+	jobQueue := make(chan *RegistrationJob, 5)
+	// no workers are started, so dispatched jobs wait for a worker
+	dispatcher := newDispatcher(jobQueue, 1)
+	go dispatcher.dispatch()
+	defer close(dispatcher.quit)
+
+	jobQueue <- testJob("10.12751/g-node.aaaaa1", "owner/repoa", nil)
+	jobQueue <- testJob("10.12751/g-node.bbbbb2", "owner/repob", nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for (len(jobQueue) > 0 || dispatcher.queued() != 2) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := dispatcher.queued(); n != 2 || len(jobQueue) != 0 {
+		t.Fatalf("Expected 2 waiting jobs but got %d", n)
+	}
+
+	// a free worker takes a waiting job
+	workerJobQueue := make(chan *RegistrationJob)
+	dispatcher.workerPool <- workerJobQueue
+	<-workerJobQueue
+	for dispatcher.queued() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := dispatcher.queued(); n != 1 {
+		t.Fatalf("Expected 1 waiting job but got %d", n)
+	}
+}
@@ -1,12 +1,13 @@
 module github.com/G-Node/gin-doi
 
-go 1.20
+go 1.21
 
 require (
 	github.com/G-Node/gin-cli v0.0.0-20200213155541-7b8a0596ebb3
 	github.com/G-Node/libgin v0.5.6
 	github.com/dustin/go-humanize v1.0.0
 	github.com/gogs/go-gogs-client v0.0.0-20200905025246-8bb8a50cb355
+	github.com/klauspost/compress v1.16.7
 	github.com/spf13/cobra v0.0.6
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,156 @@
+package gdtmpl
+
+// AdminJobList is the template for rendering the list of all registration
+// jobs in the curator admin interface.
+const AdminJobList = `<!DOCTYPE html>
+<html lang="en">
+	<head data-suburl="">
+
+		<meta http-equiv="Content-Type" content="text/html; charset=UTF-8">
+		<meta http-equiv="X-UA-Compatible" content="IE=edge">
+
+		<meta name="robots" content="noindex,nofollow">
+
+		<link rel="shortcut icon" href="/assets/img/favicon.png">
+		<link rel="stylesheet" href="/assets/octicons-4.3.0/octicons.min.css">
+		<link rel="stylesheet" href="/assets/css/semantic-2.3.1.min.css">
+		<link rel="stylesheet" href="/assets/css/gogs.css">
+		<link rel="stylesheet" href="/assets/css/custom.css">
+
+		<title>G-Node DOI: Registration jobs</title>
+
+		<meta name="theme-color" content="#ffffff">
+	</head>
+	<body>
+		<div class="full height" id="main">
+			<div class="home middle very relaxed page" id="main">
+				<div class="ui container">
+					<h2>Registration jobs</h2>
+					<form class="ui form" method="get" action="/admin">
+						<div class="inline fields">
+							<div class="field">
+								<label for="state">State</label>
+								<select name="state" id="state">
+									<option value="">all</option>
+									{{$filter := .Filter}}
+									{{range .States}}
+									<option value="{{.}}"{{if eq . $filter}} selected{{end}}>{{.}}</option>
+									{{end}}
+								</select>
+							</div>
+							<div class="field">
+								<button class="ui button" type="submit">Filter</button>
+							</div>
+						</div>
+					</form>
+					<p>{{len .Jobs}} jobs</p>
+					<table class="ui celled table">
+						<thead>
+							<tr>
+								<th>DOI</th>
+								<th>State</th>
+								<th>Repository</th>
+								<th>User</th>
+								<th>Commit</th>
+								<th>Zip size</th>
+								<th>Created</th>
+								<th>Updated</th>
+								<th>Re-run</th>
+								<th>Review</th>
+							</tr>
+						</thead>
+						<tbody>
+						{{range .Jobs}}
+							<tr>
+								<td><a href="/status/{{.DOI}}">{{.DOI}}</a></td>
+								<td>{{.State}}</td>
+								<td><a href="{{GINServerURL}}/{{.Repository}}">{{.Repository}}</a></td>
+								<td>{{.Username}}{{if .RealName}} ({{.RealName}}){{end}}{{if .Email}}<br>{{.Email}}{{end}}</td>
+								<td>{{if .CommitHash}}<a href="{{GINServerURL}}/{{.Repository}}/commit/{{.CommitHash}}">{{.CommitHash}}</a>{{end}}</td>
+								<td>{{.ZipSize}}</td>
+								<td>{{.Created.Format "2006-01-02 15:04"}}</td>
+								<td>{{.Updated.Format "2006-01-02 15:04"}}</td>
+								<td>
+									{{if .Retryable}}
+									<form class="ui form" method="post" action="/admin/retry">
+										<input type="hidden" name="doi" value="{{.DOI}}">
+										<input type="hidden" name="csrf" value="{{$.CSRFToken}}">
+										<select name="stage">
+											{{range $.RetryStages}}
+											<option value="{{.}}">{{.}}</option>
+											{{end}}
+										</select>
+										<button class="ui mini button" type="submit">Re-run</button>
+									</form>
+									{{end}}
+								</td>
+								<td>
+									{{if .Registered}}
+									<p>DOI registered {{.Registered.Format "2006-01-02 15:04"}}</p>
+									{{end}}
+									{{if .Reviewable}}
+									<form class="ui form" method="post" action="/admin/review">
+										<input type="hidden" name="doi" value="{{.DOI}}">
+										<input type="hidden" name="csrf" value="{{$.CSRFToken}}">
+										<textarea name="message" rows="2" placeholder="Message to the requester"></textarea>
+										<button class="ui mini positive button" type="submit" name="action" value="approve">Approve</button>
+										{{if eq .State "done"}}
+										<button class="ui mini button" type="submit" name="action" value="changes">Request changes</button>
+										<button class="ui mini negative button" type="submit" name="action" value="reject">Reject</button>
+										{{end}}
+									</form>
+									{{end}}
+								</td>
+							</tr>
+							{{if or .Errors .Warnings}}
+							<tr>
+								<td colspan="10">
+									{{if .Errors}}
+									<div class="ui error message">
+										<div class="header">Errors</div>
+										<ol>{{range .Errors}}<li>{{.}}</li>{{end}}</ol>
+									</div>
+									{{end}}
+									{{if .Warnings}}
+									<div class="ui warning message">
+										<div class="header">Warnings</div>
+										<ol>{{range .Warnings}}<li>{{.}}</li>{{end}}</ol>
+									</div>
+									{{end}}
+								</td>
+							</tr>
+							{{end}}
+						{{end}}
+						</tbody>
+					</table>
+					{{if .Storage}}
+					<h3>Storage</h3>
+					<table class="ui celled table">
+						<thead>
+							<tr>
+								<th>Storage</th>
+								<th>Directory</th>
+								<th>Used</th>
+								<th>Free</th>
+								<th>Quota</th>
+							</tr>
+						</thead>
+						<tbody>
+						{{range .Storage}}
+							<tr>
+								<td>{{.Name}}</td>
+								<td>{{.Directory}}</td>
+								<td>{{.HumanUsed}}</td>
+								<td>{{.HumanFree}}</td>
+								<td>{{.HumanQuota}}</td>
+							</tr>
+						{{end}}
+						</tbody>
+					</table>
+					{{end}}
+				</div>
+			</div>
+		</div>
+		{{template "Footer"}}
+	</body>
+</html>`
@@ -37,10 +37,9 @@ const ChecklistFile = `# Part 1 - pre registration
 - on the DOI server ({{ .CL.Doiserver }}) make sure all information has been properly downloaded 
   to the staging directory and all annex files are unlocked and the content is present:
     -[ ] {{ .CL.Dirdoiprep }}/annexcheck {{ .SemiDOIDirpath }}
-    -[ ] if locked content has been found and unlocked by the doi-server, {{ .SemiDOICleanup }}
-         will contain a second folder named "{{ .RepoLower }}_unlocked". The zip file was created
-         with the content of this repository which should contain only unlocked files.
-         DO NOT USE the "unlocked" folder to upload to the DOI fork later on.
+    -[ ] if locked content has been found, the doi-server created the zip file with the
+         content of the annex objects the locked files point to; the zip file should not
+         contain any symlinks into the annex object store.
     - identify "normal" git annex issues e.g. locked or missing annex content
     -[ ] cd {{ .SemiDOICleanup }}/{{ .RepoLower }}
     -[ ] gin git annex find --locked
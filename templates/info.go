@@ -14,8 +14,17 @@ const DOIInfo = `
 	<a href="{{if .Identifier.ID}}https://doi.org/{{.Identifier.ID}}{{end}}" class="ui black doi label" itemprop="url">DOI: {{if .Identifier.ID}}{{.Identifier.ID}}{{else}}UNPUBLISHED{{end}}</a>
 	{{if .SourceRepository}}<a href="{{GINServerURL}}/{{.SourceRepository}}" class="ui blue doi label" data-tooltip="Browse the live dataset's contents on GIN. The repository may contain updates."><i class="doi label octicon octicon-link"></i>&nbsp;BROWSE REPOSITORY</a>{{end}}
 	{{if .ForkRepository}}<a href="{{GINServerURL}}/{{.ForkRepository}}" class="ui blue doi label" data-tooltip="Browse the archived dataset's contents on GIN. This is a snapshot of the published version."><i class="doi label octicon octicon-link"></i>&nbsp;BROWSE ARCHIVE</a>{{end}}
-	<a href="{{if .Identifier.ID}}{{Replace .Identifier.ID "/" "_"}}.zip{{end}}" class="ui green doi label"><i class="doi label octicon octicon-desktop-download"></i>&nbsp;DOWNLOAD ARCHIVE (ZIP{{if .Sizes}} {{index .Sizes 0}}{{end}})</a>
+	{{if not ArchiveParts}}<a href="{{if .Identifier.ID}}{{Replace .Identifier.ID "/" "_"}}.{{ArchiveExt}}{{end}}" class="ui green doi label"><i class="doi label octicon octicon-desktop-download"></i>&nbsp;DOWNLOAD ARCHIVE ({{Upper ArchiveExt}}{{if .Sizes}} {{index .Sizes 0}}{{end}})</a>{{end}}
 	</p>
+	{{with ArchiveParts}}
+	<p><strong>Download archive</strong> in {{len .}} parts{{if $.Sizes}} ({{index $.Sizes 0}} in total){{end}} | <a href="{{Replace $.Identifier.ID "/" "_"}}.manifest.json">File manifest</a></p>
+	<ul class="doi itemlist">
+		{{range .}}<li><a href="{{.Name}}" class="ui green doi label"><i class="doi label octicon octicon-desktop-download"></i>&nbsp;{{.Name}} ({{.HumanSize}})</a>{{with .Checksum}} SHA-256 <code>{{.}}</code>{{end}}</li>
+		{{end}}
+	</ul>
+	{{else}}
+	{{with ArchiveChecksum}}<p><strong>Archive SHA-256</strong> <code>{{.}}</code> | <a href="{{Replace $.Identifier.ID "/" "_"}}.manifest.json">File manifest</a></p>{{end}}
+	{{end}}
 	<p><strong>Published</strong> {{FormatIssuedDate .}} | <strong>License</strong> {{with index .RightsList 0}} <a href="{{.URL}}" itemprop="license">{{.Name}}</a>{{end}}</p>
 </div>
 <hr>
@@ -54,7 +54,7 @@ const RequestPage = `<!DOCTYPE html>
 						<h1>Welcome to the GIN DOI service <i class="mega-octicon octicon octicon-squirrel"></i></h1>
 					</div>
 
-					{{if HasGitModules GINServerURL .Repository}}
+					{{if HasGitModules GINServerURL .Repository .Ref}}
 					<div class="ui negative message" id="gitmodulewarning">
 						<div id="gitmodulebox">
 							<div class="header">Your repository appears to contain git submodules</div>
@@ -92,7 +92,7 @@ const RequestPage = `<!DOCTYPE html>
 							<p><b>Please note that content linked via git submodules will not be included in the published dataset.</b></p>
 							<p><b>Please make sure it does not contain any private files, SSH keys, address books, password collections, or similar sensitive, private data.</b></p>
 							<p><b>All contents of the repository will be part of the public archive!</b></p>
-							<p><b>Please note that only contents of the master branch will be part of the archive.</b></p>
+							<p><b>Please note that only contents of the revision <i>{{.Ref}}</i> will be part of the archive.</b></p>
 						</div>
 					</div>
 					<form action="/submit" method="post">
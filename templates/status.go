@@ -0,0 +1,66 @@
+package gdtmpl
+
+// JobStatus is the template for rendering the processing status of a
+// registration job after the user has submitted a request.
+const JobStatus = `<!DOCTYPE html>
+<html lang="en">
+	<head data-suburl="">
+
+		<meta http-equiv="Content-Type" content="text/html; charset=UTF-8">
+		<meta http-equiv="X-UA-Compatible" content="IE=edge">
+
+		<meta name="robots" content="noindex,nofollow">
+
+		<meta name="author" content="G-Node">
+		<meta name="description" content="Info">
+		<meta name="keywords" content="gin, data, sharing, science git">
+
+		<link rel="shortcut icon" href="/assets/img/favicon.png">
+		<link rel="stylesheet" href="/assets/octicons-4.3.0/octicons.min.css">
+		<link rel="stylesheet" href="/assets/css/semantic-2.3.1.min.css">
+		<link rel="stylesheet" href="/assets/css/gogs.css">
+		<link rel="stylesheet" href="/assets/css/custom.css">
+
+		<title>G-Node DOI: {{.DOI}}</title>
+
+		<meta name="theme-color" content="#ffffff">
+	</head>
+	<body>
+		<div class="full height" id="main">
+			<div class="following bar light">
+				<div class="ui container">
+					<div class="column">
+						<div class="ui top secondary menu">
+							<a class="item brand" href="{{GINServerURL}}/">
+								<img class="ui mini image" src="/assets/img/favicon.png">
+							</a>
+							<a class="item active" href="{{GINServerURL}}/{{.Repository}}">Back to GIN</a>
+						</div>
+					</div>
+				</div>
+			</div>
+			<div class="home middle very relaxed page" id="main">
+				<div class="ui container">
+					<h2>DOI request status</h2>
+					<p><strong>DOI</strong> {{.DOI}} | <strong>Repository</strong> {{.Repository}}</p>
+					<div class="ui {{if or (eq .State "failed") (eq .State "rejected")}}error{{else if eq .State "changes requested"}}warning{{else if eq .State "published"}}success{{else}}info{{end}} message">
+						<div><b>{{.State}}</b></div>
+						{{if .Progress}}<p>{{.Progress}}</p>{{end}}
+					</div>
+					<table class="ui table">
+						<thead>
+							<tr><th>Stage</th><th>Started</th></tr>
+						</thead>
+						<tbody>
+						{{range .History}}
+							<tr><td>{{.State}}</td><td>{{.Time.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+						{{end}}
+						</tbody>
+					</table>
+					<p>Please note that the registration process includes a manual curation step after the archive has been prepared.</p>
+				</div>
+			</div>
+		</div>
+		{{template "Footer"}}
+	</body>
+</html>`